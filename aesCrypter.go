@@ -0,0 +1,357 @@
+package walg
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// aesHeader is the first byte of objects and data keys encrypted by AESCrypter.
+// The first byte of OpenPGP packets always has the high bit set, so this byte
+// tells objects of AESCrypter from ones of OpenPGPCrypter.
+const aesHeader byte = 0x01
+
+// aesChunkSize is size of plaintext sealed at once. Each chunk is authenticated
+// separately, so objects are decrypted as a stream without buffering them whole.
+const aesChunkSize = 64 * 1024
+
+// NewCrypter creates crypter of objects to upload: by AWS KMS when WALG_KMS_CMK_ID
+// is set, AES-256-GCM when WALG_AES_KEY or WALG_AES_KEY_PATH is set, otherwise
+// OpenPGP configured by WALE_GPG_KEY_ID
+func NewCrypter() Crypter {
+	if getKMSKeyId() != "" {
+		return &KMSCrypter{}
+	}
+	if isAESKeySet() {
+		return &AESCrypter{}
+	}
+	return &OpenPGPCrypter{}
+}
+
+func isAESKeySet() bool {
+	return os.Getenv("WALG_AES_KEY") != "" || os.Getenv("WALG_AES_KEY_PATH") != ""
+}
+
+// getAESKey reads 32 byte key from WALG_AES_KEY or from file WALG_AES_KEY_PATH,
+// in hex or base64. Returns nil if neither is set.
+func getAESKey() []byte {
+	encoded := os.Getenv("WALG_AES_KEY")
+	if encoded == "" {
+		path := os.Getenv("WALG_AES_KEY_PATH")
+		if path == "" {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal("Unable to read WALG_AES_KEY_PATH ", err)
+		}
+		encoded = string(content)
+	}
+	key, err := parseAESKey(encoded)
+	if err != nil {
+		log.Fatal("Unable to parse WALG_AES_KEY ", err)
+	}
+	return key
+}
+
+func parseAESKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == dataKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == dataKeySize {
+		return key, nil
+	}
+	return nil, errors.Errorf("parseAESKey: key must be %d bytes in hex or base64", dataKeySize)
+}
+
+// AESCrypter encrypts objects with AES-256-GCM by a symmetric key.
+// Objects start with aesHeader and a random nonce, followed by sealed chunks.
+// Objects without aesHeader, such as ones uploaded before the key was set,
+// are decrypted by OpenPGPCrypter configured by WALE_GPG_KEY_ID.
+type AESCrypter struct {
+	configured bool
+	key        []byte
+
+	// dataKey is symmetric key of one backup, nil if objects are encrypted with key
+	dataKey []byte
+
+	pgp OpenPGPCrypter
+}
+
+// NewAESCrypter creates crypter with given key instead of WALG_AES_KEY
+func NewAESCrypter(key []byte) (*AESCrypter, error) {
+	if len(key) != dataKeySize {
+		return nil, errors.Errorf("NewAESCrypter: key must be %d bytes, got %d", dataKeySize, len(key))
+	}
+	return &AESCrypter{configured: true, key: key}, nil
+}
+
+// IsUsed is to check necessity of Crypter use
+// Must be called prior to any other crypter call
+func (crypter *AESCrypter) IsUsed() bool {
+	if !crypter.configured {
+		crypter.configured = true
+		crypter.key = getAESKey()
+	}
+	return crypter.key != nil
+}
+
+func (crypter *AESCrypter) newAEAD() (cipher.AEAD, error) {
+	if !crypter.configured {
+		return nil, ErrCrypterUseMischief
+	}
+	key := crypter.key
+	if crypter.dataKey != nil {
+		key = crypter.dataKey
+	}
+	if key == nil {
+		return nil, errors.New("Object is encrypted by AES, but WALG_AES_KEY is not set")
+	}
+	return newAESGCM(key)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt creates encryption writer from ordinary writer.
+// Close of the returned writer does not close writer.
+func (crypter *AESCrypter) Encrypt(writer io.WriteCloser) (io.WriteCloser, error) {
+	aead, err := crypter.newAEAD()
+	if err != nil {
+		return nil, err
+	}
+	return newAESWriter(writer, aead, nil)
+}
+
+// Decrypt creates decrypted reader from ordinary reader.
+// Objects without aesHeader are passed to OpenPGPCrypter.
+func (crypter *AESCrypter) Decrypt(reader io.ReadCloser) (io.Reader, error) {
+	aead, err := crypter.newAEAD()
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReaderSize(reader, aesChunkSize+aead.Overhead())
+	first, err := buffered.Peek(1)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decrypt: failed to read header")
+	}
+	if first[0] != aesHeader {
+		if !crypter.pgp.IsUsed() && crypter.pgp.dataKey == nil {
+			return nil, errors.New("Decrypt: object is not encrypted by WALG_AES_KEY and WALE_GPG_KEY_ID is not set")
+		}
+		return crypter.pgp.Decrypt(&ReadCascadeClose{buffered, reader})
+	}
+
+	header := make([]byte, 1+aead.NonceSize())
+	_, err = io.ReadFull(buffered, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decrypt: failed to read nonce")
+	}
+	return &aesReader{inner: buffered, aead: aead, nonce: header[1:]}, nil
+}
+
+// GenerateDataKey creates fresh random symmetric key for one backup
+func (crypter *AESCrypter) GenerateDataKey() ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapDataKey encrypts data key with the long-term key
+func (crypter *AESCrypter) WrapDataKey(key []byte) ([]byte, error) {
+	if !crypter.configured {
+		return nil, ErrCrypterUseMischief
+	}
+	aead, err := newAESGCM(crypter.key)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(key)+aead.Overhead())
+	wrapped[0] = aesHeader
+	_, err = rand.Read(wrapped[1:])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(wrapped, wrapped[1:], key, nil), nil
+}
+
+// UnwrapDataKey decrypts data key with the long-term key.
+// Data keys of backups made with OpenPGPCrypter are passed to it.
+func (crypter *AESCrypter) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	if !crypter.configured {
+		return nil, ErrCrypterUseMischief
+	}
+	if len(wrapped) == 0 || wrapped[0] != aesHeader {
+		if !crypter.pgp.IsUsed() {
+			return nil, errors.New("UnwrapDataKey: data key is not encrypted by WALG_AES_KEY and WALE_GPG_KEY_ID is not set")
+		}
+		return crypter.pgp.UnwrapDataKey(wrapped)
+	}
+	aead, err := newAESGCM(crypter.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < 1+aead.NonceSize() {
+		return nil, errors.New("UnwrapDataKey: wrapped data key is truncated")
+	}
+	key, err := aead.Open(nil, wrapped[1:1+aead.NonceSize()], wrapped[1+aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "UnwrapDataKey: failed to decrypt data key")
+	}
+	if len(key) != dataKeySize {
+		return nil, errors.New("Unwrapped data key has wrong size")
+	}
+	return key, nil
+}
+
+// SetDataKey makes Encrypt and Decrypt use symmetric data key of a backup
+func (crypter *AESCrypter) SetDataKey(key []byte) {
+	crypter.dataKey = key
+	crypter.pgp.SetDataKey(key)
+}
+
+// chunkNonce is nonce of chunk number counter of object with nonce.
+// Last flag goes to additional data, so truncation at a chunk boundary is detected.
+func chunkNonce(nonce []byte, counter uint64) []byte {
+	result := make([]byte, len(nonce))
+	copy(result, nonce)
+	tail := result[len(result)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^counter)
+	return result
+}
+
+var (
+	aesChunkData = []byte{0}
+	aesLastChunk = []byte{1}
+)
+
+// aesWriter seals chunks of aesChunkSize. The last chunk is sealed on Close,
+// possibly empty. Header is written with the first chunk, see DelayWriteCloser.
+type aesWriter struct {
+	inner   io.Writer
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	buf     []byte
+	// header is written before the first chunk, nil once it is written
+	header []byte
+}
+
+// newAESWriter creates writer of object with random nonce, prefix goes before aesHeader
+func newAESWriter(writer io.Writer, aead cipher.AEAD, prefix []byte) (*aesWriter, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append(prefix[:len(prefix):len(prefix)], aesHeader), nonce...)
+	return &aesWriter{inner: writer, aead: aead, nonce: nonce, buf: make([]byte, 0, aesChunkSize), header: header}, nil
+}
+
+func (w *aesWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == aesChunkSize {
+			// Chunk is sealed once more data follows, only the last one is sealed by Close
+			if err := w.seal(aesChunkData); err != nil {
+				return n, err
+			}
+		}
+		copied := copy(w.buf[len(w.buf):aesChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+copied]
+		p = p[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+func (w *aesWriter) seal(additionalData []byte) error {
+	if w.header != nil {
+		_, err := w.inner.Write(w.header)
+		if err != nil {
+			return err
+		}
+		w.header = nil
+	}
+	sealed := w.aead.Seal(nil, chunkNonce(w.nonce, w.counter), w.buf, additionalData)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.inner.Write(sealed)
+	return err
+}
+
+// Close seals the last chunk
+func (w *aesWriter) Close() error {
+	return w.seal(aesLastChunk)
+}
+
+// aesReader opens chunks sealed by aesWriter
+type aesReader struct {
+	inner   *bufio.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	plain   []byte
+	done    bool
+}
+
+func (r *aesReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *aesReader) open() error {
+	sealed := make([]byte, aesChunkSize+r.aead.Overhead())
+	n, err := io.ReadFull(r.inner, sealed)
+	last := false
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		last = true
+	} else if err != nil {
+		return err
+	} else if _, err = r.inner.Peek(1); err == io.EOF {
+		last = true
+	} else if err != nil {
+		return err
+	}
+	additionalData := aesChunkData
+	if last {
+		additionalData = aesLastChunk
+	}
+	plain, err := r.aead.Open(sealed[:0], chunkNonce(r.nonce, r.counter), sealed[:n], additionalData)
+	if err != nil {
+		return errors.Wrapf(err, "Decrypt: chunk %d is damaged or truncated", r.counter)
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
@@ -0,0 +1,141 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+var aesTestKey = bytes.Repeat([]byte{0x42}, dataKeySize)
+
+func aesEncrypt(t *testing.T, crypter Crypter, plain []byte) []byte {
+	var sealed bytes.Buffer
+	wc, err := crypter.Encrypt(&ClosingBuffer{&sealed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wc.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err = wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func aesDecrypt(crypter Crypter, sealed []byte) ([]byte, error) {
+	reader, err := crypter.Decrypt(ioutil.NopCloser(bytes.NewReader(sealed)))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+func TestAESCrypterRoundTrip(t *testing.T) {
+	crypter, err := NewAESCrypter(aesTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, aesChunkSize - 1, aesChunkSize, aesChunkSize + 1, 3 * aesChunkSize} {
+		plain := bytes.Repeat([]byte("wal-g"), size/5+1)[:size]
+		sealed := aesEncrypt(t, crypter, plain)
+		if sealed[0] != aesHeader {
+			t.Errorf("aesCrypter: object of %d bytes starts with %x", size, sealed[0])
+		}
+		decrypted, err := aesDecrypt(crypter, sealed)
+		if err != nil {
+			t.Errorf("aesCrypter: failed to decrypt %d bytes: %v", size, err)
+		} else if !bytes.Equal(decrypted, plain) {
+			t.Errorf("aesCrypter: decrypted %d bytes differ", size)
+		}
+	}
+
+	// Each object has its own nonce
+	plain := []byte("same content")
+	if bytes.Equal(aesEncrypt(t, crypter, plain), aesEncrypt(t, crypter, plain)) {
+		t.Errorf("aesCrypter: same content encrypted twice is equal")
+	}
+}
+
+func TestAESCrypterDetectsDamage(t *testing.T) {
+	crypter, _ := NewAESCrypter(aesTestKey)
+	sealed := aesEncrypt(t, crypter, bytes.Repeat([]byte{7}, 2*aesChunkSize+100))
+
+	damaged := append([]byte{}, sealed...)
+	damaged[len(damaged)/2] ^= 1
+	if _, err := aesDecrypt(crypter, damaged); err == nil {
+		t.Errorf("aesCrypter: damaged object decrypted")
+	}
+	// Cut exactly after the second chunk, so the rest looks like a complete object
+	chunk := aesChunkSize + 16
+	if _, err := aesDecrypt(crypter, sealed[:1+12+2*chunk]); err == nil {
+		t.Errorf("aesCrypter: object truncated at chunk boundary decrypted")
+	}
+
+	other, _ := NewAESCrypter(bytes.Repeat([]byte{1}, dataKeySize))
+	if _, err := aesDecrypt(other, sealed); err == nil {
+		t.Errorf("aesCrypter: object decrypted with other key")
+	}
+}
+
+// Backups made with OpenPGPCrypter before WALG_AES_KEY was set are still restored
+func TestAESCrypterDecryptsOpenPGP(t *testing.T) {
+	pgp := &OpenPGPCrypter{armed: true, configured: true}
+	dataKey, _ := pgp.GenerateDataKey()
+	pgp.SetDataKey(dataKey)
+	plain := []byte("encrypted before WALG_AES_KEY was set")
+	sealed := aesEncrypt(t, pgp, plain)
+
+	crypter, _ := NewAESCrypter(aesTestKey)
+	crypter.SetDataKey(dataKey)
+	decrypted, err := aesDecrypt(crypter, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Errorf("aesCrypter: OpenPGP object decrypted as %q", decrypted)
+	}
+}
+
+func TestAESCrypterDataKey(t *testing.T) {
+	crypter, _ := NewAESCrypter(aesTestKey)
+	dataKey, err := crypter.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := crypter.WrapDataKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := crypter.UnwrapDataKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("aesCrypter: unwrapped data key differs")
+	}
+
+	crypter.SetDataKey(dataKey)
+	sealed := aesEncrypt(t, crypter, []byte("backup"))
+	longTerm, _ := NewAESCrypter(aesTestKey)
+	if _, err := aesDecrypt(longTerm, sealed); err == nil {
+		t.Errorf("aesCrypter: object of data key decrypted with long-term key")
+	}
+	if decrypted, err := aesDecrypt(crypter, sealed); err != nil || string(decrypted) != "backup" {
+		t.Errorf("aesCrypter: object of data key is not decrypted: %v", err)
+	}
+}
+
+func TestParseAESKey(t *testing.T) {
+	for _, encoded := range []string{hex.EncodeToString(aesTestKey), base64.StdEncoding.EncodeToString(aesTestKey) + "\n"} {
+		key, err := parseAESKey(encoded)
+		if err != nil || !bytes.Equal(key, aesTestKey) {
+			t.Errorf("aesCrypter: key %q is not parsed: %v", encoded, err)
+		}
+	}
+	if _, err := parseAESKey(hex.EncodeToString(aesTestKey[:16])); err == nil {
+		t.Errorf("aesCrypter: 16 byte key accepted")
+	}
+}
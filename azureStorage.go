@@ -0,0 +1,359 @@
+package walg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	azureAPIVersion = "2019-12-12"
+	// Size of staged blocks of large blobs, a blob has at most 50000 blocks
+	azureBlockSize  = 8 << 20
+	azureRetries    = 5
+	azureRetryDelay = 100 * time.Millisecond
+)
+
+// AzureStorage is StorageBackend of Azure Blob Storage container, accessed with REST API
+// authorized by shared key of storage account. Large objects are uploaded as staged
+// blocks committed at the end, so a network failure only resends one block.
+type AzureStorage struct {
+	Account   string
+	Key       []byte
+	Container string
+	// Endpoint of blob service, https://<account>.blob.core.windows.net by default
+	Endpoint  string
+	Client    *http.Client
+	BlockSize int
+}
+
+// NewAzureStorage creates storage of container with access key of account encoded in base64
+func NewAzureStorage(account, accessKey, container string) (*AzureStorage, error) {
+	key, err := base64.StdEncoding.DecodeString(accessKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewAzureStorage: access key is not base64 encoded")
+	}
+	return &AzureStorage{
+		Account:   account,
+		Key:       key,
+		Container: container,
+		Endpoint:  "https://" + account + ".blob.core.windows.net",
+		Client:    &http.Client{},
+		BlockSize: azureBlockSize,
+	}, nil
+}
+
+// AzureError is returned for unexpected response of blob service
+type AzureError struct {
+	Status int
+	Body   string
+}
+
+func (err AzureError) Error() string {
+	return fmt.Sprintf("Azure responded with status %d: %s", err.Status, err.Body)
+}
+
+func isRetryableAzureError(err error) bool {
+	if azureErr, ok := errors.Cause(err).(AzureError); ok {
+		return azureErr.Status >= 500 || azureErr.Status == http.StatusTooManyRequests
+	}
+	_, ok := errors.Cause(err).(*url.Error)
+	return ok
+}
+
+// retryAzure calls request until it succeeds or fails with error which is not transient
+func retryAzure(request func() error) error {
+	var err error
+	for attempt := 0; attempt < azureRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("AzureStorage: retrying after error: %v\n", err)
+			time.Sleep(azureRetryDelay << uint(attempt-1))
+		}
+		err = request()
+		if err == nil || !isRetryableAzureError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *AzureStorage) blobURL(key string, query url.Values) string {
+	u := s.Endpoint + (&url.URL{Path: "/" + s.Container + "/" + key}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// sign adds SharedKey authorization of request
+func (s *AzureStorage) sign(req *http.Request, contentLength int) {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	length := ""
+	if contentLength > 0 {
+		length = strconv.Itoa(contentLength)
+	}
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonicalHeaders strings.Builder
+	for _, name := range msHeaders {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	resource := "/" + s.Account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalHeaders.String() + resource
+
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+s.Account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// do sends signed request, responses with other status than expected one are errors
+func (s *AzureStorage) do(method string, u string, body []byte, headers map[string]string, expected int) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	s.sign(req, len(body))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == expected {
+		return resp, nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	return nil, AzureError{resp.StatusCode, strings.TrimSpace(string(message))}
+}
+
+// GetArchive downloads blob
+func (s *AzureStorage) GetArchive(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.blobURL(key, nil), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, errors.Wrapf(err, "AzureStorage GetArchive: failed to get '%s'", key)
+	}
+	return resp.Body, nil
+}
+
+// Exists gets properties of blob
+func (s *AzureStorage) Exists(key string) (bool, error) {
+	resp, err := s.do(http.MethodHead, s.blobURL(key, nil), nil, nil, http.StatusOK)
+	if azureErr, ok := err.(AzureError); ok && azureErr.Status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "AzureStorage Exists: failed to check '%s'", key)
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+type azureBlobList struct {
+	Blobs []struct {
+		Name       string
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		}
+	} `xml:"Blobs>Blob"`
+	NextMarker string
+}
+
+// List lists blobs page by page with "/" delimiter
+func (s *AzureStorage) List(prefix string) ([]StorageObject, error) {
+	return s.list(url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}, "delimiter": {"/"}})
+}
+
+// ListAll lists blobs page by page without delimiter
+func (s *AzureStorage) ListAll(prefix string) ([]StorageObject, error) {
+	return s.list(url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}})
+}
+
+func (s *AzureStorage) list(query url.Values) ([]StorageObject, error) {
+	prefix := query.Get("prefix")
+	var objects []StorageObject
+	marker := ""
+	for {
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		u := s.Endpoint + (&url.URL{Path: "/" + s.Container}).EscapedPath() + "?" + query.Encode()
+		resp, err := s.do(http.MethodGet, u, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, errors.Wrapf(err, "AzureStorage List: failed to list '%s'", prefix)
+		}
+		var page azureBlobList
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "AzureStorage List: failed to parse listing of '%s'", prefix)
+		}
+		for _, blob := range page.Blobs {
+			modified, err := time.Parse(http.TimeFormat, blob.Properties.LastModified)
+			if err != nil {
+				return nil, errors.Wrapf(err, "AzureStorage List: failed to parse modification time of '%s'", blob.Name)
+			}
+			objects = append(objects, StorageObject{Key: blob.Name, LastModified: modified, Size: blob.Properties.ContentLength})
+		}
+		if page.NextMarker == "" {
+			return objects, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+// Delete removes blobs one by one
+func (s *AzureStorage) Delete(keys []string) error {
+	for _, key := range keys {
+		err := retryAzure(func() error {
+			resp, err := s.do(http.MethodDelete, s.blobURL(key, nil), nil, nil, http.StatusAccepted)
+			if azureErr, ok := err.(AzureError); ok && azureErr.Status == http.StatusNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "AzureStorage Delete: failed to delete '%s'", key)
+		}
+	}
+	return nil
+}
+
+// Put uploads blob of one block in a single request, larger blobs
+// are staged block by block and committed with block list
+func (s *AzureStorage) Put(key string, r io.Reader) error {
+	blockSize := s.BlockSize
+	if blockSize <= 0 {
+		blockSize = azureBlockSize
+	}
+	block := make([]byte, blockSize)
+	var ids []string
+	for {
+		n, err := io.ReadFull(r, block)
+		if err == io.EOF && len(ids) > 0 {
+			break
+		}
+		end := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !end {
+			return errors.Wrapf(err, "AzureStorage Put: failed to read content of '%s'", key)
+		}
+		if end && len(ids) == 0 {
+			err = retryAzure(func() error {
+				return s.put(s.blobURL(key, nil), block[:n], map[string]string{"x-ms-blob-type": "BlockBlob"})
+			})
+			if err != nil {
+				return errors.Wrapf(err, "AzureStorage Put: failed to put '%s'", key)
+			}
+			return nil
+		}
+
+		// Block ids of blob must be of the same length
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%010d", len(ids))))
+		err = retryAzure(func() error {
+			return s.put(s.blobURL(key, url.Values{"comp": {"block"}, "blockid": {id}}), block[:n], nil)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "AzureStorage Put: failed to stage block %d of '%s'", len(ids), key)
+		}
+		ids = append(ids, id)
+		if end {
+			break
+		}
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(xml.Header + "<BlockList>")
+	for _, id := range ids {
+		blockList.WriteString("<Latest>" + id + "</Latest>")
+	}
+	blockList.WriteString("</BlockList>")
+	err := retryAzure(func() error {
+		return s.put(s.blobURL(key, url.Values{"comp": {"blocklist"}}), blockList.Bytes(), nil)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "AzureStorage Put: failed to commit blocks of '%s'", key)
+	}
+	return nil
+}
+
+func (s *AzureStorage) put(u string, body []byte, headers map[string]string) error {
+	resp, err := s.do(http.MethodPut, u, body, headers, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// configureAzureStorage creates uploader and prefix of azure://container/path URL
+func configureAzureStorage(u *url.URL) (*TarUploader, *Prefix, error) {
+	account := os.Getenv("AZURE_STORAGE_ACCOUNT")
+	accessKey := os.Getenv("AZURE_STORAGE_ACCESS_KEY")
+	if account == "" || accessKey == "" {
+		return nil, nil, &UnsetEnvVarError{names: []string{"AZURE_STORAGE_ACCOUNT", "AZURE_STORAGE_ACCESS_KEY"}}
+	}
+	storage, err := NewAzureStorage(account, accessKey, u.Host)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "configureAzureStorage")
+	}
+	if endpoint := os.Getenv("WALG_AZURE_ENDPOINT"); endpoint != "" {
+		storage.Endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+	upload, pre := ConfigureStorageBackend(storage, strings.TrimSuffix(u.Path, "/"))
+	return upload, pre, nil
+}
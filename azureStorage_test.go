@@ -0,0 +1,253 @@
+package walg_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wal-g/wal-g"
+)
+
+var azureTestKey = []byte("wal-g azure test key")
+
+// fakeAzure serves the subset of blob service REST API used by AzureStorage
+type fakeAzure struct {
+	t      *testing.T
+	mutex  sync.Mutex
+	blobs  map[string][]byte
+	blocks map[string][]byte
+	// failBlocks makes that many block requests fail
+	failBlocks int
+	pageSize   int
+}
+
+func newFakeAzure(t *testing.T) (*fakeAzure, *httptest.Server, *walg.AzureStorage) {
+	fake := &fakeAzure{t: t, blobs: make(map[string][]byte), blocks: make(map[string][]byte), pageSize: 1000}
+	server := httptest.NewServer(fake)
+	storage, err := walg.NewAzureStorage("account", base64.StdEncoding.EncodeToString(azureTestKey), "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Endpoint = server.URL
+	storage.Client = server.Client()
+	storage.BlockSize = 1000
+	return fake, server, storage
+}
+
+// checkSignature computes SharedKey signature of request as documented for blob service
+func (f *fakeAzure) checkSignature(r *http.Request) bool {
+	var msHeaders []string
+	for name := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-") {
+			msHeaders = append(msHeaders, strings.ToLower(name)+":"+r.Header.Get(name)+"\n")
+		}
+	}
+	sort.Strings(msHeaders)
+	length := r.Header.Get("Content-Length")
+	if length == "0" {
+		length = ""
+	}
+	resource := "/account" + r.URL.EscapedPath()
+	query := r.URL.Query()
+	var params []string
+	for name, values := range query {
+		params = append(params, "\n"+name+":"+strings.Join(values, ","))
+	}
+	sort.Strings(params)
+	stringToSign := r.Method + "\n\n\n" + length + "\n\n\n\n\n\n\n\n\n" + strings.Join(msHeaders, "") + resource + strings.Join(params, "")
+	mac := hmac.New(sha256.New, azureTestKey)
+	mac.Write([]byte(stringToSign))
+	return r.Header.Get("Authorization") == "SharedKey account:"+base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.checkSignature(r) || r.Header.Get("x-ms-date") == "" {
+		f.t.Errorf("azureStorage: wrong signature of %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	path, _ := url.PathUnescape(r.URL.EscapedPath())
+	query := r.URL.Query()
+	if path == "/container" && query.Get("comp") == "list" {
+		f.serveList(w, query)
+		return
+	}
+	if !strings.HasPrefix(path, "/container/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(path, "/container/")
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		if f.failBlocks > 0 {
+			f.failBlocks--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.blocks[name+"/"+query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string
+		}
+		xml.Unmarshal(body, &list)
+		var content []byte
+		for _, id := range list.Latest {
+			content = append(content, f.blocks[name+"/"+id]...)
+		}
+		f.blobs[name] = content
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[name] = body
+		w.WriteHeader(http.StatusCreated)
+	default:
+		content, ok := f.blobs[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodDelete:
+			delete(f.blobs, name)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodGet:
+			w.Write(content)
+		}
+	}
+}
+
+func (f *fakeAzure) serveList(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	var names []string
+	for name := range f.blobs {
+		if strings.HasPrefix(name, prefix) && !strings.Contains(name[len(prefix):], "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	start := 0
+	if marker := query.Get("marker"); marker != "" {
+		start = sort.SearchStrings(names, marker)
+	}
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for i := start; i < len(names) && i < start+f.pageSize; i++ {
+		fmt.Fprintf(w, `<Blob><Name>%s</Name><Properties><Last-Modified>Thu, 01 Mar 2018 10:00:00 GMT</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>`,
+			names[i], len(f.blobs[names[i]]))
+	}
+	fmt.Fprint(w, `</Blobs>`)
+	if start+f.pageSize < len(names) {
+		fmt.Fprintf(w, `<NextMarker>%s</NextMarker>`, names[start+f.pageSize])
+	}
+	fmt.Fprint(w, `</EnumerationResults>`)
+}
+
+func TestAzureStorage(t *testing.T) {
+	fake, server, storage := newFakeAzure(t)
+	defer server.Close()
+	fake.pageSize = 2
+	fake.failBlocks = 1
+
+	// Staged blocks with incomplete last one, exact blocks, single put and empty blob
+	contents := map[string][]byte{
+		"server/wal_005/000000010000000000000001.lz4":               make([]byte, 3500),
+		"server/wal_005/000000010000000000000002.lzo":               make([]byte, 2000),
+		"server/wal_005/000000010000000000000003.lz4":               make([]byte, 999),
+		"server/wal_005/000000010000000000000004.lz4":               {},
+		"server/basebackups_005/base/tar_partitions/part_1.tar.lz4": []byte("part"),
+	}
+	for key, content := range contents {
+		rand.Read(content)
+		err := storage.Put(key, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("azureStorage: failed to put %s: %v", key, err)
+		}
+	}
+	for key, content := range contents {
+		reader, err := storage.GetArchive(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if !bytes.Equal(body, content) {
+			t.Errorf("azureStorage: %s is read with %d bytes instead of %d", key, len(body), len(content))
+		}
+	}
+
+	objects, err := storage.List("server/wal_005/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 4 || objects[0].Size != 3500 || !objects[0].LastModified.Equal(time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("azureStorage: expected 4 WAL files of all pages to be listed but got %v", objects)
+	}
+
+	key := "server/wal_005/000000010000000000000002.lzo"
+	exists, err := storage.Exists(key)
+	if err != nil || !exists {
+		t.Errorf("azureStorage: expected %s to exist but got %v, %v", key, exists, err)
+	}
+	err = storage.Delete([]string{key, "server/wal_005/missing"})
+	if err != nil {
+		t.Errorf("azureStorage: expected delete of missing blob to succeed but got %v", err)
+	}
+	exists, err = storage.Exists(key)
+	if err != nil || exists {
+		t.Errorf("azureStorage: expected %s to be deleted but got %v, %v", key, exists, err)
+	}
+}
+
+func TestAzureStorageWALFetch(t *testing.T) {
+	_, server, storage := newFakeAzure(t)
+	defer server.Close()
+	tu, pre := walg.ConfigureStorageBackend(storage, "server")
+
+	dir, err := ioutil.TempDir("", "azure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	walName := "000000010000000000000005"
+	wal := make([]byte, walg.WalSegmentSize)
+	copy(wal, "wal-g")
+	err = ioutil.WriteFile(filepath.Join(dir, walName), wal, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tu.UploadWal(filepath.Join(dir, walName), pre, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location := filepath.Join(dir, "fetched")
+	if found, err := walg.DownloadWALFile(pre, walName, location); err != nil || !found {
+		t.Fatalf("azureStorage: uploaded WAL is not found")
+	}
+	fetched, _ := ioutil.ReadFile(location)
+	if !bytes.Equal(wal, fetched) {
+		t.Errorf("azureStorage: fetched WAL differs from uploaded one")
+	}
+}
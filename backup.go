@@ -3,15 +3,17 @@ package walg
 import (
 	"encoding/json"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path"
 	"sort"
 	"strings"
+	"time"
 )
 
 // WalFiles represent any file generated by WAL-G.
@@ -41,26 +43,24 @@ func (s *S3ReaderMaker) Format() string { return s.FileFormat }
 // Path to file in bucket
 func (s *S3ReaderMaker) Path() string { return *s.Key }
 
-// Reader creates a new S3 reader for each S3 object.
+// Reader opens the object in storage of the backup each time it is called.
 func (s *S3ReaderMaker) Reader() (io.ReadCloser, error) {
-	input := &s3.GetObjectInput{
-		Bucket: s.Backup.Prefix.Bucket,
-		Key:    s.Key,
-	}
-
-	rdr, err := s.Backup.Prefix.Svc.GetObject(input)
+	rdr, err := s.Backup.Prefix.Storage().GetArchive(*s.Key)
 	if err != nil {
-		return nil, errors.Wrap(err, "S3 Reader: s3.GetObject failed")
+		return nil, errors.Wrap(err, "S3 Reader: failed to get object")
 	}
-	return rdr.Body, nil
-
+	return rdr, nil
 }
 
 // Prefix contains the S3 service client, bucket and string.
+// Objects are accessed through Storage(), Backend replaces the bucket of Svc when set.
 type Prefix struct {
-	Svc    s3iface.S3API
-	Bucket *string
-	Server *string
+	Svc     s3iface.S3API
+	Bucket  *string
+	Server  *string
+	Backend StorageBackend
+	// DownloadRateLimiter throttles reading of all archives of prefix, nil is unlimited
+	DownloadRateLimiter *RateLimiter
 }
 
 // Backup contains information about a valid backup
@@ -90,29 +90,21 @@ func (b *Backup) GetLatest() (string, error) {
 // GetBackups receives backup descriptions and sorts them by time
 func (b *Backup) GetBackups() ([]BackupTime, error) {
 	var sortTimes []BackupTime
-	objects := &s3.ListObjectsV2Input{
-		Bucket:    b.Prefix.Bucket,
-		Prefix:    b.Path,
-		Delimiter: aws.String("/"),
-	}
-
-	var backups = make([]*s3.Object, 0)
-
-	err := b.Prefix.Svc.ListObjectsV2Pages(objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
-		backups = append(backups, files.Contents...)
-		return true
-	})
-
+	objects, err := b.Prefix.Storage().List(*b.Path)
 	if err != nil {
-		return nil, errors.Wrap(err, "GetLatest: s3.ListObjectsV2 failed")
+		return nil, errors.Wrap(err, "GetLatest: failed to list backups")
 	}
 
-	count := len(backups)
+	count := len(objects)
 
 	if count == 0 {
 		return nil, ErrLatestNotFound
 	}
 
+	backups := make([]*s3.Object, count)
+	for i, object := range objects {
+		backups[i] = &s3.Object{Key: aws.String(object.Key), LastModified: aws.Time(object.LastModified)}
+	}
 	sortTimes = GetBackupTimeSlices(backups)
 
 	return sortTimes, nil
@@ -123,8 +115,13 @@ func GetBackupTimeSlices(backups []*s3.Object) []BackupTime {
 	sortTimes := make([]BackupTime, len(backups))
 	for i, ob := range backups {
 		key := *ob.Key
+		name := stripNameBackup(key)
 		time := *ob.LastModified
-		sortTimes[i] = BackupTime{stripNameBackup(key), time, stripWalFileName(key)}
+		// Start time in the name is not changed by rewrites of object metadata
+		if nameTime, ok := parseBackupNameTime(name); ok {
+			time = nameTime
+		}
+		sortTimes[i] = BackupTime{name, time, stripWalFileName(key)}
 	}
 	slice := TimeSlice(sortTimes)
 	sort.Sort(slice)
@@ -144,82 +141,99 @@ func stripWalFileName(key string) string {
 	name = strings.SplitN(name, "_D_", 2)[0]
 
 	if strings.HasPrefix(name, backupNamePrefix) {
-		return name[len(backupNamePrefix):]
+		name = name[len(backupNamePrefix):]
+		if _, ok := parseBackupNameTime(backupNamePrefix + name); ok {
+			name = name[len(backupNameTimeFormat)+1:]
+		}
+		return name
 	}
 	return ""
 }
 
-// CheckExistence checks that the specified backup exists.
-func (b *Backup) CheckExistence() (bool, error) {
-	js := &s3.HeadObjectInput{
-		Bucket: b.Prefix.Bucket,
-		Key:    b.Js,
-	}
+// backupNameTimeFormat is the format of UTC start time in backup names
+// base_TIME_WALFILE. Fixed width makes names sort lexically in chronological order.
+const backupNameTimeFormat = "20060102T150405Z"
 
-	_, err := b.Prefix.Svc.HeadObject(js)
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			switch awsErr.Code() {
-			case "NotFound":
-				return false, nil
-			default:
-				return false, awsErr
-			}
+// addBackupNameTime puts start time in front of WAL file part of backup name
+func addBackupNameTime(name string, start time.Time) string {
+	return backupNamePrefix + start.UTC().Format(backupNameTimeFormat) + "_" + strings.TrimPrefix(name, backupNamePrefix)
+}
 
-		}
+// parseBackupNameTime extracts start time from backup name, false if name has no time
+func parseBackupNameTime(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupNamePrefix) {
+		return time.Time{}, false
+	}
+	name = name[len(backupNamePrefix):]
+	if len(name) <= len(backupNameTimeFormat) || name[len(backupNameTimeFormat)] != '_' {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupNameTimeFormat, name[:len(backupNameTimeFormat)])
+	if err != nil {
+		return time.Time{}, false
 	}
-	return true, nil
+	return t, true
+}
+
+// CheckExistence checks that the specified backup exists.
+func (b *Backup) CheckExistence() (bool, error) {
+	return b.Prefix.Storage().Exists(aws.StringValue(b.Js))
 }
 
 // GetKeys returns all the keys for the Files in the specified backup.
 func (b *Backup) GetKeys() ([]string, error) {
-	objects := &s3.ListObjectsV2Input{
-		Bucket: b.Prefix.Bucket,
-		Prefix: aws.String(sanitizePath(*b.Path + *b.Name + "/tar_partitions")),
+	objects, err := b.Prefix.Storage().List(sanitizePath(*b.Path + *b.Name + "/tar_partitions/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "GetKeys: failed to list partitions")
 	}
 
-	result := make([]string, 0)
-
-	err := b.Prefix.Svc.ListObjectsV2Pages(objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
-
-		arr := make([]string, len(files.Contents))
+	result := make([]string, len(objects))
+	for i, ob := range objects {
+		result[i] = ob.Key
+	}
 
-		for i, ob := range files.Contents {
-			key := *ob.Key
-			arr[i] = key
-		}
+	return result, nil
+}
 
-		result = append(result, arr...)
-		return true
-	})
+// GetTarPartitions lists keys of tar partitions of backup, telling them by name
+// rather than by order of listing: pg_control.tar.* is returned separately, as it
+// must be extracted last, and objects which are not tar partitions, like a stray
+// sentinel, are skipped. pgControl is empty if backup has no separate pg_control.
+func (b *Backup) GetTarPartitions() (partitions []string, pgControl string, err error) {
+	keys, err := b.GetKeys()
 	if err != nil {
-		return nil, errors.Wrap(err, "GetKeys: s3.ListObjectsV2 failed")
+		return nil, "", err
+	}
+	for _, key := range keys {
+		switch {
+		case isPgControlPartition(key):
+			pgControl = key
+		case isTarPartition(key):
+			partitions = append(partitions, key)
+		default:
+			log.Printf("WARNING: %v is not a tar partition, skipped\n", key)
+		}
 	}
+	return partitions, pgControl, nil
+}
 
-	return result, nil
+// isTarPartition tells whether key is a tar partition of any compression and encryption
+func isTarPartition(key string) bool {
+	return strings.Contains(path.Base(key), ".tar")
 }
 
-// GetWals returns all WAL file keys less then key provided
-func (b *Backup) GetWals(before string) ([]*s3.ObjectIdentifier, error) {
-	objects := &s3.ListObjectsV2Input{
-		Bucket: b.Prefix.Bucket,
-		Prefix: aws.String(sanitizePath(*b.Path)),
+// GetWals returns keys of WAL objects obsolete before WAL file name provided, see isObsoleteWAL
+func (b *Backup) GetWals(before string) ([]string, error) {
+	objects, err := b.Prefix.Storage().List(sanitizePath(*b.Path))
+	if err != nil {
+		return nil, errors.Wrap(err, "GetWals: failed to list WAL")
 	}
 
-	arr := make([]*s3.ObjectIdentifier, 0)
-
-	err := b.Prefix.Svc.ListObjectsV2Pages(objects, func(files *s3.ListObjectsV2Output, lastPage bool) bool {
-		for _, ob := range files.Contents {
-			key := *ob.Key
-			if stripWalName(key) < before {
-				arr = append(arr, &s3.ObjectIdentifier{Key: aws.String(key)})
-			}
+	arr := make([]string, 0)
+	for _, ob := range objects {
+		if isObsoleteWAL(ob.Key, before) {
+			arr = append(arr, ob.Key)
 		}
-		return true
-	})
-
-	if err != nil {
-		return nil, errors.Wrap(err, "GetKeys: s3.ListObjectsV2 failed")
 	}
 
 	return arr, nil
@@ -240,59 +254,45 @@ type Archive struct {
 
 // CheckExistence checks that the specified WAL file exists.
 func (a *Archive) CheckExistence() (bool, error) {
-	arch := &s3.HeadObjectInput{
-		Bucket: a.Prefix.Bucket,
-		Key:    a.Archive,
-	}
-
-	_, err := a.Prefix.Svc.HeadObject(arch)
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			switch awsErr.Code() {
-			case "NotFound":
-				return false, nil
-			default:
-				return false, awsErr
-			}
-		}
-	}
-	return true, nil
+	return a.Prefix.Storage().Exists(aws.StringValue(a.Archive))
 }
 
-// GetETag aquires ETag of the object from S3
+// GetETag aquires ETag of the object from S3, other backends have no ETag
 func (a *Archive) GetETag() (*string, error) {
-	arch := &s3.HeadObjectInput{
-		Bucket: a.Prefix.Bucket,
-		Key:    a.Archive,
+	storage := a.Prefix.Storage()
+	if limited, ok := storage.(*rateLimitedStorage); ok {
+		storage = limited.StorageBackend
 	}
-
-	h, err := a.Prefix.Svc.HeadObject(arch)
-	if err != nil {
-		return nil, err
+	eTags, ok := storage.(eTagStorage)
+	if !ok {
+		return nil, ErrNotS3Storage
 	}
-
-	return h.ETag, nil
+	return eTags.GetETag(*a.Archive)
 }
 
-// GetArchive downloads the specified archive from S3.
+// GetArchive downloads the specified archive from storage.
 func (a *Archive) GetArchive() (io.ReadCloser, error) {
-	input := &s3.GetObjectInput{
-		Bucket: a.Prefix.Bucket,
-		Key:    a.Archive,
-	}
-
-	archive, err := a.Prefix.Svc.GetObject(input)
+	archive, err := a.Prefix.Storage().GetArchive(*a.Archive)
 	if err != nil {
-		return nil, errors.Wrap(err, "GetArchive: s3.GetObject failed")
+		return nil, errors.Wrap(err, "GetArchive: failed to get object")
 	}
 
-	return archive.Body, nil
+	return archive, nil
 }
 
 // SentinelSuffix is a suffix of backup finish sentinel file
 const SentinelSuffix = "_backup_stop_sentinel.json"
 
 func fetchSentinel(backupName string, bk *Backup, pre *Prefix) (dto S3TarBallSentinelDto) {
+	dto, err := readSentinel(backupName, bk, pre)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	return
+}
+
+// readSentinel downloads and parses sentinel of backup
+func readSentinel(backupName string, bk *Backup, pre *Prefix) (dto S3TarBallSentinelDto, err error) {
 	latestSentinel := backupName + SentinelSuffix
 	previousBackupReader := S3ReaderMaker{
 		Backup:     bk,
@@ -301,20 +301,87 @@ func fetchSentinel(backupName string, bk *Backup, pre *Prefix) (dto S3TarBallSen
 	}
 	prevBackup, err := previousBackupReader.Reader()
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return dto, err
 	}
+	defer prevBackup.Close()
 	sentinelDto, err := ioutil.ReadAll(prevBackup)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return dto, errors.Wrapf(err, "readSentinel: failed to read sentinel of %s", backupName)
 	}
 
 	err = json.Unmarshal(sentinelDto, &dto)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return dto, errors.Wrapf(err, "readSentinel: failed to parse sentinel of %s", backupName)
 	}
 	return
 }
 
+// FetchSentinels downloads sentinels of many backups concurrently.
+// Number of simultaneous requests is limited by WALG_DOWNLOAD_CONCURRENCY.
+func FetchSentinels(backupNames []string, bk *Backup, pre *Prefix) (map[string]S3TarBallSentinelDto, error) {
+	sentinels := make(map[string]S3TarBallSentinelDto, len(backupNames))
+	if len(backupNames) == 0 {
+		return sentinels, nil
+	}
+
+	type result struct {
+		name string
+		dto  S3TarBallSentinelDto
+		err  error
+	}
+	names := make(chan string)
+	results := make(chan result)
+	workers := getMaxDownloadConcurrency(min(len(backupNames), 16))
+	for i := 0; i < workers; i++ {
+		go func() {
+			for name := range names {
+				dto, err := readSentinel(name, bk, pre)
+				results <- result{name, dto, err}
+			}
+		}()
+	}
+	go func() {
+		for _, name := range backupNames {
+			names <- name
+		}
+		close(names)
+	}()
+
+	var firstErr error
+	for range backupNames {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		sentinels[r.name] = r.dto
+	}
+	if firstErr != nil {
+		return nil, errors.Wrap(firstErr, "FetchSentinels: failed to fetch sentinel")
+	}
+	return sentinels, nil
+}
+
+// DefaultWALSubpath is the folder of WAL archive under the prefix unless WALG_WAL_SUBPATH is set
+const DefaultWALSubpath = "wal_005"
+
+// GetWALSubpath returns the folder of WAL archive under the prefix. WALG_WAL_SUBPATH changes it
+// to share archive laid out by other tools, slashes around it are ignored.
+func GetWALSubpath() string {
+	subpath := strings.Trim(os.Getenv("WALG_WAL_SUBPATH"), "/")
+	if subpath == "" {
+		return DefaultWALSubpath
+	}
+	return subpath
+}
+
+// GetWALPath gets path for WAL archive of server in a bucket
+func GetWALPath(server string) string {
+	return sanitizePath(server + "/" + GetWALSubpath() + "/")
+}
+
 // GetBackupPath gets path for basebackup in a bucket
 func GetBackupPath(prefix *Prefix) *string {
 	path := *prefix.Server + "/basebackups_005/"
@@ -0,0 +1,174 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// BackupIndexName is the name of object listing all objects of a backup
+const BackupIndexName = "backup_index.json"
+
+// BackupIndexEntry describes one object of a backup as it was at upload time
+type BackupIndexEntry struct {
+	Key  string
+	Size int64
+	// ETag is known on S3 only
+	ETag string `json:",omitempty"`
+	// Crc32c of stored body, compressed and encrypted, is known for tar partitions
+	Crc32c *uint32 `json:",omitempty"`
+}
+
+// BackupIndex lists every object of a backup. It is uploaded before the sentinel,
+// so a backup whose upload was aborted has neither.
+type BackupIndex struct {
+	Objects []BackupIndexEntry
+}
+
+// BackupAuditProblem describes object which differs from backup index
+type BackupAuditProblem struct {
+	Key    string
+	Reason string
+}
+
+func getBackupIndexKey(server string, backupName string) string {
+	return sanitizePath(server + "/basebackups_005/" + backupName + "/" + BackupIndexName)
+}
+
+// uploadBackupIndex lists uploaded objects of the backup and stores them with sizes,
+// ETags and checksums of tar partitions
+func (tu *TarUploader) uploadBackupIndex(backupName string) error {
+	index, err := tu.listBackupObjects(backupName)
+	if err != nil {
+		return err
+	}
+	for i, entry := range index.Objects {
+		if sum, ok := tu.partitionChecksums.Load(entry.Key); ok {
+			crc := sum.(uint32)
+			index.Objects[i].Crc32c = &crc
+		}
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "uploadBackupIndex: failed to encode index")
+	}
+	err = tu.put(getBackupIndexKey(tu.server, backupName), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "uploadBackupIndex: failed to upload index")
+	}
+	return nil
+}
+
+// listBackupObjects lists uploaded objects of the backup, with ETags on S3
+func (tu *TarUploader) listBackupObjects(backupName string) (BackupIndex, error) {
+	indexKey := getBackupIndexKey(tu.server, backupName)
+	prefix := sanitizePath(tu.server + "/basebackups_005/" + backupName + "/")
+	var index BackupIndex
+	objects, err := tu.storage().ListAll(prefix)
+	if err != nil {
+		return index, errors.Wrap(err, "listBackupObjects: failed to list backup")
+	}
+	for _, object := range objects {
+		if object.Key != indexKey {
+			index.Objects = append(index.Objects, BackupIndexEntry{Key: object.Key, Size: object.Size, ETag: object.ETag})
+		}
+	}
+	return index, nil
+}
+
+// FetchBackupIndex downloads index of the backup
+func FetchBackupIndex(pre *Prefix, backupName string) (*BackupIndex, error) {
+	archive := &Archive{
+		Prefix:  pre,
+		Archive: aws.String(getBackupIndexKey(*pre.Server, backupName)),
+	}
+	exists, err := archive.CheckExistence()
+	if err != nil {
+		return nil, errors.Wrap(err, "FetchBackupIndex: failed to check index existence")
+	}
+	if !exists {
+		return nil, BackupIndexNonExistenceError{backupName}
+	}
+
+	reader, err := archive.GetArchive()
+	if err != nil {
+		return nil, errors.Wrap(err, "FetchBackupIndex: failed to fetch index")
+	}
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "FetchBackupIndex: failed to fetch index")
+	}
+	var index BackupIndex
+	err = json.Unmarshal(body, &index)
+	if err != nil {
+		return nil, errors.Wrap(err, "FetchBackupIndex: failed to parse index")
+	}
+	return &index, nil
+}
+
+// CheckBackupCompleteness compares objects of index with one listing of the backup, so a
+// missing or truncated partition is found without reading any of them. Works with any storage,
+// on S3 ETags are compared too, which finds objects overwritten with the same size.
+func CheckBackupCompleteness(pre *Prefix, backupName string, index *BackupIndex) ([]BackupAuditProblem, error) {
+	objects, err := pre.Storage().ListAll(*GetBackupPath(pre) + backupName + "/")
+	if err != nil {
+		return nil, errors.Wrapf(err, "CheckBackupCompleteness: failed to list backup %s", backupName)
+	}
+	listed := make(map[string]StorageObject, len(objects))
+	for _, object := range objects {
+		listed[object.Key] = object
+	}
+
+	var problems []BackupAuditProblem
+	for _, entry := range index.Objects {
+		object, ok := listed[entry.Key]
+		if !ok {
+			problems = append(problems, BackupAuditProblem{entry.Key, "missing"})
+		} else if object.Size != entry.Size {
+			problems = append(problems, BackupAuditProblem{entry.Key, fmt.Sprintf("size is %d instead of %d", object.Size, entry.Size)})
+		} else if entry.ETag != "" && object.ETag != "" && object.ETag != entry.ETag {
+			problems = append(problems, BackupAuditProblem{entry.Key, fmt.Sprintf("ETag is %s instead of %s", object.ETag, entry.ETag)})
+		}
+	}
+	return problems, nil
+}
+
+// HandleBackupAudit is invoked to perform wal-g backup-audit
+func HandleBackupAudit(pre *Prefix, backupName string) error {
+	if backupName == "LATEST" {
+		var bk = &Backup{
+			Prefix: pre,
+			Path:   GetBackupPath(pre),
+		}
+		latest, err := bk.GetLatest()
+		if err != nil {
+			return err
+		}
+		backupName = latest
+	}
+
+	index, err := FetchBackupIndex(pre, backupName)
+	if err != nil {
+		return err
+	}
+	problems, err := CheckBackupCompleteness(pre, backupName, index)
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", strings.TrimPrefix(problem.Key, *GetBackupPath(pre)), problem.Reason)
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("HandleBackupAudit: backup %s is damaged: %d of %d objects differ from index", backupName, len(problems), len(index.Objects))
+	}
+	fmt.Printf("Backup %s is intact: all %d objects are present.\n", backupName, len(index.Objects))
+	return nil
+}
@@ -0,0 +1,137 @@
+package walg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/wal-g/wal-g"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+func TestBackupIndexAudit(t *testing.T) {
+	tu, pre, client := newMemoryStorage()
+	maker := &walg.S3TarBallMaker{
+		BaseDir:  "data",
+		Trim:     "",
+		BkupName: "base_000000010000000000000002",
+		Tu:       tu,
+	}
+
+	for i := 0; i < 2; i++ {
+		tarBall := maker.Make(false)
+		tarBall.SetUp(&walg.OpenPGPCrypter{})
+		err := tarBall.Tw().WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tarBall.CloseTar()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			err = tarBall.Finish(&walg.S3TarBallSentinelDto{})
+			if err != nil {
+				t.Fatalf("index: failed to finish backup: %v", err)
+			}
+		}
+	}
+
+	index, err := walg.FetchBackupIndex(pre, "base_000000010000000000000002")
+	if err != nil {
+		t.Fatalf("index: failed to fetch index: %v", err)
+	}
+	if len(index.Objects) != 2 {
+		t.Fatalf("index: expected 2 partitions in index, got %v", index.Objects)
+	}
+	for _, entry := range index.Objects {
+		if entry.ETag == "" {
+			t.Errorf("index: expected ETag of %s in index", entry.Key)
+		}
+	}
+	problems, err := walg.CheckBackupCompleteness(pre, "base_000000010000000000000002", index)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("index: intact backup reported as %v, %v", problems, err)
+	}
+
+	// Object removed by lifecycle rule and object overwritten with the same size
+	delete(client.objects, index.Objects[0].Key)
+	client.objects[index.Objects[1].Key] = bytes.Repeat([]byte("x"), len(client.objects[index.Objects[1].Key]))
+	problems, err = walg.CheckBackupCompleteness(pre, "base_000000010000000000000002", index)
+	if err != nil {
+		t.Fatalf("index: audit failed: %v", err)
+	}
+	if len(problems) != 2 || problems[0].Reason != "missing" || !strings.HasPrefix(problems[1].Reason, "ETag") {
+		t.Errorf("index: expected missing and changed objects but got %v", problems)
+	}
+}
+
+func TestBackupIndexCompleteness(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	maker := &walg.S3TarBallMaker{
+		BaseDir:  "data",
+		Trim:     "",
+		BkupName: "base_000000010000000000000002",
+		Tu:       tu,
+	}
+
+	for i := 0; i < 3; i++ {
+		tarBall := maker.Make(false)
+		tarBall.SetUp(&walg.OpenPGPCrypter{})
+		err := tarBall.Tw().WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tarBall.CloseTar()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			err = tarBall.Finish(&walg.S3TarBallSentinelDto{})
+			if err != nil {
+				t.Fatalf("index: failed to finish backup: %v", err)
+			}
+		}
+	}
+
+	index, err := walg.FetchBackupIndex(pre, "base_000000010000000000000002")
+	if err != nil {
+		t.Fatalf("index: failed to fetch index: %v", err)
+	}
+	if len(index.Objects) != 3 {
+		t.Fatalf("index: expected 3 partitions in index, got %v", index.Objects)
+	}
+	for _, entry := range index.Objects {
+		if entry.Crc32c == nil || *entry.Crc32c != crc32.Checksum(storage.objects[entry.Key], crc32.MakeTable(crc32.Castagnoli)) {
+			t.Errorf("index: expected checksum of stored %s in index but got %v", entry.Key, entry.Crc32c)
+		}
+	}
+	problems, err := walg.CheckBackupCompleteness(pre, "base_000000010000000000000002", index)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("index: complete backup reported as %v, %v", problems, err)
+	}
+	if err = walg.HandleBackupAudit(pre, "LATEST"); err != nil {
+		t.Errorf("index: audit of complete backup on non-S3 storage failed: %v", err)
+	}
+
+	// Partition lost after abort and partition cut short
+	delete(storage.objects, index.Objects[0].Key)
+	storage.objects[index.Objects[1].Key] = storage.objects[index.Objects[1].Key][:1]
+	problems, err = walg.CheckBackupCompleteness(pre, "base_000000010000000000000002", index)
+	if err != nil {
+		t.Fatalf("index: completeness check failed: %v", err)
+	}
+	if len(problems) != 2 || problems[0].Key != index.Objects[0].Key || problems[0].Reason != "missing" {
+		t.Errorf("index: expected missing and truncated partitions but got %v", problems)
+	}
+	if err = walg.HandleBackupAudit(pre, "base_000000010000000000000002"); err == nil {
+		t.Errorf("index: audit of damaged backup succeeded")
+	}
+
+	if _, err = walg.FetchBackupIndex(pre, "base_000000010000000000000004"); err == nil {
+		t.Errorf("index: expected error for backup without index")
+	} else if _, ok := err.(walg.BackupIndexNonExistenceError); !ok {
+		t.Errorf("index: expected BackupIndexNonExistenceError but got %v", err)
+	}
+}
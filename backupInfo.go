@@ -0,0 +1,139 @@
+package walg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// BackupInfo is the report of backup-info about one backup
+type BackupInfo struct {
+	Name              string `json:"name"`
+	StartLSN          string `json:"start_lsn,omitempty"`
+	FinishLSN         string `json:"finish_lsn,omitempty"`
+	PgVersion         int    `json:"pg_version,omitempty"`
+	WalSegmentSize    uint64 `json:"wal_segment_size,omitempty"`
+	CompressionMethod string `json:"compression_method,omitempty"`
+	IsIncremental     bool   `json:"is_incremental"`
+	// Number of deltas from the base backup to this one, zero for full backups
+	IncrementCount int    `json:"increment_count"`
+	BaseBackup     string `json:"base_backup,omitempty"`
+	DeltaFrom      string `json:"delta_from,omitempty"`
+	// Files of restored backup and their total size, as they were on disk at push
+	FileCount        int   `json:"file_count"`
+	UncompressedSize int64 `json:"uncompressed_size"`
+	// Files which are not stored in delta, as they did not change since the previous backup
+	SkippedFileCount int `json:"skipped_file_count"`
+	// Backups to restore one after another, from the base backup to this one
+	Chain []string `json:"chain"`
+}
+
+// NewBackupInfo summarizes sentinel of backup. Chain consists of the backup alone.
+func NewBackupInfo(name string, sentinel S3TarBallSentinelDto) BackupInfo {
+	info := BackupInfo{
+		Name:              name,
+		PgVersion:         sentinel.PgVersion,
+		WalSegmentSize:    sentinel.WalSegmentSize,
+		CompressionMethod: sentinel.CompressionMethod,
+		IsIncremental:     sentinel.IsIncremental(),
+		FileCount:         len(sentinel.Files),
+		Chain:             []string{name},
+	}
+	if sentinel.LSN != nil {
+		info.StartLSN = formatOptionalLSN(sentinel.LSN)
+	}
+	if sentinel.FinishLSN != nil {
+		info.FinishLSN = formatOptionalLSN(sentinel.FinishLSN)
+	}
+	if info.IsIncremental {
+		info.IncrementCount = *sentinel.IncrementCount
+		info.BaseBackup = *sentinel.IncrementFullName
+		info.DeltaFrom = *sentinel.IncrementFrom
+	}
+	for _, fd := range sentinel.Files {
+		info.UncompressedSize += fd.Size
+		if fd.IsSkipped {
+			info.SkippedFileCount++
+		}
+	}
+	return info
+}
+
+// GetBackupChain walks deltas from backup to its base backup with fetch and returns
+// names of backups in order of restore, from the base backup to backup itself
+func GetBackupChain(name string, sentinel S3TarBallSentinelDto, fetch func(name string) (S3TarBallSentinelDto, error)) ([]string, error) {
+	chain := []string{name}
+	seen := map[string]bool{name: true}
+	for sentinel.IsIncremental() {
+		name = *sentinel.IncrementFrom
+		if seen[name] {
+			return nil, errors.Errorf("GetBackupChain: delta chain of %s has a cycle at %s", chain[0], name)
+		}
+		seen[name] = true
+		var err error
+		sentinel, err = fetch(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetBackupChain: failed to fetch sentinel of %s", name)
+		}
+		chain = append(chain, name)
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// HandleBackupInfo is invoked to perform wal-g backup-info
+func HandleBackupInfo(backupName string, pre *Prefix, asJSON bool) error {
+	backupName, sentinel, err := fetchBackupSentinel(pre, backupName)
+	if err != nil {
+		return err
+	}
+	info := NewBackupInfo(backupName, sentinel)
+
+	bk := &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	chain, err := GetBackupChain(backupName, sentinel, func(name string) (S3TarBallSentinelDto, error) {
+		bk.Name = aws.String(name)
+		return readSentinel(name, bk, pre)
+	})
+	if err != nil {
+		return err
+	}
+	info.Chain = chain
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "name:\t%v\n", info.Name)
+	fmt.Fprintf(w, "start_lsn:\t%v\n", formatOptionalLSN(sentinel.LSN))
+	fmt.Fprintf(w, "finish_lsn:\t%v\n", formatOptionalLSN(sentinel.FinishLSN))
+	fmt.Fprintf(w, "pg_version:\t%v\n", info.PgVersion)
+	fmt.Fprintf(w, "wal_segment_size:\t%v\n", sentinel.GetWalSegmentSize())
+	if info.CompressionMethod != "" {
+		fmt.Fprintf(w, "compression_method:\t%v\n", info.CompressionMethod)
+	}
+	fmt.Fprintf(w, "incremental:\t%v\n", info.IsIncremental)
+	if info.IsIncremental {
+		fmt.Fprintf(w, "increment_count:\t%v\n", info.IncrementCount)
+		fmt.Fprintf(w, "delta_from:\t%v\n", info.DeltaFrom)
+		fmt.Fprintf(w, "base_backup:\t%v\n", info.BaseBackup)
+	}
+	fmt.Fprintf(w, "file_count:\t%v\n", info.FileCount)
+	fmt.Fprintf(w, "skipped_file_count:\t%v\n", info.SkippedFileCount)
+	fmt.Fprintf(w, "uncompressed_size:\t%v\n", info.UncompressedSize)
+	fmt.Fprintf(w, "chain:\t%v\n", strings.Join(info.Chain, " -> "))
+	return nil
+}
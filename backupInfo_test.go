@@ -0,0 +1,101 @@
+package walg_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func makeDeltaSentinel(from string, full string, count int) walg.S3TarBallSentinelDto {
+	lsn := uint64(0x3000028)
+	return walg.S3TarBallSentinelDto{
+		LSN:               &lsn,
+		IncrementFrom:     &from,
+		IncrementFromLSN:  &lsn,
+		IncrementFullName: &full,
+		IncrementCount:    &count,
+	}
+}
+
+func TestNewBackupInfo(t *testing.T) {
+	sentinel := makeDeltaSentinel("base_1", "base_0", 2)
+	sentinel.PgVersion = 100005
+	sentinel.Files = walg.BackupFileList{
+		"base/1/1": {Size: 8192},
+		"base/1/2": {Size: 16384, IsIncremented: true},
+		"base/1/3": {Size: 100, IsSkipped: true},
+	}
+
+	info := walg.NewBackupInfo("base_2", sentinel)
+	if !info.IsIncremental || info.IncrementCount != 2 || info.BaseBackup != "base_0" || info.DeltaFrom != "base_1" {
+		t.Errorf("backupInfo: unexpected delta properties %+v", info)
+	}
+	if info.FileCount != 3 || info.SkippedFileCount != 1 || info.UncompressedSize != 24676 {
+		t.Errorf("backupInfo: unexpected file statistics %+v", info)
+	}
+	if info.StartLSN != "3000028" || info.FinishLSN != "" || info.PgVersion != 100005 {
+		t.Errorf("backupInfo: unexpected LSNs or version %+v", info)
+	}
+}
+
+func TestGetBackupChain(t *testing.T) {
+	sentinels := map[string]walg.S3TarBallSentinelDto{
+		"base_0": {},
+		"base_1": makeDeltaSentinel("base_0", "base_0", 1),
+	}
+	fetch := func(name string) (walg.S3TarBallSentinelDto, error) {
+		sentinel, ok := sentinels[name]
+		if !ok {
+			return sentinel, errors.New("no sentinel of " + name)
+		}
+		return sentinel, nil
+	}
+
+	chain, err := walg.GetBackupChain("base_2", makeDeltaSentinel("base_1", "base_0", 2), fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(chain, []string{"base_0", "base_1", "base_2"}) {
+		t.Errorf("backupInfo: unexpected chain %v", chain)
+	}
+
+	chain, err = walg.GetBackupChain("base_0", walg.S3TarBallSentinelDto{}, fetch)
+	if err != nil || !reflect.DeepEqual(chain, []string{"base_0"}) {
+		t.Errorf("backupInfo: expected chain of full backup alone but got %v, %v", chain, err)
+	}
+
+	_, err = walg.GetBackupChain("base_3", makeDeltaSentinel("base_missing", "base_0", 3), fetch)
+	if err == nil {
+		t.Errorf("backupInfo: expected error for chain with missing backup")
+	}
+
+	sentinels["base_1"] = makeDeltaSentinel("base_2", "base_0", 1)
+	_, err = walg.GetBackupChain("base_2", makeDeltaSentinel("base_1", "base_0", 2), fetch)
+	if err == nil {
+		t.Errorf("backupInfo: expected error for chain with a cycle")
+	}
+}
+
+func TestHandleBackupInfoReturnsErrors(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	_, pre := walg.ConfigureStorageBackend(storage, "/server")
+	full := "base_000000010000000000000002"
+	delta := "base_000000010000000000000004_D_000000010000000000000002"
+	storage.objects["server/basebackups_005/"+full+walg.SentinelSuffix] = []byte(`{"LSN": 33554472, "FinishLSN": 33554688}`)
+	storage.objects["server/basebackups_005/"+delta+walg.SentinelSuffix] = []byte(`{"LSN": 67108904, "FinishLSN": 67109120, ` +
+		`"DeltaFrom": "` + full + `", "DeltaFromLSN": 33554472, "DeltaFullName": "` + full + `", "DeltaCount": 1}`)
+
+	if err := walg.HandleBackupInfo(delta, pre, true); err != nil {
+		t.Errorf("info: backup-info of delta failed: %v", err)
+	}
+	if err := walg.HandleBackupInfo("base_000000010000000000000006", pre, false); err == nil {
+		t.Errorf("info: backup-info of missing backup succeeded")
+	}
+	// Chain cannot be followed without the base
+	delete(storage.objects, "server/basebackups_005/"+full+walg.SentinelSuffix)
+	if err := walg.HandleBackupInfo(delta, pre, false); err == nil {
+		t.Errorf("info: backup-info of delta without base succeeded")
+	}
+}
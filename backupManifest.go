@@ -0,0 +1,111 @@
+package walg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BackupManifestName is the file read by pg_verifybackup in the root of restored backup
+const BackupManifestName = "backup_manifest"
+
+// BackupManifestFile is one file of backup as it is written to restored directory
+type BackupManifestFile struct {
+	Path     string
+	Size     int64
+	MTime    time.Time
+	Checksum []byte
+}
+
+// BackupManifest collects files of a full backup for backup_manifest in the format
+// of Postgres 13, so restored backup can be checked by pg_verifybackup
+type BackupManifest struct {
+	Timeline uint32
+	StartLSN uint64
+
+	mutex sync.Mutex
+	files []BackupManifestFile
+}
+
+// NewBackupManifest creates empty manifest
+func NewBackupManifest() *BackupManifest {
+	return &BackupManifest{}
+}
+
+// NewChecksum creates hash to compute checksum of file content for AddFile
+func (m *BackupManifest) NewChecksum() hash.Hash {
+	return sha256.New()
+}
+
+// AddFile records file of backup by its name in tarball; safe for concurrent use
+func (m *BackupManifest) AddFile(name string, size int64, mtime time.Time, checksum []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Paths in manifest are relative to data directory
+	m.files = append(m.files, BackupManifestFile{strings.TrimPrefix(name, "/"), size, mtime, checksum})
+}
+
+func formatManifestLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, uint32(lsn))
+}
+
+// Bytes renders manifest of backup finished at finishLSN. The last line holds
+// SHA256 of everything before it, as pg_verifybackup expects.
+func (m *BackupManifest) Bytes(finishLSN uint64) []byte {
+	m.mutex.Lock()
+	files := make([]BackupManifestFile, len(m.files))
+	copy(files, m.files)
+	m.mutex.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	var buf bytes.Buffer
+	buf.WriteString("{ \"PostgreSQL-Backup-Manifest-Version\": 1,\n\"Files\": [")
+	for i, file := range files {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		path, _ := json.Marshal(file.Path)
+		fmt.Fprintf(&buf, "\n{ \"Path\": %s, \"Size\": %d, \"Last-Modified\": \"%s\", \"Checksum-Algorithm\": \"SHA256\", \"Checksum\": \"%s\" }",
+			path, file.Size, file.MTime.UTC().Format("2006-01-02 15:04:05 GMT"), hex.EncodeToString(file.Checksum))
+	}
+	buf.WriteString(" ],\n\"WAL-Ranges\": [\n")
+	fmt.Fprintf(&buf, "{ \"Timeline\": %d, \"Start-LSN\": \"%s\", \"End-LSN\": \"%s\" }\n],\n",
+		m.Timeline, formatManifestLSN(m.StartLSN), formatManifestLSN(finishLSN))
+
+	checksum := sha256.Sum256(buf.Bytes())
+	fmt.Fprintf(&buf, "\"Manifest-Checksum\": \"%s\"}\n", hex.EncodeToString(checksum[:]))
+	return buf.Bytes()
+}
+
+// checksumReader passes content of file through hash
+func checksumReader(r io.Reader, h hash.Hash) io.Reader {
+	if h == nil {
+		return r
+	}
+	return io.TeeReader(r, h)
+}
+
+// getBackupManifest tells whether WALG_BACKUP_MANIFEST asks to include backup_manifest into full backups
+func getBackupManifest() (bool, error) {
+	useStr, ok := os.LookupEnv("WALG_BACKUP_MANIFEST")
+	if !ok {
+		return false, nil
+	}
+	use, err := strconv.ParseBool(useStr)
+	if err != nil {
+		return false, errors.Wrap(err, "getBackupManifest: failed to parse WALG_BACKUP_MANIFEST")
+	}
+	return use, nil
+}
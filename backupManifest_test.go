@@ -0,0 +1,88 @@
+package walg_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestBackupManifestFromWalk(t *testing.T) {
+	data, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+	os.MkdirAll(filepath.Join(data, "base", "1"), 0700)
+	content := bytes.Repeat([]byte{7}, 5000)
+	err = ioutil.WriteFile(filepath.Join(data, "base", "1", "1234"), content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maker := &memoryTarBallMaker{trim: data}
+	bundle := &walg.Bundle{
+		MinSize:  int64(1) << 62,
+		Files:    &sync.Map{},
+		Tbm:      maker,
+		Manifest: walg.NewBackupManifest(),
+	}
+	bundle.Manifest.Timeline = 1
+	bundle.Manifest.StartLSN = 0x2000028
+	bundle.StartQueue()
+	err = walg.Walk(data, bundle.TarWalker)
+	if err != nil {
+		t.Fatalf("manifest: walk failed: %v", err)
+	}
+	err = bundle.FinishQueue()
+	if err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+
+	manifest := bundle.Manifest.Bytes(0x1000002100)
+
+	// The last line holds checksum of everything before it
+	lastLine := bytes.LastIndexByte(manifest[:len(manifest)-1], '\n') + 1
+	checksum := sha256.Sum256(manifest[:lastLine])
+	if !bytes.Contains(manifest[lastLine:], []byte(hex.EncodeToString(checksum[:]))) {
+		t.Errorf("manifest: wrong manifest checksum in %s", manifest[lastLine:])
+	}
+
+	var parsed struct {
+		Files []struct {
+			Path     string
+			Size     int64
+			Checksum string
+			Modified string `json:"Last-Modified"`
+		}
+		WALRanges []struct {
+			Timeline uint32
+			StartLSN string `json:"Start-LSN"`
+			EndLSN   string `json:"End-LSN"`
+		} `json:"WAL-Ranges"`
+	}
+	err = json.Unmarshal(manifest, &parsed)
+	if err != nil {
+		t.Fatalf("manifest: invalid JSON: %v\n%s", err, manifest)
+	}
+	fileChecksum := sha256.Sum256(content)
+	if len(parsed.Files) != 1 || parsed.Files[0].Path != "base/1/1234" || parsed.Files[0].Size != 5000 ||
+		parsed.Files[0].Checksum != hex.EncodeToString(fileChecksum[:]) {
+		t.Errorf("manifest: unexpected files %+v", parsed.Files)
+	}
+	if _, err = time.Parse("2006-01-02 15:04:05 GMT", parsed.Files[0].Modified); err != nil {
+		t.Errorf("manifest: invalid modification time: %v", err)
+	}
+	if len(parsed.WALRanges) != 1 || parsed.WALRanges[0].Timeline != 1 ||
+		parsed.WALRanges[0].StartLSN != "0/2000028" || parsed.WALRanges[0].EndLSN != "10/2100" {
+		t.Errorf("manifest: unexpected WAL ranges %+v", parsed.WALRanges)
+	}
+}
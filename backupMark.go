@@ -0,0 +1,138 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// PermanentMarkName is the object in folder of backup which protects it from delete
+const PermanentMarkName = "permanent_mark.json"
+
+// PermanentMark records that backup is kept by delete regardless of retention rules.
+// Backup is impermanent again once the mark object is removed.
+type PermanentMark struct {
+	Name     string    `json:"name"`
+	MarkedAt time.Time `json:"marked_at"`
+}
+
+func getPermanentMarkKey(pre *Prefix, name string) string {
+	return *GetBackupPath(pre) + name + "/" + PermanentMarkName
+}
+
+// IsBackupPermanent tells whether backup has permanent mark
+func IsBackupPermanent(pre *Prefix, name string) (bool, error) {
+	exists, err := pre.Storage().Exists(getPermanentMarkKey(pre, name))
+	if err != nil {
+		return false, errors.Wrapf(err, "IsBackupPermanent: failed to check mark of %s", name)
+	}
+	return exists, nil
+}
+
+// MarkBackup uploads permanent mark of backup, or removes it to make backup impermanent
+func MarkBackup(tu *TarUploader, pre *Prefix, name string, permanent bool) error {
+	bk := &Backup{Prefix: pre, Path: GetBackupPath(pre), Name: aws.String(name)}
+	bk.Js = aws.String(*bk.Path + name + SentinelSuffix)
+	exists, err := bk.CheckExistence()
+	if err != nil {
+		return errors.Wrapf(err, "MarkBackup: failed to check backup %s", name)
+	}
+	if !exists {
+		return BackupNonExistenceError{name}
+	}
+
+	key := getPermanentMarkKey(pre, name)
+	if !permanent {
+		err = pre.Storage().Delete([]string{key})
+		if err != nil {
+			return errors.Wrapf(err, "MarkBackup: failed to remove mark of %s", name)
+		}
+		return nil
+	}
+	body, err := json.Marshal(PermanentMark{Name: name, MarkedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	err = tu.put(key, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "MarkBackup: failed to upload mark of %s", name)
+	}
+	return nil
+}
+
+// GetPermanentBackups finds backups with permanent mark and bases of permanent deltas,
+// which delete keeps regardless of its target. Returns sentinels of them by name.
+func GetPermanentBackups(pre *Prefix, backups []BackupTime) (map[string]S3TarBallSentinelDto, error) {
+	kept := make(map[string]S3TarBallSentinelDto)
+	for _, b := range backups {
+		permanent, err := IsBackupPermanent(pre, b.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !permanent {
+			continue
+		}
+		name := b.Name
+		// Chain is not longer than the list of backups, unless it has a cycle
+		for step := 0; step < len(backups); step++ {
+			if _, ok := kept[name]; ok {
+				break
+			}
+			bk := &Backup{Prefix: pre, Path: GetBackupPath(pre), Name: aws.String(name)}
+			dto, err := readSentinel(name, bk, pre)
+			if err != nil {
+				return nil, err
+			}
+			kept[name] = dto
+			if !dto.IsIncremental() {
+				break
+			}
+			name = *dto.IncrementFrom
+		}
+	}
+	return kept, nil
+}
+
+// getPermanentWALRanges lists WAL segments which make permanent backups consistent,
+// delete keeps them together with the backups. Fails if WAL of any of them is unknown.
+func getPermanentWALRanges(permanent map[string]S3TarBallSentinelDto) ([]BackupWALRange, error) {
+	var ranges []BackupWALRange
+	for name, dto := range permanent {
+		walRange, err := GetBackupWALRange(name, dto)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getPermanentWALRanges: failed to find WAL of permanent backup %s", name)
+		}
+		ranges = append(ranges, walRange)
+	}
+	return ranges, nil
+}
+
+// isPermanentWAL tells whether WAL file of key is needed by a permanent backup
+func isPermanentWAL(key string, ranges []BackupWALRange) bool {
+	name := stripWalName(key)
+	for _, walRange := range ranges {
+		if name >= walRange.First() && name <= walRange.Last() {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleBackupMark is invoked to perform wal-g backup-mark
+func HandleBackupMark(tu *TarUploader, pre *Prefix, name string, permanent bool) error {
+	err := MarkBackup(tu, pre, name, permanent)
+	if err != nil {
+		return err
+	}
+	if permanent {
+		fmt.Printf("%v is marked permanent and is kept by delete\n", name)
+	} else {
+		fmt.Printf("%v is no longer permanent\n", name)
+	}
+	return nil
+}
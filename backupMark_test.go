@@ -0,0 +1,101 @@
+package walg_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestPermanentBackupSurvivesRetain(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	backups := []string{
+		"base_20181017T090000Z_000000010000000000000002",
+		"base_20181017T100000Z_000000010000000000000004",
+		"base_20181017T110000Z_000000010000000000000006",
+	}
+	for i, name := range backups {
+		lsn := uint64(0x2000028 + i*0x2000000)
+		sentinel := fmt.Sprintf(`{"LSN": %d, "FinishLSN": %d}`, lsn, lsn+0x100)
+		storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix] = []byte(sentinel)
+		storage.objects["server/basebackups_005/"+name+"/tar_partitions/part_001.tar.lz4"] = []byte("data")
+	}
+	for segment := 2; segment <= 6; segment++ {
+		storage.objects[fmt.Sprintf("server/wal_005/00000001000000000000000%d.lz4", segment)] = []byte("wal")
+	}
+
+	if err := walg.MarkBackup(tu, pre, "base_20181017T080000Z_000000010000000000000001", true); err == nil {
+		t.Errorf("backup-mark: marked backup which does not exist")
+	}
+	if err := walg.MarkBackup(tu, pre, backups[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if permanent, err := walg.IsBackupPermanent(pre, backups[0]); err != nil || !permanent {
+		t.Fatalf("backup-mark: expected %s to be permanent but got %v, %v", backups[0], permanent, err)
+	}
+
+	walg.HandleDelete(tu, pre, []string{"delete", "retain", "1", "--confirm"})
+
+	for i, name := range backups {
+		_, ok := storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix]
+		if expected := i != 1; ok != expected {
+			t.Errorf("backup-mark: expected %s kept %v but got %v", name, expected, ok)
+		}
+	}
+	for segment := 2; segment <= 6; segment++ {
+		_, ok := storage.objects[fmt.Sprintf("server/wal_005/00000001000000000000000%d.lz4", segment)]
+		if expected := segment == 2 || segment == 6; ok != expected {
+			t.Errorf("backup-mark: expected WAL segment %d kept %v but got %v", segment, expected, ok)
+		}
+	}
+
+	// Impermanent backup is deleted like any other
+	if err := walg.MarkBackup(tu, pre, backups[0], false); err != nil {
+		t.Fatal(err)
+	}
+	walg.HandleDelete(tu, pre, []string{"delete", "retain", "1", "--confirm"})
+	if _, ok := storage.objects["server/basebackups_005/"+backups[0]+walg.SentinelSuffix]; ok {
+		t.Errorf("backup-mark: backup is kept after its mark is removed")
+	}
+}
+
+func TestPermanentBackupWithoutFinishLSNKeepsWAL(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	backups := []string{
+		"base_20181017T090000Z_000000010000000000000002",
+		"base_20181017T100000Z_000000010000000000000004",
+		"base_20181017T110000Z_000000010000000000000006",
+	}
+	for i, name := range backups {
+		lsn := uint64(0x2000028 + i*0x2000000)
+		sentinel := fmt.Sprintf(`{"LSN": %d, "FinishLSN": %d}`, lsn, lsn+0x100)
+		if i == 0 {
+			// Sentinel of older wal-g, WAL range of backup is unknown
+			sentinel = fmt.Sprintf(`{"LSN": %d}`, lsn)
+		}
+		storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix] = []byte(sentinel)
+		storage.objects["server/basebackups_005/"+name+"/tar_partitions/part_001.tar.lz4"] = []byte("data")
+	}
+	for segment := 2; segment <= 6; segment++ {
+		storage.objects[fmt.Sprintf("server/wal_005/00000001000000000000000%d.lz4", segment)] = []byte("wal")
+	}
+	if err := walg.MarkBackup(tu, pre, backups[0], true); err != nil {
+		t.Fatal(err)
+	}
+
+	walg.HandleDelete(tu, pre, []string{"delete", "retain", "1", "--confirm"})
+
+	for i, name := range backups {
+		_, ok := storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix]
+		if expected := i != 1; ok != expected {
+			t.Errorf("backup-mark: expected %s kept %v but got %v", name, expected, ok)
+		}
+	}
+	for segment := 2; segment <= 6; segment++ {
+		if _, ok := storage.objects[fmt.Sprintf("server/wal_005/00000001000000000000000%d.lz4", segment)]; !ok {
+			t.Errorf("backup-mark: WAL segment %d is deleted though WAL of permanent backup is unknown", segment)
+		}
+	}
+}
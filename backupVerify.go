@@ -0,0 +1,133 @@
+package walg
+
+import (
+	"archive/tar"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newMemberChecksum creates hash of tar member content recorded in BackupFileDescription
+func newMemberChecksum() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
+
+// BackupChecksumResult is the outcome of checksum verification of one backup
+type BackupChecksumResult struct {
+	// Number of files whose checksum was compared
+	Checked int
+	// Number of files without checksum in sentinel, e.g. of backups made by older versions
+	Unchecked  int
+	Mismatches []ChecksumMismatchError
+}
+
+// checksumTarInterpreter computes checksums of members and compares them with files of sentinel
+type checksumTarInterpreter struct {
+	files BackupFileList
+
+	mutex  sync.Mutex
+	result BackupChecksumResult
+}
+
+func (ti *checksumTarInterpreter) Interpret(r io.Reader, hdr *tar.Header) error {
+	crc := newMemberChecksum()
+	_, err := io.Copy(crc, r)
+	if err != nil {
+		return errors.Wrapf(err, "Interpret: failed to read %s", hdr.Name)
+	}
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return nil
+	}
+
+	ti.mutex.Lock()
+	defer ti.mutex.Unlock()
+	fd, ok := ti.files[hdr.Name]
+	if !ok || fd.Crc32c == nil {
+		ti.result.Unchecked++
+		return nil
+	}
+	ti.result.Checked++
+	if sum := crc.Sum32(); sum != *fd.Crc32c {
+		ti.result.Mismatches = append(ti.result.Mismatches, ChecksumMismatchError{hdr.Name, *fd.Crc32c, sum})
+	}
+	return nil
+}
+
+// VerifyChecksums reads tar partitions as backup-fetch would and compares checksum of each
+// file with the one in files of sentinel. Nothing is written to disk.
+func VerifyChecksums(partitions []ReaderMaker, pgControl ReaderMaker, crypter Crypter, files BackupFileList) (BackupChecksumResult, error) {
+	ti := &checksumTarInterpreter{files: files}
+	err := ExtractBackup(ti, partitions, pgControl, crypter)
+	sort.Slice(ti.result.Mismatches, func(i, j int) bool { return ti.result.Mismatches[i].Name < ti.result.Mismatches[j].Name })
+	return ti.result, err
+}
+
+// HandleBackupVerify is invoked to perform wal-g backup-verify.
+// Returns error if content of some file differs from its checksum.
+func HandleBackupVerify(pre *Prefix, backupName string) error {
+	backupName, sentinel, err := fetchBackupSentinel(pre, backupName)
+	if err != nil {
+		return err
+	}
+	bk := &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+		Name:   aws.String(backupName),
+	}
+	// Partitions missing since upload are found by their index before anything is read
+	index, err := FetchBackupIndex(pre, backupName)
+	if _, ok := err.(BackupIndexNonExistenceError); ok {
+		fmt.Printf("WARNING: %v, its completeness is not checked.\n", err)
+	} else if err != nil {
+		return err
+	} else {
+		problems, err := CheckBackupCompleteness(pre, backupName, index)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", strings.TrimPrefix(problem.Key, *GetBackupPath(pre)), problem.Reason)
+		}
+		if len(problems) > 0 {
+			return errors.Errorf("HandleBackupVerify: backup %s is incomplete: %d of %d objects differ from index",
+				backupName, len(problems), len(index.Objects))
+		}
+	}
+
+	partitions, pgControl, err := getBackupPartitions(bk, sentinel)
+	if err != nil {
+		return err
+	}
+	crypter, err := NewBackupCrypter(sentinel.WrappedDataKey)
+	if err != nil {
+		return err
+	}
+
+	result, err := VerifyChecksums(partitions, pgControl, crypter, sentinel.Files)
+	if err != nil {
+		// Truncated objects fail here with name of the member being read
+		return err
+	}
+
+	for _, mismatch := range result.Mismatches {
+		fmt.Printf("%s: checksum %08x, expected %08x\n", mismatch.Name, mismatch.Actual, mismatch.Expected)
+	}
+	if result.Unchecked > 0 {
+		fmt.Printf("WARNING: %d files have no checksum in sentinel and were only read.\n", result.Unchecked)
+	}
+	if len(result.Mismatches) > 0 {
+		return errors.Errorf("HandleBackupVerify: backup %s is damaged: %d of %d files differ from their checksums",
+			backupName, len(result.Mismatches), result.Checked)
+	}
+	fmt.Printf("Backup %s is intact: checksums of %d files match.\n", backupName, result.Checked)
+	return nil
+}
@@ -0,0 +1,133 @@
+package walg_test
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func checksumOf(content string) *uint32 {
+	sum := crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli))
+	return &sum
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	files := walg.BackupFileList{
+		"base/1/1":          {Crc32c: checksumOf("content of base/1/1")},
+		"base/1/2":          {Crc32c: checksumOf("content of base/1/2")},
+		"global/pg_control": {},
+	}
+	partitions := []walg.ReaderMaker{
+		&BufferReaderMaker{makeTestTar(t, "base/1/1", "base/1/2"), "part_1.tar", "tar"},
+	}
+	pgControl := &BufferReaderMaker{makeTestTar(t, "global/pg_control"), "pg_control.tar", "tar"}
+
+	result, err := walg.VerifyChecksums(partitions, pgControl, walg.MockDisarmedCrypter(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 2 || result.Unchecked != 1 || len(result.Mismatches) != 0 {
+		t.Errorf("backupVerify: unexpected result of intact backup %+v", result)
+	}
+
+	files["base/1/2"] = walg.BackupFileDescription{Crc32c: checksumOf("content of base/1/")}
+	partitions = []walg.ReaderMaker{
+		&BufferReaderMaker{makeTestTar(t, "base/1/1", "base/1/2"), "part_1.tar", "tar"},
+	}
+	result, err = walg.VerifyChecksums(partitions, nil, walg.MockDisarmedCrypter(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Mismatches) != 1 || result.Mismatches[0].Name != "base/1/2" ||
+		result.Mismatches[0].Actual != *checksumOf("content of base/1/2") {
+		t.Errorf("backupVerify: expected mismatch of base/1/2 but got %+v", result.Mismatches)
+	}
+}
+
+func TestVerifyChecksumsTruncated(t *testing.T) {
+	data := makeTestTar(t, "base/1/1").Bytes()
+	partitions := []walg.ReaderMaker{
+		&BufferReaderMaker{bytes.NewBuffer(data[:512+10]), "part_1.tar", "tar"},
+	}
+	_, err := walg.VerifyChecksums(partitions, nil, walg.MockDisarmedCrypter(), walg.BackupFileList{"base/1/1": {}})
+	if err == nil {
+		t.Errorf("backupVerify: expected truncated partition to fail but got `<nil>`")
+	}
+}
+
+func TestFileTarInterpreterVerifyChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verifyChecksums")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := walg.BackupFileList{
+		"base/1/1": {Crc32c: checksumOf("content of base/1/1")},
+		"base/1/2": {Crc32c: checksumOf("content of base/1/")},
+		"base/1/3": {},
+	}
+	extract := func(verify bool) error {
+		ti := &walg.FileTarInterpreter{
+			NewDir:          dir,
+			Sentinel:        walg.S3TarBallSentinelDto{Files: files},
+			VerifyChecksums: verify,
+		}
+		partitions := []walg.ReaderMaker{
+			&BufferReaderMaker{makeTestTar(t, "base/1/1", "base/1/3"), "part_1.tar", "tar"},
+			&BufferReaderMaker{makeTestTar(t, "base/1/2"), "part_2.tar", "tar"},
+		}
+		return walg.ExtractAll(ti, partitions)
+	}
+
+	if err := extract(false); err != nil {
+		t.Errorf("verifyChecksums: expected extraction without verification to pass but got %v", err)
+	}
+	err = extract(true)
+	mismatch, ok := err.(walg.ChecksumMismatchError)
+	if !ok || mismatch.Name != "base/1/2" || mismatch.Actual != *checksumOf("content of base/1/2") {
+		t.Errorf("verifyChecksums: expected ChecksumMismatchError of base/1/2 but got %v", err)
+	}
+
+	files["base/1/2"] = walg.BackupFileDescription{Crc32c: checksumOf("content of base/1/2")}
+	if err := extract(true); err != nil {
+		t.Errorf("verifyChecksums: expected intact backup to pass but got %v", err)
+	}
+}
+
+func TestBackupVerifyOnStorageBackend(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_backup_verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(data, "base/1"), 0700)
+	os.MkdirAll(filepath.Join(data, "global"), 0700)
+	ioutil.WriteFile(filepath.Join(data, "base/1/1"), bytes.Repeat([]byte("relation"), 100), 0600)
+	ioutil.WriteFile(filepath.Join(data, "global/pg_control"), []byte("control"), 0600)
+	pushTestBackup(t, tu, pre, data, "base_000000010000000000000002")
+
+	if err = walg.HandleBackupVerify(pre, "LATEST"); err != nil {
+		t.Fatalf("verify: intact backup failed: %v", err)
+	}
+	for key, body := range storage.objects {
+		if strings.Contains(key, "/tar_partitions/") {
+			storage.objects[key] = body[:len(body)/2]
+		}
+	}
+	if err = walg.HandleBackupVerify(pre, "LATEST"); err == nil {
+		t.Errorf("verify: backup with truncated partitions succeeded")
+	}
+	if err = walg.HandleBackupVerify(pre, "base_000000010000000000000004"); err == nil {
+		t.Errorf("verify: missing backup succeeded")
+	}
+}
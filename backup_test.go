@@ -1,6 +1,7 @@
 package walg_test
 
 import (
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -386,6 +387,28 @@ func TestGetBackupTimeSlices(t *testing.T) {
 
 }
 
+func TestGetBackupTimeSlicesByNameTime(t *testing.T) {
+	older := "mockServer/basebackups_005/base_20181017T090000Z_000000010000000000000005_backup_stop_sentinel.json"
+	newer := "mockServer/basebackups_005/base_20181017T100000Z_000000010000000000000003_D_000000010000000000000001_backup_stop_sentinel.json"
+	// Lifecycle rewrite made older backup look modified last
+	olderModified := time.Now()
+	newerModified := olderModified.Add(-time.Hour)
+
+	slice := walg.GetBackupTimeSlices([]*s3.Object{
+		{Key: &older, LastModified: &olderModified},
+		{Key: &newer, LastModified: &newerModified},
+	})
+	if slice[0].Name != "base_20181017T100000Z_000000010000000000000003_D_000000010000000000000001" {
+		t.Errorf("backup: expected backup with later time in name first, got %v", slice[0].Name)
+	}
+	if slice[0].WalFileName != "000000010000000000000003" || slice[1].WalFileName != "000000010000000000000005" {
+		t.Errorf("backup: unexpected WAL file names %v, %v", slice[0].WalFileName, slice[1].WalFileName)
+	}
+	if !slice[1].Time.Equal(time.Date(2018, 10, 17, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("backup: expected time from name, got %v", slice[1].Time)
+	}
+}
+
 func checkSortingPermutationResult(objectsFromS3 *s3.ListObjectsV2Output, t *testing.T) {
 	//t.Log(objectsFromS3)
 	slice := walg.GetBackupTimeSlices(objectsFromS3.Contents)
@@ -402,3 +425,36 @@ func checkSortingPermutationResult(objectsFromS3 *s3.ListObjectsV2Output, t *tes
 		t.Error("Sorting does not work correctly")
 	}
 }
+
+func TestFetchSentinels(t *testing.T) {
+	_, pre, client := newMemoryStorage()
+	bk := &walg.Backup{
+		Prefix: pre,
+		Path:   walg.GetBackupPath(pre),
+	}
+
+	var names []string
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("base_0000000100000000000000%02X", i)
+		names = append(names, name)
+		client.objects["server/basebackups_005/"+name+walg.SentinelSuffix] = []byte(fmt.Sprintf(`{"LSN":%d,"PgVersion":100000}`, i))
+	}
+
+	sentinels, err := walg.FetchSentinels(names, bk, pre)
+	if err != nil {
+		t.Fatalf("sentinels: %v", err)
+	}
+	if len(sentinels) != len(names) {
+		t.Fatalf("sentinels: expected %d sentinels, got %d", len(names), len(sentinels))
+	}
+	for i, name := range names {
+		if *sentinels[name].LSN != uint64(i) {
+			t.Errorf("sentinels: %s got sentinel of another backup", name)
+		}
+	}
+
+	_, err = walg.FetchSentinels(append(names, "base_000000010000000000000099"), bk, pre)
+	if err == nil {
+		t.Errorf("sentinels: expected error for missing sentinel")
+	}
+}
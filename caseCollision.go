@@ -0,0 +1,76 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FindCaseCollisions returns groups of files of backup whose names differ only by case.
+// Such files overwrite each other when restored to case-insensitive filesystem.
+func FindCaseCollisions(files BackupFileList) [][]string {
+	byFoldedName := make(map[string][]string)
+	for name := range files {
+		folded := strings.ToLower(name)
+		byFoldedName[folded] = append(byFoldedName[folded], name)
+	}
+	var collisions [][]string
+	for _, names := range byFoldedName {
+		if len(names) > 1 {
+			sort.Strings(names)
+			collisions = append(collisions, names)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i][0] < collisions[j][0] })
+	return collisions
+}
+
+// isCaseInsensitiveDirectory probes whether directory is on case-insensitive filesystem
+// by creating a file and looking it up by name in other case
+func isCaseInsensitiveDirectory(dir string) (bool, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return false, errors.Wrapf(err, "isCaseInsensitiveDirectory: failed to create %s", dir)
+	}
+	probe, err := ioutil.TempFile(dir, ".walg-case-probe-")
+	if err != nil {
+		return false, errors.Wrapf(err, "isCaseInsensitiveDirectory: failed to create probe file in %s", dir)
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	_, err = os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(probe.Name()))))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "isCaseInsensitiveDirectory: failed to stat probe file")
+	}
+	return true, nil
+}
+
+// CheckCaseCollisions fails if backup has files differing only by case
+// and dirArc is on case-insensitive filesystem, where they would overwrite each other
+func CheckCaseCollisions(dirArc string, files BackupFileList) error {
+	collisions := FindCaseCollisions(files)
+	if len(collisions) == 0 {
+		return nil
+	}
+	insensitive, err := isCaseInsensitiveDirectory(dirArc)
+	if err != nil {
+		return err
+	}
+	if !insensitive {
+		return nil
+	}
+	var groups []string
+	for _, names := range collisions {
+		groups = append(groups, strings.Join(names, ", "))
+	}
+	return errors.Errorf("CheckCaseCollisions: %s is on case-insensitive filesystem, "+
+		"restoring would overwrite files whose names differ only by case: %s", dirArc, strings.Join(groups, "; "))
+}
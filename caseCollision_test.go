@@ -0,0 +1,60 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFindCaseCollisions(t *testing.T) {
+	files := BackupFileList{
+		"/base/1/1234":                       {},
+		"/pg_tblspc/16384/PG_10/1/Data":      {},
+		"/pg_tblspc/16384/PG_10/1/data":      {},
+		"/pg_tblspc/16384/PG_10/1/DATA":      {},
+		"/global/pg_control":                 {},
+		"/pg_tblspc/16385/PG_10/1/a/b/other": {},
+	}
+	collisions := FindCaseCollisions(files)
+	expected := [][]string{{
+		"/pg_tblspc/16384/PG_10/1/DATA",
+		"/pg_tblspc/16384/PG_10/1/Data",
+		"/pg_tblspc/16384/PG_10/1/data",
+	}}
+	if !reflect.DeepEqual(collisions, expected) {
+		t.Errorf("case collisions: expected %v, got %v", expected, collisions)
+	}
+
+	if collisions = FindCaseCollisions(BackupFileList{"/a": {}, "/b": {}}); len(collisions) != 0 {
+		t.Errorf("case collisions: unexpected collisions %v", collisions)
+	}
+}
+
+func TestCheckCaseCollisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "case")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	insensitive, err := isCaseInsensitiveDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckCaseCollisions(dir, BackupFileList{"/a": {}, "/A": {}})
+	if insensitive && err == nil {
+		t.Errorf("case collisions: collision on case-insensitive filesystem is not reported")
+	}
+	if !insensitive && err != nil {
+		t.Errorf("case collisions: unexpected error on case-sensitive filesystem: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("case collisions: probe file is left in directory")
+	}
+}
@@ -0,0 +1,189 @@
+package walg
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// BackupVerifyResult is the outcome of structural check of one backup
+type BackupVerifyResult struct {
+	Name string
+	// Number of regular files read from tar partitions
+	Members int
+	Err     error
+}
+
+// verifyTarInterpreter reads members of partitions without writing them anywhere
+type verifyTarInterpreter struct {
+	mutex   sync.Mutex
+	members map[string]Empty
+}
+
+func (ti *verifyTarInterpreter) Interpret(r io.Reader, hdr *tar.Header) error {
+	// Content is read to the end, so decompression and checksums of the whole stream are checked
+	_, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return errors.Wrapf(err, "Interpret: failed to read %s", hdr.Name)
+	}
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+		ti.mutex.Lock()
+		ti.members[hdr.Name] = Empty{}
+		ti.mutex.Unlock()
+	}
+	return nil
+}
+
+// CheckBackupMembers fails if some file of sentinel is missing among members of backup.
+// Skipped files of delta are not stored in it and are not expected.
+func CheckBackupMembers(files BackupFileList, members map[string]Empty) error {
+	var missing []string
+	for name, fd := range files {
+		if fd.IsSkipped {
+			continue
+		}
+		if _, ok := members[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return errors.Errorf("CheckBackupMembers: %d files of sentinel are missing in tar partitions, first is %s", len(missing), missing[0])
+}
+
+// VerifyPartitions decrypts, decompresses and parses tar partitions as backup-fetch would,
+// and checks their members against files of sentinel. Nothing is written to disk.
+func VerifyPartitions(partitions []ReaderMaker, pgControl ReaderMaker, crypter Crypter, files BackupFileList) (int, error) {
+	ti := &verifyTarInterpreter{members: make(map[string]Empty)}
+	err := ExtractBackup(ti, partitions, pgControl, crypter)
+	if err != nil {
+		return len(ti.members), err
+	}
+	return len(ti.members), CheckBackupMembers(files, ti.members)
+}
+
+// VerifyBackup checks structure of one backup of the catalog
+func VerifyBackup(pre *Prefix, name string) (int, error) {
+	bk := &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+		Name:   aws.String(name),
+	}
+	sentinel, err := readSentinel(name, bk, pre)
+	if err != nil {
+		return 0, err
+	}
+	partitions, pgControl, err := getBackupPartitions(bk, sentinel)
+	if err != nil {
+		return 0, err
+	}
+	crypter, err := NewBackupCrypter(sentinel.WrappedDataKey)
+	if err != nil {
+		return 0, errors.Wrap(err, "VerifyBackup: failed to unwrap data key of backup")
+	}
+	return VerifyPartitions(partitions, pgControl, crypter, sentinel.Files)
+}
+
+// getBackupPartitions lists tar partitions of backup to be read as backup-fetch would,
+// pg_control separately from the rest
+func getBackupPartitions(bk *Backup, sentinel S3TarBallSentinelDto) ([]ReaderMaker, ReaderMaker, error) {
+	keys, pgControlKey, err := bk.GetTarPartitions()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keys) == 0 && pgControlKey == "" {
+		return nil, nil, errors.Errorf("getBackupPartitions: backup %s has no tar partitions", *bk.Name)
+	}
+
+	var partitions []ReaderMaker
+	for _, key := range keys {
+		partitions = append(partitions, &S3ReaderMaker{
+			Backup:     bk,
+			Key:        aws.String(key),
+			FileFormat: sentinel.GetPartitionFormat(key),
+		})
+	}
+	var pgControl ReaderMaker
+	if pgControlKey != "" {
+		pgControl = &S3ReaderMaker{
+			Backup:     bk,
+			Key:        aws.String(pgControlKey),
+			FileFormat: sentinel.GetPartitionFormat(pgControlKey),
+		}
+	}
+	if pgControl == nil && requiresSeparatePgControl(*bk.Name, sentinel) {
+		return nil, nil, errors.Errorf("getBackupPartitions: backup %s is missing pg_control", *bk.Name)
+	}
+	return partitions, pgControl, nil
+}
+
+// VerifyCatalog checks every backup with up to concurrency backups at once.
+// A failure of one backup does not stop checks of others, results are in order of backups.
+func VerifyCatalog(backups []BackupTime, concurrency int, verify func(name string) (int, error)) []BackupVerifyResult {
+	results := make([]BackupVerifyResult, len(backups))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				name := backups[i].Name
+				members, err := verify(name)
+				results[i] = BackupVerifyResult{Name: name, Members: members, Err: err}
+			}
+		}()
+	}
+	for i := range backups {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return results
+}
+
+// HandleCatalogVerify is invoked to perform wal-g catalog-verify.
+// It returns error after printing the report if any backup failed the check.
+func HandleCatalogVerify(pre *Prefix, concurrency int) error {
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	backups, err := bk.GetBackups()
+	if err != nil {
+		return err
+	}
+
+	results := VerifyCatalog(backups, concurrency, func(name string) (int, error) {
+		return VerifyBackup(pre, name)
+	})
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "name\tfiles\tresult")
+	for i := len(results) - 1; i >= 0; i-- {
+		r := results[i]
+		result := "ok"
+		if r.Err != nil {
+			failed++
+			result = "FAILED: " + r.Err.Error()
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", r.Name, r.Members, result)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return errors.Errorf("HandleCatalogVerify: %d of %d backups failed verification", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package walg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pierrec/lz4"
+	"github.com/wal-g/wal-g"
+)
+
+func makeTestTar(t *testing.T, names ...string) *bytes.Buffer {
+	b := &bytes.Buffer{}
+	tw := tar.NewWriter(b)
+	for _, name := range names {
+		content := []byte("content of " + name)
+		err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestVerifyPartitions(t *testing.T) {
+	files := walg.BackupFileList{
+		"base/1/1":          {},
+		"base/1/2":          {IsIncremented: true},
+		"base/1/3":          {IsSkipped: true},
+		"global/pg_control": {},
+	}
+	partitions := []walg.ReaderMaker{
+		&BufferReaderMaker{makeTestTar(t, "base/1/1"), "part_1.tar", "tar"},
+		&BufferReaderMaker{makeTestTar(t, "base/1/2", "backup_label"), "part_2.tar", "tar"},
+	}
+	pgControl := &BufferReaderMaker{makeTestTar(t, "global/pg_control"), "pg_control.tar", "tar"}
+
+	members, err := walg.VerifyPartitions(partitions, pgControl, walg.MockDisarmedCrypter(), files)
+	if err != nil {
+		t.Errorf("catalogVerify: expected complete backup to pass but got %v", err)
+	}
+	if members != 4 {
+		t.Errorf("catalogVerify: expected 4 members but got %d", members)
+	}
+
+	partitions = []walg.ReaderMaker{
+		&BufferReaderMaker{makeTestTar(t, "base/1/1"), "part_1.tar", "tar"},
+	}
+	pgControl = &BufferReaderMaker{makeTestTar(t, "global/pg_control"), "pg_control.tar", "tar"}
+	_, err = walg.VerifyPartitions(partitions, pgControl, walg.MockDisarmedCrypter(), files)
+	if err == nil || !strings.Contains(err.Error(), "base/1/2") {
+		t.Errorf("catalogVerify: expected missing base/1/2 to be reported but got %v", err)
+	}
+}
+
+func TestVerifyPartitionsCorrupted(t *testing.T) {
+	compressed := &bytes.Buffer{}
+	lz := lz4.NewWriter(compressed)
+	lz.Write(makeTestTar(t, "base/1/1").Bytes())
+	lz.Close()
+	data := compressed.Bytes()
+	data[len(data)/2] ^= 0xff
+
+	partitions := []walg.ReaderMaker{
+		&BufferReaderMaker{bytes.NewBuffer(data), "part_1.tar.lz4", "lz4"},
+	}
+	_, err := walg.VerifyPartitions(partitions, nil, walg.MockDisarmedCrypter(), walg.BackupFileList{"base/1/1": {}})
+	if err == nil {
+		t.Errorf("catalogVerify: expected corrupted partition to fail but got `<nil>`")
+	}
+}
+
+func TestVerifyCatalog(t *testing.T) {
+	backups := []walg.BackupTime{
+		{Name: "base_3"}, {Name: "base_2"}, {Name: "base_1"}, {Name: "base_0"},
+	}
+	var calls int32
+	results := walg.VerifyCatalog(backups, 2, func(name string) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		if name == "base_2" || name == "base_0" {
+			return 1, errors.New("broken " + name)
+		}
+		return 10, nil
+	})
+
+	if calls != 4 {
+		t.Errorf("catalogVerify: expected every backup to be verified despite failures, got %d calls", calls)
+	}
+	for i, r := range results {
+		if r.Name != backups[i].Name {
+			t.Errorf("catalogVerify: expected result %d for %s but got %s", i, backups[i].Name, r.Name)
+		}
+		failed := r.Name == "base_2" || r.Name == "base_0"
+		if failed != (r.Err != nil) {
+			t.Errorf("catalogVerify: unexpected result of %s: %v", r.Name, r.Err)
+		}
+	}
+}
+
+func TestCatalogVerifyOnStorageBackend(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_catalog_verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(data, "base/1"), 0700)
+	os.MkdirAll(filepath.Join(data, "global"), 0700)
+	ioutil.WriteFile(filepath.Join(data, "base/1/1"), bytes.Repeat([]byte("relation"), 100), 0600)
+	ioutil.WriteFile(filepath.Join(data, "global/pg_control"), []byte("control"), 0600)
+	pushTestBackup(t, tu, pre, data, "base_000000010000000000000002")
+	pushTestBackup(t, tu, pre, data, "base_000000010000000000000004")
+
+	if err = walg.HandleCatalogVerify(pre, 2); err != nil {
+		t.Fatalf("catalogVerify: intact catalog failed: %v", err)
+	}
+	for key, body := range storage.objects {
+		if strings.Contains(key, "base_000000010000000000000002/tar_partitions/") {
+			storage.objects[key] = body[:len(body)/2]
+		}
+	}
+	if err = walg.HandleCatalogVerify(pre, 2); err == nil {
+		t.Errorf("catalogVerify: catalog with truncated backup succeeded")
+	}
+}
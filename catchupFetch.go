@@ -0,0 +1,82 @@
+package walg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// catchupKeptEntries are files of a replica which catchup-push does not pack, so
+// catchup-fetch keeps them instead of removing with files absent from catchup
+var catchupKeptEntries = map[string]Empty{
+	"recovery.conf":   {},
+	"standby.signal":  {},
+	"recovery.signal": {},
+	"pg_wal":          {},
+	"pg_xlog":         {},
+}
+
+// HandleCatchupFetch is invoked to perform wal-g catchup-fetch. It applies catchup
+// pushed by catchup-push to data directory of the stopped replica in dirArc: changed
+// pages are written into relation files, other files are replaced and files absent
+// from catchup are removed. Recovery settings and WAL of the replica are kept, so
+// started replica recovers from backup_label of the catchup.
+func HandleCatchupFetch(pre *Prefix, dirArc string, catchupName string, options BackupFetchOptions) (err error) {
+	dirArc = ResolveSymlink(dirArc)
+	catchupPre := *pre
+	catchupPre.Server = aws.String(*pre.Server + CatchupServerSuffix)
+	bk := &Backup{
+		Prefix: &catchupPre,
+		Path:   GetBackupPath(&catchupPre),
+	}
+	if catchupName == "LATEST" {
+		catchupName, err = bk.GetLatest()
+		if err != nil {
+			return err
+		}
+	}
+	bk.Name = aws.String(catchupName)
+	bk.Js = aws.String(*bk.Path + catchupName + SentinelSuffix)
+	exists, err := bk.CheckExistence()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return BackupNonExistenceError{catchupName}
+	}
+	sentinel, err := readSentinel(catchupName, bk, &catchupPre)
+	if err != nil {
+		return err
+	}
+	if !sentinel.IsCatchup() {
+		return errors.Errorf("HandleCatchupFetch: %v is not a catchup", catchupName)
+	}
+	fmt.Printf("Catchup %v from LSN %x\n", catchupName, *sentinel.IncrementFromLSN)
+
+	span := StartSpan("catchup-fetch")
+	span.SetAttribute("backup.name", catchupName)
+	options.span = span
+	options.keptEntries = catchupKeptEntries
+	options.progress, err = OpenFetchProgress(dirArc, options.Resume)
+	if err != nil {
+		return err
+	}
+	startFetch := time.Now()
+	err = unwrapBackup(bk, dirArc, &catchupPre, sentinel, options)
+	span.End()
+	FlushTraces()
+	if err != nil {
+		if options.progress.Close() == nil && options.progress.records > 0 {
+			fmt.Printf("Catchup is interrupted, use catchup-fetch --resume to continue it\n")
+		}
+		return err
+	}
+	err = options.progress.Remove()
+	if err != nil {
+		return err
+	}
+	getMetrics().ObserveFetchDuration("catchup-fetch", time.Since(startFetch))
+	return nil
+}
@@ -0,0 +1,147 @@
+package walg
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CatchupServerSuffix is appended to storage prefix of catchup backups. They are kept
+// apart from basebackups_005 of the prefix, so they are never LATEST, a delta base or
+// counted by delete.
+const CatchupServerSuffix = "/catchup"
+
+// catchupNamePrefix starts names of catchup backups instead of base_
+const catchupNamePrefix = "catchup_"
+
+// IsCatchup tells whether sentinel is of catchup backup: a delta from LSN of a replica,
+// not from another backup
+func (dto *S3TarBallSentinelDto) IsCatchup() bool {
+	return dto.IncrementFromLSN != nil && dto.IncrementFrom == nil
+}
+
+// hasIncrementBase tells whether sentinel is applied on top of files already in
+// output directory: a delta on its base or a catchup on its replica
+func (dto *S3TarBallSentinelDto) hasIncrementBase() bool {
+	return dto.IsIncremental() || dto.IsCatchup()
+}
+
+// HandleCatchupPush is invoked to perform wal-g catchup-push. It pushes pages of
+// the cluster in dirArc changed since fromLSN, e.g. the replay LSN of a replica
+// which has fallen behind. Unlike delta of backup-push, base is not looked up in
+// storage: paged files of the base are all assumed present, so only their changed
+// pages are packed, other files are packed whole. Sentinel lists all files of the
+// cluster, so files absent in it can be removed from the replica.
+func HandleCatchupPush(dirArc string, tu *TarUploader, pre *Prefix, fromLSN uint64) (err error) {
+	dirArc = ResolveSymlink(dirArc)
+	logger := NewLogger("catchup-push")
+	startPush := time.Now()
+	defer func() {
+		if err != nil {
+			getMetrics().IncUploadFailures("catchup-push")
+		}
+	}()
+
+	err = CheckWritable(tu, pre)
+	if err != nil {
+		return err
+	}
+	tarSizeThreshold, err := GetTarSizeThreshold()
+	if err != nil {
+		return err
+	}
+	smallFileSize, err := getSmallFileSize()
+	if err != nil {
+		return err
+	}
+
+	catchupUploader := tu.Clone()
+	catchupUploader.server = tu.server + CatchupServerSuffix
+	bundle := &Bundle{
+		MinSize:            tarSizeThreshold,
+		SmallFileSize:      smallFileSize,
+		IncrementFromLsn:   &fromLSN,
+		IncrementFromFiles: make(BackupFileList),
+		Catchup:            true,
+		Files:              &sync.Map{},
+		Crypter:            NewCrypter(),
+	}
+
+	conn, err := Connect()
+	if err != nil {
+		return err
+	}
+	// Postgres aborts backup which is not stopped when session ends
+	defer conn.Close()
+	bundle.WalSegmentSize, err = readWalSegmentSize(conn)
+	if err != nil {
+		return err
+	}
+	name, lsn, pgVersion, err := bundle.StartBackup(conn, time.Now().String())
+	if err != nil {
+		return err
+	}
+	if fromLSN > lsn {
+		return errors.Errorf("HandleCatchupPush: LSN %x is after start of backup at %x", fromLSN, lsn)
+	}
+	name = catchupNamePrefix + stripWalFileName(name)
+	fmt.Printf("Catchup from LSN %x to %v\n", fromLSN, name)
+
+	bundle.Tbm = &S3TarBallMaker{
+		BaseDir:          filepath.Base(dirArc),
+		Trim:             dirArc,
+		BkupName:         name,
+		Tu:               catchupUploader,
+		Lsn:              &lsn,
+		IncrementFromLsn: &fromLSN,
+	}
+
+	bundle.StartQueue()
+	fmt.Println("Walking ...")
+	err = Walk(dirArc, bundle.TarWalker)
+	if err != nil {
+		return err
+	}
+	err = bundle.FinishQueue()
+	if err != nil {
+		return err
+	}
+	err = bundle.HandleSentinel()
+	if err != nil {
+		return err
+	}
+	finishLsn, err := bundle.HandleLabelFiles(conn)
+	if err != nil {
+		return err
+	}
+
+	// Without sentinel only uploads are awaited
+	var sentinel *S3TarBallSentinelDto
+	if !bundle.CheckTimelineChanged(conn) {
+		sentinel = &S3TarBallSentinelDto{
+			LSN:               &lsn,
+			IncrementFromLSN:  &fromLSN,
+			PgVersion:         pgVersion,
+			FinishLSN:         &finishLsn,
+			WalSegmentSize:    bundle.WalSegmentSize,
+			CompressionMethod: getCompressionMethod(),
+		}
+		if sentinel.CompressionMethod == ZstdCompressionMethod {
+			sentinel.CompressionLevel = getZstdLevel()
+		}
+		sentinel.SetFiles(bundle.GetFiles())
+	}
+	err = bundle.Tb.Finish(sentinel)
+	if err != nil {
+		return err
+	}
+	if sentinel == nil {
+		return errors.Errorf("HandleCatchupPush: timeline changed during catchup %v", name)
+	}
+	logger.Printf("Catchup %v from LSN %x is pushed to %v\n", name, fromLSN, catchupUploader.server)
+	getMetrics().ObservePushDuration("catchup-push", time.Since(startPush))
+	return nil
+}
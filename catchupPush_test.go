@@ -0,0 +1,234 @@
+package walg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+// testPage makes Postgres page with valid header of lsn
+func testPage(lsn uint64) []byte {
+	page := make([]byte, walg.BlockSize)
+	binary.LittleEndian.PutUint32(page[0:], uint32(lsn>>32))
+	binary.LittleEndian.PutUint32(page[4:], uint32(lsn))
+	binary.LittleEndian.PutUint16(page[12:], 24)
+	binary.LittleEndian.PutUint16(page[14:], walg.BlockSize)
+	binary.LittleEndian.PutUint16(page[16:], walg.BlockSize)
+	binary.LittleEndian.PutUint16(page[18:], walg.BlockSize+4)
+	return page
+}
+
+func TestCatchupPacksChangedPages(t *testing.T) {
+	data, err := ioutil.TempDir("", "catchup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+	os.MkdirAll(filepath.Join(data, "base", "1"), 0700)
+	relation := append(testPage(0x100), testPage(0x300)...)
+	if err = ioutil.WriteFile(filepath.Join(data, "base", "1", "1259"), relation, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replica is at LSN between changes of the pages, it has no backup in storage
+	fromLSN := uint64(0x200)
+	for _, catchup := range []bool{false, true} {
+		maker := &memoryTarBallMaker{trim: data}
+		bundle := &walg.Bundle{
+			MinSize:            int64(1) << 62,
+			IncrementFromLsn:   &fromLSN,
+			IncrementFromFiles: make(walg.BackupFileList),
+			Catchup:            catchup,
+			Files:              &sync.Map{},
+			Tbm:                maker,
+		}
+		bundle.StartQueue()
+		if err = walg.Walk(data, bundle.TarWalker); err != nil {
+			t.Fatalf("catchup: %v", err)
+		}
+		if err = bundle.FinishQueue(); err != nil {
+			t.Fatalf("catchup: %v", err)
+		}
+
+		value, _ := bundle.Files.Load("/base/1/1259")
+		if description := value.(walg.BackupFileDescription); description.IsIncremented != catchup {
+			t.Errorf("catchup: catchup=%v expected incremented=%v", catchup, catchup)
+		}
+		// Increment is a header, number and list of blocks and the changed page
+		expectedSize := int64(len(relation))
+		if catchup {
+			expectedSize = 4 + 8 + 4 + 4 + int64(walg.BlockSize)
+		}
+		packed := false
+		for _, tarBall := range maker.tarBalls {
+			tr := tar.NewReader(&tarBall.buf)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("catchup: partition is broken: %v", err)
+				}
+				if hdr.Name != "/base/1/1259" {
+					continue
+				}
+				packed = true
+				if hdr.Size != expectedSize {
+					t.Errorf("catchup: catchup=%v expected %d bytes packed, got %d", catchup, expectedSize, hdr.Size)
+				}
+			}
+		}
+		if !packed {
+			t.Errorf("catchup: catchup=%v relation is not packed", catchup)
+		}
+	}
+}
+
+// writeTestFiles writes files by path relative to dir
+func writeTestFiles(t *testing.T, dir string, files map[string][]byte) {
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// pushTestCatchup uploads catchup of data from fromLSN with its sentinel, as catchup-push does
+func pushTestCatchup(t *testing.T, storage walg.StorageBackend, data string, name string, fromLSN uint64) {
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server"+walg.CatchupServerSuffix)
+	lsn := uint64(0x400)
+	bundle := &walg.Bundle{
+		MinSize:            10,
+		IncrementFromLsn:   &fromLSN,
+		IncrementFromFiles: make(walg.BackupFileList),
+		Catchup:            true,
+		Files:              &sync.Map{},
+	}
+	bundle.Tbm = &walg.S3TarBallMaker{BaseDir: "data", Trim: data, BkupName: name, Tu: tu, Lsn: &lsn, IncrementFromLsn: &fromLSN}
+	bundle.StartQueue()
+	if err := walg.Walk(data, bundle.TarWalker); err != nil {
+		t.Fatal(err)
+	}
+	if err := bundle.FinishQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bundle.HandleSentinel(); err != nil {
+		t.Fatal(err)
+	}
+	tu.Finish()
+	sentinel := &walg.S3TarBallSentinelDto{LSN: &lsn, IncrementFromLSN: &fromLSN}
+	sentinel.SetFiles(bundle.GetFiles())
+	body, err := json.Marshal(sentinel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pre.Storage().Put(*walg.GetBackupPath(pre)+name+walg.SentinelSuffix, bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCatchupFetchAppliesCatchupToReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catchup_fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primary := filepath.Join(dir, "primary")
+	replica := filepath.Join(dir, "replica")
+
+	// Replica replayed up to 0x200, the second page changed on primary after it
+	fromLSN := uint64(0x200)
+	replicaPage := testPage(0x100)
+	copy(replicaPage[100:], "replica")
+	writeTestFiles(t, primary, map[string][]byte{
+		"base/1/1259":       append(testPage(0x100), testPage(0x300)...),
+		"global/pg_control": []byte("control of primary"),
+		"postgresql.conf":   []byte("primary"),
+	})
+	os.MkdirAll(filepath.Join(primary, "pg_wal"), 0700)
+	writeTestFiles(t, replica, map[string][]byte{
+		"base/1/1259":                     append(replicaPage, testPage(0x100)...),
+		"base/1/9999":                     []byte("dropped relation"),
+		"global/pg_control":               []byte("control of replica"),
+		"postgresql.conf":                 []byte("replica"),
+		"recovery.conf":                   []byte("standby_mode = on"),
+		"standby.signal":                  nil,
+		"pg_wal/000000010000000000000001": []byte("wal"),
+	})
+
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	name := "catchup_000000010000000000000004"
+	pushTestCatchup(t, storage, primary, name, fromLSN)
+	_, pre := walg.ConfigureStorageBackend(storage, "/server")
+
+	if _, err = walg.HandleBackupFetch(name, pre, filepath.Join(dir, "restore"), false, walg.BackupFetchOptions{}); err == nil {
+		t.Errorf("catchup: backup-fetch of catchup succeeded")
+	}
+	if err = walg.HandleCatchupFetch(pre, replica, "LATEST", walg.BackupFetchOptions{}); err != nil {
+		t.Fatalf("catchup: catchup-fetch failed: %v", err)
+	}
+
+	expected := map[string][]byte{
+		"base/1/1259":                     append(replicaPage, testPage(0x300)...),
+		"global/pg_control":               []byte("control of primary"),
+		"postgresql.conf":                 []byte("primary"),
+		"recovery.conf":                   []byte("standby_mode = on"),
+		"standby.signal":                  {},
+		"pg_wal/000000010000000000000001": []byte("wal"),
+	}
+	for file, content := range expected {
+		actual, err := ioutil.ReadFile(filepath.Join(replica, file))
+		if err != nil {
+			t.Errorf("catchup: %v is not kept: %v", file, err)
+		} else if !bytes.Equal(actual, content) {
+			t.Errorf("catchup: %v has unexpected content", file)
+		}
+	}
+	for _, file := range []string{"base/1/9999", "increment_base", walg.FetchProgressFileName} {
+		if _, err := os.Lstat(filepath.Join(replica, file)); !os.IsNotExist(err) {
+			t.Errorf("catchup: %v is not removed", file)
+		}
+	}
+}
+
+func TestCatchupFetchRefusesNewerReplica(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catchup_fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	primary := filepath.Join(dir, "primary")
+	replica := filepath.Join(dir, "replica")
+	writeTestFiles(t, primary, map[string][]byte{
+		"base/1/1259":       append(testPage(0x100), testPage(0x300)...),
+		"global/pg_control": []byte("control"),
+	})
+	// First page of replica changed after LSN the catchup is pushed for
+	writeTestFiles(t, replica, map[string][]byte{
+		"base/1/1259":       append(testPage(0x280), testPage(0x100)...),
+		"global/pg_control": []byte("control"),
+	})
+
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	name := "catchup_000000010000000000000004"
+	pushTestCatchup(t, storage, primary, name, 0x200)
+	_, pre := walg.ConfigureStorageBackend(storage, "/server")
+
+	if err = walg.HandleCatchupFetch(pre, replica, name, walg.BackupFetchOptions{}); err == nil {
+		t.Errorf("catchup: catchup to replica newer than its LSN succeeded")
+	}
+	if err = walg.HandleCatchupFetch(pre, replica, "catchup_000000010000000000000006", walg.BackupFetchOptions{}); err == nil {
+		t.Errorf("catchup: missing catchup succeeded")
+	}
+}
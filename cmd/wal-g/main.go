@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"runtime/pprof"
+	"time"
 )
 
 var profile bool
@@ -15,10 +16,41 @@ var help bool
 var l *log.Logger
 var helpMsg = "  backup-fetch\tfetch a backup from S3\n" +
 	"  backup-push\tstarts and uploads a finished backup to S3\n" +
+	"  catchup-push\tuploads pages changed since LSN of a replica to catch it up\n" +
+	"  catchup-fetch\tapplies catchup to data directory of the stopped replica\n" +
 	"  backup-list\tprints available backups\n" +
+	"  backup-info\tprints LSNs, size, file count and delta chain of a backup\n" +
+	"  backup-wal-range\tprints WAL segments needed to make a backup consistent\n" +
+	"  backup-audit\tchecks that all objects of a backup are present in storage\n" +
+	"  backup-verify\treads a backup and checks its files against checksums recorded by backup-push\n" +
+	"  copy\tcopies backups to another storage under the same names\n" +
+	"  backup-mark\tmarks a backup permanent, so delete keeps it, or impermanent again\n" +
+	"  catalog-verify\treads every backup without restoring it and checks its files against the sentinel\n" +
+	"  backup-storage-report\tprints storage classes of backups and deltas whose base is in archive storage\n" +
+	"  restore-point-create\tcreates named restore point and records its LSN\n" +
+	"  restore-point-list\tprints restore points and backups to reach them\n" +
 	"  wal-fetch\tfetch a WAL file from S3\n" +
 	"  wal-push\tupload a WAL file to S3\n" +
-	"  delete\tclear old backups and WALs\n"
+	"  wal-prefetch\tdownloads WAL segments ahead of wal-fetch, e.g. to warm up before failover\n" +
+	"  wal-prefetch-clean\tremoves abandoned prefetched WAL files\n" +
+	"  wal-verify-between\tchecks that all WAL from the end of one backup to the start of another is archived\n" +
+	"  wal-verify\tchecks that all WAL segments between two segments are archived\n" +
+	"  timeline-list\tprints timelines of archived WAL and where they were forked\n" +
+	"  wal-show\tprints archived WAL segments and history files by timeline with gaps between segments\n" +
+	"  delete\tclear old backups and WALs\n" +
+	"  delete-expired\tremoves backups marked by delete with WALG_SOFT_DELETE after grace period\n"
+
+const walVerifyBetweenUsage = "usage:\twal-g wal-verify-between older_backup_name newer_backup_name\n\twal-g wal-verify-between older_backup_name LATEST\n\n"
+
+const walVerifyUsage = "usage:\twal-g wal-verify start_segment end_segment\n\n"
+
+const walPrefetchUsage = "usage:\twal-g wal-prefetch --count n start_segment wal_directory\n\n"
+
+const copyUsage = "usage:\twal-g copy --to prefix_url [--with-bases] backup_name\n\twal-g copy --to prefix_url [--with-bases] LATEST\n\twal-g copy --to prefix_url ALL\n\n"
+
+const catchupFetchUsage = "usage:\twal-g catchup-fetch [--force-delta-base] [--resume] [--progress] data_directory catchup_name\n\twal-g catchup-fetch [--force-delta-base] [--resume] [--progress] data_directory LATEST\n\n"
+
+const backupMarkUsage = "usage:\twal-g backup-mark --permanent backup_name\n\twal-g backup-mark --impermanent backup_name\n\n"
 
 func init() {
 	flag.Usage = func() {
@@ -36,6 +68,105 @@ func init() {
 	flag.BoolVar(&showVersionVerbose, "vv", false, "\tLong version")
 
 	l = log.New(os.Stderr, "", 0)
+
+	backupPushFlags := newCommandFlagSet("backup-push")
+	backupPushFlags.BoolVar(&forceBackupPush, "force", false, "\toverride lock left by another backup-push")
+	backupPushFlags.BoolVar(&showProgress, "progress", false, "\tprint progress even if output is not a terminal")
+
+	catchupPushFlags := newCommandFlagSet("catchup-push")
+	catchupPushFlags.StringVar(&catchupFromLSN, "from-lsn", "", "\tLSN of the replica, e.g. 0/3000028, pages changed after it are pushed")
+
+	catchupFetchFlags := newCommandFlagSet("catchup-fetch")
+	catchupFetchFlags.BoolVar(&fetchForceDeltaBase, "force-delta-base", false, "\tapply catchup even if pages of the replica are newer than its LSN")
+	catchupFetchFlags.BoolVar(&fetchResume, "resume", false, "\tcontinue catchup interrupted in data directory")
+	catchupFetchFlags.BoolVar(&showProgress, "progress", false, "\tprint progress even if output is not a terminal")
+
+	backupFetchFlags := newCommandFlagSet("backup-fetch")
+	backupFetchFlags.StringVar(&fetchOwner, "chown", "", "\tuid:gid to own restored files")
+	backupFetchFlags.BoolVar(&fetchPreserveOwner, "preserve-owner", false, "\trestore ownership of files recorded in backup")
+	backupFetchFlags.BoolVar(&fetchInspect, "inspect", false, "\tprint how to start isolated read-only instance on restored backup")
+	backupFetchFlags.BoolVar(&fetchVerifyControl, "verify-pg-control", false, "\twarn if checkpoint in restored pg_control does not match backup LSNs")
+	backupFetchFlags.BoolVar(&fetchForceDeltaBase, "force-delta-base", false, "\tapply delta even if restored base does not match its LSN")
+	backupFetchFlags.StringVar(&fetchLocalBase, "local-base", "", "\tname of backup of delta chain already restored in output directory")
+	backupFetchFlags.StringVar(&fetchDatabase, "database", "", "\tOID of the only database whose relation files are restored")
+	backupFetchFlags.BoolVar(&fetchVerifyChecksums, "verify-checksums", false, "\tfail if restored file does not match checksum recorded by backup-push")
+	backupFetchFlags.BoolVar(&fetchResume, "resume", false, "\tcontinue restore interrupted in output directory")
+	backupFetchFlags.StringVar(&fetchTablespaces, "tablespaces", "", "\tcomma separated OIDs of the only tablespaces restored")
+	backupFetchFlags.StringVar(&fetchExcludeTablespaces, "exclude-tablespaces", "", "\tcomma separated OIDs of tablespaces not restored")
+	backupFetchFlags.StringVar(&fetchTablespaceLocations, "tablespace-location", "", "\tcomma separated OID=DIR of tablespaces restored to new locations")
+	backupFetchFlags.BoolVar(&showProgress, "progress", false, "\tprint progress even if output is not a terminal")
+	backupFetchFlags.StringVar(&fetchTargetLSN, "target-lsn", "", "\tLSN recovery stops at, e.g. 0/3000028: refuse backup finished after it, LATEST is the latest finished before it")
+
+	backupListFlags := newCommandFlagSet("backup-list")
+	backupListFlags.BoolVar(&listDetail, "detail", false, "\tfetch sentinels to show LSNs, Postgres version and delta origin")
+	backupListFlags.BoolVar(&listJSON, "json", false, "\tprint backups with details as JSON array")
+	backupListFlags.DurationVar(&listCheckFrequency, "check-frequency", 0, "\texit with error if the latest backup is older than this, e.g. 24h")
+
+	backupMarkFlags := newCommandFlagSet("backup-mark")
+	backupMarkFlags.BoolVar(&markPermanent, "permanent", false, "\tprotect backup from delete")
+	backupMarkFlags.BoolVar(&markImpermanent, "impermanent", false, "\tlet delete remove backup again")
+
+	copyFlags := newCommandFlagSet("copy")
+	copyFlags.StringVar(&copyTo, "to", "", "\tdestination in the form of WALE_S3_PREFIX, e.g. s3://other-bucket/path")
+	copyFlags.BoolVar(&copyWithBases, "with-bases", false, "\talso copy bases of delta backup")
+
+	backupInfoFlags := newCommandFlagSet("backup-info")
+	backupInfoFlags.BoolVar(&infoJSON, "json", false, "\tprint report as JSON object")
+
+	walShowFlags := newCommandFlagSet("wal-show")
+	walShowFlags.BoolVar(&walShowJSON, "json", false, "\tprint timelines as JSON array")
+
+	backupStorageReportFlags := newCommandFlagSet("backup-storage-report")
+	backupStorageReportFlags.DurationVar(&reportColdAfter, "cold-after", 0, "\ttreat objects older than this as transitioned to archive storage, e.g. 720h")
+
+	catalogVerifyFlags := newCommandFlagSet("catalog-verify")
+	catalogVerifyFlags.IntVar(&verifyConcurrency, "concurrency", 1, "\tnumber of backups verified at once")
+
+	walPushFlags := newCommandFlagSet("wal-push")
+	walPushFlags.BoolVar(&verifyWALPush, "verify", false, "\tverify uploaded WAL against its ETag")
+
+	walPrefetchFlags := newCommandFlagSet("wal-prefetch")
+	walPrefetchFlags.IntVar(&prefetchCount, "count", 0, "\tnumber of segments to download starting with start_segment")
+
+	walPrefetchCleanFlags := newCommandFlagSet("wal-prefetch-clean")
+	walPrefetchCleanFlags.DurationVar(&prefetchCleanAge, "older-than", walg.DefaultPrefetchCleanAge, "\tremove prefetch files not modified for this long")
+
+	deleteExpiredFlags := newCommandFlagSet("delete-expired")
+	deleteExpiredFlags.DurationVar(&deleteGracePeriod, "older-than", walg.DefaultDeleteGracePeriod, "\tremove backups marked for deletion longer than this ago")
+	deleteExpiredFlags.BoolVar(&deleteExpiredConfirm, "confirm", false, "\tactually remove backups, without it only prints what would be removed")
+
+	walPushDrainFlags := newCommandFlagSet("wal-push-drain")
+	walPushDrainFlags.BoolVar(&verifyWALPush, "verify", false, "\tverify uploaded WAL against its ETag")
+}
+
+// commandFlags contains flag sets of commands which have options
+var commandFlags = make(map[string]*flag.FlagSet)
+
+func newCommandFlagSet(command string) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	commandFlags[command] = flags
+	return flags
+}
+
+// parseCommandArgs parses options of the command which may be interleaved with positional arguments
+func parseCommandArgs(command string, args []string) ([]string, error) {
+	flags, ok := commandFlags[command]
+	if !ok {
+		return args, nil
+	}
+	positional := make([]string, 0, len(args))
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
 }
 
 var WalgVersion = "devel"
@@ -45,6 +176,39 @@ var BuildDate = "devel"
 var showVersion bool
 var showVersionVerbose bool
 
+var forceBackupPush bool
+var showProgress bool
+var catchupFromLSN string
+var fetchOwner string
+var fetchPreserveOwner bool
+var fetchInspect bool
+var fetchDatabase string
+var fetchVerifyControl bool
+var fetchVerifyChecksums bool
+var fetchResume bool
+var fetchTargetLSN string
+var fetchTablespaces string
+var fetchExcludeTablespaces string
+var fetchTablespaceLocations string
+var fetchForceDeltaBase bool
+var fetchLocalBase string
+var markPermanent bool
+var markImpermanent bool
+var copyTo string
+var copyWithBases bool
+var listDetail bool
+var listJSON bool
+var infoJSON bool
+var walShowJSON bool
+var listCheckFrequency time.Duration
+var reportColdAfter time.Duration
+var verifyConcurrency int
+var verifyWALPush bool
+var prefetchCount int
+var prefetchCleanAge time.Duration
+var deleteGracePeriod time.Duration
+var deleteExpiredConfirm bool
+
 func main() {
 	flag.Parse()
 
@@ -66,44 +230,104 @@ func main() {
 		l.Fatalf("Please choose a command:\n%s", helpMsg)
 	}
 	command := all[0]
+	args, err := parseCommandArgs(command, all[1:])
+	if err == flag.ErrHelp {
+		args = []string{"--help"}
+	} else if err != nil {
+		l.Fatalf("%v\n", err)
+	}
 	firstArgument := ""
-	if len(all) > 1 {
-		firstArgument = all[1]
+	if len(args) > 0 {
+		firstArgument = args[0]
 	}
 
 	// Usage strings for supported commands
 	// TODO: refactor arg parsing towards gloang flag usage and more helpful messages
-	if firstArgument == "-h" || firstArgument == "--help" || (firstArgument == "" && command != "backup-list") {
+	if firstArgument == "-h" || firstArgument == "--help" || (firstArgument == "" && command != "backup-list" && command != "restore-point-list" && command != "delete-expired" && command != "backup-storage-report" && command != "catalog-verify" && command != "timeline-list" && command != "wal-show") {
 		switch command {
 		case "backup-fetch":
-			fmt.Printf("usage:\twal-g backup-fetch output_directory backup_name\n\twal-g backup-fetch output_directory LATEST\n\n")
+			fmt.Printf("usage:\twal-g backup-fetch [--chown uid:gid|--preserve-owner] [--inspect] [--database oid] [--tablespaces oids|--exclude-tablespaces oids] [--tablespace-location oid=dir] [--verify-pg-control] [--verify-checksums] [--force-delta-base] [--local-base backup_name] [--resume] [--target-lsn lsn] [--progress] output_directory backup_name\n\twal-g backup-fetch [--chown uid:gid|--preserve-owner] [--inspect] [--database oid] [--tablespaces oids|--exclude-tablespaces oids] [--tablespace-location oid=dir] [--verify-pg-control] [--verify-checksums] [--force-delta-base] [--local-base backup_name] [--resume] [--target-lsn lsn] [--progress] output_directory LATEST\n\n")
 			os.Exit(1)
 		case "backup-push":
-			fmt.Printf("usage:\twal-g backup-push backup_directory\n\n")
+			fmt.Printf("usage:\twal-g backup-push [--force] [--progress] backup_directory\n\n")
+			os.Exit(1)
+		case "catchup-push":
+			fmt.Printf("usage:\twal-g catchup-push --from-lsn lsn backup_directory\n\n")
+			os.Exit(1)
+		case "catchup-fetch":
+			fmt.Print(catchupFetchUsage)
 			os.Exit(1)
 		case "backup-list":
-			fmt.Printf("usage:\twal-g backup-list\n\n")
+			fmt.Printf("usage:\twal-g backup-list [--detail] [--json] [--check-frequency duration]\n\n")
+			os.Exit(1)
+		case "backup-info":
+			fmt.Printf("usage:\twal-g backup-info [--json] backup_name\n\twal-g backup-info [--json] LATEST\n\n")
+			os.Exit(1)
+		case "backup-storage-report":
+			fmt.Printf("usage:\twal-g backup-storage-report [--cold-after duration]\n\n")
+			os.Exit(1)
+		case "catalog-verify":
+			fmt.Printf("usage:\twal-g catalog-verify [--concurrency n]\n\n")
+			os.Exit(1)
+		case "backup-wal-range":
+			fmt.Printf("usage:\twal-g backup-wal-range backup_name\n\twal-g backup-wal-range LATEST\n\n")
+			os.Exit(1)
+		case "restore-point-create":
+			fmt.Printf("usage:\twal-g restore-point-create restore_point_name\n\n")
+			os.Exit(1)
+		case "restore-point-list":
+			fmt.Printf("usage:\twal-g restore-point-list\n\n")
+			os.Exit(1)
+		case "backup-audit":
+			fmt.Printf("usage:\twal-g backup-audit backup_name\n\twal-g backup-audit LATEST\n\n")
+			os.Exit(1)
+		case "backup-verify":
+			fmt.Printf("usage:\twal-g backup-verify backup_name\n\twal-g backup-verify LATEST\n\n")
+			os.Exit(1)
+		case "backup-mark":
+			fmt.Print(backupMarkUsage)
+			os.Exit(1)
+		case "copy":
+			fmt.Print(copyUsage)
 			os.Exit(1)
 		case "wal-fetch":
 			fmt.Printf("usage:\twal-g wal-fetch wal_name file_name\n\t   wal_name: name of WAL archive\n\t   file_name: name of file to be written to\n\n")
 			os.Exit(1)
 		case "wal-push":
-			fmt.Printf("usage:\twal-g wal-push archive_path\n\n")
+			fmt.Printf("usage:\twal-g wal-push [--verify] archive_path\n\n")
+			os.Exit(1)
+		case "wal-prefetch":
+			fmt.Print(walPrefetchUsage)
+			os.Exit(1)
+		case "wal-prefetch-clean":
+			fmt.Printf("usage:\twal-g wal-prefetch-clean [--older-than duration] wal_directory\n\n")
+			os.Exit(1)
+		case "wal-verify-between":
+			fmt.Print(walVerifyBetweenUsage)
+			os.Exit(1)
+		case "wal-verify":
+			fmt.Print(walVerifyUsage)
+			os.Exit(1)
+		case "timeline-list":
+			fmt.Printf("usage:\twal-g timeline-list\n\n")
+			os.Exit(1)
+		case "wal-show":
+			fmt.Printf("usage:\twal-g wal-show [--json]\n\n")
 			os.Exit(1)
 		case "delete":
 			fmt.Println(walg.DeleteUsage)
 			os.Exit(1)
+		case "delete-expired":
+			fmt.Printf("usage:\twal-g delete-expired [--older-than duration] [--confirm]\n\n")
+			os.Exit(1)
 		default:
 			l.Fatalf("Command '%s' is unsupported by WAL-G.\n\n", command)
 		}
 	}
 
 	var backupName string
-	var verify = false
-	if len(all) == 3 {
-		backupName = all[2]
-		//TODO: use cobra
-		verify = all[2] == "--verify"
+	if len(args) > 1 {
+		backupName = args[1]
 	}
 
 	// Various profiling options
@@ -116,6 +340,21 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	// Cleanup of prefetch directory is local and does not need storage
+	if command == "wal-prefetch-clean" {
+		err := walg.HandleWALPrefetchClean(firstArgument, prefetchCleanAge)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		return
+	}
+
+	// Queued wal-push must succeed while storage is unavailable, so it does not connect to storage
+	if command == "wal-push" && walg.GetWALPushQueue() != "" {
+		walg.HandleWALPush(nil, firstArgument, nil, verifyWALPush)
+		return
+	}
+
 	// Configure and start S3 session with bucket, region, and path names.
 	// Checks that environment variables are properly set.
 	tu, pre, err := walg.Configure()
@@ -123,25 +362,232 @@ func main() {
 		log.Fatalf("FATAL: %+v\n", err)
 	}
 
-	fmt.Println("BUCKET:", *pre.Bucket)
-	fmt.Println("SERVER:", *pre.Server)
+	// JSON output is piped to other tools, so nothing else is printed to stdout
+	if !(command == "backup-list" && listJSON) && !(command == "backup-info" && infoJSON) && !(command == "wal-show" && walShowJSON) {
+		fmt.Println("BUCKET:", *pre.Bucket)
+		fmt.Println("SERVER:", *pre.Server)
+	}
 
 	if command == "wal-fetch" {
 		// Fetch and decompress a WAL file from S3.
-		walg.HandleWALFetch(pre, firstArgument, backupName, true)
+		err := walg.HandleWALFetch(pre, firstArgument, backupName, true)
+		if _, ok := err.(walg.ArchiveNonExistenceError); ok {
+			os.Exit(walg.GetWALMissingExitCode())
+		} else if err != nil {
+			walg.NewLogger("wal-fetch").With("wal_file", firstArgument).Fatalf("%+v\n", err)
+		}
 	} else if command == "wal-prefetch" {
-		walg.HandleWALPrefetch(pre, firstArgument, backupName)
+		if prefetchCount == 0 {
+			// Forked by wal-fetch with the segment it fetched and its destination
+			walg.HandleWALPrefetch(pre, firstArgument, backupName)
+			return
+		}
+		if backupName == "" {
+			fmt.Print(walPrefetchUsage)
+			os.Exit(1)
+		}
+		prefetched, err := walg.HandleWALPrefetchRange(pre, firstArgument, prefetchCount, backupName)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		fmt.Printf("Prefetched %d of %d segments\n", prefetched, prefetchCount)
 	} else if command == "wal-push" {
 		// Upload a WAL file to S3.
-		walg.HandleWALPush(tu, firstArgument, pre, verify)
+		walg.HandleWALPush(tu, firstArgument, pre, verifyWALPush)
+	} else if command == "wal-push-drain" {
+		// Started by wal-push when WALG_WAL_PUSH_QUEUE is set
+		err = walg.HandleWALPushDrain(tu, pre, firstArgument, verifyWALPush)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
 	} else if command == "backup-push" {
-		walg.HandleBackupPush(firstArgument, tu, pre)
+		err := walg.HandleBackupPush(firstArgument, tu, pre, forceBackupPush, showProgress)
+		if err != nil {
+			walg.NewLogger("backup-push").Fatalf("%+v\n", err)
+		}
+	} else if command == "catchup-push" {
+		if catchupFromLSN == "" {
+			fmt.Printf("usage:\twal-g catchup-push --from-lsn lsn backup_directory\n\n")
+			os.Exit(1)
+		}
+		fromLSN, err := walg.ParseTargetLSN(catchupFromLSN)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		err = walg.HandleCatchupPush(firstArgument, tu, pre, fromLSN)
+		if err != nil {
+			walg.NewLogger("catchup-push").Fatalf("%+v\n", err)
+		}
+	} else if command == "catchup-fetch" {
+		if backupName == "" {
+			fmt.Print(catchupFetchUsage)
+			os.Exit(1)
+		}
+		options := walg.BackupFetchOptions{
+			ForceIncrementBase: fetchForceDeltaBase,
+			Resume:             fetchResume,
+			ShowProgress:       showProgress,
+		}
+		err := walg.HandleCatchupFetch(pre, firstArgument, backupName, options)
+		if err != nil {
+			walg.NewLogger("catchup-fetch").Fatalf("%+v\n", err)
+		}
 	} else if command == "backup-fetch" {
-		walg.HandleBackupFetch(backupName, pre, firstArgument, mem)
+		options := walg.BackupFetchOptions{
+			Inspect:            fetchInspect,
+			VerifyPgControl:    fetchVerifyControl,
+			ForceIncrementBase: fetchForceDeltaBase,
+			LocalBase:          fetchLocalBase,
+			VerifyChecksums:    fetchVerifyChecksums,
+			Resume:             fetchResume,
+			ShowProgress:       showProgress,
+		}
+		if fetchOwner != "" && fetchPreserveOwner {
+			log.Fatalf("--chown and --preserve-owner cannot be used together\n")
+		}
+		options.PreserveOwner = fetchPreserveOwner
+		if fetchOwner != "" {
+			options.Owner, err = walg.ParseFileOwner(fetchOwner)
+			if err != nil {
+				log.Fatalf("%v\n", err)
+			}
+		}
+		if fetchDatabase != "" {
+			options.DatabaseOID, err = walg.ParseDatabaseOID(fetchDatabase)
+			if err != nil {
+				log.Fatalf("%v\n", err)
+			}
+		}
+		if fetchTablespaces != "" && fetchExcludeTablespaces != "" {
+			log.Fatalf("--tablespaces and --exclude-tablespaces cannot be used together\n")
+		}
+		if fetchTablespaces != "" {
+			options.Tablespaces, err = walg.ParseTablespaceFilter(fetchTablespaces, true)
+		} else if fetchExcludeTablespaces != "" {
+			options.Tablespaces, err = walg.ParseTablespaceFilter(fetchExcludeTablespaces, false)
+		}
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if fetchTablespaceLocations != "" {
+			options.TablespaceLocations, err = walg.ParseTablespaceLocations(fetchTablespaceLocations)
+			if err != nil {
+				log.Fatalf("%v\n", err)
+			}
+		}
+		if fetchTargetLSN != "" {
+			lsn, err := walg.ParseTargetLSN(fetchTargetLSN)
+			if err != nil {
+				log.Fatalf("%v\n", err)
+			}
+			options.TargetLSN = &lsn
+		}
+		_, err = walg.HandleBackupFetch(backupName, pre, firstArgument, mem, options)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
 	} else if command == "backup-list" {
-		walg.HandleBackupList(pre)
+		walg.HandleBackupList(pre, listDetail, listJSON, listCheckFrequency)
+	} else if command == "backup-info" {
+		err = walg.HandleBackupInfo(firstArgument, pre, infoJSON)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "backup-storage-report" {
+		err = walg.HandleBackupStorageReport(pre, reportColdAfter)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "catalog-verify" {
+		if verifyConcurrency < 1 {
+			log.Fatalf("--concurrency must be positive, got %d\n", verifyConcurrency)
+		}
+		err = walg.HandleCatalogVerify(pre, verifyConcurrency)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "backup-wal-range" {
+		err = walg.HandleBackupWALRange(pre, firstArgument)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "backup-audit" {
+		err = walg.HandleBackupAudit(pre, firstArgument)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "backup-verify" {
+		err = walg.HandleBackupVerify(pre, firstArgument)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "backup-mark" {
+		if markPermanent == markImpermanent {
+			fmt.Print(backupMarkUsage)
+			os.Exit(1)
+		}
+		err = walg.HandleBackupMark(tu, pre, firstArgument, markPermanent)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "copy" {
+		if copyTo == "" {
+			fmt.Print(copyUsage)
+			os.Exit(1)
+		}
+		dstTu, dstPre, err := walg.ConfigurePrefix(copyTo)
+		if err != nil {
+			log.Fatalf("FATAL: %+v\n", err)
+		}
+		err = walg.HandleCopy(pre, dstTu, dstPre, firstArgument, copyWithBases)
+		if err != nil {
+			walg.NewLogger("copy").Fatalf("%+v\n", err)
+		}
+	} else if command == "restore-point-create" {
+		err = walg.HandleRestorePointCreate(tu, pre, firstArgument)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "restore-point-list" {
+		err = walg.HandleRestorePointList(pre)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "wal-verify-between" {
+		if backupName == "" {
+			fmt.Print(walVerifyBetweenUsage)
+			os.Exit(1)
+		}
+		err = walg.HandleWALVerifyBetween(pre, firstArgument, backupName)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "wal-verify" {
+		if backupName == "" {
+			fmt.Print(walVerifyUsage)
+			os.Exit(1)
+		}
+		err = walg.HandleWALVerify(pre, firstArgument, backupName)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "timeline-list" {
+		err = walg.HandleTimelineList(pre)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+	} else if command == "wal-show" {
+		err = walg.HandleWALShow(pre, walShowJSON)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
 	} else if command == "delete" {
-		walg.HandleDelete(pre, all)
+		walg.HandleDelete(tu, pre, all)
+	} else if command == "delete-expired" {
+		err = walg.HandleDeleteExpired(pre, deleteGracePeriod, !deleteExpiredConfirm)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
 	} else {
 		l.Fatalf("Command '%s' is unsupported by WAL-G.", command)
 	}
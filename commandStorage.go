@@ -0,0 +1,225 @@
+package walg
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CommandStorage keeps objects with user supplied shell commands, e.g. on tape or in
+// a custom store.
+//
+// Every command is run with `sh -c` and gets the object key in WALG_OBJECT_KEY:
+// WriterCommand stores its stdin, ReaderCommand prints the object to stdout,
+// DeleteCommand removes the object. ListCommand gets WALG_OBJECT_PREFIX and prints
+// one object per line as "key size [modification time in RFC3339]".
+// Any non-zero exit code is an error of the operation.
+type CommandStorage struct {
+	WriterCommand string
+	ReaderCommand string
+	ListCommand   string
+	DeleteCommand string
+}
+
+// configureCommandStorage creates TarUploader and Prefix backed by WALG_*_COMMAND variables.
+// WALG_COMMAND_PREFIX is prepended to keys of all objects like path of WALE_S3_PREFIX.
+func configureCommandStorage(writerCommand string) (*TarUploader, *Prefix, error) {
+	storage := &CommandStorage{
+		WriterCommand: writerCommand,
+		ReaderCommand: os.Getenv("WALG_READER_COMMAND"),
+		ListCommand:   os.Getenv("WALG_LIST_COMMAND"),
+		DeleteCommand: os.Getenv("WALG_DELETE_COMMAND"),
+	}
+	var unset []string
+	if storage.ReaderCommand == "" {
+		unset = append(unset, "WALG_READER_COMMAND")
+	}
+	if storage.ListCommand == "" {
+		unset = append(unset, "WALG_LIST_COMMAND")
+	}
+	if len(unset) > 0 {
+		return nil, nil, &UnsetEnvVarError{names: unset}
+	}
+
+	server := strings.Trim(os.Getenv("WALG_COMMAND_PREFIX"), "/")
+	upload, pre := ConfigureStorageBackend(storage, server)
+	return upload, pre, nil
+}
+
+func (c *CommandStorage) command(command string, env ...string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	return cmd
+}
+
+// runStorageCommand runs command and includes its stderr in the error
+func runStorageCommand(cmd *exec.Cmd, key string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, errors.Wrapf(err, "storage command failed for '%s': %s", key, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Put streams object to stdin of writer command
+func (c *CommandStorage) Put(key string, r io.Reader) error {
+	cmd := c.command(c.WriterCommand, "WALG_OBJECT_KEY="+key)
+	cmd.Stdin = r
+	_, err := runStorageCommand(cmd, key)
+	if err != nil {
+		return errors.Wrap(err, "CommandStorage Put")
+	}
+	return nil
+}
+
+// commandReadCloser is stdout of reader command. Exit code is checked at the end
+// of output, so failure of command in the middle is not mistaken for short object.
+type commandReadCloser struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	key    string
+	stderr *bytes.Buffer
+	waited bool
+}
+
+func (r *commandReadCloser) wait() error {
+	if r.waited {
+		return nil
+	}
+	r.waited = true
+	err := r.cmd.Wait()
+	if err != nil {
+		return errors.Wrapf(err, "storage command failed for '%s': %s", r.key, strings.TrimSpace(r.stderr.String()))
+	}
+	return nil
+}
+
+func (r *commandReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		if waitErr := r.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (r *commandReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	if waitErr := r.wait(); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// GetArchive streams object from stdout of reader command
+func (c *CommandStorage) GetArchive(key string) (io.ReadCloser, error) {
+	cmd := c.command(c.ReaderCommand, "WALG_OBJECT_KEY="+key)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "CommandStorage GetArchive: failed to create pipe")
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.Wrap(err, "CommandStorage GetArchive: failed to start reader command")
+	}
+	return &commandReadCloser{stdout, cmd, key, stderr, false}, nil
+}
+
+// listObjects runs list command and parses its output
+func (c *CommandStorage) listObjects(prefix string) ([]StorageObject, error) {
+	output, err := runStorageCommand(c.command(c.ListCommand, "WALG_OBJECT_PREFIX="+prefix), prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "CommandStorage list")
+	}
+	var objects []StorageObject
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], prefix) {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, errors.Errorf("CommandStorage list: no size in line '%s'", scanner.Text())
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "CommandStorage list: invalid size in line '%s'", scanner.Text())
+		}
+		var modified time.Time
+		if len(fields) > 2 {
+			modified, err = time.Parse(time.RFC3339, fields[2])
+			if err != nil {
+				return nil, errors.Wrapf(err, "CommandStorage list: invalid time in line '%s'", scanner.Text())
+			}
+		}
+		objects = append(objects, StorageObject{Key: fields[0], Size: size, LastModified: modified})
+	}
+	return objects, nil
+}
+
+// filterByDelimiter leaves objects whose keys have no "/" after prefix,
+// as S3 does for listing with delimiter
+func filterByDelimiter(objects []StorageObject, prefix string) []StorageObject {
+	var filtered []StorageObject
+	for _, object := range objects {
+		if !strings.Contains(strings.TrimPrefix(object.Key, prefix), "/") {
+			filtered = append(filtered, object)
+		}
+	}
+	return filtered
+}
+
+// List returns objects printed by list command directly under prefix
+func (c *CommandStorage) List(prefix string) ([]StorageObject, error) {
+	objects, err := c.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterByDelimiter(objects, prefix), nil
+}
+
+// ListAll returns all objects printed by list command
+func (c *CommandStorage) ListAll(prefix string) ([]StorageObject, error) {
+	return c.listObjects(prefix)
+}
+
+// Exists finds object in output of list command
+func (c *CommandStorage) Exists(key string) (bool, error) {
+	objects, err := c.listObjects(key)
+	if err != nil {
+		return false, err
+	}
+	for _, object := range objects {
+		if object.Key == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Delete removes objects one by one with delete command
+func (c *CommandStorage) Delete(keys []string) error {
+	if c.DeleteCommand == "" {
+		return errors.Errorf("CommandStorage Delete: WALG_DELETE_COMMAND is not set, cannot delete %v", keys)
+	}
+	for _, key := range keys {
+		_, err := runStorageCommand(c.command(c.DeleteCommand, "WALG_OBJECT_KEY="+key), key)
+		if err != nil {
+			return errors.Wrap(err, "CommandStorage Delete")
+		}
+	}
+	return nil
+}
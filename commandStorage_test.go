@@ -0,0 +1,101 @@
+package walg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestCommandStorage(t *testing.T) (*CommandStorage, string) {
+	dir, err := ioutil.TempDir("", "walg_command_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CommandStorage{
+		WriterCommand: `mkdir -p "$(dirname ` + dir + `/"$WALG_OBJECT_KEY")" && cat > ` + dir + `/"$WALG_OBJECT_KEY"`,
+		ReaderCommand: `cat ` + dir + `/"$WALG_OBJECT_KEY"`,
+		ListCommand:   `cd ` + dir + ` && TZ=UTC find . -type f -printf "%P %s %TFT%TTZ\n"`,
+		DeleteCommand: `rm ` + dir + `/"$WALG_OBJECT_KEY"`,
+	}, dir
+}
+
+func TestCommandStorageCycle(t *testing.T) {
+	storage, dir := newTestCommandStorage(t)
+	defer os.RemoveAll(dir)
+
+	key := "server/wal_005/000000010000000000000001.lz4"
+	err := storage.Put(key, strings.NewReader("segment"))
+	if err != nil {
+		t.Fatalf("command storage: put failed: %v", err)
+	}
+
+	exists, err := storage.Exists(key)
+	if err != nil || !exists {
+		t.Fatalf("command storage: expected object to exist, got %v, %v", exists, err)
+	}
+
+	objects, err := storage.ListAll("server/wal_005/")
+	if err != nil {
+		t.Fatalf("command storage: list failed: %v", err)
+	}
+	if len(objects) != 1 || objects[0].Key != key {
+		t.Errorf("command storage: unexpected listing %v", objects)
+	} else {
+		if objects[0].Size != int64(len("segment")) {
+			t.Errorf("command storage: expected size %d, got %d", len("segment"), objects[0].Size)
+		}
+		if objects[0].LastModified.IsZero() {
+			t.Errorf("command storage: no modification time of %s", key)
+		}
+	}
+	if objects, err = storage.List("server/"); err != nil || len(objects) != 0 {
+		t.Errorf("command storage: expected nothing directly under server/, got %v, %v", objects, err)
+	}
+
+	archive, err := storage.GetArchive(key)
+	if err != nil {
+		t.Fatalf("command storage: get failed: %v", err)
+	}
+	body, err := ioutil.ReadAll(archive)
+	archive.Close()
+	if err != nil || !bytes.Equal(body, []byte("segment")) {
+		t.Errorf("command storage: read '%s', %v", body, err)
+	}
+
+	err = storage.Delete([]string{key})
+	if err != nil {
+		t.Fatalf("command storage: delete failed: %v", err)
+	}
+	if exists, err = storage.Exists(key); err != nil || exists {
+		t.Errorf("command storage: deleted object exists: %v, %v", exists, err)
+	}
+}
+
+func TestCommandStorageExitCode(t *testing.T) {
+	storage := &CommandStorage{
+		WriterCommand: "cat > /dev/null; echo tape is full >&2; exit 3",
+		ReaderCommand: "echo partial; exit 4",
+	}
+
+	err := storage.Put("key", strings.NewReader("data"))
+	if err == nil || !strings.Contains(err.Error(), "tape is full") {
+		t.Errorf("command storage: expected writer failure with stderr, got %v", err)
+	}
+
+	archive, err := storage.GetArchive("key")
+	if err != nil {
+		t.Fatalf("command storage: get failed: %v", err)
+	}
+	_, err = ioutil.ReadAll(archive)
+	if err == nil {
+		t.Errorf("command storage: reader failure after partial output is not reported")
+	}
+	archive.Close()
+
+	err = storage.Delete([]string{"key"})
+	if err == nil {
+		t.Errorf("command storage: delete without WALG_DELETE_COMMAND must fail")
+	}
+}
@@ -1,7 +1,7 @@
 package walg
 
 import (
-	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,9 +9,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"runtime/pprof"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -23,14 +23,12 @@ import (
 
 // walk recursively descends path, calling walkFn.
 func walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
-	if !info.IsDir() && info.Mode() & os.ModeSymlink == 0 {
+	// Tablespaces are walked through their links, so their files are named under
+	// pg_tblspc. Other links are not followed.
+	if _, isTablespace := tablespaceOfLink(path, info); !info.IsDir() && !isTablespace {
 		return walkFn(path, info, nil)
 	}
 
-	if info.Mode() & os.ModeSymlink != 0 {
-		path, _ = filepath.EvalSymlinks(path)
-	}
-
 	names, err := readDirNames(path)
 	err1 := walkFn(path, info, err)
 	// If err != nil, walk can't walk into this directory.
@@ -68,7 +66,7 @@ func walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
 // and directories are filtered by walkFn. The files are walked in lexical
 // order, which makes the output deterministic but means that for very
 // large directories Walk can be inefficient.
-// Walk does not follow symbolic links.
+// Walk follows only links of tablespaces in pg_tblspc.
 func Walk(root string, walkFn filepath.WalkFunc) error {
 	info, err := os.Lstat(root)
 	if info.Mode() & os.ModeSymlink != 0 {
@@ -104,18 +102,43 @@ func readDirNames(dirname string) ([]string, error) {
 }
 
 
-// HandleDelete is invoked to perform wal-g delete
-func HandleDelete(pre *Prefix, args []string) {
+// HandleDelete is invoked to perform wal-g delete. With WALG_SOFT_DELETE
+// backups are only marked and removed later by delete-expired.
+func HandleDelete(tu *TarUploader, pre *Prefix, args []string) {
 	cfg := ParseDeleteArguments(args, printDeleteUsageAndFail)
+	if getSoftDelete() {
+		cfg.marker = tu
+	}
+	if cfg.everything {
+		err := HandlePurge(pre, cfg.marker, cfg.force, cfg.dryrun)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		return
+	}
 
 	var bk = &Backup{
 		Prefix: pre,
 		Path:   GetBackupPath(pre),
 	}
 
+	if cfg.retainFor > 0 {
+		backups, err := bk.GetBackups()
+		if err != nil {
+			log.Fatal(err)
+		}
+		target := FindRetentionTarget(backups, time.Now().Add(-cfg.retainFor), cfg.minCount)
+		if target < 0 {
+			fmt.Printf("All %v backups are retained.\n", len(backups))
+			return
+		}
+		// Base of delta is found, so the floor and the age keep whole delta chains
+		deleteBeforeTarget(backups[target].Name, bk, pre, true, backups, cfg)
+		return
+	}
 	if cfg.before {
 		if cfg.beforeTime == nil {
-			deleteBeforeTarget(cfg.target, bk, pre, cfg.findFull, nil, cfg.dryrun)
+			deleteBeforeTarget(cfg.target, bk, pre, cfg.findFull, nil, cfg)
 		} else {
 			backups, err := bk.GetBackups()
 			if err != nil {
@@ -123,7 +146,7 @@ func HandleDelete(pre *Prefix, args []string) {
 			}
 			for _, b := range backups {
 				if b.Time.Before(*cfg.beforeTime) {
-					deleteBeforeTarget(b.Name, bk, pre, cfg.findFull, backups, cfg.dryrun)
+					deleteBeforeTarget(b.Name, bk, pre, cfg.findFull, backups, cfg)
 					return
 				}
 			}
@@ -146,7 +169,7 @@ func HandleDelete(pre *Prefix, args []string) {
 			left := number
 			for _, b := range backups {
 				if left == 1 {
-					deleteBeforeTarget(b.Name, bk, pre, true, backups, cfg.dryrun)
+					deleteBeforeTarget(b.Name, bk, pre, true, backups, cfg)
 					return
 				}
 				dto := fetchSentinel(b.Name, bk, pre)
@@ -160,14 +183,36 @@ func HandleDelete(pre *Prefix, args []string) {
 				fmt.Printf("Have only %v backups.\n", number)
 			} else {
 				cfg.target = backups[number-1].Name
-				deleteBeforeTarget(cfg.target, bk, pre, cfg.findFull, nil, cfg.dryrun)
+				deleteBeforeTarget(cfg.target, bk, pre, cfg.findFull, nil, cfg)
 			}
 		}
 	}
 }
 
-// HandleBackupList is invoked to perform wal-g backup-list
-func HandleBackupList(pre *Prefix) {
+// CheckBackupFrequency returns error if the newest of backups is older than maxAge at now
+func CheckBackupFrequency(backups []BackupTime, maxAge time.Duration, now time.Time) error {
+	if len(backups) == 0 {
+		return ErrLatestNotFound
+	}
+	latest := backups[0]
+	for _, b := range backups[1:] {
+		if b.Time.After(latest.Time) {
+			latest = b
+		}
+	}
+	age := now.Sub(latest.Time)
+	if age > maxAge {
+		return errors.Errorf("Latest backup %v was taken %v ago at %v, which is more than allowed %v",
+			latest.Name, age.Truncate(time.Second), latest.Time.Format(time.RFC3339), maxAge)
+	}
+	return nil
+}
+
+// HandleBackupList is invoked to perform wal-g backup-list.
+// Names and times come from a single listing; with detail sentinels
+// of all backups are fetched concurrently to show LSNs and delta origins.
+// Non-zero checkFrequency makes it fail after printing if the latest backup is older.
+func HandleBackupList(pre *Prefix, detail bool, asJSON bool, checkFrequency time.Duration) {
 	var bk = &Backup{
 		Prefix: pre,
 		Path:   GetBackupPath(pre),
@@ -178,34 +223,218 @@ func HandleBackupList(pre *Prefix) {
 	}
 
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-	defer w.Flush()
-	fmt.Fprintln(w, "name\tlast_modified\twal_segment_backup_start")
+	defer func() {
+		w.Flush()
+		if checkFrequency == 0 {
+			return
+		}
+		if err := CheckBackupFrequency(backups, checkFrequency, time.Now()); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}()
+	if !detail && !asJSON {
+		fmt.Fprintln(w, "name\tlast_modified\twal_segment_backup_start")
+		for i := len(backups) - 1; i >= 0; i-- {
+			b := backups[i]
+			fmt.Fprintln(w, fmt.Sprintf("%v\t%v\t%v", b.Name, b.Time.Format(time.RFC3339), b.WalFileName))
+		}
+		return
+	}
+
+	names := make([]string, len(backups))
+	for i, b := range backups {
+		names[i] = b.Name
+	}
+	sentinels, err := FetchSentinels(names, bk, pre)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(NewBackupListEntries(backups, sentinels)); err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		return
+	}
+	fmt.Fprintln(w, "name\tlast_modified\twal_segment_backup_start\tstart_lsn\tfinish_lsn\tpg_version\tdelta_from")
+	for i := len(backups) - 1; i >= 0; i-- {
+		b := backups[i]
+		dto := sentinels[b.Name]
+		deltaFrom := "-"
+		if dto.IsIncremental() {
+			deltaFrom = *dto.IncrementFrom
+		}
+		fmt.Fprintln(w, fmt.Sprintf("%v\t%v\t%v\t%v\t%v\t%v\t%v", b.Name, b.Time.Format(time.RFC3339), b.WalFileName,
+			formatOptionalLSN(dto.LSN), formatOptionalLSN(dto.FinishLSN), dto.PgVersion, deltaFrom))
+	}
+}
 
+// BackupListEntry is one backup in JSON output of backup-list
+type BackupListEntry struct {
+	Name          string    `json:"name"`
+	Time          time.Time `json:"last_modified"`
+	WalFileName   string    `json:"wal_segment_backup_start"`
+	IsIncremental bool      `json:"is_incremental"`
+	StartLSN      string    `json:"start_lsn,omitempty"`
+	FinishLSN     string    `json:"finish_lsn,omitempty"`
+	PgVersion     int       `json:"pg_version,omitempty"`
+	DeltaFrom     string    `json:"delta_from,omitempty"`
+}
+
+// NewBackupListEntries describes backups with their sentinels, the newest first as in the table
+func NewBackupListEntries(backups []BackupTime, sentinels map[string]S3TarBallSentinelDto) []BackupListEntry {
+	entries := make([]BackupListEntry, 0, len(backups))
 	for i := len(backups) - 1; i >= 0; i-- {
 		b := backups[i]
-		fmt.Fprintln(w, fmt.Sprintf("%v\t%v\t%v", b.Name, b.Time.Format(time.RFC3339), b.WalFileName))
+		dto := sentinels[b.Name]
+		entry := BackupListEntry{
+			Name:          b.Name,
+			Time:          b.Time,
+			WalFileName:   b.WalFileName,
+			IsIncremental: dto.IsIncremental(),
+			PgVersion:     dto.PgVersion,
+		}
+		if dto.LSN != nil {
+			entry.StartLSN = formatOptionalLSN(dto.LSN)
+		}
+		if dto.FinishLSN != nil {
+			entry.FinishLSN = formatOptionalLSN(dto.FinishLSN)
+		}
+		if entry.IsIncremental {
+			entry.DeltaFrom = *dto.IncrementFrom
+		}
+		entries = append(entries, entry)
 	}
+	return entries
+}
+
+func formatOptionalLSN(lsn *uint64) string {
+	if lsn == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%x", *lsn)
+}
+
+// BackupFetchOptions incapsulates optional behavior of backup-fetch
+type BackupFetchOptions struct {
+	// Owner of restored files, nil means ownership is not changed
+	Owner *FileOwner
+
+	// PreserveOwner restores ownership of files recorded in backup, which requires root
+	PreserveOwner bool
+
+	// Inspect leaves a marker in restored directory and prints how to start
+	// an isolated read-only instance on it
+	Inspect bool
+
+	// VerifyPgControl compares checkpoint of restored pg_control with LSNs of backup
+	VerifyPgControl bool
+
+	// LocalBase is the backup of delta chain already restored in output directory,
+	// only deltas after it are fetched
+	LocalBase string
+
+	// ForceIncrementBase applies delta even if restored base does not match its DeltaFromLSN
+	ForceIncrementBase bool
+
+	// DatabaseOID restores relation files of only this database, zero restores all
+	DatabaseOID uint32
+
+	// Tablespaces limits restored tablespaces, nil restores all
+	Tablespaces *TablespaceFilter
+
+	// TablespaceLocations are new locations of tablespaces by OID, others are
+	// restored to their locations at backup time
+	TablespaceLocations map[uint32]string
+
+	// VerifyChecksums fails restore if content of a file differs from its checksum in sentinel
+	VerifyChecksums bool
+
+	// Resume continues restore interrupted in the same directory, see FetchProgress
+	Resume bool
+
+	// TargetLSN is the LSN recovery stops at. Backup finished after it is refused,
+	// LATEST is the latest backup finished before it. Nil skips the check.
+	TargetLSN *uint64
+
+	// ShowProgress prints progress of extraction even if output is not a terminal
+	ShowProgress bool
+
+	// span of the whole fetch, extraction of each delta step is its child
+	span *Span
+
+	// progress records what is extracted until the whole fetch completes
+	progress *FetchProgress
+
+	// keptEntries of output directory stay in place instead of moving to increment base,
+	// so files of a replica absent from catchup survive it
+	keptEntries map[string]Empty
 }
 
-// HandleBackupFetch is invoked to perform wal-g backup-fetch
-func HandleBackupFetch(backupName string, pre *Prefix, dirArc string, mem bool) (lsn *uint64) {
+// HandleBackupFetch is invoked to perform wal-g backup-fetch.
+// Returns start LSN of restored backup.
+func HandleBackupFetch(backupName string, pre *Prefix, dirArc string, mem bool, options BackupFetchOptions) (lsn *uint64, err error) {
 	dirArc = ResolveSymlink(dirArc)
-	lsn = deltaFetchRecursion(backupName, pre, dirArc)
+	if options.TargetLSN != nil {
+		backupName, err = resolveTargetLSNBackup(backupName, pre, *options.TargetLSN)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	span := StartSpan("backup-fetch")
+	span.SetAttribute("backup.name", backupName)
+	options.span = span
+	options.progress, err = OpenFetchProgress(dirArc, options.Resume)
+	if err != nil {
+		return nil, err
+	}
+	startFetch := time.Now()
+	bk, sentinel, err := deltaFetchRecursion(backupName, pre, dirArc, options)
+	span.End()
+	FlushTraces()
+	if err != nil {
+		if options.progress.Close() == nil && options.progress.records > 0 {
+			fmt.Printf("Restore is interrupted, use backup-fetch --resume to continue it\n")
+		}
+		return nil, err
+	}
+	err = options.progress.Remove()
+	if err != nil {
+		return nil, err
+	}
+	lsn = sentinel.LSN
+	getMetrics().ObserveFetchDuration("backup-fetch", time.Since(startFetch))
+
+	if options.VerifyPgControl {
+		err := VerifyRestoredPgControl(dirArc, sentinel)
+		if err != nil {
+			return lsn, err
+		}
+	}
+
+	if options.Inspect {
+		err := PrepareInspection(dirArc, *bk.Name, sentinel)
+		if err != nil {
+			return lsn, err
+		}
+	}
 
 	if mem {
 		f, err := os.Create("mem.prof")
 		if err != nil {
-			log.Fatal(err)
+			return lsn, err
 		}
 
 		pprof.WriteHeapProfile(f)
 		defer f.Close()
 	}
-	return
+	return lsn, nil
 }
 
 // deltaFetchRecursion function composes Backup object and recursively searches for necessary base backup
-func deltaFetchRecursion(backupName string, pre *Prefix, dirArc string) (lsn *uint64) {
+func deltaFetchRecursion(backupName string, pre *Prefix, dirArc string, options BackupFetchOptions) (*Backup, S3TarBallSentinelDto, error) {
 	var bk *Backup
 	// Check if BACKUPNAME exists and if it does extract to DIRARC.
 	if backupName != "LATEST" {
@@ -218,10 +447,10 @@ func deltaFetchRecursion(backupName string, pre *Prefix, dirArc string) (lsn *ui
 
 		exists, err := bk.CheckExistence()
 		if err != nil {
-			log.Fatalf("%+v\n", err)
+			return nil, S3TarBallSentinelDto{}, err
 		}
 		if !exists {
-			log.Fatalf("Backup '%s' does not exist.\n", *bk.Name)
+			return nil, S3TarBallSentinelDto{}, BackupNonExistenceError{*bk.Name}
 		}
 
 		// Find the LATEST valid backup (checks against JSON file and grabs backup name) and extract to DIRARC.
@@ -233,156 +462,289 @@ func deltaFetchRecursion(backupName string, pre *Prefix, dirArc string) (lsn *ui
 
 		latest, err := bk.GetLatest()
 		if err != nil {
-			log.Fatalf("%+v\n", err)
+			return nil, S3TarBallSentinelDto{}, err
 		}
 		bk.Name = aws.String(latest)
 	}
-	var dto = fetchSentinel(*bk.Name, bk, pre)
+	dto, err := readSentinel(*bk.Name, bk, pre)
+	if err != nil {
+		return nil, dto, err
+	}
+
+	if *bk.Name == options.LocalBase {
+		// Base is already restored in dirArc, only deltas are applied on top of it
+		fmt.Printf("Using %v restored in %v as base\n", *bk.Name, dirArc)
+		return bk, dto, nil
+	}
+
+	if options.progress.IsDone(*bk.Name) {
+		fmt.Printf("%v is already restored in %v\n", *bk.Name, dirArc)
+		return bk, dto, nil
+	}
+
+	if dto.IsCatchup() {
+		return nil, dto, errors.Errorf("%v is a catchup from LSN %x, use catchup-fetch to apply it to a replica at that LSN", *bk.Name, *dto.IncrementFromLSN)
+	}
 
 	if dto.IsIncremental() {
 		fmt.Printf("Delta from %v at LSN %x \n", *dto.IncrementFrom, *dto.IncrementFromLSN)
-		deltaFetchRecursion(*dto.IncrementFrom, pre, dirArc)
+		_, baseDto, err := deltaFetchRecursion(*dto.IncrementFrom, pre, dirArc, options)
+		if err != nil {
+			return nil, dto, err
+		}
+		// Interrupted fetch has already checked base and moved it to increment base
+		if !options.progress.IsResumed(*bk.Name) {
+			err = CheckIncrementBase(dirArc, *dto.IncrementFrom, baseDto, dto)
+		}
+		if err != nil {
+			if !options.ForceIncrementBase {
+				return nil, dto, errors.WithMessage(err, fmt.Sprintf("Delta %s is not applied, use --force-delta-base to apply it anyway", *bk.Name))
+			}
+			fmt.Printf("WARNING: applying delta to mismatching base: %v\n", err)
+		}
 		fmt.Printf("%v fetched. Upgrading from LSN %x to LSN %x \n", *dto.IncrementFrom, *dto.IncrementFromLSN, dto.LSN)
+	} else if options.LocalBase != "" {
+		return nil, dto, errors.Errorf("Local base %s is not in delta chain, which starts from full backup %s", options.LocalBase, *bk.Name)
+	}
+
+	err = unwrapBackup(bk, dirArc, pre, dto, options)
+	if err != nil {
+		return nil, dto, err
 	}
+	return bk, dto, nil
+}
 
-	unwrapBackup(bk, dirArc, pre, dto)
+// benignDirectoryEntries may be present in directory to restore to, e.g. a freshly formatted mount point
+var benignDirectoryEntries = map[string]Empty{
+	"lost+found":          {},
+	FetchProgressFileName: {},
+}
 
-	lsn = dto.LSN
-	return
+// isDirectoryEmpty tells whether directory has no entries except benign ones.
+// Stops at the first real entry, so a stale large tree is not walked.
+// Directory which does not exist yet is empty.
+func isDirectoryEmpty(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "isDirectoryEmpty: failed to open %s", dir)
+	}
+	defer f.Close()
+
+	for {
+		names, err := f.Readdirnames(16)
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "isDirectoryEmpty: failed to read %s", dir)
+		}
+		for _, name := range names {
+			if _, ok := benignDirectoryEntries[name]; !ok {
+				return false, nil
+			}
+		}
+	}
 }
 
 // Do the job of unpacking Backup object
-func unwrapBackup(bk *Backup, dirArc string, pre *Prefix, sentinel S3TarBallSentinelDto) {
+func unwrapBackup(bk *Backup, dirArc string, pre *Prefix, sentinel S3TarBallSentinelDto, options BackupFetchOptions) (err error) {
+	err = CheckCaseCollisions(dirArc, sentinel.Files)
+	if err != nil {
+		return err
+	}
+	err = options.Tablespaces.Validate(*bk.Name, sentinel.Files)
+	if err != nil {
+		return err
+	}
 
 	incrementBase := path.Join(dirArc, "increment_base")
-	if !sentinel.IsIncremental() {
-		var empty = true
-		searchLambda := func(path string, info os.FileInfo, err error) error {
-			if path != dirArc {
-				empty = false
+	resumed := options.progress.IsResumed(*bk.Name)
+	if resumed {
+		// Files restored by interrupted fetch are kept, the rest of base is in increment base
+		fmt.Printf("Resuming interrupted restore of %v\n", *bk.Name)
+	}
+	if !sentinel.hasIncrementBase() {
+		if !resumed {
+			empty, err := isDirectoryEmpty(dirArc)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return errors.Errorf("Directory %v for delta base must be empty", dirArc)
 			}
-			return nil
 		}
-		filepath.Walk(dirArc, searchLambda)
-
-		if !empty {
-			log.Fatalf("Directory %v for delta base must be empty", dirArc)
+		err = createTablespaceLinks(dirArc, sentinel, options, resumed)
+		if err != nil {
+			return err
 		}
 	} else {
 		defer func() {
-			err := os.RemoveAll(incrementBase)
 			if err != nil {
-				log.Fatal(err)
+				// Base files not incremented yet are kept for backup-fetch --resume
+				return
+			}
+			removeErr := removeTablespaceIncrementBases(incrementBase)
+			if removeErr != nil {
+				err = removeErr
+				return
+			}
+			removeErr = os.RemoveAll(incrementBase)
+			if removeErr != nil {
+				err = errors.Wrap(removeErr, "unwrapBackup: failed to remove increment base")
 			}
 		}()
 
-		err := os.MkdirAll(incrementBase, os.FileMode(0777))
-		if err != nil {
-			log.Fatal(err)
-		}
+		if !resumed {
+			err := os.MkdirAll(incrementBase, os.FileMode(0777))
+			if err != nil {
+				return err
+			}
 
-		files, err := ioutil.ReadDir(dirArc)
-		if err != nil {
-			log.Fatal(err)
-		}
+			files, err := ioutil.ReadDir(dirArc)
+			if err != nil {
+				return err
+			}
 
-		for _, f := range files {
-			objName := f.Name()
-			if objName != "increment_base" {
-				err := os.Rename(path.Join(dirArc, objName), path.Join(incrementBase, objName))
-				if err != nil {
-					log.Fatal(err)
+			for _, f := range files {
+				objName := f.Name()
+				if _, kept := options.keptEntries[objName]; kept {
+					continue
+				}
+				if _, ok := benignDirectoryEntries[objName]; !ok && objName != "increment_base" {
+					err := os.Rename(path.Join(dirArc, objName), path.Join(incrementBase, objName))
+					if err != nil {
+						return err
+					}
 				}
 			}
+			err = moveTablespacesToIncrementBase(incrementBase)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Skipped files of tablespaces are moved through the links
+		err = createTablespaceLinks(dirArc, sentinel, options, resumed)
+		if err != nil {
+			return err
 		}
 
+		var skipped []string
 		for fileName, fd := range sentinel.Files {
-			if !fd.IsSkipped {
-				continue
-			}
-			fmt.Printf("Skipped file %v\n", fileName)
-			targetPath := path.Join(dirArc, fileName)
-			// this path is only used for increment restoration
-			incrementalPath := path.Join(incrementBase, fileName)
-			err = MoveFileAndCreateDirs(incrementalPath, targetPath, fileName)
-			if err != nil {
-				log.Fatal(err, "Failed to move skipped file for "+targetPath+" "+fileName)
+			// Placeholders of other databases restored with base are kept too
+			if fd.IsSkipped && !options.Tablespaces.skips(fileName) {
+				skipped = append(skipped, fileName)
 			}
 		}
+		err = moveSkippedFiles(incrementBase, dirArc, skipped, resumed)
+		if err != nil {
+			return err
+		}
 
 	}
-
-	var allKeys []string
-	var keys []string
-	allKeys, err := bk.GetKeys()
+	keys, pgControlKey, err := bk.GetTarPartitions()
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return err
 	}
-	keys = allKeys[:len(allKeys)-1] // TODO: WTF is going on?
+
+	span := options.span.StartChild("extract")
+	defer span.End()
+	span.SetAttribute("backup.name", *bk.Name)
+	span.SetAttribute("backup.delta", sentinel.IsIncremental())
 	f := &FileTarInterpreter{
 		NewDir:             dirArc,
 		Sentinel:           sentinel,
 		IncrementalBaseDir: incrementBase,
+		Owner:              options.Owner,
+		PreserveOwner:      options.PreserveOwner,
+		DatabaseOID:        options.DatabaseOID,
+		Tablespaces:        options.Tablespaces,
+		DiskRateLimiter:    NewRateLimiter(getRestoreDiskRateLimit()),
+		VerifyChecksums:    options.VerifyChecksums,
+		ForceIncrementBase: options.ForceIncrementBase,
+		Progress:           options.progress,
+		BackupName:         *bk.Name,
+	}
+	err = options.progress.Start(*bk.Name)
+	if err != nil {
+		return err
 	}
-	out := make([]ReaderMaker, len(keys))
-	for i, key := range keys {
-		s := &S3ReaderMaker{
+	var partitions []ReaderMaker
+	for _, key := range keys {
+		if options.progress.IsExtracted(*bk.Name, key) {
+			// Extracted by interrupted fetch
+			continue
+		}
+		partitions = append(partitions, &S3ReaderMaker{
 			Backup:     bk,
 			Key:        aws.String(key),
-			FileFormat: CheckType(key),
+			FileFormat: sentinel.GetPartitionFormat(key),
+		})
+	}
+	var pgControl ReaderMaker
+	if pgControlKey != "" && !options.progress.IsExtracted(*bk.Name, pgControlKey) {
+		pgControl = &S3ReaderMaker{
+			Backup:     bk,
+			Key:        aws.String(pgControlKey),
+			FileFormat: sentinel.GetPartitionFormat(pgControlKey),
 		}
-		out[i] = s
 	}
-	// Extract all compressed tar members except `pg_control.tar.lz4` if WALG version backup.
-	err = ExtractAll(f, out)
-	if serr, ok := err.(*UnsupportedFileTypeError); ok {
-		log.Fatalf("%v\n", serr)
-	} else if err != nil {
-		log.Fatalf("%+v\n", err)
+	span.SetAttribute("extract.partitions", len(partitions))
+
+	if pgControlKey == "" && requiresSeparatePgControl(*bk.Name, sentinel) {
+		return errors.New("Corrupt backup: missing pg_control")
 	}
-	// Check name for backwards compatibility. Will check for `pg_control` if WALG version of backup.
-	re := regexp.MustCompile(`^([^_]+._{1}[^_]+._{1})`)
-	match := re.FindString(*bk.Name)
-	if match == "" || sentinel.IsIncremental() {
-		// Extract pg_control last. If pg_control does not exist, program exits with error code 1.
-		name := *bk.Path + *bk.Name + "/tar_partitions/pg_control.tar.lz4"
-		pgControl := &Archive{
-			Prefix:  pre,
-			Archive: aws.String(name),
-		}
 
-		exists, err := pgControl.CheckExistence()
-		if err != nil {
-			log.Fatalf("%+v\n", err)
-		}
+	crypter, err := NewBackupCrypter(sentinel.WrappedDataKey)
+	if err != nil {
+		return errors.Wrap(err, "unwrapBackup: failed to unwrap data key of backup")
+	}
 
-		if exists {
-			sentinel := make([]ReaderMaker, 1)
-			sentinel[0] = &S3ReaderMaker{
-				Backup:     bk,
-				Key:        aws.String(name),
-				FileFormat: CheckType(name),
-			}
-			err := ExtractAll(f, sentinel)
-			if serr, ok := err.(*UnsupportedFileTypeError); ok {
-				log.Fatalf("%v\n", serr)
-			} else if err != nil {
-				log.Fatalf("%+v\n", err)
-			}
-			fmt.Printf("\nBackup extraction complete.\n")
-		} else {
-			log.Fatal("Corrupt backup: missing pg_control")
-		}
+	f.Reporter = StartProgress("backup-fetch "+*bk.Name, restoredSize(sentinel.Files, options.DatabaseOID, options.Tablespaces), options.ShowProgress)
+	// Extract all partitions concurrently, then pg_control last.
+	err = ExtractBackup(f, partitions, pgControl, crypter)
+	f.Reporter.Stop()
+	if mismatch, ok := err.(ChecksumMismatchError); ok {
+		return errors.WithMessage(mismatch, "Corrupt backup")
+	} else if err != nil {
+		return err
+	}
+	if pgControl != nil {
+		fmt.Printf("\nBackup extraction complete.\n")
+	}
+	err = options.Tablespaces.pruneTablespaceMap(dirArc)
+	if err != nil {
+		return err
+	}
+	err = relocateTablespaceMap(dirArc, options.TablespaceLocations)
+	if err != nil {
+		return err
 	}
+	return options.progress.Done(*bk.Name)
 }
 
-func getDeltaConfig() (maxDeltas int, fromFull bool) {
+// isPgControlPartition tells whether key is the partition of pg_control, of any compression
+func isPgControlPartition(key string) bool {
+	return strings.HasPrefix(path.Base(key), "pg_control.tar.")
+}
+
+// requiresSeparatePgControl tells whether backup must have pg_control in its own partition.
+// WAL-G backups always have `pg_control` stored separately, backups of WAL-E do not. These
+// are told by name base_WALFILE_OFFSET, which has offset after WAL file unlike names of WAL-G
+// with or without start time.
+func requiresSeparatePgControl(name string, sentinel S3TarBallSentinelDto) bool {
+	return sentinel.hasIncrementBase() || !strings.Contains(stripWalFileName(name), "_")
+}
+
+func getDeltaConfig() (maxDeltas int, fromFull bool, strict bool, err error) {
 	stepsStr, hasSteps := os.LookupEnv("WALG_DELTA_MAX_STEPS")
-	var err error
 	if hasSteps {
 		maxDeltas, err = strconv.Atoi(stepsStr)
 		if err != nil {
-			log.Fatal("Unable to parse WALG_DELTA_MAX_STEPS ", err)
+			return 0, false, false, errors.Wrap(err, "getDeltaConfig: unable to parse WALG_DELTA_MAX_STEPS")
 		}
 	}
 	origin, hasOrigin := os.LookupEnv("WALG_DELTA_ORIGIN")
@@ -392,16 +754,87 @@ func getDeltaConfig() (maxDeltas int, fromFull bool) {
 		case "LATEST_FULL":
 			fromFull = false
 		default:
-			log.Fatal("Unknown WALG_DELTA_ORIGIN:", origin)
+			return 0, false, false, errors.Errorf("getDeltaConfig: unknown WALG_DELTA_ORIGIN '%s'", origin)
+		}
+	}
+	strictStr, hasStrict := os.LookupEnv("WALG_DELTA_STRICT")
+	if hasStrict {
+		strict, err = strconv.ParseBool(strictStr)
+		if err != nil {
+			return 0, false, false, errors.Wrap(err, "getDeltaConfig: unable to parse WALG_DELTA_STRICT")
 		}
 	}
 	return
 }
 
 // HandleBackupPush is invoked to performa wal-g backup-push
-func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
+func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix, force bool, progress bool) (err error) {
 	dirArc = ResolveSymlink(dirArc)
-	maxDeltas, fromFull := getDeltaConfig()
+	maxDeltas, fromFull, strictDelta, err := getDeltaConfig()
+	if err != nil {
+		return err
+	}
+	tarSizeThreshold, err := GetTarSizeThreshold()
+	if err != nil {
+		return err
+	}
+	// Settings are read before the lock is taken, so that a misconfigured push does not leave it behind
+	smallFileSize, err := getSmallFileSize()
+	if err != nil {
+		return err
+	}
+	useDataKey, err := getBackupDataKey()
+	if err != nil {
+		return err
+	}
+	nameTimestamp, err := getBackupNameTimestamp()
+	if err != nil {
+		return err
+	}
+	makeManifest, err := getBackupManifest()
+	if err != nil {
+		return err
+	}
+	detectTornPages, err := getDetectTornPages()
+	if err != nil {
+		return err
+	}
+	err = checkCompressionSettings()
+	if err != nil {
+		return err
+	}
+	// Keys of the crypter are read by IsUsed, which exits on invalid ones
+	crypter := NewCrypter()
+	crypter.IsUsed()
+
+	span := StartSpan("backup-push")
+	defer FlushTraces()
+	defer span.End()
+	startPush := time.Now()
+	logger := NewLogger("backup-push")
+	defer func() {
+		if err != nil {
+			getMetrics().IncUploadFailures("backup-push")
+		}
+	}()
+
+	err = CheckWritable(tu, pre)
+	if err != nil {
+		return err
+	}
+
+	lock, err := AcquireBackupPushLock(tu, pre, force)
+	if err != nil {
+		return err
+	}
+	stopSignals := lock.ReleaseOnSignal()
+	defer func() {
+		stopSignals()
+		err := lock.Release()
+		if err != nil {
+			logger.Warnf("%+v\n", err)
+		}
+	}()
 
 	var bk = &Backup{
 		Prefix: pre,
@@ -410,16 +843,18 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 
 	var dto S3TarBallSentinelDto
 	var latest string
-	var err error
 	incrementCount := 1
 
 	if maxDeltas > 0 {
 		latest, err = bk.GetLatest()
 		if err != ErrLatestNotFound {
 			if err != nil {
-				log.Fatalf("%+v\n", err)
+				return err
+			}
+			dto, err = readSentinel(latest, bk, pre)
+			if err != nil {
+				return err
 			}
-			dto = fetchSentinel(latest, bk, pre)
 			if dto.IncrementCount != nil {
 				incrementCount = *dto.IncrementCount + 1
 			}
@@ -433,7 +868,10 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 				if fromFull {
 					fmt.Println("Delta will be made from full backup.")
 					latest = *dto.IncrementFullName
-					dto = fetchSentinel(latest, bk, pre)
+					dto, err = readSentinel(latest, bk, pre)
+					if err != nil {
+						return err
+					}
 				}
 				fmt.Printf("Delta backup from %v with LSN %x. \n", latest, *dto.LSN)
 			}
@@ -441,28 +879,77 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 	}
 
 	bundle := &Bundle{
-		MinSize:            int64(1000000000), //MINSIZE = 1GB
+		MinSize:            tarSizeThreshold,
+		SmallFileSize:      smallFileSize,
 		IncrementFromLsn:   dto.LSN,
 		IncrementFromFiles: dto.Files,
+		StrictDelta:        strictDelta,
 		Files:              &sync.Map{},
+		Crypter:            crypter,
 	}
 	if dto.Files == nil {
 		bundle.IncrementFromFiles = make(map[string]BackupFileDescription)
 	}
 
+	// Objects of the backup are encrypted with its own key, kept in the sentinel wrapped by the long-term key
+	var wrappedDataKey []byte
+	if useDataKey && bundle.Crypter.IsUsed() {
+		dataKey, err := bundle.Crypter.GenerateDataKey()
+		if err == nil {
+			wrappedDataKey, err = bundle.Crypter.WrapDataKey(dataKey)
+		}
+		if err != nil {
+			return errors.Wrap(err, "HandleBackupPush: failed to create data key")
+		}
+		bundle.Crypter.SetDataKey(dataKey)
+	}
+
 	// Connect to postgres and start/finish a nonexclusive backup.
 	conn, err := Connect()
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return err
 	}
-	name, lsn, pgVersion, err := bundle.StartBackup(conn, time.Now().String())
+	// Postgres aborts backup which is not stopped when session ends
+	defer conn.Close()
+	bundle.WalSegmentSize, err = readWalSegmentSize(conn)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return err
+	}
+	startSpan := span.StartChild("start-backup")
+	startTime := time.Now()
+	name, lsn, pgVersion, err := bundle.StartBackup(conn, startTime.String())
+	if err != nil {
+		return err
+	}
+	if nameTimestamp {
+		name = addBackupNameTime(name, startTime)
+	}
+	startSpan.SetAttribute("backup.start_lsn", lsn)
+	startSpan.End()
+
+	if detectTornPages {
+		bundle.TornPages = NewTornPageDetector(lsn)
+	}
+
+	// Delta holds only changed pages of files, so checksums of restored files are unknown
+	if makeManifest && dto.LSN == nil {
+		timeline, err := ParseWALFileName(stripWalFileName(name))
+		if err != nil {
+			return err
+		}
+		bundle.Manifest = NewBackupManifest()
+		bundle.Manifest.Timeline = timeline
+		bundle.Manifest.StartLSN = lsn
+	} else if makeManifest {
+		fmt.Println("backup_manifest is made only for full backups, delta backup is pushed without it.")
 	}
 
 	if len(latest) > 0 && dto.LSN != nil {
 		name = name + "_D_" + stripWalFileName(latest)
+		span.SetAttribute("backup.delta_from", latest)
 	}
+	span.SetAttribute("backup.name", name)
+	span.SetAttribute("postgres.version", pgVersion)
 
 	// Start a new tar bundle and walk the DIRARC directory and upload to S3.
 	bundle.Tbm = &S3TarBallMaker{
@@ -475,26 +962,45 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 		IncrementFrom:    latest,
 	}
 
+	// Size of files is estimated by a separate walk, only if progress is printed
+	if _, shown := progressInterval(progress); shown {
+		bundle.Progress = StartProgress("backup-push", estimateBackupSize(dirArc), progress)
+		defer bundle.Progress.Stop()
+	}
+
 	bundle.StartQueue()
 	fmt.Println("Walking ...")
+	walkSpan := span.StartChild("walk")
 	err = Walk(dirArc, bundle.TarWalker)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return err
 	}
+	walkSpan.End()
+
+	// Walk only enqueues partitions, the rest are uploaded here
+	uploadSpan := span.StartChild("upload")
 	err = bundle.FinishQueue()
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return err
 	}
 	// Upload `pg_control`.
 	err = bundle.HandleSentinel()
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return err
 	}
+	bundle.Progress.Stop()
+	uploadSpan.SetAttribute("upload.bytes", bundle.TarSize())
+	uploadSpan.SetAttribute("upload.partitions", bundle.Tb.Number())
+	uploadSpan.End()
+
 	// Stops backup and write/upload postgres `backup_label` and `tablespace_map` Files
+	stopSpan := span.StartChild("stop-backup")
 	finishLsn, err := bundle.HandleLabelFiles(conn)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return err
 	}
+	stopSpan.SetAttribute("backup.finish_lsn", finishLsn)
+	stopSpan.End()
 
 	timelineChanged := bundle.CheckTimelineChanged(conn)
 	var sentinel *S3TarBallSentinelDto
@@ -504,6 +1010,14 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 			LSN:              &lsn,
 			IncrementFromLSN: dto.LSN,
 			PgVersion:        pgVersion,
+			WalSegmentSize:   bundle.WalSegmentSize,
+			// Partitions are written by StartUpload with WALG_COMPRESSION_METHOD
+			CompressionMethod: getCompressionMethod(),
+			WrappedDataKey:    wrappedDataKey,
+			Tablespaces:       bundle.Tablespaces,
+		}
+		if sentinel.CompressionMethod == ZstdCompressionMethod {
+			sentinel.CompressionLevel = getZstdLevel()
 		}
 		if dto.LSN != nil {
 			sentinel.IncrementFrom = &latest
@@ -517,50 +1031,61 @@ func HandleBackupPush(dirArc string, tu *TarUploader, pre *Prefix) {
 		sentinel.SetFiles(bundle.GetFiles())
 		sentinel.FinishLSN = &finishLsn
 	}
+	if bundle.TornPages != nil && bundle.TornPages.Count() > 0 {
+		fmt.Printf("WARNING: %d pages were suspected to be torn while read, backup may be inconsistent.\n", bundle.TornPages.Count())
+		if sentinel != nil {
+			sentinel.TornPages = bundle.TornPages.Count()
+		}
+	}
 
 	// Wait for all uploads to finish.
+	sentinelSpan := span.StartChild("upload-sentinel")
 	err = bundle.Tb.Finish(sentinel)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return err
 	}
+	sentinelSpan.End()
+	getMetrics().ObservePushDuration("backup-push", time.Since(startPush))
+	return nil
 }
 
 // HandleWALFetch is invoked to performa wal-g wal-fetch
-func HandleWALFetch(pre *Prefix, walFileName string, location string, triggerPrefetch bool) {
+func HandleWALFetch(pre *Prefix, walFileName string, location string, triggerPrefetch bool) error {
 	location = ResolveSymlink(location)
+	logger := NewLogger("wal-fetch").With("wal_file", walFileName)
 	if triggerPrefetch {
 		defer forkPrefetch(walFileName, location)
 	}
+	// Segments are fetched in order, so prefetched ones before this are never asked for
+	if _, err := ParseWALFileName(walFileName); err == nil {
+		defer cleanupPrefetchDirectories(walFileName, path.Dir(location), FileSystemCleaner{})
+	}
 
 	_, _, running, prefetched := getPrefetchLocations(path.Dir(location), walFileName)
 	seenSize := int64(-1)
+	startFetch := time.Now()
 
 	for {
-		if stat, err := os.Stat(prefetched); err == nil {
-			if stat.Size() != int64(WalSegmentSize) {
-				log.Println("WAL-G: Prefetch error: wrong file size of prefetched file ", stat.Size())
+		// Prefetcher renames file to prefetched only after it is fully written and validated
+		if _, err := os.Stat(prefetched); err == nil {
+			err = checkWALFile(prefetched, getWALDirPgVersion(path.Dir(location)))
+			if err != nil {
+				logger.Warnf("Prefetched file contain errors %v", err)
+				os.Remove(prefetched)
 				break
 			}
 
 			err = os.Rename(prefetched, location)
 			if err != nil {
-				log.Fatalf("%+v\n", err)
-			}
-
-			err := checkWALFileMagic(location)
-			if err != nil {
-				log.Println("Prefetched file contain errors", err)
-				os.Remove(location)
-				break
+				return errors.Wrap(err, "HandleWALFetch: failed to move prefetched file")
 			}
+			getMetrics().ObserveFetchDuration("wal-fetch", time.Since(startFetch))
 
-			return
+			return nil
 		} else if !os.IsNotExist(err) {
-			log.Fatalf("%+v\n", err)
+			return errors.Wrap(err, "HandleWALFetch: failed to check prefetched file")
 		}
 
-		// We have race condition here, if running is renamed here, but it's OK
-
 		if runStat, err := os.Stat(running); err == nil {
 			observedSize := runStat.Size() // If there is no progress in 50 ms - start downloading myself
 			if observedSize <= seenSize {
@@ -572,6 +1097,10 @@ func HandleWALFetch(pre *Prefix, walFileName string, location string, triggerPre
 			}
 			seenSize = observedSize
 		} else if os.IsNotExist(err) {
+			// Running file could have been renamed to prefetched right after we looked for it
+			if _, err := os.Stat(prefetched); err == nil {
+				continue
+			}
 			break // Normal startup path
 		} else {
 			break // Abnormal path. Permission denied etc. Yes, I know that previous 'else' can be eliminated.
@@ -579,108 +1108,130 @@ func HandleWALFetch(pre *Prefix, walFileName string, location string, triggerPre
 		time.Sleep(50 * time.Millisecond)
 	}
 
-	DownloadWALFile(pre, walFileName, location)
-}
-
-func checkWALFileMagic(prefetched string) error {
-	file, err := os.Open(prefetched)
+	found, err := DownloadWALFile(pre, walFileName, location)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	magic := make([]byte, 4)
-	file.Read(magic)
-	if binary.LittleEndian.Uint32(magic) < 0xD061 {
-		return errors.New("WAL-G: WAL file magic is invalid ")
+	if !found {
+		return ArchiveNonExistenceError{walFileName}
 	}
-
+	getMetrics().ObserveFetchDuration("wal-fetch", time.Since(startFetch))
 	return nil
 }
 
-// DownloadWALFile downloads a file and writes it to local file
-func DownloadWALFile(pre *Prefix, walFileName string, location string) {
-	a := &Archive{
-		Prefix:  pre,
-		Archive: aws.String(sanitizePath(*pre.Server + "/wal_005/" + walFileName + ".lzo")),
+// DownloadWALFile downloads a file and writes it to local file.
+// Returns false if there is no such WAL file in storage.
+// File whose checksum does not match one recorded by wal-push is removed and downloaded again.
+func DownloadWALFile(pre *Prefix, walFileName string, location string) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		found, err := downloadWALFileOnce(pre, walFileName, location)
+		mismatch, ok := err.(WALChecksumMismatchError)
+		if !ok || attempt == walChecksumAttempts {
+			return found, err
+		}
+		NewLogger("wal-fetch").With("wal_file", walFileName).Warnf("%v, downloading again", mismatch)
 	}
-	// Check existence of compressed LZO WAL file
-	exists, err := a.CheckExistence()
+}
+
+func downloadWALFileOnce(pre *Prefix, walFileName string, location string) (bool, error) {
+	logger := NewLogger("wal-fetch").With("wal_file", walFileName)
+	// Check existence of WAL file compressed with any of codecs
+	a, err := getWALArchive(pre, walFileName)
 	if err != nil {
-		log.Fatalf("%+v\n", err)
+		return false, err
+	}
+	if a == nil {
+		logger.Printf("Archive '%s' does not exist.\n", walFileName)
+		return false, nil
 	}
-	var crypter = OpenPGPCrypter{}
-	if exists {
-		arch, err := a.GetArchive()
-		if err != nil {
-			log.Fatalf("%+v\n", err)
-		}
 
-		if crypter.IsUsed() {
-			var reader io.Reader
-			reader, err = crypter.Decrypt(arch)
-			if err != nil {
-				log.Fatalf("%v\n", err)
-			}
-			arch = ReadCascadeClose{reader, arch}
-		}
+	arch, err := a.GetArchive()
+	if err != nil {
+		return false, err
+	}
+	defer arch.Close()
 
-		f, err := os.Create(location)
+	crypter := NewCrypter()
+	var reader io.Reader = arch
+	if crypter.IsUsed() {
+		reader, err = crypter.Decrypt(arch)
 		if err != nil {
-			log.Fatalf("%v\n", err)
+			return false, errors.Wrap(err, "DownloadWALFile: failed to decrypt")
 		}
+	}
 
-		err = DecompressLzo(f, arch)
+	f, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0666)
+	if err != nil {
+		return false, errors.Wrap(err, "DownloadWALFile: failed to create file")
+	}
+	defer f.Close()
+
+	checksum := newMemberChecksum()
+	size, err := GetDecompressor(CheckType(*a.Archive)).Decompress(io.MultiWriter(f, checksum), reader)
+	if err != nil {
+		return false, err
+	}
+	// History and backup label files are small by nature, only segments are checked
+	if _, err := ParseWALFileName(walFileName); err == nil {
+		// Size of segments is chosen at initdb since Postgres 11, first page of segment records it
+		segmentSize, err := getExpectedWALSegmentSize(f)
 		if err != nil {
-			log.Fatalf("%+v\n", err)
+			return false, errors.Wrap(err, "DownloadWALFile: failed to read WAL page header")
 		}
-		f.Close()
-	} else if !exists {
-		// Check existence of compressed LZ4 WAL file
-		a.Archive = aws.String(sanitizePath(*pre.Server + "/wal_005/" + walFileName + ".lz4"))
-		exists, err = a.CheckExistence()
+		if size != int64(segmentSize) {
+			return false, errors.Errorf("Download WAL error: wrong size %d", size)
+		}
+	} else if _, err := ParseTimelineHistoryFileName(walFileName); err == nil {
+		// History is text without WAL page magic, Postgres follows it to switch timelines
+		err = checkTimelineHistoryFile(f)
 		if err != nil {
-			log.Fatalf("%+v\n", err)
+			return false, err
 		}
+	}
+	expected, recorded, err := readWALChecksum(pre, walFileName)
+	if err != nil {
+		return false, err
+	}
+	if recorded && expected != checksum.Sum32() {
+		f.Close()
+		os.Remove(location)
+		return true, WALChecksumMismatchError{walFileName, expected, checksum.Sum32()}
+	}
+	err = f.Close()
+	if err != nil {
+		return false, errors.Wrap(err, "DownloadWALFile: failed to close file")
+	}
+	return true, nil
+}
 
-		if exists {
-			arch, err := a.GetArchive()
-			if err != nil {
-				log.Fatalf("%+v\n", err)
-			}
-
-			if crypter.IsUsed() {
-				var reader io.Reader
-				reader, err = crypter.Decrypt(arch)
-				if err != nil {
-					log.Fatalf("%v\n", err)
-				}
-				arch = ReadCascadeClose{reader, arch}
-			}
-
-			f, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0666)
-			if err != nil {
-				log.Fatalf("%v\n", err)
-			}
-
-			size, err := DecompressLz4(f, arch)
-			if err != nil {
-				log.Fatalf("%+v\n", err)
-			}
-			if size != int64(WalSegmentSize) {
-				log.Fatal("Download WAL error: wrong size ", size)
-			}
-			err = f.Close()
-			if err != nil {
-				log.Fatalf("%+v\n", err)
-			}
-		} else {
-			log.Printf("Archive '%s' does not exist.\n", walFileName)
-		}
+// GetWALMissingExitCode returns exit code of wal-fetch for WAL absent in storage.
+// Zero, the default, tells Postgres that archive has ended.
+func GetWALMissingExitCode() int {
+	codeStr, ok := os.LookupEnv("WALG_WAL_MISSING_EXIT_CODE")
+	if !ok {
+		return 0
+	}
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || code < 0 || code > 255 {
+		log.Fatal("Unable to parse WALG_WAL_MISSING_EXIT_CODE ", codeStr)
 	}
+	return code
 }
 
 // HandleWALPush is invoked to perform wal-g wal-push
 func HandleWALPush(tu *TarUploader, dirArc string, pre *Prefix, verify bool) {
+	logger := NewLogger("wal-push").With("wal_file", filepath.Base(dirArc))
+	if queueDir := GetWALPushQueue(); queueDir != "" {
+		// Report success as soon as segment is durably queued, upload happens in background
+		err := EnqueueWAL(queueDir, dirArc)
+		if err != nil {
+			fatalUploadFailure(logger, "%+v\n", err)
+		}
+		forkWALPushDrain(queueDir, verify)
+		return
+	}
+
+	startPush := time.Now()
 	bu := BgUploader{}
 	// Look for new WALs while doing main upload
 	bu.Start(dirArc, int32(getMaxUploadConcurrency(16)-1), tu, pre, verify)
@@ -688,15 +1239,20 @@ func HandleWALPush(tu *TarUploader, dirArc string, pre *Prefix, verify bool) {
 	UploadWALFile(tu, dirArc, pre, verify)
 
 	bu.Stop()
+	getMetrics().ObservePushDuration("wal-push", time.Since(startPush))
 }
 
 // UploadWALFile from FS to the cloud
 func UploadWALFile(tu *TarUploader, dirArc string, pre *Prefix, verify bool) {
+	logger := NewLogger("wal-push").With("wal_file", filepath.Base(dirArc))
 	path, err := tu.UploadWal(dirArc, pre, verify)
 	if re, ok := err.(Lz4Error); ok {
-		log.Fatalf("FATAL: could not upload '%s' due to compression error.\n%+v\n", path, re)
+		fatalUploadFailure(logger, "FATAL: could not upload '%s' due to compression error.\n%+v\n", path, re)
 	} else if err != nil {
-		log.Printf("upload: could not upload '%s'\n", path)
-		log.Fatalf("FATAL%+v\n", err)
+		logger.Warnf("upload: could not upload '%s'\n", path)
+		fatalUploadFailure(logger, "FATAL%+v\n", err)
+	}
+	if _, err := ParseWALFileName(filepath.Base(dirArc)); err == nil {
+		getMetrics().IncWALSegmentsPushed()
 	}
 }
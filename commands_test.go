@@ -1,6 +1,15 @@
 package walg
 
-import "testing"
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestDeleteArgsParsingRetain(t *testing.T) {
 	var args DeleteCommandArguments
@@ -76,9 +85,345 @@ func TestDeleteArgsParsingBefore(t *testing.T) {
 	}
 }
 
+func TestDeleteArgsParsingRetainFor(t *testing.T) {
+	var args DeleteCommandArguments
+	command := []string{"delete", "retain_for", "7d", "3", "--confirm"}
+
+	if parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if args.retainFor != 7*24*time.Hour || args.minCount != 3 || args.dryrun || args.retain || args.before {
+		t.Fatal("Parsing was wrong")
+	}
+
+	command = []string{"delete", "retain_for", "36h", "1"}
+	if parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if args.retainFor != 36*time.Hour || args.minCount != 1 || !args.dryrun {
+		t.Fatal("Parsing was wrong")
+	}
+
+	for _, command := range [][]string{
+		{"delete", "retain_for", "7d"},
+		{"delete", "retain_for", "week", "3"},
+		{"delete", "retain_for", "7d", "0"},
+	} {
+		if !parseAndTestFail(command, &args) {
+			t.Fatalf("Parsing of delete comand parsed wrong input %v", command)
+		}
+	}
+}
+
+func TestDeleteArgsParsingRetainAfter(t *testing.T) {
+	var args DeleteCommandArguments
+	command := []string{"delete", "retain", "after", "base_20181017T120000Z_000000010000000000000008"}
+
+	if parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if !args.before || !args.findFull || args.retain || !args.dryrun || args.beforeTime != nil ||
+		args.target != "base_20181017T120000Z_000000010000000000000008" {
+		t.Fatal("Parsing was wrong")
+	}
+
+	command = []string{"delete", "retain", "after", "2018-10-17T12:00:00Z", "--confirm"}
+	if parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if args.beforeTime != nil || args.dryrun {
+		t.Fatal("Name of backup after retain after must not be parsed as time")
+	}
+
+	command = []string{"delete", "retain", "after"}
+	if !parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand did not fail without backup name")
+	}
+}
+
+func TestDeleteArgsParsingFlags(t *testing.T) {
+	var args DeleteCommandArguments
+	command := []string{"delete", "before", "FIND_FULL", "x", "--delete-orphans", "--confirm"}
+
+	if parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if !args.deleteOrphans || args.dryrun || args.target != "x" {
+		t.Fatal("Parsing was wrong")
+	}
+
+	command = []string{"delete", "retain_for", "7d", "3", "--delete-orphans"}
+	if parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if !args.deleteOrphans || !args.dryrun {
+		t.Fatal("Parsing was wrong")
+	}
+}
+
+func TestDeleteArgsParsingUntilWAL(t *testing.T) {
+	var args DeleteCommandArguments
+	command := []string{"delete", "retain", "5", "--until-wal=16", "--confirm"}
+
+	if parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if args.walGrace != 16 || args.dryrun || args.target != "5" {
+		t.Fatal("Parsing was wrong")
+	}
+
+	command = []string{"delete", "retain_for", "7d", "3", "--until-wal"}
+	if parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if args.walGrace != 0 {
+		t.Fatal("Parsing was wrong")
+	}
+
+	command = []string{"delete", "before", "x", "--until-wal=-1"}
+	if !parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand did not fail with negative number of segments")
+	}
+
+	command = []string{"delete", "retain", "5", "--until-wal", "16", "--confirm"}
+	if !parseAndTestFail(command, &args) {
+		t.Fatal("Parsing of delete comand did not fail with number of segments apart from --until-wal")
+	}
+}
+
+func TestDeleteArgsParsingUnknownFlags(t *testing.T) {
+	var args DeleteCommandArguments
+	for _, command := range [][]string{
+		{"delete", "retain", "5", "--no-wall", "--confirm"},
+		{"delete", "before", "FIND_FULL", "x", "--confirm", "--delete-orphan"},
+		{"delete", "retain_for", "7d", "3", "--confirm", "extra"},
+		{"delete", "retain", "after", "x", "--dryrun"},
+		{"delete", "everything", "--confrim"},
+	} {
+		if !parseAndTestFail(command, &args) {
+			t.Errorf("Parsing of delete comand %v did not fail with unknown argument", command)
+		}
+	}
+}
+
+func TestDeleteArgsParsingEverything(t *testing.T) {
+	var args DeleteCommandArguments
+	if parseAndTestFail([]string{"delete", "everything"}, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if !args.everything || !args.dryrun {
+		t.Fatal("Delete everything must be a dry run by default")
+	}
+	if parseAndTestFail([]string{"delete", "everything", "--confirm"}, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if !args.everything || args.dryrun {
+		t.Fatal("Parsing was wrong")
+	}
+	if args.force {
+		t.Fatal("Delete everything must not remove permanent backups by default")
+	}
+	args = DeleteCommandArguments{}
+	if parseAndTestFail([]string{"delete", "everything", "FORCE", "--confirm"}, &args) {
+		t.Fatal("Parsing of delete comand failed")
+	}
+	if !args.everything || !args.force || args.dryrun {
+		t.Fatal("Parsing of FORCE was wrong")
+	}
+	if !parseAndTestFail([]string{"delete", "everything", "--confirm", "FORCE"}, &args) {
+		t.Fatal("Parsing of delete comand did not fail with FORCE after flags")
+	}
+}
+
+func TestFindOrphanedBackups(t *testing.T) {
+	delta := func(from string, full string) S3TarBallSentinelDto {
+		lsn, count := uint64(1), 1
+		return S3TarBallSentinelDto{IncrementFrom: &from, IncrementFromLSN: &lsn, IncrementFullName: &full, IncrementCount: &count}
+	}
+	// Two deltas chain from the old full backup, pushed after a newer full backup
+	backups := []BackupTime{{Name: "delta_2"}, {Name: "delta_1"}, {Name: "full_new"}, {Name: "full_old"}, {Name: "full_oldest"}}
+	sentinels := map[string]S3TarBallSentinelDto{
+		"delta_2":  delta("delta_1", "full_old"),
+		"delta_1":  delta("full_old", "full_old"),
+		"full_new": {},
+	}
+
+	orphans := FindOrphanedBackups(backups, 2, sentinels)
+	if len(orphans) != 2 || orphans[0] != "delta_2" || orphans[1] != "delta_1" {
+		t.Errorf("delete: expected both deltas of deleted full backup orphaned but got %v", orphans)
+	}
+	sentinels["full_old"] = S3TarBallSentinelDto{}
+	if orphans := FindOrphanedBackups(backups, 3, sentinels); len(orphans) != 0 {
+		t.Errorf("delete: expected no orphans when base is kept but got %v", orphans)
+	}
+}
+
+func TestFindRetentionTarget(t *testing.T) {
+	now := time.Date(2018, 10, 17, 12, 0, 0, 0, time.UTC)
+	var backups []BackupTime
+	for _, age := range []time.Duration{1, 30, 200, 300, 400, 500} {
+		backups = append(backups, BackupTime{Name: fmt.Sprintf("base_%d", age), Time: now.Add(-age * time.Hour)})
+	}
+	cutoff := now.Add(-7 * 24 * time.Hour)
+
+	// Two recent backups and the newest one before the week are kept
+	if target := FindRetentionTarget(backups, cutoff, 1); target != 2 {
+		t.Errorf("retention: expected backups up to base_200 kept by age but got %d", target)
+	}
+	// Floor wins over age
+	if target := FindRetentionTarget(backups, cutoff, 5); target != 4 {
+		t.Errorf("retention: expected 5 backups kept by floor but got %d", target)
+	}
+	if target := FindRetentionTarget(backups, cutoff, 6); target != -1 {
+		t.Errorf("retention: expected all backups kept by floor but got %d", target)
+	}
+	if target := FindRetentionTarget(backups[:2], cutoff, 1); target != -1 {
+		t.Errorf("retention: expected recent backups kept but got %d", target)
+	}
+}
+
 func parseAndTestFail(command []string, arguments *DeleteCommandArguments) bool {
 	var failed bool
 	result := ParseDeleteArguments(command, func() { failed = true })
 	*arguments = result
 	return failed
 }
+
+func TestGetWALMissingExitCode(t *testing.T) {
+	defer os.Unsetenv("WALG_WAL_MISSING_EXIT_CODE")
+
+	os.Unsetenv("WALG_WAL_MISSING_EXIT_CODE")
+	if code := GetWALMissingExitCode(); code != 0 {
+		t.Errorf("Missing WAL must not be an error by default, got exit code %d", code)
+	}
+
+	os.Setenv("WALG_WAL_MISSING_EXIT_CODE", "74")
+	if code := GetWALMissingExitCode(); code != 74 {
+		t.Errorf("Expected exit code 74 but got %d", code)
+	}
+}
+
+func TestIsDirectoryEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore_target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, check := range []struct {
+		prepare func() error
+		empty   bool
+	}{
+		{func() error { return nil }, true},
+		{func() error { return os.Mkdir(filepath.Join(dir, "lost+found"), 0700) }, true},
+		{func() error { return ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("10\n"), 0600) }, false},
+	} {
+		err = check.prepare()
+		if err != nil {
+			t.Fatal(err)
+		}
+		empty, err := isDirectoryEmpty(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if empty != check.empty {
+			t.Errorf("empty: expected %v for %s", check.empty, dir)
+		}
+	}
+
+	empty, err := isDirectoryEmpty(filepath.Join(dir, "missing"))
+	if err != nil || !empty {
+		t.Errorf("empty: directory which does not exist must be empty, got %v %v", empty, err)
+	}
+}
+
+func TestCheckBackupFrequency(t *testing.T) {
+	now := time.Date(2018, 10, 17, 12, 0, 0, 0, time.UTC)
+	backups := []BackupTime{
+		{Name: "base_000000010000000000000004", Time: now.Add(-30 * time.Hour)},
+		{Name: "base_000000010000000000000008", Time: now.Add(-2 * time.Hour)},
+	}
+	if err := CheckBackupFrequency(backups, 24*time.Hour, now); err != nil {
+		t.Errorf("backup-list: fresh backup reported as stale: %v", err)
+	}
+	if err := CheckBackupFrequency(backups, time.Hour, now); err == nil || !strings.Contains(err.Error(), "base_000000010000000000000008") {
+		t.Errorf("backup-list: expected stale latest backup to be reported, got %v", err)
+	}
+	if err := CheckBackupFrequency(nil, time.Hour, now); err != ErrLatestNotFound {
+		t.Errorf("backup-list: expected no backups to be an error, got %v", err)
+	}
+}
+
+func TestNewBackupListEntries(t *testing.T) {
+	now := time.Date(2018, 10, 17, 12, 0, 0, 0, time.UTC)
+	backups := []BackupTime{
+		{Name: "base_000000010000000000000004", Time: now.Add(-30 * time.Hour), WalFileName: "000000010000000000000004"},
+		{Name: "base_000000010000000000000008_D_000000010000000000000004", Time: now, WalFileName: "000000010000000000000008"},
+	}
+	start, finish, count := uint64(0x8000028), uint64(0x9000100), 1
+	full, base := backups[0].Name, backups[0].Name
+	sentinels := map[string]S3TarBallSentinelDto{
+		backups[0].Name: {},
+		backups[1].Name: {LSN: &start, FinishLSN: &finish, PgVersion: 100005,
+			IncrementFrom: &base, IncrementFromLSN: &start, IncrementFullName: &full, IncrementCount: &count},
+	}
+
+	data, err := json.Marshal(NewBackupListEntries(backups, sentinels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0]["name"] != backups[1].Name || entries[1]["name"] != backups[0].Name {
+		t.Fatalf("backup-list: expected the newest backup first, got %s", data)
+	}
+	if entries[0]["is_incremental"] != true || entries[0]["delta_from"] != base || entries[0]["start_lsn"] != "8000028" ||
+		entries[0]["last_modified"] != "2018-10-17T12:00:00Z" || entries[0]["wal_segment_backup_start"] != "000000010000000000000008" {
+		t.Errorf("backup-list: unexpected entry of delta %s", data)
+	}
+	if _, ok := entries[1]["start_lsn"]; ok || entries[1]["is_incremental"] != false {
+		t.Errorf("backup-list: unexpected entry of backup without LSNs %s", data)
+	}
+}
+
+func TestMoveSkippedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg_move_skipped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	incrementBase := filepath.Join(dir, "increment_base")
+	var names []string
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("base/%d/%d", 16384+i%7, i)
+		names = append(names, name)
+		os.MkdirAll(filepath.Dir(filepath.Join(incrementBase, name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(incrementBase, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	if err := moveSkippedFiles(incrementBase, dir, names, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("moved %d files in %v", len(names), time.Since(start))
+	for _, name := range names {
+		if content, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(content) != name {
+			t.Fatalf("moveSkippedFiles: %s is not moved: %q", name, content)
+		}
+	}
+
+	// Files moved by interrupted fetch are missing in increment base
+	if err := moveSkippedFiles(incrementBase, dir, names[:10], true); err != nil {
+		t.Errorf("moveSkippedFiles: resumed move failed: %v", err)
+	}
+	if err := moveSkippedFiles(incrementBase, dir, names[:10], false); err == nil {
+		t.Errorf("moveSkippedFiles: move of missing files succeeded")
+	}
+	if err := moveSkippedFiles(incrementBase, dir, []string{"increment_base/base/1/1"}, false); err == nil {
+		t.Errorf("moveSkippedFiles: moved file into increment base")
+	}
+}
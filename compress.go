@@ -1,19 +1,98 @@
 package walg
 
 import (
-	"github.com/pierrec/lz4"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"io"
+	"log"
+	"os"
+	"strconv"
 )
 
+// Level of zstd compression without WALG_ZSTD_LEVEL, the default of zstd tool
+const defaultZstdLevel = 3
+
+// getCompressionMethod reads WALG_COMPRESSION_METHOD of new backups and WAL, LZ4 by default
+func getCompressionMethod() string {
+	method, err := parseCompressionMethod()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return method
+}
+
+func parseCompressionMethod() (string, error) {
+	method, ok := os.LookupEnv("WALG_COMPRESSION_METHOD")
+	if !ok || method == "" {
+		return Lz4CompressionMethod, nil
+	}
+	if _, ok := compressors[method]; !ok {
+		return "", errors.Errorf("WALG_COMPRESSION_METHOD must be one of %s, got %s", compressionMethods(), method)
+	}
+	return method, nil
+}
+
+// getZstdLevel reads WALG_ZSTD_LEVEL, levels 1-22 of zstd tool
+func getZstdLevel() int {
+	level, err := parseZstdLevel()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return level
+}
+
+func parseZstdLevel() (int, error) {
+	levelStr, ok := os.LookupEnv("WALG_ZSTD_LEVEL")
+	if !ok {
+		return defaultZstdLevel, nil
+	}
+	level, err := strconv.Atoi(levelStr)
+	if err != nil {
+		return 0, errors.Wrap(err, "Unable to parse WALG_ZSTD_LEVEL")
+	}
+	if level < 1 || level > 22 {
+		return 0, errors.Errorf("WALG_ZSTD_LEVEL must be from 1 to 22, got %d", level)
+	}
+	return level, nil
+}
+
+// checkCompressionSettings reports invalid compression settings, which otherwise exit once the first writer is made
+func checkCompressionSettings() error {
+	if _, err := parseCompressionMethod(); err != nil {
+		return err
+	}
+	if _, err := parseZstdLevel(); err != nil {
+		return err
+	}
+	if _, err := parseLz4BlockSize(); err != nil {
+		return err
+	}
+	if _, err := parseLz4HighCompression(); err != nil {
+		return err
+	}
+	_, err := parseCompressionThreads()
+	return err
+}
+
+// newZstdWriter creates zstd writer of WALG_ZSTD_LEVEL
+func newZstdWriter(dst io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(dst,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(getZstdLevel())),
+		zstd.WithEncoderConcurrency(getCompressionThreads()))
+}
+
 // Lz4CascadeClose bundles multiple closures
 // into one function. Calling Close() will close the
 // lz4 and underlying writer.
 type Lz4CascadeClose struct {
-	*lz4.Writer
+	Writer     io.WriteCloser
 	Underlying io.WriteCloser
 }
 
+func (lcc *Lz4CascadeClose) Write(p []byte) (int, error) {
+	return lcc.Writer.Write(p)
+}
+
 // Close returns the first encountered error from closing
 // the lz4 writer or the underlying writer.
 func (lcc *Lz4CascadeClose) Close() error {
@@ -31,11 +110,15 @@ func (lcc *Lz4CascadeClose) Close() error {
 // Lz4CascadeClose2 cascade closers with two independent closers.
 // This peculiar behavior is required to handle OpenGPG Writer behavior
 type Lz4CascadeClose2 struct {
-	*lz4.Writer
+	Writer      io.WriteCloser
 	Underlying  io.WriteCloser
 	Underlying2 io.WriteCloser
 }
 
+func (lcc *Lz4CascadeClose2) Write(p []byte) (int, error) {
+	return lcc.Writer.Write(p)
+}
+
 // Close returns the first encountered error from closing
 // the lz4 writer or the underlying writer.
 func (lcc *Lz4CascadeClose2) Close() error {
@@ -78,20 +161,20 @@ func (p *LzPipeWriter) Compress(crypter Crypter) {
 	}
 
 	w := &EmptyWriteIgnorer{wc}
-	lzw := lz4.NewWriter(w)
+	lzw := newCompressingWriter(w)
 
 	go func() {
-		_, err := lzw.ReadFrom(p.Input)
+		_, err := io.Copy(lzw, p.Input)
 
 		if err != nil {
-			e := Lz4Error{errors.Wrap(err, "Compress: lz4 compression failed")}
+			e := Lz4Error{errors.Wrap(err, "Compress: compression failed")}
 			pw.CloseWithError(e)
 		}
 
 		defer func() {
 			if err == nil {
 				if err := lzw.Close(); err != nil {
-					e := Lz4Error{errors.Wrap(err, "Compress: lz4 writer close failed")}
+					e := Lz4Error{errors.Wrap(err, "Compress: compressing writer close failed")}
 					pw.CloseWithError(e)
 				} else {
 					if crypter.IsUsed() {
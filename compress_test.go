@@ -3,11 +3,14 @@ package walg_test
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"github.com/pierrec/lz4"
 	"github.com/wal-g/wal-g"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -198,3 +201,109 @@ func TestLzPipeWriterError(t *testing.T) {
 		t.Errorf("compress: LzPipeWriter expected Lz4Error but got %v", re)
 	}
 }
+
+func TestParallelLz4Writer(t *testing.T) {
+	// Several blocks of compressible and random data with incomplete last block
+	var b []byte
+	for i := 0; i < 5; i++ {
+		b = append(b, bytes.Repeat([]byte("wal-g"), 400000)...)
+		random := make([]byte, 1000000)
+		rand.Read(random)
+		b = append(b, random...)
+	}
+
+	for _, content := range [][]byte{b, []byte("small"), nil} {
+		compressed := &bytes.Buffer{}
+		w := walg.NewParallelLz4Writer(compressed, 4)
+		// Odd chunks to cross block boundaries
+		for i := 0; i < len(content); i += 777777 {
+			end := i + 777777
+			if end > len(content) {
+				end = len(content)
+			}
+			if _, err := w.Write(content[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		decompressed, err := ioutil.ReadAll(lz4.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("compress: parallel LZ4 frame of %d bytes is not readable: %v", len(content), err)
+		}
+		if !bytes.Equal(content, decompressed) {
+			t.Errorf("compress: parallel LZ4 frame of %d bytes decompressed to %d different bytes", len(content), len(decompressed))
+		}
+	}
+}
+
+func TestParallelLz4WriterError(t *testing.T) {
+	w := walg.NewParallelLz4Writer(&ErrorWriteCloser{}, 2)
+	w.Write(make([]byte, 5<<20))
+	if err := w.Close(); err == nil {
+		t.Errorf("compress: ParallelLz4Writer expected error of underlying writer but got `<nil>`")
+	}
+}
+
+func TestLz4HighCompressionWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lz4hc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Records of text with random ids, compressible like real WAL
+	wal := make([]byte, 0, walg.WalSegmentSize)
+	for len(wal) < int(walg.WalSegmentSize) {
+		wal = append(wal, fmt.Sprintf("INSERT INTO backups VALUES (%d, 'wal-g');", rand.Intn(100000))...)
+	}
+	wal = wal[:walg.WalSegmentSize]
+	walName := "000000010000000000000003"
+	err = ioutil.WriteFile(filepath.Join(dir, walName), wal, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	push := func(env map[string]string) *mapStorage {
+		for name, value := range env {
+			os.Setenv(name, value)
+			defer os.Unsetenv(name)
+		}
+		storage := &mapStorage{objects: make(map[string][]byte)}
+		tu, pre := walg.ConfigureStorageBackend(storage, "server")
+		_, err := tu.UploadWal(filepath.Join(dir, walName), pre, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		location := filepath.Join(dir, "fetched")
+		defer os.Remove(location)
+		if found, err := walg.DownloadWALFile(pre, walName, location); err != nil || !found {
+			t.Fatalf("compress: WAL pushed with %v is not found", env)
+		}
+		fetched, err := ioutil.ReadFile(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(wal, fetched) {
+			t.Errorf("compress: WAL pushed with %v decompressed to %d different bytes", env, len(fetched))
+		}
+		return storage
+	}
+
+	key := "server/wal_005/" + walName + ".lz4"
+	fast := push(nil)
+	for _, threads := range []string{"1", "4"} {
+		hc := push(map[string]string{
+			"WALG_LZ4_HC":              "true",
+			"WALG_LZ4_BLOCK_SIZE":      "65536",
+			"WALG_COMPRESSION_THREADS": threads,
+		})
+		if len(hc.objects[key]) >= len(fast.objects[key]) {
+			t.Errorf("compress: expected HC mode of %s threads to compress better than %d bytes but got %d",
+				threads, len(fast.objects[key]), len(hc.objects[key]))
+		}
+	}
+}
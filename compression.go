@@ -0,0 +1,126 @@
+package walg
+
+import (
+	"io"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Decompressor reads objects of one file format, which is the extension of their keys
+type Decompressor interface {
+	// Decompress writes content of src to dst and returns number of written bytes
+	Decompress(dst io.Writer, src io.Reader) (int64, error)
+	FileExtension() string
+}
+
+// Compressor creates writers of new backups and WAL of one compression method
+type Compressor interface {
+	NewWriter(dst io.Writer) io.WriteCloser
+}
+
+var (
+	// Decompressors in order of registration, WAL files are looked up in this order
+	decompressors []Decompressor
+	compressors   = make(map[string]Compressor)
+	methodFormats = make(map[string]string)
+)
+
+// RegisterCodec makes objects of decompressor's extension readable and, unless compressor
+// is nil, method selectable with WALG_COMPRESSION_METHOD. Methods kept only to read old
+// objects, like LZO of WAL-E, have no compressor.
+func RegisterCodec(method string, compressor Compressor, decompressor Decompressor) {
+	decompressors = append(decompressors, decompressor)
+	methodFormats[method] = decompressor.FileExtension()
+	if compressor != nil {
+		compressors[method] = compressor
+	}
+}
+
+// GetDecompressor returns decompressor of file format, nil if format is unknown
+func GetDecompressor(format string) Decompressor {
+	for _, decompressor := range decompressors {
+		if decompressor.FileExtension() == format {
+			return decompressor
+		}
+	}
+	return nil
+}
+
+// compressionFileFormat gives extension of objects compressed with method
+func compressionFileFormat(method string) string {
+	if format, ok := methodFormats[method]; ok {
+		return format
+	}
+	return method
+}
+
+// compressionMethods lists methods which new objects may be compressed with
+func compressionMethods() string {
+	var methods []string
+	for method := range compressors {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+// newCompressingWriter creates writer of WALG_COMPRESSION_METHOD
+func newCompressingWriter(dst io.Writer) io.WriteCloser {
+	return compressors[getCompressionMethod()].NewWriter(dst)
+}
+
+type lzoCodec struct{}
+
+func (lzoCodec) Decompress(dst io.Writer, src io.Reader) (int64, error) {
+	counter := &writeCounter{Writer: dst}
+	err := DecompressLzo(counter, src)
+	return counter.n, err
+}
+
+func (lzoCodec) FileExtension() string { return LzoCompressionMethod }
+
+type lz4Codec struct{}
+
+func (lz4Codec) NewWriter(dst io.Writer) io.WriteCloser { return newLz4Writer(dst) }
+
+func (lz4Codec) Decompress(dst io.Writer, src io.Reader) (int64, error) {
+	return DecompressLz4(dst, src)
+}
+
+func (lz4Codec) FileExtension() string { return Lz4CompressionMethod }
+
+type zstdCodec struct{}
+
+func (zstdCodec) NewWriter(dst io.Writer) io.WriteCloser {
+	zw, err := newZstdWriter(dst)
+	if err != nil {
+		log.Fatal("Unable to create zstd writer ", err)
+	}
+	return zw
+}
+
+func (zstdCodec) Decompress(dst io.Writer, src io.Reader) (int64, error) {
+	return DecompressZstd(dst, src)
+}
+
+func (zstdCodec) FileExtension() string { return ZstdFileFormat }
+
+// writeCounter counts bytes written to Writer
+type writeCounter struct {
+	io.Writer
+	n int64
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func init() {
+	// LZO is tried first on lookup of WAL files, as it always was
+	RegisterCodec(LzoCompressionMethod, nil, lzoCodec{})
+	RegisterCodec(Lz4CompressionMethod, lz4Codec{}, lz4Codec{})
+	RegisterCodec(ZstdCompressionMethod, zstdCodec{}, zstdCodec{})
+}
@@ -0,0 +1,80 @@
+package walg_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+// gzipCodec shows that a codec is added with one registration
+type gzipCodec struct{}
+
+func (gzipCodec) NewWriter(dst io.Writer) io.WriteCloser { return gzip.NewWriter(dst) }
+
+func (gzipCodec) Decompress(dst io.Writer, src io.Reader) (int64, error) {
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, zr)
+}
+
+func (gzipCodec) FileExtension() string { return "gz" }
+
+func TestGetDecompressor(t *testing.T) {
+	for _, format := range []string{"lzo", "lz4", "zst"} {
+		decompressor := walg.GetDecompressor(format)
+		if decompressor == nil || decompressor.FileExtension() != format {
+			t.Errorf("compression: expected decompressor of %s but got %v", format, decompressor)
+		}
+	}
+	for _, format := range []string{"tar", "gzip", ""} {
+		if decompressor := walg.GetDecompressor(format); decompressor != nil {
+			t.Errorf("compression: expected no decompressor of %s but got %v", format, decompressor)
+		}
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	walg.RegisterCodec("gzip", gzipCodec{}, gzipCodec{})
+	os.Setenv("WALG_COMPRESSION_METHOD", "gzip")
+	defer os.Unsetenv("WALG_COMPRESSION_METHOD")
+
+	dir, err := ioutil.TempDir("", "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walName := "000000010000000000000004"
+	wal := make([]byte, walg.WalSegmentSize)
+	copy(wal, "gzip")
+	err = ioutil.WriteFile(filepath.Join(dir, walName), wal, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "server")
+	key, err := tu.UploadWal(filepath.Join(dir, walName), pre, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "server/wal_005/"+walName+".gz" {
+		t.Errorf("compression: expected WAL key with extension of registered codec but got %s", key)
+	}
+
+	location := filepath.Join(dir, "fetched")
+	if found, err := walg.DownloadWALFile(pre, walName, location); err != nil || !found {
+		t.Fatalf("compression: WAL of registered codec is not found")
+	}
+	fetched, _ := ioutil.ReadFile(location)
+	if !bytes.Equal(wal, fetched) {
+		t.Errorf("compression: fetched WAL differs from uploaded one")
+	}
+}
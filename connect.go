@@ -61,7 +61,7 @@ func (b *Bundle) StartBackup(conn *pgx.Conn, backup string) (backupName string,
 	var name, lsnStr string
 	queryRunner, err := NewPgQueryRunner(conn)
 	if err != nil {
-		return "", 0, queryRunner.Version, errors.Wrap(err, "StartBackup: Failed to build query runner.")
+		return "", 0, 0, errors.Wrap(err, "StartBackup: Failed to build query runner.")
 	}
 	name, lsnStr, b.Replica, err = queryRunner.StartBackup(backup)
 
@@ -71,7 +71,11 @@ func (b *Bundle) StartBackup(conn *pgx.Conn, backup string) (backupName string,
 	lsn, err = ParseLsn(lsnStr)
 
 	if b.Replica {
-		name, b.Timeline, err = WALFileName(lsn, conn)
+		walSegmentSize := b.WalSegmentSize
+		if walSegmentSize == 0 {
+			walSegmentSize = WalSegmentSize
+		}
+		name, b.Timeline, err = WALFileName(lsn, walSegmentSize, conn)
 		if err != nil {
 			return "", 0, queryRunner.Version, err
 		}
@@ -0,0 +1,166 @@
+package walg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// CopyAllBackups is the backup name which makes wal-g copy take every backup of the source
+const CopyAllBackups = "ALL"
+
+// HandleCopy is invoked to perform wal-g copy. It copies backup of srcPre to dstPre,
+// written by dstTu, under the same names, so the destination lists and fetches it
+// like the source did. With withBases, bases of delta backup are copied too; ALL
+// copies every backup.
+// Objects are streamed as is, the destination needs the same encryption keys.
+// Backups whose sentinel is already in the destination are skipped, so an
+// interrupted copy can be repeated.
+func HandleCopy(srcPre *Prefix, dstTu *TarUploader, dstPre *Prefix, backupName string, withBases bool) error {
+	bk := &Backup{Prefix: srcPre, Path: GetBackupPath(srcPre)}
+	names, err := getCopiedBackups(bk, backupName, withBases)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		dstSentinel := *GetBackupPath(dstPre) + name + SentinelSuffix
+		exists, err := dstPre.Storage().Exists(dstSentinel)
+		if err != nil {
+			return errors.Wrapf(err, "HandleCopy: failed to check %s in destination", name)
+		}
+		if exists {
+			fmt.Printf("%v is already in destination, skipped\n", name)
+			continue
+		}
+		err = copyBackup(srcPre, dstTu, dstPre, name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%v is copied\n", name)
+	}
+
+	if !withBases && backupName != CopyAllBackups && len(names) == 1 {
+		warnMissingCopyBase(bk, dstPre, names[0])
+	}
+	return nil
+}
+
+// getCopiedBackups lists names of backups copied by HandleCopy. Bases precede
+// their deltas, so the destination never has a delta without its base.
+func getCopiedBackups(bk *Backup, backupName string, withBases bool) ([]string, error) {
+	if backupName == CopyAllBackups {
+		backups, err := bk.GetBackups()
+		if err != nil {
+			return nil, err
+		}
+		// Backups are sorted newest first, bases are always older than deltas
+		names := make([]string, 0, len(backups))
+		for i := len(backups) - 1; i >= 0; i-- {
+			names = append(names, backups[i].Name)
+		}
+		return names, nil
+	}
+
+	if backupName == "LATEST" {
+		latest, err := bk.GetLatest()
+		if err != nil {
+			return nil, err
+		}
+		backupName = latest
+	}
+	bk.Name = aws.String(backupName)
+	bk.Js = aws.String(*bk.Path + backupName + SentinelSuffix)
+	exists, err := bk.CheckExistence()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, BackupNonExistenceError{backupName}
+	}
+	if !withBases {
+		return []string{backupName}, nil
+	}
+
+	chain := []string{backupName}
+	for name := backupName; ; {
+		dto, err := readSentinel(name, bk, bk.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		if dto.IncrementFrom == nil {
+			break
+		}
+		name = *dto.IncrementFrom
+		chain = append([]string{name}, chain...)
+	}
+	return chain, nil
+}
+
+// copyBackup streams all objects in folder of backup, then its sentinel. Sentinel
+// is written last, so the destination does not list backup until it is complete.
+func copyBackup(srcPre *Prefix, dstTu *TarUploader, dstPre *Prefix, name string) error {
+	srcPath := *GetBackupPath(srcPre)
+	dstPath := *GetBackupPath(dstPre)
+	objects, err := srcPre.Storage().ListAll(srcPath + name + "/")
+	if err != nil {
+		return errors.Wrapf(err, "copyBackup: failed to list objects of %s", name)
+	}
+	keys := make(chan string)
+	errs := make(chan error)
+	workers := getMaxUploadConcurrency(min(len(objects)+1, 10))
+	for i := 0; i < workers; i++ {
+		// Each worker writes through its own uploader, clones share only rate limiter and checksums
+		tu := dstTu.Clone()
+		go func() {
+			for key := range keys {
+				errs <- copyObject(srcPre, tu, key, dstPath+strings.TrimPrefix(key, srcPath))
+			}
+		}()
+	}
+	go func() {
+		for _, object := range objects {
+			keys <- object.Key
+		}
+		close(keys)
+	}()
+
+	var firstErr error
+	for range objects {
+		err := <-errs
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return copyObject(srcPre, dstTu, srcPath+name+SentinelSuffix, dstPath+name+SentinelSuffix)
+}
+
+func copyObject(srcPre *Prefix, dstTu *TarUploader, srcKey, dstKey string) error {
+	reader, err := srcPre.Storage().GetArchive(srcKey)
+	if err != nil {
+		return errors.Wrapf(err, "copyObject: failed to read %s", srcKey)
+	}
+	defer reader.Close()
+	err = dstTu.put(dstKey, reader)
+	if err != nil {
+		return errors.Wrapf(err, "copyObject: failed to write %s", dstKey)
+	}
+	return nil
+}
+
+// warnMissingCopyBase reports delta copied without --with-bases when its base is not in destination
+func warnMissingCopyBase(bk *Backup, dstPre *Prefix, name string) {
+	dto, err := readSentinel(name, bk, bk.Prefix)
+	if err != nil || dto.IncrementFrom == nil {
+		return
+	}
+	exists, err := dstPre.Storage().Exists(*GetBackupPath(dstPre) + *dto.IncrementFrom + SentinelSuffix)
+	if err == nil && !exists {
+		fmt.Printf("WARNING: base %v of %v is not in destination, copy it with --with-bases to restore\n", *dto.IncrementFrom, name)
+	}
+}
@@ -2,11 +2,14 @@ package walg
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/json"
-	"errors"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"os/user"
@@ -14,25 +17,39 @@ import (
 	"strings"
 )
 
-// Crypter is responsible for makeing cryptographical pipeline parts when needed
+// Crypter is responsible for makeing cryptographical pipeline parts when needed.
+// Data key of a backup is generated by GenerateDataKey, kept in the sentinel wrapped
+// by the long-term key, and after SetDataKey used by Encrypt and Decrypt instead of the long-term key.
 type Crypter interface {
 	IsUsed() bool
 	Encrypt(writer io.WriteCloser) (io.WriteCloser, error)
 	Decrypt(reader io.ReadCloser) (io.Reader, error)
+	GenerateDataKey() ([]byte, error)
+	WrapDataKey(key []byte) ([]byte, error)
+	UnwrapDataKey(wrapped []byte) ([]byte, error)
+	SetDataKey(key []byte)
 }
 
 // OpenPGPCrypter incapsulates specific of cypher method
 // Includes keys, infrastructutre information etc
-// If many encryption methods will be used it worth
-// to extract interface
 type OpenPGPCrypter struct {
 	configured, armed bool
 	keyRingId         string
+	// keyPaths are armored key files of WALG_PGP_KEY_PATH and WALG_PGP_KEYS, they override keyRingId
+	keyPaths []string
 
 	pubKey    openpgp.EntityList
 	secretKey openpgp.EntityList
+
+	// dataKey is symmetric key of one backup, nil if objects are encrypted to pubKey
+	dataKey []byte
 }
 
+const dataKeySize = 32
+
+// dataKeyConfig encrypts objects with data key by AES-256
+var dataKeyConfig = &packet.Config{DefaultCipher: packet.CipherAES256}
+
 // IsUsed is to check necessity of Crypter use
 // Must be called prior to any other crypter call
 func (crypter *OpenPGPCrypter) IsUsed() bool {
@@ -46,31 +63,169 @@ func (crypter *OpenPGPCrypter) IsUsed() bool {
 func (crypter *OpenPGPCrypter) ConfigureGPGCrypter() {
 	crypter.configured = true
 	crypter.keyRingId = GetKeyRingId()
-	crypter.armed = len(crypter.keyRingId) != 0
+	crypter.keyPaths = getPGPKeyPaths()
+	crypter.armed = len(crypter.keyRingId) != 0 || len(crypter.keyPaths) != 0
 }
 
 // ErrCrypterUseMischief happens when crypter is used before initialization
 var ErrCrypterUseMischief = errors.New("Crypter is not checked before use")
 
+func (crypter *OpenPGPCrypter) loadPubKey() error {
+	if crypter.pubKey != nil {
+		return nil
+	}
+	if len(crypter.keyPaths) != 0 {
+		// Objects are encrypted to the newest key only, older ones are kept to decrypt history
+		var newest *openpgp.Entity
+		for _, path := range crypter.keyPaths {
+			entitylist, err := readKeyFile(path)
+			if err != nil {
+				return errors.Wrapf(err, "loadPubKey: failed to read %s", path)
+			}
+			for _, entity := range entitylist {
+				if newest == nil || entity.PrimaryKey.CreationTime.After(newest.PrimaryKey.CreationTime) {
+					newest = entity
+				}
+			}
+		}
+		if newest == nil {
+			return errors.New("loadPubKey: no keys in WALG_PGP_KEY_PATH and WALG_PGP_KEYS")
+		}
+		crypter.pubKey = openpgp.EntityList{newest}
+		return nil
+	}
+	armour, err := getPubRingArmour(crypter.keyRingId)
+	if err != nil {
+		return err
+	}
+
+	entitylist, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armour))
+	if err != nil {
+		return err
+	}
+	crypter.pubKey = entitylist
+	return nil
+}
+
+func (crypter *OpenPGPCrypter) loadSecretKey() error {
+	if crypter.secretKey != nil {
+		return nil
+	}
+	if len(crypter.keyPaths) != 0 {
+		// All keys are candidates, ReadMessage picks the one objects are encrypted to.
+		// Keys which fail to load are skipped, the object may be encrypted to another one.
+		passphrase := getPGPKeyPassphrase()
+		var entitylist openpgp.EntityList
+		var err error
+		for _, path := range crypter.keyPaths {
+			var keys openpgp.EntityList
+			keys, err = readKeyFile(path)
+			if err == nil {
+				err = decryptPrivateKeys(keys, passphrase)
+			}
+			if err != nil {
+				err = errors.Wrapf(err, "loadSecretKey: failed to load %s", path)
+				log.Printf("WARNING: %v\n", err)
+				continue
+			}
+			entitylist = append(entitylist, keys...)
+		}
+		if len(entitylist) == 0 {
+			return err
+		}
+		crypter.secretKey = entitylist
+		return nil
+	}
+	armour, err := getSecretRingArmour(crypter.keyRingId)
+	if err != nil {
+		return err
+	}
+
+	entitylist, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armour))
+	if err != nil {
+		return err
+	}
+	crypter.secretKey = entitylist
+	return nil
+}
+
 // Encrypt creates encryption writer from ordinary writer
 func (crypter *OpenPGPCrypter) Encrypt(writer io.WriteCloser) (io.WriteCloser, error) {
 	if !crypter.configured {
 		return nil, ErrCrypterUseMischief
 	}
-	if crypter.pubKey == nil {
-		armour, err := getPubRingArmour(crypter.keyRingId)
-		if err != nil {
-			return nil, err
-		}
+	if crypter.dataKey != nil {
+		return &DelayWriteCloser{writer, nil, crypter.dataKey, nil}, nil
+	}
+	err := crypter.loadPubKey()
+	if err != nil {
+		return nil, err
+	}
 
-		entitylist, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armour))
-		if err != nil {
-			return nil, err
-		}
-		crypter.pubKey = entitylist
+	return &DelayWriteCloser{writer, crypter.pubKey, nil, nil}, nil
+}
+
+// GenerateDataKey creates fresh random symmetric key for one backup
+func (crypter *OpenPGPCrypter) GenerateDataKey() ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
 	}
+	return key, nil
+}
 
-	return &DelayWriteCloser{writer, crypter.pubKey, nil}, nil
+// WrapDataKey encrypts data key to the long-term public key
+func (crypter *OpenPGPCrypter) WrapDataKey(key []byte) ([]byte, error) {
+	if !crypter.configured {
+		return nil, ErrCrypterUseMischief
+	}
+	err := crypter.loadPubKey()
+	if err != nil {
+		return nil, err
+	}
+	var wrapped bytes.Buffer
+	wc, err := openpgp.Encrypt(&wrapped, crypter.pubKey, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = wc.Write(key)
+	if err != nil {
+		return nil, err
+	}
+	err = wc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return wrapped.Bytes(), nil
+}
+
+// UnwrapDataKey decrypts data key with the long-term secret key
+func (crypter *OpenPGPCrypter) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	if !crypter.configured {
+		return nil, ErrCrypterUseMischief
+	}
+	err := crypter.loadSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	md, err := openpgp.ReadMessage(bytes.NewReader(wrapped), crypter.secretKey, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != dataKeySize {
+		return nil, errors.New("Unwrapped data key has wrong size")
+	}
+	return key, nil
+}
+
+// SetDataKey makes Encrypt and Decrypt use symmetric data key of a backup
+func (crypter *OpenPGPCrypter) SetDataKey(key []byte) {
+	crypter.dataKey = key
 }
 
 // DelayWriteCloser delays first writes.
@@ -79,10 +234,27 @@ func (crypter *OpenPGPCrypter) Encrypt(writer io.WriteCloser) (io.WriteCloser, e
 // is ready. This is why here is used special writer, which delays encryption
 // initialization before actual write. If no write occurs, initialization
 // still is performed, to handle zero-byte Files correctly
+// Objects are encrypted either to public keys el or with symmetric key passphrase.
 type DelayWriteCloser struct {
-	inner io.WriteCloser
-	el    openpgp.EntityList
-	outer *io.WriteCloser
+	inner      io.WriteCloser
+	el         openpgp.EntityList
+	passphrase []byte
+	outer      *io.WriteCloser
+}
+
+func (d *DelayWriteCloser) start() error {
+	var wc io.WriteCloser
+	var err error
+	if d.passphrase != nil {
+		wc, err = openpgp.SymmetricallyEncrypt(d.inner, d.passphrase, nil, dataKeyConfig)
+	} else {
+		wc, err = openpgp.Encrypt(d.inner, d.el, nil, nil, nil)
+	}
+	if err != nil {
+		return err
+	}
+	d.outer = &wc
+	return nil
 }
 
 func (d *DelayWriteCloser) Write(p []byte) (n int, err error) {
@@ -90,11 +262,10 @@ func (d *DelayWriteCloser) Write(p []byte) (n int, err error) {
 		return 0, nil
 	}
 	if d.outer == nil {
-		wc, err0 := openpgp.Encrypt(d.inner, d.el, nil, nil, nil)
-		if err0 != nil {
+		err = d.start()
+		if err != nil {
 			return 0, err
 		}
-		d.outer = &wc
 	}
 	n, err = (*d.outer).Write(p)
 	return
@@ -103,11 +274,10 @@ func (d *DelayWriteCloser) Write(p []byte) (n int, err error) {
 // Close DelayWriteCloser
 func (d *DelayWriteCloser) Close() error {
 	if d.outer == nil {
-		wc, err0 := openpgp.Encrypt(d.inner, d.el, nil, nil, nil)
-		if err0 != nil {
-			return err0
+		err := d.start()
+		if err != nil {
+			return err
 		}
-		d.outer = &wc
 	}
 
 	return (*d.outer).Close()
@@ -118,17 +288,12 @@ func (crypter *OpenPGPCrypter) Decrypt(reader io.ReadCloser) (io.Reader, error)
 	if !crypter.configured {
 		return nil, ErrCrypterUseMischief
 	}
-	if crypter.secretKey == nil {
-		armour, err := getSecretRingArmour(crypter.keyRingId)
-		if err != nil {
-			return nil, err
-		}
-
-		entitylist, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(armour))
-		if err != nil {
-			return nil, err
-		}
-		crypter.secretKey = entitylist
+	if crypter.dataKey != nil {
+		return decryptWithDataKey(reader, crypter.dataKey)
+	}
+	err := crypter.loadSecretKey()
+	if err != nil {
+		return nil, err
 	}
 
 	var md, err0 = openpgp.ReadMessage(reader, crypter.secretKey, nil, nil)
@@ -139,11 +304,108 @@ func (crypter *OpenPGPCrypter) Decrypt(reader io.ReadCloser) (io.Reader, error)
 	return md.UnverifiedBody, nil
 }
 
+func decryptWithDataKey(reader io.Reader, key []byte) (io.Reader, error) {
+	// ReadMessage asks again while the key does not fit, so it is given only once
+	prompted := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted || !symmetric {
+			return nil, errors.New("Object is not encrypted with data key of the backup")
+		}
+		prompted = true
+		return key, nil
+	}
+	md, err := openpgp.ReadMessage(reader, nil, prompt, dataKeyConfig)
+	if err != nil {
+		return nil, err
+	}
+	return md.UnverifiedBody, nil
+}
+
+// NewBackupCrypter creates crypter for objects of backup with given wrapped data key.
+// Backups without data key are decrypted with the long-term key.
+func NewBackupCrypter(wrappedDataKey []byte) (Crypter, error) {
+	crypter := NewCrypter()
+	if wrappedDataKey == nil {
+		return crypter, nil
+	}
+	if !crypter.IsUsed() {
+		return nil, errors.New("Backup is encrypted with a data key, but neither WALG_AES_KEY nor WALE_GPG_KEY_ID is set")
+	}
+	key, err := crypter.UnwrapDataKey(wrappedDataKey)
+	if err != nil {
+		return nil, err
+	}
+	crypter.SetDataKey(key)
+	return crypter, nil
+}
+
 // GetKeyRingId extracts name of a key to use from env variable
 func GetKeyRingId() string {
 	return os.Getenv("WALE_GPG_KEY_ID")
 }
 
+// getPGPKeyPaths reads armored key files used instead of WALE_GPG_KEY_ID:
+// WALG_PGP_KEY_PATH followed by WALG_PGP_KEYS, a list separated like PATH
+func getPGPKeyPaths() []string {
+	var paths []string
+	if path := os.Getenv("WALG_PGP_KEY_PATH"); path != "" {
+		paths = append(paths, path)
+	}
+	for _, path := range filepath.SplitList(os.Getenv("WALG_PGP_KEYS")) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// getPGPKeyPassphrase reads passphrase of secret key from file WALG_PGP_KEY_PASSPHRASE_PATH,
+// without trailing newline. Returns nil if it is not set.
+func getPGPKeyPassphrase() []byte {
+	path := os.Getenv("WALG_PGP_KEY_PASSPHRASE_PATH")
+	if path == "" {
+		return nil
+	}
+	passphrase, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal("Unable to read WALG_PGP_KEY_PASSPHRASE_PATH ", err)
+	}
+	return bytes.TrimRight(passphrase, "\r\n")
+}
+
+// readKeyFile reads armored public or secret key ring
+func readKeyFile(path string) (openpgp.EntityList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return openpgp.ReadArmoredKeyRing(file)
+}
+
+// decryptPrivateKeys decrypts secret keys protected by passphrase
+func decryptPrivateKeys(entitylist openpgp.EntityList, passphrase []byte) error {
+	for _, entity := range entitylist {
+		keys := []*packet.PrivateKey{entity.PrivateKey}
+		for _, subkey := range entity.Subkeys {
+			keys = append(keys, subkey.PrivateKey)
+		}
+		for _, key := range keys {
+			if key == nil || !key.Encrypted {
+				continue
+			}
+			if passphrase == nil {
+				return errors.New("Secret key of WALG_PGP_KEY_PATH is protected, but WALG_PGP_KEY_PASSPHRASE_PATH is not set")
+			}
+			err := key.Decrypt(passphrase)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 const gpgBin = "gpg"
 
 // CachedKey is the data transfer object describing format of key ring cache
@@ -0,0 +1,74 @@
+package walg
+
+import (
+	"archive/tar"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseDatabaseOID parses OID of database given to backup-fetch --database
+func ParseDatabaseOID(oid string) (uint32, error) {
+	parsed, err := strconv.ParseUint(oid, 10, 32)
+	if err != nil || parsed == 0 {
+		return 0, errors.Errorf("ParseDatabaseOID: invalid database OID '%s'", oid)
+	}
+	return uint32(parsed), nil
+}
+
+// isOtherDatabaseFile tells whether file of backup belongs to a database other than oid.
+// Relation files of database live in base/OID/ and pg_tblspc/SPC/VERSION/OID/,
+// everything else (global/, pg_xact/, configs, ...) is needed for startup and is kept.
+// Files of other databases are restored as placeholders, see restorePlaceholder.
+// Zero oid means all databases are restored.
+func isOtherDatabaseFile(name string, oid uint32) bool {
+	if oid == 0 {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	var dir string
+	switch {
+	case parts[0] == "base" && len(parts) > 1:
+		dir = parts[1]
+	case parts[0] == "pg_tblspc" && len(parts) > 3:
+		dir = parts[3]
+	default:
+		return false
+	}
+	return dir != strconv.FormatUint(uint64(oid), 10)
+}
+
+// restorePlaceholder creates relation file of database other than restored one as
+// a sparse file of zeroes of its size. WAL replay at startup fails on missing relation
+// files, while pages of zeroes are taken for new ones. Content of file is not read.
+func (ti *FileTarInterpreter) restorePlaceholder(targetPath string, hdr *tar.Header) error {
+	size := hdr.Size
+	if fd, ok := ti.Sentinel.Files[hdr.Name]; ok && fd.IsIncremented {
+		// Member of incremented file is the increment, sentinel keeps size of the whole file
+		size = fd.Size
+	}
+	f, err := os.Create(targetPath)
+	if os.IsNotExist(err) {
+		err = ti.createParentDirs(hdr.Name, targetPath, hdr)
+		if err != nil {
+			return errors.Wrap(err, "restorePlaceholder: failed to create all directories")
+		}
+		f, err = os.Create(targetPath)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "restorePlaceholder: failed to create %s", targetPath)
+	}
+	err = f.Truncate(size)
+	if err == nil {
+		err = f.Chmod(os.FileMode(hdr.Mode))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "restorePlaceholder: failed to create %s", targetPath)
+	}
+	return ti.chownRestored(targetPath, hdr)
+}
@@ -0,0 +1,44 @@
+package walg
+
+import "testing"
+
+func TestParseDatabaseOID(t *testing.T) {
+	oid, err := ParseDatabaseOID("16384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oid != 16384 {
+		t.Errorf("database: expected 16384 but got %d", oid)
+	}
+
+	for _, invalid := range []string{"", "0", "-1", "postgres", "4294967296"} {
+		_, err = ParseDatabaseOID(invalid)
+		if err == nil {
+			t.Errorf("database: expected error for '%s'", invalid)
+		}
+	}
+}
+
+func TestIsOtherDatabaseFile(t *testing.T) {
+	cases := map[string]bool{
+		"/base/16384/1259":   false,
+		"/base/16384":        false,
+		"/base/1/1259":       true,
+		"/base/163840/1259":  true,
+		"/base":              false,
+		"/global/pg_control": false,
+		"/global/1262":       false,
+		"/pg_xact/0000":      false,
+		"/pg_tblspc/16400/PG_10_201707211/16384/16401": false,
+		"/pg_tblspc/16400/PG_10_201707211/13000/16402": true,
+		"/pg_tblspc/16400/PG_10_201707211":             false,
+	}
+	for name, expected := range cases {
+		if actual := isOtherDatabaseFile(name, 16384); actual != expected {
+			t.Errorf("database: expected %v for %s but got %v", expected, name, actual)
+		}
+	}
+	if isOtherDatabaseFile("/base/1/1259", 0) {
+		t.Errorf("database: zero OID must restore all databases")
+	}
+}
@@ -2,6 +2,7 @@ package walg
 
 import (
 	"encoding/binary"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pierrec/lz4"
 	"github.com/pkg/errors"
 	"github.com/rasky/go-lzo"
@@ -26,6 +27,16 @@ var Uncompressed uint32
 // Compressed is used to log compression ratio.
 var Compressed uint32
 
+// Compression methods of backups recorded in sentinel
+const (
+	Lz4CompressionMethod  = "lz4"
+	LzoCompressionMethod  = "lzo"
+	ZstdCompressionMethod = "zstd"
+)
+
+// ZstdFileFormat is extension of zstd objects, unlike LZ4 and LZO it differs from name of method
+const ZstdFileFormat = "zst"
+
 // CheckType grabs the file extension from PATH.
 func CheckType(path string) string {
 	re := regexp.MustCompile(`\.([^\.]+)$`)
@@ -143,6 +154,20 @@ func DecompressLz4(d io.Writer, s io.Reader) (int64, error) {
 	return n, nil
 }
 
+// DecompressZstd decompresses a .zst file. Returns an error upon failure.
+func DecompressZstd(d io.Writer, s io.Reader) (int64, error) {
+	zr, err := zstd.NewReader(s, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return 0, errors.Wrap(err, "DecompressZstd: failed to create zstd reader")
+	}
+	defer zr.Close()
+	n, err := zr.WriteTo(d)
+	if err != nil {
+		return n, errors.Wrap(err, "DecompressZstd: zstd write failed")
+	}
+	return n, nil
+}
+
 // ReadCascadeClose composes io.ReadCloser from two parts
 type ReadCascadeClose struct {
 	io.Reader
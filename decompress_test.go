@@ -11,6 +11,7 @@ var fileNames = []struct {
 }{
 	{"mock.lzo", "lzo"},
 	{"mock.tar.lzo", "lzo"},
+	{"part_001.tar.zst", "zst"},
 	{"mock.gzip", "gzip"},
 	{"mockgzip", ""},
 }
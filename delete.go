@@ -2,7 +2,7 @@ package walg
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
 	"log"
 	"strconv"
 	"time"
@@ -18,16 +18,52 @@ type DeleteCommandArguments struct {
 	target     string
 	beforeTime *time.Time
 	dryrun     bool
+	// retainFor keeps backups of this period, but no fewer than minCount backups
+	retainFor time.Duration
+	minCount  int
+	// deleteOrphans deletes deltas whose base is deleted instead of refusing to delete
+	deleteOrphans bool
+	// marker uploads delete marks instead of removing backups, nil deletes at once
+	marker *TarUploader
+	// everything deletes all backups, WAL and other wal-g objects of prefix, see HandlePurge
+	everything bool
+	// force lets delete everything remove permanent backups too
+	force bool
+	// noWAL keeps WAL of deleted backups
+	noWAL bool
+	// walGrace is the number of segments kept before the start of the oldest kept backup
+	walGrace uint64
+}
+
+// markOptions returns retention options recorded in delete marks, see DeleteMarkOptions
+func (cfg DeleteCommandArguments) markOptions() DeleteMarkOptions {
+	return DeleteMarkOptions{NoWAL: cfg.noWAL, WALGrace: cfg.walGrace}
 }
 
 // ParseDeleteArguments interprets arguments for delete command. TODO: use flags or cobra
 func ParseDeleteArguments(args []string, fallBackFunc func()) (result DeleteCommandArguments) {
+	if len(args) >= 2 && args[1] == "everything" {
+		result.everything = true
+		flags := args[2:]
+		if len(flags) > 0 && flags[0] == "FORCE" {
+			result.force = true
+			flags = flags[1:]
+		}
+		parseDeleteFlags(flags, &result, fallBackFunc)
+		return
+	}
 	if len(args) < 3 {
 		fallBackFunc()
 		return
 	}
 
 	params := args[1:]
+	if params[0] == "retain_for" {
+		return parseRetainForArguments(params[1:], fallBackFunc)
+	}
+	if params[0] == "retain" && params[1] == "after" {
+		return parseRetainAfterArguments(params[2:], fallBackFunc)
+	}
 	if params[0] == "retain" {
 		result.retain = true
 		params = params[1:]
@@ -60,10 +96,7 @@ func ParseDeleteArguments(args []string, fallBackFunc func()) (result DeleteComm
 		result.beforeTime = &t
 	}
 	//if DeleteConfirmed && !DeleteDryrun  // TODO: use flag
-	result.dryrun = true
-	if len(params) > 1 && (params[1] == "--confirm" || params[1] == "-confirm") {
-		result.dryrun = false
-	}
+	parseDeleteFlags(params[1:], &result, fallBackFunc)
 
 	if result.retain {
 		number, err := strconv.Atoi(result.target)
@@ -81,7 +114,126 @@ func ParseDeleteArguments(args []string, fallBackFunc func()) (result DeleteComm
 	return
 }
 
-func deleteBeforeTarget(target string, bk *Backup, pre *Prefix, findFull bool, backups []BackupTime, dryRun bool) {
+// parseRetainForArguments interprets arguments of delete retain_for DURATION MIN_COUNT
+func parseRetainForArguments(params []string, fallBackFunc func()) (result DeleteCommandArguments) {
+	if len(params) < 2 {
+		log.Print("Retention period and minimal number of backups are not specified")
+		fallBackFunc()
+		return
+	}
+	period, err := parseRetentionPeriod(params[0])
+	if err != nil || period <= 0 {
+		log.Println("Cannot parse retention period ", params[0])
+		fallBackFunc()
+		return
+	}
+	minCount, err := strconv.Atoi(params[1])
+	if err != nil || minCount <= 0 {
+		log.Println("Cannot parse minimal number of backups ", params[1])
+		fallBackFunc()
+		return
+	}
+	result.retainFor = period
+	result.minCount = minCount
+	result.target = params[0]
+	parseDeleteFlags(params[2:], &result, fallBackFunc)
+	return
+}
+
+// parseRetainAfterArguments interprets arguments of delete retain after NAME. It is
+// before FIND_FULL NAME by name only, so NAME like a date is not taken for time.
+func parseRetainAfterArguments(params []string, fallBackFunc func()) (result DeleteCommandArguments) {
+	if len(params) < 1 {
+		log.Print("Backup name not specified")
+		fallBackFunc()
+		return
+	}
+	result.before = true
+	result.findFull = true
+	result.target = params[0]
+	parseDeleteFlags(params[1:], &result, fallBackFunc)
+	return
+}
+
+// parseDeleteFlags interprets flags after positional arguments of delete command,
+// any other argument fails parsing before anything is deleted
+func parseDeleteFlags(flags []string, result *DeleteCommandArguments, fallBackFunc func()) {
+	result.dryrun = true
+	for _, flag := range flags {
+		if grace, ok := cutDeleteFlagValue(flag, "until-wal"); ok {
+			segments, err := strconv.ParseUint(grace, 10, 32)
+			if err != nil {
+				log.Println("Cannot parse number of WAL segments ", grace)
+				fallBackFunc()
+				return
+			}
+			result.walGrace = segments
+			continue
+		}
+		switch flag {
+		case "--confirm", "-confirm":
+			result.dryrun = false
+		case "--dry-run", "-dry-run":
+			// Dry run is the default, the flag only makes it explicit
+		case "--delete-orphans", "-delete-orphans":
+			result.deleteOrphans = true
+		case "--no-wal", "-no-wal":
+			result.noWAL = true
+		case "--until-wal", "-until-wal":
+			// Without grace WAL is kept from the start of the oldest kept backup, as by default
+		default:
+			// Misspelled flag or value given apart from its flag must not widen deletion
+			log.Println("Unknown argument ", flag)
+			fallBackFunc()
+			return
+		}
+	}
+}
+
+// cutDeleteFlagValue returns value of flag given as --name=value or -name=value
+func cutDeleteFlagValue(flag string, name string) (string, bool) {
+	for _, prefix := range []string{"--" + name + "=", "-" + name + "="} {
+		if strings.HasPrefix(flag, prefix) {
+			return strings.TrimPrefix(flag, prefix), true
+		}
+	}
+	return "", false
+}
+
+// parseRetentionPeriod parses duration of time.ParseDuration, or whole days like 7d
+func parseRetentionPeriod(period string) (time.Duration, error) {
+	if strings.HasSuffix(period, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(period, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(period)
+}
+
+// FindRetentionTarget finds the oldest backup kept by retention of backups started after cutoff,
+// with the floor of minCount backups winning over the age. Like before TIME, the newest backup
+// started before cutoff is kept to recover to any moment after cutoff. Backups are sorted
+// from the newest. Returns -1 if all backups are kept.
+func FindRetentionTarget(backups []BackupTime, cutoff time.Time, minCount int) int {
+	target := len(backups) - 1
+	for i, b := range backups {
+		if b.Time.Before(cutoff) {
+			target = i
+			break
+		}
+	}
+	if target < minCount-1 {
+		target = minCount - 1
+	}
+	if target >= len(backups)-1 {
+		return -1
+	}
+	return target
+}
+
+func deleteBeforeTarget(target string, bk *Backup, pre *Prefix, findFull bool, backups []BackupTime, cfg DeleteCommandArguments) {
 	dto := fetchSentinel(target, bk, pre)
 	if dto.IsIncremental() {
 		if findFull {
@@ -98,38 +250,224 @@ func deleteBeforeTarget(target string, bk *Backup, pre *Prefix, findFull bool, b
 		}
 	}
 
-	skip := true
 	skipLine := len(backups)
 	for i, b := range backups {
-		if skip {
-			log.Printf("%v skipped\n", b.Name)
-		} else {
-			log.Printf("%v will be deleted\n", b.Name)
-		}
 		if b.Name == target {
-			skip = false
 			skipLine = i
+			break
+		}
+	}
+
+	// Permanent backups and bases of permanent deltas are spared regardless of target
+	permanent, err := GetPermanentBackups(pre, backups)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	permanentWAL, err := getPermanentWALRanges(permanent)
+	if err != nil {
+		// WAL needed by permanent backup can't be told apart from obsolete WAL, as with --no-wal
+		log.Printf("WARNING: %v, WAL is not deleted\n", err)
+		cfg.noWAL = true
+	}
+
+	// Deltas kept after target may still chain from backups before it
+	orphans := make(map[string]bool)
+	if skipLine < len(backups)-1 {
+		names := make([]string, skipLine+1)
+		for i := range names {
+			names[i] = backups[i].Name
+		}
+		sentinels, err := FetchSentinels(names, bk, pre)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		orphanNames := findOrphans(backups, skipLine, sentinels, permanent)
+		if len(orphanNames) > 0 && !cfg.deleteOrphans {
+			log.Fatalf("Deletion would leave %d deltas without their base: %v. Choose an older target or use --delete-orphans to delete them too.\n",
+				len(orphanNames), strings.Join(orphanNames, ", "))
+		}
+		for _, name := range orphanNames {
+			orphans[name] = true
+		}
+	}
+
+	oldestWAL := ""
+	if !cfg.noWAL {
+		oldestWAL = getOldestNeededWAL(backups, skipLine, orphans)
+	}
+	if oldestWAL != "" && cfg.walGrace > 0 {
+		segmentSize, err := getBackupWalSegmentSize(pre, backups[skipLine].Name)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		oldestWAL = moveWALBack(oldestWAL, cfg.walGrace, segmentSize)
+		log.Printf("WAL is kept from %v, %d segments before the oldest kept backup\n", oldestWAL, cfg.walGrace)
+	}
+
+	action := "deleted"
+	if cfg.marker != nil {
+		action = "marked for deletion"
+	}
+	for i, b := range backups {
+		if _, ok := permanent[b.Name]; ok && (i > skipLine || orphans[b.Name]) {
+			log.Printf("%v spared, as it is permanent or the base of a permanent delta\n", b.Name)
+		} else if i > skipLine {
+			log.Printf("%v will be %v\n", b.Name, action)
+		} else if orphans[b.Name] {
+			log.Printf("%v will be %v, as its base is %v\n", b.Name, action, action)
+		} else {
+			log.Printf("%v skipped\n", b.Name)
 		}
 	}
 
-	if !dryRun {
+	if !cfg.dryrun && cfg.marker != nil {
+		// WAL is deleted by delete-expired together with the backups
+		options := cfg.markOptions()
+		markBackupsBefore(backups, skipLine, permanent, pre, cfg.marker, options)
+		markOrphans(backups, orphans, pre, cfg.marker, options)
+		log.Printf("Marked backups are deleted by delete-expired after grace period.\n")
+	} else if !cfg.dryrun {
+		// WAL left by earlier deletions is reclaimed even if no backup is deleted now
+		if oldestWAL != "" {
+			deleteWALBefore(oldestWAL, pre, permanentWAL)
+		}
 		if skipLine < len(backups)-1 {
-			deleteWALBefore(backups[skipLine], pre)
-			deleteBackupsBefore(backups, skipLine, pre)
+			deleteBackupsBefore(backups, skipLine, permanent, pre)
+			for _, b := range backups {
+				if orphans[b.Name] {
+					dropBackup(pre, b)
+				}
+			}
 		}
 	} else {
+		var names []string
+		for i, b := range backups {
+			if _, ok := permanent[b.Name]; !ok && (i > skipLine || orphans[b.Name]) {
+				names = append(names, b.Name)
+			}
+		}
+		backupBytes, walBytes, err := GetDeletedSize(pre, names, oldestWAL, permanentWAL)
+		if err != nil {
+			log.Fatalf("%+v\n", err)
+		}
+		log.Printf("Deletion would free %d bytes: %d bytes of %d backups and %d bytes of WAL.\n",
+			backupBytes+walBytes, backupBytes, len(names), walBytes)
 		log.Printf("Dry run finished.\n")
 	}
 }
 
-func deleteBackupsBefore(backups []BackupTime, skipline int, pre *Prefix) {
+// GetDeletedSize sums sizes of objects which deletion of backups with names and of WAL
+// before walFileName, except WAL of permanent backups, removes, as dropBackup and deleteWALBefore do
+func GetDeletedSize(pre *Prefix, names []string, walFileName string, permanentWAL []BackupWALRange) (backupBytes int64, walBytes int64, err error) {
+	path := *GetBackupPath(pre)
+	sentinels, err := pre.Storage().List(path)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "GetDeletedSize: failed to list backups")
+	}
+	sentinelSizes := make(map[string]int64, len(sentinels))
+	for _, object := range sentinels {
+		sentinelSizes[object.Key] = object.Size
+	}
+
+	for _, name := range names {
+		backupBytes += sentinelSizes[path+name+SentinelSuffix]
+		objects, err := pre.Storage().List(path + name + "/")
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "GetDeletedSize: failed to list backup %s", name)
+		}
+		for _, object := range objects {
+			if object.Key == path+name+"/"+BackupIndexName {
+				backupBytes += object.Size
+			}
+		}
+		// Delta stores only changed files, so its partitions are all it takes
+		partitions, err := pre.Storage().List(path + name + "/tar_partitions/")
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "GetDeletedSize: failed to list partitions of %s", name)
+		}
+		for _, object := range partitions {
+			backupBytes += object.Size
+		}
+	}
+
+	wals, err := pre.Storage().List(GetWALPath(*pre.Server))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "GetDeletedSize: failed to list WAL")
+	}
+	for _, object := range wals {
+		if isObsoleteWAL(object.Key, walFileName) && !isPermanentWAL(object.Key, permanentWAL) {
+			walBytes += object.Size
+		}
+	}
+	return backupBytes, walBytes, nil
+}
+
+// FindOrphanedBackups lists backups kept by deletion of backups after skipLine, whose delta chain
+// reaches one of deleted backups. Backups are sorted from the newest, sentinels are of kept backups.
+func FindOrphanedBackups(backups []BackupTime, skipLine int, sentinels map[string]S3TarBallSentinelDto) []string {
+	return findOrphans(backups, skipLine, sentinels, nil)
+}
+
+// findOrphans is FindOrphanedBackups with permanent backups spared from deletion
+func findOrphans(backups []BackupTime, skipLine int, sentinels map[string]S3TarBallSentinelDto, permanent map[string]S3TarBallSentinelDto) []string {
+	deleted := make(map[string]bool)
+	for i := skipLine + 1; i < len(backups); i++ {
+		if _, ok := permanent[backups[i].Name]; !ok {
+			deleted[backups[i].Name] = true
+		}
+	}
+
+	var orphans []string
+	for i := 0; i <= skipLine && i < len(backups); i++ {
+		name := backups[i].Name
+		// Chain is not longer than the list of backups, unless it has a cycle
+		for step := 0; step < len(backups); step++ {
+			dto, ok := sentinels[name]
+			if !ok || !dto.IsIncremental() {
+				break
+			}
+			name = *dto.IncrementFrom
+			if deleted[name] {
+				orphans = append(orphans, backups[i].Name)
+				break
+			}
+		}
+	}
+	return orphans
+}
+
+func markOrphans(backups []BackupTime, orphans map[string]bool, pre *Prefix, marker *TarUploader, options DeleteMarkOptions) {
+	now := time.Now()
+	for _, b := range backups {
+		if orphans[b.Name] {
+			err := MarkBackupForDeletion(marker, pre, b.Name, now, options)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+		}
+	}
+}
+
+func deleteBackupsBefore(backups []BackupTime, skipline int, permanent map[string]S3TarBallSentinelDto, pre *Prefix) {
 	for i, b := range backups {
-		if i > skipline {
+		if _, ok := permanent[b.Name]; !ok && i > skipline {
 			dropBackup(pre, b)
 		}
 	}
 }
 
+func markBackupsBefore(backups []BackupTime, skipline int, permanent map[string]S3TarBallSentinelDto, pre *Prefix, marker *TarUploader, options DeleteMarkOptions) {
+	now := time.Now()
+	for i, b := range backups {
+		if _, ok := permanent[b.Name]; !ok && i > skipline {
+			err := MarkBackupForDeletion(marker, pre, b.Name, now, options)
+			if err != nil {
+				log.Fatalf("%+v\n", err)
+			}
+		}
+	}
+}
+
 func dropBackup(pre *Prefix, b BackupTime) {
 	var bk = &Backup{
 		Prefix: pre,
@@ -144,49 +482,106 @@ func dropBackup(pre *Prefix, b BackupTime) {
 	folderKey := strings.TrimPrefix(*pre.Server+"/basebackups_005/"+b.Name, "/")
 	suffixKey := folderKey + SentinelSuffix
 
-	keys := append(tarFiles, suffixKey, folderKey)
-	parts := partition(keys, 1000)
-	for _, part := range parts {
+	indexKey := folderKey + "/" + BackupIndexName
 
-		input := &s3.DeleteObjectsInput{Bucket: pre.Bucket, Delete: &s3.Delete{
-			Objects: partitionToObjects(part),
-		}}
-		_, err = pre.Svc.DeleteObjects(input)
-		if err != nil {
-			log.Fatal("Unable to delete backup ", b.Name, err)
+	keys := append(tarFiles, suffixKey, indexKey, folderKey)
+	err = pre.Storage().Delete(keys)
+	if err != nil {
+		log.Fatal("Unable to delete backup ", b.Name, err)
+	}
+}
+
+// getOldestNeededWAL returns the WAL file name before which no backup kept by deletion after
+// skipLine needs WAL, see isObsoleteWAL. Backups on different timelines take the lowest timeline
+// and the lowest segment among them. Empty name, which makes no WAL obsolete, is returned when
+// start segment of a kept backup is unknown.
+func getOldestNeededWAL(backups []BackupTime, skipLine int, orphans map[string]bool) string {
+	oldest := ""
+	for i := 0; i <= skipLine && i < len(backups); i++ {
+		b := backups[i]
+		if orphans[b.Name] {
+			continue
+		}
+		if _, err := ParseWALFileName(b.WalFileName); err != nil {
+			log.Printf("Start segment of %v is unknown, WAL is not deleted\n", b.Name)
+			return ""
+		}
+		if oldest == "" {
+			oldest = b.WalFileName
+			continue
+		}
+		timeline, segment := oldest[:8], oldest[8:]
+		if b.WalFileName[:8] < timeline {
+			timeline = b.WalFileName[:8]
+		}
+		if b.WalFileName[8:] < segment {
+			segment = b.WalFileName[8:]
 		}
+		oldest = timeline + segment
+	}
+	return oldest
+}
+
+// getBackupWalSegmentSize returns size of WAL segments recorded in sentinel of backup,
+// which all backups of the cluster share
+func getBackupWalSegmentSize(pre *Prefix, backupName string) (uint64, error) {
+	_, sentinel, err := fetchBackupSentinel(pre, backupName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "getBackupWalSegmentSize: failed to read sentinel of %s", backupName)
+	}
+	return sentinel.GetWalSegmentSize(), nil
+}
 
+// moveWALBack returns name of WAL file of segmentSize count segments before walFileName
+// on its timeline, the first segment if there are fewer
+func moveWALBack(walFileName string, count uint64, segmentSize uint64) string {
+	segment, err := ParseWalSegmentName(walFileName, segmentSize)
+	if err != nil {
+		return walFileName
+	}
+	if segment.LogSegNo < count {
+		segment.LogSegNo = 0
+	} else {
+		segment.LogSegNo -= count
 	}
+	return segment.String()
 }
 
-func partitionToObjects(keys []string) []*s3.ObjectIdentifier {
-	objs := make([]*s3.ObjectIdentifier, len(keys))
-	for i, k := range keys {
-		objs[i] = &s3.ObjectIdentifier{Key: aws.String(k)}
+// isObsoleteWAL tells if WAL object with key precedes oldestNeeded on its timeline and on all
+// timelines before it. Segments of later timelines, history files and other objects are kept,
+// their branch may still be needed to recover along a timeline of a kept backup.
+// Checksums and backup history files of a segment go with it.
+func isObsoleteWAL(key string, oldestNeeded string) bool {
+	name := stripWalName(key)
+	if _, err := ParseWALFileName(name); err != nil || len(oldestNeeded) != len(name) {
+		return false
 	}
-	return objs
+	return name[:8] <= oldestNeeded[:8] && name[8:] < oldestNeeded[8:]
 }
 
-func deleteWALBefore(bt BackupTime, pre *Prefix) {
+// deleteWALBefore deletes WAL which isObsoleteWAL before walFileName, except WAL which makes
+// permanent backups consistent. Segments of every compression method are deleted.
+func deleteWALBefore(walFileName string, pre *Prefix, permanentWAL []BackupWALRange) {
 	var bk = &Backup{
 		Prefix: pre,
-		Path:   aws.String(sanitizePath(*pre.Server + "/wal_005/")),
+		Path:   aws.String(GetWALPath(*pre.Server)),
 	}
 
-	objects, err := bk.GetWals(bt.WalFileName)
+	objects, err := bk.GetWals(walFileName)
 	if err != nil {
-		log.Fatal("Unable to obtaind WALS for border ", bt.Name, err)
-	}
-	parts := partitionObjects(objects, 1000)
-	for _, part := range parts {
-		input := &s3.DeleteObjectsInput{Bucket: pre.Bucket, Delete: &s3.Delete{
-			Objects: part,
-		}}
-		_, err = pre.Svc.DeleteObjects(input)
-		if err != nil {
-			log.Fatal("Unable to delete WALS before ", bt.Name, err)
+		log.Fatal("Unable to obtaind WALS before ", walFileName, err)
+	}
+	var deleted []string
+	for _, key := range objects {
+		if !isPermanentWAL(key, permanentWAL) {
+			deleted = append(deleted, key)
 		}
 	}
+	objects = deleted
+	err = pre.Storage().Delete(objects)
+	if err != nil {
+		log.Fatal("Unable to delete WALS before ", walFileName, err)
+	}
 }
 
 // DeleteUsage is a text message explaining how to use delete
@@ -195,7 +590,14 @@ var DeleteUsage = "delete requires at least 2 parameters" + `
 		retain FULL 5                 keep 5 full backups and all deltas of them
 		retail FIND_FULL 5            find necessary full for 5th and keep everything after it
 		before base_0123              keep everything after base_0123 including itself
-		before FIND_FULL base_0123    keep everything after the base of base_0123`
+		before FIND_FULL base_0123    keep everything after the base of base_0123
+		retain after base_0123        keep base_0123, everything after it and bases it needs
+		retain_for 7d 3               keep backups of 7 days but no fewer than 3, with bases of deltas
+		everything [FORCE]            delete all backups, WAL and other wal-g objects of prefix, e.g. of a decommissioned cluster, FORCE to delete permanent backups too
+	WAL which no kept backup needs is deleted too, unless --no-wal is given
+	--until-wal=N keeps also N segments of WAL before the oldest kept backup
+	Deletion which would leave deltas without their base fails, unless --delete-orphans is given to delete them too
+	Backups marked by backup-mark --permanent are spared, together with bases of permanent deltas and their WAL`
 
 func printDeleteUsageAndFail() {
 	log.Fatal(DeleteUsage)
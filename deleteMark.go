@@ -0,0 +1,255 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// DeleteMarkSuffix is the suffix of objects marking backups for deletion
+const DeleteMarkSuffix = ".json"
+
+// DefaultDeleteGracePeriod is how long marked backups are kept by delete-expired by default
+const DefaultDeleteGracePeriod = 48 * time.Hour
+
+// DeleteMark records that backup was chosen for deletion by delete with WALG_SOFT_DELETE.
+// Backup is removed by delete-expired after grace period; removing mark object cancels deletion.
+type DeleteMark struct {
+	Name     string    `json:"name"`
+	MarkedAt time.Time `json:"marked_at"`
+	DeleteMarkOptions
+}
+
+// DeleteMarkOptions are retention options of delete which marked backup, applied by delete-expired
+// when it removes the backup. Marks uploaded by older versions have no options.
+type DeleteMarkOptions struct {
+	// NoWAL keeps WAL of the backup, as delete --no-wal does
+	NoWAL bool `json:"no_wal,omitempty"`
+	// WALGrace is the number of segments kept before the oldest kept backup, as by delete --until-wal
+	WALGrace uint64 `json:"wal_grace,omitempty"`
+	// Everything purges WAL and other wal-g objects of prefix once no backup is left, as delete everything does
+	Everything bool `json:"everything,omitempty"`
+}
+
+// mergeMarkOptions returns options of marks of expired backups, which keep as much WAL
+// as any of the deletes asked for
+func mergeMarkOptions(expired []BackupTime, marks map[string]DeleteMark) DeleteMarkOptions {
+	var merged DeleteMarkOptions
+	for _, b := range expired {
+		options := marks[b.Name].DeleteMarkOptions
+		merged.NoWAL = merged.NoWAL || options.NoWAL
+		merged.Everything = merged.Everything || options.Everything
+		if options.WALGrace > merged.WALGrace {
+			merged.WALGrace = options.WALGrace
+		}
+	}
+	return merged
+}
+
+// GetDeleteMarksPath returns prefix of delete marks in storage
+func GetDeleteMarksPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/delete_marks_005/")
+}
+
+// getSoftDelete tells whether WALG_SOFT_DELETE asks delete to mark backups instead of removing them
+func getSoftDelete() bool {
+	softStr, ok := os.LookupEnv("WALG_SOFT_DELETE")
+	if !ok {
+		return false
+	}
+	soft, err := strconv.ParseBool(softStr)
+	if err != nil {
+		log.Fatal("Unable to parse WALG_SOFT_DELETE ", err)
+	}
+	return soft
+}
+
+// MarkBackupForDeletion uploads delete mark of backup with options of delete. Backup marked
+// earlier keeps its mark, so repeated retention runs do not postpone deletion.
+func MarkBackupForDeletion(tu *TarUploader, pre *Prefix, name string, now time.Time, options DeleteMarkOptions) error {
+	key := GetDeleteMarksPath(pre) + name + DeleteMarkSuffix
+	archive := &Archive{Prefix: pre, Archive: aws.String(key)}
+	exists, err := archive.CheckExistence()
+	if err != nil {
+		return errors.Wrapf(err, "MarkBackupForDeletion: failed to check mark of %s", name)
+	}
+	if exists {
+		return nil
+	}
+	body, err := json.Marshal(DeleteMark{Name: name, MarkedAt: now.UTC(), DeleteMarkOptions: options})
+	if err != nil {
+		return err
+	}
+	err = tu.put(key, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "MarkBackupForDeletion: failed to upload mark of %s", name)
+	}
+	return nil
+}
+
+// GetDeleteMarks fetches all delete marks in storage by backup name
+func GetDeleteMarks(pre *Prefix) (map[string]DeleteMark, error) {
+	var keys []string
+	objects, err := pre.Storage().List(GetDeleteMarksPath(pre))
+	if err != nil {
+		return nil, errors.Wrap(err, "GetDeleteMarks: failed to list marks")
+	}
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, DeleteMarkSuffix) {
+			keys = append(keys, object.Key)
+		}
+	}
+
+	marks := make(map[string]DeleteMark, len(keys))
+	for _, key := range keys {
+		archive := &Archive{Prefix: pre, Archive: aws.String(key)}
+		reader, err := archive.GetArchive()
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetDeleteMarks: failed to fetch %s", key)
+		}
+		body, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetDeleteMarks: failed to fetch %s", key)
+		}
+		var mark DeleteMark
+		err = json.Unmarshal(body, &mark)
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetDeleteMarks: failed to parse %s", key)
+		}
+		marks[mark.Name] = mark
+	}
+	return marks, nil
+}
+
+// FindExpiredBackups returns backups marked for deletion more than gracePeriod before now
+func FindExpiredBackups(backups []BackupTime, marks map[string]DeleteMark, gracePeriod time.Duration, now time.Time) []BackupTime {
+	var expired []BackupTime
+	for _, b := range backups {
+		mark, ok := marks[b.Name]
+		if ok && now.Sub(mark.MarkedAt) > gracePeriod {
+			expired = append(expired, b)
+		}
+	}
+	return expired
+}
+
+// deleteMark removes delete mark of backup from storage
+func deleteMark(pre *Prefix, name string) error {
+	key := GetDeleteMarksPath(pre) + name + DeleteMarkSuffix
+	err := pre.Storage().Delete([]string{key})
+	if err != nil {
+		return errors.Wrapf(err, "deleteMark: failed to delete mark of %s", name)
+	}
+	return nil
+}
+
+// HandleDeleteExpired is invoked to perform wal-g delete-expired. It removes backups
+// marked by delete more than gracePeriod ago and WAL older than the oldest remaining backup.
+// When backups marked by delete everything expire and none is left, everything wal-g keeps in prefix is purged.
+func HandleDeleteExpired(pre *Prefix, gracePeriod time.Duration, dryRun bool) error {
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	backups, err := bk.GetBackups()
+	if err != nil && err != ErrLatestNotFound {
+		return errors.Wrap(err, "HandleDeleteExpired: failed to list backups")
+	}
+	marks, err := GetDeleteMarks(pre)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	// Backups made permanent after they were marked are kept
+	permanent, err := GetPermanentBackups(pre, backups)
+	if err != nil {
+		return err
+	}
+	var expired []BackupTime
+	for _, b := range FindExpiredBackups(backups, marks, gracePeriod, now) {
+		if _, ok := permanent[b.Name]; ok {
+			log.Printf("%v spared, as it is permanent or the base of a permanent delta\n", b.Name)
+			continue
+		}
+		expired = append(expired, b)
+	}
+	isExpired := make(map[string]bool, len(expired))
+	for _, b := range expired {
+		isExpired[b.Name] = true
+	}
+	var remaining []BackupTime
+	for _, b := range backups {
+		if isExpired[b.Name] {
+			log.Printf("%v marked at %v will be deleted\n", b.Name, marks[b.Name].MarkedAt.Format(time.RFC3339))
+			continue
+		}
+		if mark, ok := marks[b.Name]; ok {
+			log.Printf("%v marked at %v is kept until %v\n", b.Name, mark.MarkedAt.Format(time.RFC3339),
+				mark.MarkedAt.Add(gracePeriod).Format(time.RFC3339))
+		}
+		remaining = append(remaining, b)
+	}
+
+	if dryRun {
+		log.Printf("Dry run finished.\n")
+		return nil
+	}
+	for _, b := range expired {
+		dropBackup(pre, b)
+		if err = deleteMark(pre, b.Name); err != nil {
+			return err
+		}
+	}
+	// WAL is needed from the start of the oldest one left
+	options := mergeMarkOptions(expired, marks)
+	if options.NoWAL {
+		log.Printf("WAL is kept, as backups were marked by delete --no-wal\n")
+	} else if len(expired) > 0 && len(remaining) > 0 {
+		if oldestWAL := getOldestNeededWAL(remaining, len(remaining)-1, nil); oldestWAL != "" {
+			if options.WALGrace > 0 {
+				segmentSize, err := getBackupWalSegmentSize(pre, remaining[len(remaining)-1].Name)
+				if err != nil {
+					return err
+				}
+				oldestWAL = moveWALBack(oldestWAL, options.WALGrace, segmentSize)
+				log.Printf("WAL is kept from %v, %d segments before the oldest kept backup\n", oldestWAL, options.WALGrace)
+			}
+			deleteWALBefore(oldestWAL, pre, nil)
+		}
+	}
+	// Marks of backups which were deleted otherwise are not needed
+	for name := range marks {
+		if !containsBackup(backups, name) {
+			if err = deleteMark(pre, name); err != nil {
+				return err
+			}
+		}
+	}
+	if options.Everything && len(expired) > 0 && len(remaining) == 0 {
+		if err = HandlePurge(pre, nil, true, false); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Deleted %d expired backups.\n", len(expired))
+	return nil
+}
+
+func containsBackup(backups []BackupTime, name string) bool {
+	for _, b := range backups {
+		if b.Name == name {
+			return true
+		}
+	}
+	return false
+}
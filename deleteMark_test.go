@@ -0,0 +1,230 @@
+package walg_test
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestDeleteMarks(t *testing.T) {
+	tu, pre, client := newMemoryStorage()
+	now := time.Date(2018, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	err := walg.MarkBackupForDeletion(tu, pre, "base_000000010000000000000002", now.Add(-72*time.Hour), walg.DeleteMarkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = walg.MarkBackupForDeletion(tu, pre, "base_000000010000000000000004", now.Add(-time.Hour), walg.DeleteMarkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Marking again does not postpone deletion
+	err = walg.MarkBackupForDeletion(tu, pre, "base_000000010000000000000002", now, walg.DeleteMarkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.objects["server/delete_marks_005/base_000000010000000000000002.json"]; !ok {
+		t.Fatalf("delete marks: mark object was not uploaded")
+	}
+
+	marks, err := walg.GetDeleteMarks(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 2 || !marks["base_000000010000000000000002"].MarkedAt.Equal(now.Add(-72*time.Hour)) {
+		t.Fatalf("delete marks: unexpected marks %v", marks)
+	}
+
+	backups := []walg.BackupTime{
+		{Name: "base_000000010000000000000006"},
+		{Name: "base_000000010000000000000004"},
+		{Name: "base_000000010000000000000002"},
+	}
+	expired := walg.FindExpiredBackups(backups, marks, 48*time.Hour, now)
+	if len(expired) != 1 || expired[0].Name != "base_000000010000000000000002" {
+		t.Errorf("delete marks: expected only backup marked 72h ago to expire, got %v", expired)
+	}
+	if expired := walg.FindExpiredBackups(backups, marks, 30*time.Minute, now); len(expired) != 2 {
+		t.Errorf("delete marks: expected both marked backups to expire, got %v", expired)
+	}
+}
+
+func TestDeleteExpiredOnStorageBackend(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	backups := []string{
+		"base_20181017T090000Z_000000010000000000000002",
+		"base_20181017T100000Z_000000010000000000000004",
+		"base_20181017T110000Z_000000010000000000000006",
+	}
+	for _, name := range backups {
+		storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix] = []byte("{}")
+		storage.objects["server/basebackups_005/"+name+"/tar_partitions/part_001.tar.lz4"] = []byte("data")
+	}
+	markKey := func(name string) string {
+		return "server/delete_marks_005/" + name + walg.DeleteMarkSuffix
+	}
+
+	os.Setenv("WALG_SOFT_DELETE", "true")
+	walg.HandleDelete(tu, pre, []string{"delete", "retain", "2", "--confirm"})
+	os.Unsetenv("WALG_SOFT_DELETE")
+	if _, ok := storage.objects[markKey(backups[0])]; !ok {
+		t.Fatalf("delete marks: soft delete did not mark %s", backups[0])
+	}
+	if _, ok := storage.objects["server/basebackups_005/"+backups[0]+walg.SentinelSuffix]; !ok {
+		t.Fatalf("delete marks: soft delete removed %s", backups[0])
+	}
+
+	// Mark of the oldest backup is past grace period, mark of a backup deleted otherwise is stale
+	old, err := json.Marshal(walg.DeleteMark{Name: backups[0], MarkedAt: time.Now().Add(-72 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.objects[markKey(backups[0])] = old
+	err = walg.MarkBackupForDeletion(tu, pre, "base_20181016T090000Z_000000010000000000000001", time.Now(), walg.DeleteMarkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = walg.MarkBackupForDeletion(tu, pre, backups[1], time.Now(), walg.DeleteMarkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := walg.HandleDeleteExpired(pre, 48*time.Hour, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storage.objects[markKey(backups[0])]; !ok {
+		t.Fatalf("delete marks: dry run removed mark of %s", backups[0])
+	}
+
+	if err := walg.HandleDeleteExpired(pre, 48*time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	for key := range storage.objects {
+		if key == markKey(backups[0]) || key == markKey("base_20181016T090000Z_000000010000000000000001") {
+			t.Errorf("delete marks: %s is kept", key)
+		}
+	}
+	for i, name := range backups {
+		_, ok := storage.objects["server/basebackups_005/"+name+"/tar_partitions/part_001.tar.lz4"]
+		if expected := i != 0; ok != expected {
+			t.Errorf("delete marks: expected %s kept %v but got %v", name, expected, ok)
+		}
+	}
+	if _, ok := storage.objects[markKey(backups[1])]; !ok {
+		t.Errorf("delete marks: mark within grace period is removed")
+	}
+}
+
+// softDeleteThenExpire marks backups by soft delete with args, ages the marks past grace period,
+// runs delete-expired and returns WAL left on storage
+func softDeleteThenExpire(t *testing.T, args ...string) map[string]bool {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	for _, name := range []string{
+		"base_20181017T090000Z_000000010000000000000002",
+		"base_20181017T100000Z_000000010000000000000004",
+		"base_20181017T110000Z_000000010000000000000006",
+	} {
+		storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix] = []byte("{}")
+	}
+	for _, name := range []string{"1", "2", "3", "4", "5", "6", "7"} {
+		storage.objects["server/wal_005/00000001000000000000000"+name+".lz4"] = []byte("wal")
+	}
+
+	os.Setenv("WALG_SOFT_DELETE", "true")
+	walg.HandleDelete(tu, pre, append([]string{"delete", "retain", "1", "--confirm"}, args...))
+	os.Unsetenv("WALG_SOFT_DELETE")
+	marks, err := walg.GetDeleteMarks(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 2 {
+		t.Fatalf("delete marks: expected 2 backups marked, got %v", marks)
+	}
+	for _, mark := range marks {
+		mark.MarkedAt = mark.MarkedAt.Add(-72 * time.Hour)
+		old, err := json.Marshal(mark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage.objects["server/delete_marks_005/"+mark.Name+walg.DeleteMarkSuffix] = old
+	}
+
+	if err := walg.HandleDeleteExpired(pre, 48*time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storage.objects["server/basebackups_005/base_20181017T090000Z_000000010000000000000002"+walg.SentinelSuffix]; ok {
+		t.Fatalf("delete marks: expired backup is kept")
+	}
+	wal := make(map[string]bool)
+	for key := range storage.objects {
+		if strings.HasPrefix(key, "server/wal_005/") {
+			wal[strings.TrimSuffix(strings.TrimPrefix(key, "server/wal_005/"), ".lz4")] = true
+		}
+	}
+	return wal
+}
+
+func TestDeleteExpiredAppliesNoWAL(t *testing.T) {
+	if wal := softDeleteThenExpire(t); len(wal) != 2 || !wal["000000010000000000000006"] {
+		t.Errorf("delete marks: expected WAL from the oldest kept backup left, got %v", wal)
+	}
+	if wal := softDeleteThenExpire(t, "--no-wal"); len(wal) != 7 {
+		t.Errorf("delete marks: expected WAL kept by --no-wal, got %v", wal)
+	}
+}
+
+func TestDeleteExpiredAppliesWALGrace(t *testing.T) {
+	wal := softDeleteThenExpire(t, "--until-wal=2")
+	if len(wal) != 4 || !wal["000000010000000000000004"] || wal["000000010000000000000003"] {
+		t.Errorf("delete marks: expected WAL kept 2 segments before the oldest kept backup, got %v", wal)
+	}
+}
+
+func TestDeleteExpiredPurgesMarkedEverything(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	for _, key := range []string{
+		"server/basebackups_005/base_000000010000000000000002" + walg.SentinelSuffix,
+		"server/basebackups_005/base_000000010000000000000002/tar_partitions/part_1.tar.lz4",
+		"server/wal_005/000000010000000000000002.lz4",
+		"server/wal_005/000000010000000000000003.lz4",
+		"server/restore_points_005/before_upgrade.json",
+		"other_server/wal_005/000000010000000000000002.lz4",
+	} {
+		storage.objects[key] = []byte("{}")
+	}
+
+	os.Setenv("WALG_SOFT_DELETE", "true")
+	walg.HandleDelete(tu, pre, []string{"delete", "everything", "--confirm"})
+	os.Unsetenv("WALG_SOFT_DELETE")
+	if err := walg.HandleDeleteExpired(pre, 48*time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.objects) != 7 {
+		t.Fatalf("delete marks: backup marked by delete everything is deleted within grace period")
+	}
+
+	key := "server/delete_marks_005/base_000000010000000000000002" + walg.DeleteMarkSuffix
+	var mark walg.DeleteMark
+	if err := json.Unmarshal(storage.objects[key], &mark); err != nil {
+		t.Fatal(err)
+	}
+	mark.MarkedAt = mark.MarkedAt.Add(-72 * time.Hour)
+	old, err := json.Marshal(mark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.objects[key] = old
+	if err := walg.HandleDeleteExpired(pre, 48*time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.objects) != 1 || storage.objects["other_server/wal_005/000000010000000000000002.lz4"] == nil {
+		t.Errorf("delete marks: expected only objects of other server kept but got %v", storage.objects)
+	}
+}
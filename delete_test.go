@@ -0,0 +1,147 @@
+package walg_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestDeleteRetainAfterKeepsDeltaChain(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	backups := []string{
+		"base_20181017T090000Z_000000010000000000000002",
+		"base_20181017T100000Z_000000010000000000000004",
+		"base_20181017T110000Z_000000010000000000000006",
+		"base_20181017T120000Z_000000010000000000000008",
+	}
+	for i, name := range backups {
+		lsn := uint64(0x2000028 + i*0x2000000)
+		sentinel := fmt.Sprintf(`{"LSN": %d, "FinishLSN": %d}`, lsn, lsn+0x100)
+		if i >= 2 {
+			// Deltas chain from the second full backup
+			sentinel = fmt.Sprintf(`{"LSN": %d, "FinishLSN": %d, "DeltaFrom": %q, "DeltaFromLSN": %d, "DeltaFullName": %q, "DeltaCount": %d}`,
+				lsn, lsn+0x100, backups[i-1], lsn-0x2000000, backups[1], i-1)
+		}
+		storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix] = []byte(sentinel)
+		storage.objects["server/basebackups_005/"+name+"/tar_partitions/part_001.tar.lz4"] = []byte("data")
+	}
+	for segment := 2; segment <= 8; segment++ {
+		storage.objects[fmt.Sprintf("server/wal_005/00000001000000000000000%d.lz4", segment)] = []byte("wal")
+	}
+
+	// Dry run deletes nothing
+	walg.HandleDelete(tu, pre, []string{"delete", "retain", "after", backups[3]})
+	for _, name := range backups {
+		if _, ok := storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix]; !ok {
+			t.Errorf("delete: dry run deleted %s", name)
+		}
+	}
+
+	walg.HandleDelete(tu, pre, []string{"delete", "retain", "after", backups[3], "--confirm"})
+	for i, name := range backups {
+		_, ok := storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix]
+		if expected := i != 0; ok != expected {
+			t.Errorf("delete: expected %s kept %v but got %v", name, expected, ok)
+		}
+	}
+	for segment := 2; segment <= 8; segment++ {
+		_, ok := storage.objects[fmt.Sprintf("server/wal_005/00000001000000000000000%d.lz4", segment)]
+		if expected := segment >= 4; ok != expected {
+			t.Errorf("delete: expected WAL segment %d kept %v but got %v", segment, expected, ok)
+		}
+	}
+}
+
+func TestDeleteReclaimsObsoleteWAL(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	// Cluster was promoted to timeline 2 after the second backup
+	backups := []string{
+		"base_20181017T090000Z_000000010000000000000002",
+		"base_20181017T100000Z_000000010000000000000005",
+		"base_20181017T110000Z_000000020000000000000008",
+	}
+	for _, name := range backups {
+		storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix] = []byte("{}")
+		storage.objects["server/basebackups_005/"+name+"/tar_partitions/part_001.tar.lz4"] = []byte("data")
+	}
+	wals := map[string]bool{
+		"000000010000000000000002.lzo":                 false,
+		"000000010000000000000003.lz4":                 false,
+		"000000010000000000000003.crc32":               false,
+		"000000010000000000000004.00000028.backup.lz4": false,
+		"000000010000000000000005.lz4":                 true,
+		"000000010000000000000007.partial.lz4":         true,
+		"00000002.history.lz4":                         true,
+		"000000020000000000000007.lz4":                 true,
+		"000000020000000000000008.lzo":                 true,
+		// Branch of a later timeline is kept whatever its segments are
+		"000000030000000000000003.lz4": true,
+	}
+	for wal := range wals {
+		storage.objects["server/wal_005/"+wal] = []byte("wal")
+	}
+
+	walg.HandleDelete(tu, pre, []string{"delete", "before", backups[1], "--no-wal", "--confirm"})
+	if _, ok := storage.objects["server/basebackups_005/"+backups[0]+walg.SentinelSuffix]; ok {
+		t.Fatalf("delete: %s is kept", backups[0])
+	}
+	for wal := range wals {
+		if _, ok := storage.objects["server/wal_005/"+wal]; !ok {
+			t.Errorf("delete: %s is deleted with --no-wal", wal)
+		}
+	}
+
+	// WAL left by the deletion above is reclaimed by the next one
+	walg.HandleDelete(tu, pre, []string{"delete", "before", backups[1], "--confirm"})
+	for wal, expected := range wals {
+		if _, ok := storage.objects["server/wal_005/"+wal]; ok != expected {
+			t.Errorf("delete: expected %s kept %v but got %v", wal, expected, ok)
+		}
+	}
+}
+
+func TestDeleteKeepsWALGraceBeforeOldestBackup(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	backups := []string{
+		"base_20181017T090000Z_000000010000000000000002",
+		"base_20181017T100000Z_000000010000000100000003",
+	}
+	for _, name := range backups {
+		storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix] = []byte("{}")
+	}
+	// Segments around the boundary of logical WAL file 1
+	wals := map[string]bool{
+		"0000000100000000000000FD.lz4": false,
+		"0000000100000000000000FE.lz4": true,
+		"0000000100000000000000FF.lz4": true,
+		"000000010000000100000000.lz4": true,
+		"000000010000000100000002.lz4": true,
+		"000000010000000100000003.lz4": true,
+	}
+	for wal := range wals {
+		storage.objects["server/wal_005/"+wal] = []byte("wal")
+	}
+
+	walg.HandleDelete(tu, pre, []string{"delete", "before", backups[1], "--until-wal=5", "--confirm"})
+	if _, ok := storage.objects["server/basebackups_005/"+backups[0]+walg.SentinelSuffix]; ok {
+		t.Fatalf("delete: %s is kept", backups[0])
+	}
+	for wal, expected := range wals {
+		if _, ok := storage.objects["server/wal_005/"+wal]; ok != expected {
+			t.Errorf("delete: expected %s kept %v but got %v", wal, expected, ok)
+		}
+	}
+
+	// Without grace only WAL before the oldest kept backup is deleted, the segment just before it is not kept
+	walg.HandleDelete(tu, pre, []string{"delete", "before", backups[1], "--until-wal", "--confirm"})
+	for wal, expected := range wals {
+		expected = expected && wal >= "000000010000000100000003"
+		if _, ok := storage.objects["server/wal_005/"+wal]; ok != expected {
+			t.Errorf("delete: expected %s kept %v without grace but got %v", wal, expected, ok)
+		}
+	}
+}
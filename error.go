@@ -52,3 +52,75 @@ func (e UnsupportedFileTypeError) Error() string {
 	msg := fmt.Sprintf("WAL-G does not support the file format '%s' in '%s'", e.FileFormat, e.Path)
 	return msg
 }
+
+// CompressedWALTooSmallError is used to abort wal-push of WAL segment
+// which compressed to implausibly small size, most likely due to a bug.
+type CompressedWALTooSmallError struct {
+	Path  string
+	Size  int64
+	Floor int64
+}
+
+func (e CompressedWALTooSmallError) Error() string {
+	msg := fmt.Sprintf("Compressed WAL '%s' is only %d bytes, less than WALG_WAL_MIN_COMPRESSED_SIZE %d bytes", e.Path, e.Size, e.Floor)
+	return msg
+}
+
+// ChecksumMismatchError is used to signal file of backup whose content
+// differs from CRC32C recorded by backup-push.
+type ChecksumMismatchError struct {
+	Name     string
+	Expected uint32
+	Actual   uint32
+}
+
+func (e ChecksumMismatchError) Error() string {
+	msg := fmt.Sprintf("Checksum %08x of '%s' does not match %08x recorded by backup-push", e.Actual, e.Name, e.Expected)
+	return msg
+}
+
+// WALChecksumMismatchError is used to signal downloaded WAL file whose
+// content differs from CRC32C recorded by wal-push.
+type WALChecksumMismatchError struct {
+	Name     string
+	Expected uint32
+	Actual   uint32
+}
+
+func (e WALChecksumMismatchError) Error() string {
+	msg := fmt.Sprintf("Checksum %08x of WAL file '%s' does not match %08x recorded by wal-push", e.Actual, e.Name, e.Expected)
+	return msg
+}
+
+// BackupNonExistenceError is used to signal backup which is
+// not present in storage.
+type BackupNonExistenceError struct {
+	Name string
+}
+
+func (e BackupNonExistenceError) Error() string {
+	msg := fmt.Sprintf("Backup '%s' does not exist.", e.Name)
+	return msg
+}
+
+// BackupIndexNonExistenceError is used to signal backup made by
+// older version of WAL-G, which did not upload index of its objects.
+type BackupIndexNonExistenceError struct {
+	Name string
+}
+
+func (e BackupIndexNonExistenceError) Error() string {
+	msg := fmt.Sprintf("Backup %s has no index, it was made by older version of WAL-G", e.Name)
+	return msg
+}
+
+// ArchiveNonExistenceError is used to signal WAL file which is
+// not present in storage with any of compressions.
+type ArchiveNonExistenceError struct {
+	Name string
+}
+
+func (e ArchiveNonExistenceError) Error() string {
+	msg := fmt.Sprintf("Archive '%s' does not exist.", e.Name)
+	return msg
+}
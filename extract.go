@@ -33,6 +33,11 @@ func (e EmptyWriteIgnorer) Write(p []byte) (int, error) {
 	return e.WriteCloser.Write(p)
 }
 
+// partitionRecorder is TarInterpreter which keeps track of completely extracted partitions
+type partitionRecorder interface {
+	PartitionExtracted(path string) error
+}
+
 // Extract exactly one tar bundle. Returns an error
 // upon failure. Able to configure behavior by passing
 // in different TarInterpreters.
@@ -77,15 +82,10 @@ func tarHandler(wc io.WriteCloser, rm ReaderMaker, crypter Crypter) error {
 		r = ReadCascadeClose{reader, r}
 	}
 
-	if rm.Format() == "lzo" {
-		err = DecompressLzo(wc, r)
-		if err != nil {
-			return errors.Wrap(err, "ExtractAll: lzo decompress failed. Is archive encrypted?")
-		}
-	} else if rm.Format() == "lz4" {
-		_, err = DecompressLz4(wc, r)
+	if decompressor := GetDecompressor(rm.Format()); decompressor != nil {
+		_, err = decompressor.Decompress(wc, r)
 		if err != nil {
-			return errors.Wrap(err, "ExtractAll: lz4 decompress failed. Is archive encrypted?")
+			return errors.Wrapf(err, "ExtractAll: %s decompress failed. Is archive encrypted?", rm.Format())
 		}
 	} else if rm.Format() == "tar" {
 		_, err = io.Copy(wc, r)
@@ -99,11 +99,17 @@ func tarHandler(wc io.WriteCloser, rm ReaderMaker, crypter Crypter) error {
 	return nil
 }
 
-// ExtractAll Handles all files passed in. Supports `.lzo`, `.lz4, and `.tar`.
+// ExtractAll Handles all files passed in. Supports `.tar` and extensions of registered codecs,
+// `.lzo`, `.lz4` and `.zst`.
 // File type `.nop` is used for testing purposes. Each file is extracted
 // in its own goroutine and ExtractAll will wait for all goroutines to finish.
 // Returns the first error encountered.
 func ExtractAll(ti TarInterpreter, files []ReaderMaker) error {
+	return extractAll(ti, files, NewCrypter())
+}
+
+// extractAll is ExtractAll decrypting files with crypter
+func extractAll(ti TarInterpreter, files []ReaderMaker, crypter Crypter) error {
 	if len(files) < 1 {
 		return errors.New("ExtractAll: did not provide files to extract")
 	}
@@ -111,24 +117,34 @@ func ExtractAll(ti TarInterpreter, files []ReaderMaker) error {
 	var err error
 	sem := make(chan Empty, len(files))
 	collectAll := make(chan error)
-	defer close(collectAll)
+	collected := make(chan Empty)
 	go func() {
 		for e := range collectAll {
 			if e != nil {
-				err = e
+				// Checksum mismatch is returned as is, and not replaced by failures it causes
+				// in other goroutines, so callers can tell it from other failures
+				if mismatch, ok := errors.Cause(e).(ChecksumMismatchError); ok {
+					e = mismatch
+				}
+				if _, ok := err.(ChecksumMismatchError); !ok {
+					err = e
+				}
 			}
 		}
+		close(collected)
 	}()
 
-	// Set maximum number of goroutines spun off by ExtractAll
-	var con = getMaxDownloadConcurrency(min(len(files), 10))
+	// Set maximum number of goroutines spun off by ExtractAll,
+	// there is no use in more workers than files
+	var con = min(getMaxDownloadConcurrency(min(len(files), 10)), len(files))
 
 	concurrent := make(chan Empty, con)
 	for i := 0; i < con; i++ {
 		concurrent <- Empty{}
 	}
 
-	var crypter OpenPGPCrypter
+	// Configure once, before goroutines share the crypter
+	crypter.IsUsed()
 
 	for i, val := range files {
 		<-concurrent
@@ -145,7 +161,7 @@ func ExtractAll(ti TarInterpreter, files []ReaderMaker) error {
 			collectLow := make(chan error)
 
 			go func() {
-				collectLow <- tarHandler(pw, val, &crypter)
+				collectLow <- tarHandler(pw, val, crypter)
 			}()
 
 			// Collect errors returned by extractOne.
@@ -159,23 +175,52 @@ func ExtractAll(ti TarInterpreter, files []ReaderMaker) error {
 
 			finishedTop := false
 			finishedLow := false
+			failed := false
 
 			for !(finishedTop && finishedLow) {
 				select {
 				case err := <-collectTop:
 					finishedTop = true
+					failed = failed || err != nil
 					collectAll <- err
 				case err := <-collectLow:
 					finishedLow = true
+					failed = failed || err != nil
 					collectAll <- err
 				}
 			}
 
+			if recorder, ok := ti.(partitionRecorder); ok && !failed {
+				collectAll <- recorder.PartitionExtracted(val.Path())
+			}
+
 		}(i, val)
 	}
 
 	for i := 0; i < len(files); i++ {
 		<-sem
 	}
+	// Wait for the last error to be collected
+	close(collectAll)
+	<-collected
 	return err
 }
+
+// ExtractBackup extracts backup in two phases. All partitions are extracted
+// concurrently, bounded by WALG_DOWNLOAD_CONCURRENCY, and only after every one
+// of them has completed pgControl is extracted. pg_control must be written last:
+// a directory with pg_control looks like a complete cluster to Postgres.
+// pgControl may be nil for backups which keep pg_control among partitions.
+// crypter decrypts objects of the backup, see NewBackupCrypter.
+func ExtractBackup(ti TarInterpreter, partitions []ReaderMaker, pgControl ReaderMaker, crypter Crypter) error {
+	if len(partitions) > 0 {
+		err := extractAll(ti, partitions, crypter)
+		if err != nil {
+			return err
+		}
+	}
+	if pgControl == nil {
+		return nil
+	}
+	return extractAll(ti, []ReaderMaker{pgControl}, crypter)
+}
@@ -1,13 +1,18 @@
 package walg_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"fmt"
 	"github.com/wal-g/wal-g"
 	"github.com/wal-g/wal-g/test_tools"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNoFilesProvided(t *testing.T) {
@@ -193,3 +198,116 @@ func BenchmarkExtractAll(b *testing.B) {
 	}
 
 }
+
+// Records order in which files are extracted
+type orderTarInterpreter struct {
+	mutex sync.Mutex
+	names []string
+}
+
+func (o *orderTarInterpreter) Interpret(r io.Reader, hdr *tar.Header) error {
+	// Make partitions finish out of order
+	if hdr.Name != "global/pg_control" {
+		time.Sleep(time.Duration(len(hdr.Name)%3) * 10 * time.Millisecond)
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.names = append(o.names, hdr.Name)
+	return nil
+}
+
+func makeTarReaderMaker(t *testing.T, name string) *BufferReaderMaker {
+	member := &bytes.Buffer{}
+	tw := tar.NewWriter(member)
+	err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &BufferReaderMaker{member, name, "tar"}
+}
+
+func TestExtractBackupPgControlLast(t *testing.T) {
+	var partitions []walg.ReaderMaker
+	for i := 0; i < 20; i++ {
+		partitions = append(partitions, makeTarReaderMaker(t, fmt.Sprintf("base/1/%d", i)))
+	}
+	interpreter := &orderTarInterpreter{}
+
+	err := walg.ExtractBackup(interpreter, partitions, makeTarReaderMaker(t, "global/pg_control"), &walg.OpenPGPCrypter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interpreter.names) != len(partitions)+1 {
+		t.Fatalf("extract: expected %d files, got %d", len(partitions)+1, len(interpreter.names))
+	}
+	if last := interpreter.names[len(interpreter.names)-1]; last != "global/pg_control" {
+		t.Errorf("extract: pg_control was extracted before %s", last)
+	}
+}
+
+func TestExtractBackupConcurrentFiles(t *testing.T) {
+	os.Setenv("WALG_DOWNLOAD_CONCURRENCY", "4")
+	defer os.Unsetenv("WALG_DOWNLOAD_CONCURRENCY")
+	dir, err := ioutil.TempDir("", "concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Partitions share directories which none of them has a header of
+	var partitions []walg.ReaderMaker
+	for i := 0; i < 16; i++ {
+		name := fmt.Sprintf("base/%d/%d", i%3, i)
+		partitions = append(partitions, &BufferReaderMaker{makeTestTar(t, name), name, "tar"})
+	}
+	interpreter := &walg.FileTarInterpreter{NewDir: dir}
+	err = walg.ExtractBackup(interpreter, partitions, makeTarReaderMaker(t, "global/pg_control"), &walg.OpenPGPCrypter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 16; i++ {
+		name := fmt.Sprintf("base/%d/%d", i%3, i)
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(content) != "content of "+name {
+			t.Errorf("extract: %s restored as %q, %v", name, content, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "global/pg_control")); err != nil {
+		t.Errorf("extract: pg_control was not restored: %v", err)
+	}
+}
+
+func TestZstdTar(t *testing.T) {
+	os.Setenv("WALG_COMPRESSION_METHOD", "zstd")
+	defer os.Unsetenv("WALG_COMPRESSION_METHOD")
+
+	b := bytes.Repeat([]byte("wal-g zstd "), 1000)
+	member := &bytes.Buffer{}
+	tools.CreateTar(member, &io.LimitedReader{
+		R: bytes.NewReader(b),
+		N: int64(len(b)),
+	})
+	lz := &walg.LzPipeWriter{Input: member}
+	lz.Compress(walg.MockDisarmedCrypter())
+	compressed, err := ioutil.ReadAll(lz.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sentinel := &walg.S3TarBallSentinelDto{CompressionMethod: walg.ZstdCompressionMethod}
+	key := "base/tar_partitions/part_001.tar.zst"
+	brm := &BufferReaderMaker{bytes.NewBuffer(compressed), key, sentinel.GetPartitionFormat(key)}
+	buf := &tools.BufferTarInterpreter{}
+	err = walg.ExtractAll(buf, []walg.ReaderMaker{brm})
+	if err != nil {
+		t.Fatalf("extract: expected zstd partition to be extracted but got %+v", err)
+	}
+	if !bytes.Equal(b, buf.Out) {
+		t.Error("extract: Unbundled zstd tar output does not match input.")
+	}
+}
@@ -0,0 +1,186 @@
+package walg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FetchProgressFileName is the marker backup-fetch keeps in restored directory
+// until restore completes. It lists what is already extracted, so an interrupted
+// restore is continued by backup-fetch --resume instead of starting over.
+const FetchProgressFileName = "walg_fetch_progress"
+
+// FetchProgress records steps of delta chain, partitions and tar members which are
+// completely extracted. Members are recorded after they are synced to disk, so a
+// lost record makes only a member extracted again. A nil FetchProgress records nothing.
+type FetchProgress struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+
+	// resumed steps were started by an interrupted backup-fetch
+	resumed map[string]bool
+	done    map[string]bool
+	// extracted holds members and partitions of each step
+	extracted map[string]map[string]bool
+	// records counts lines of marker, empty marker is not kept
+	records int
+}
+
+// OpenFetchProgress creates progress marker in dir. With resume, progress recorded
+// by interrupted backup-fetch is read. Without it, the marker must not exist:
+// the directory holds an unfinished restore, which would be lost.
+func OpenFetchProgress(dir string, resume bool) (*FetchProgress, error) {
+	progress := &FetchProgress{
+		path:      filepath.Join(dir, FetchProgressFileName),
+		resumed:   make(map[string]bool),
+		done:      make(map[string]bool),
+		extracted: make(map[string]map[string]bool),
+	}
+	_, err := os.Stat(progress.path)
+	if err == nil && !resume {
+		return nil, errors.Errorf("Directory %v has unfinished restore, use --resume to continue it", dir)
+	}
+	if err == nil {
+		err = progress.read()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "OpenFetchProgress: failed to check progress marker")
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrapf(err, "OpenFetchProgress: failed to create %s", dir)
+	}
+	progress.file, err = os.OpenFile(progress.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "OpenFetchProgress: failed to open progress marker")
+	}
+	return progress, nil
+}
+
+// read parses records of interrupted backup-fetch. The last line may be cut by
+// the interruption, it is ignored.
+func (progress *FetchProgress) read() error {
+	file, err := os.Open(progress.path)
+	if err != nil {
+		return errors.Wrap(err, "OpenFetchProgress: failed to read progress marker")
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		progress.records++
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 3)
+		switch {
+		case fields[0] == "start" && len(fields) == 2:
+			progress.resumed[fields[1]] = true
+		case fields[0] == "done" && len(fields) == 2:
+			progress.done[fields[1]] = true
+		case fields[0] == "file" && len(fields) == 3:
+			progress.markExtracted(fields[1], fields[2])
+		}
+	}
+	return nil
+}
+
+func (progress *FetchProgress) markExtracted(backupName, name string) {
+	if progress.extracted[backupName] == nil {
+		progress.extracted[backupName] = make(map[string]bool)
+	}
+	progress.extracted[backupName][name] = true
+}
+
+func (progress *FetchProgress) record(format string, args ...interface{}) error {
+	progress.records++
+	_, err := fmt.Fprintf(progress.file, format+"\n", args...)
+	if err != nil {
+		return errors.Wrap(err, "FetchProgress: failed to record progress")
+	}
+	return nil
+}
+
+// IsResumed tells whether restore of backup was started by interrupted backup-fetch
+func (progress *FetchProgress) IsResumed(backupName string) bool {
+	return progress != nil && progress.resumed[backupName]
+}
+
+// IsDone tells whether backup is completely restored
+func (progress *FetchProgress) IsDone(backupName string) bool {
+	return progress != nil && progress.done[backupName]
+}
+
+// IsExtracted tells whether member or partition of backup is completely extracted
+func (progress *FetchProgress) IsExtracted(backupName, name string) bool {
+	if progress == nil {
+		return false
+	}
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	return progress.extracted[backupName][name]
+}
+
+// Start records that files of backup are being extracted
+func (progress *FetchProgress) Start(backupName string) error {
+	if progress == nil {
+		return nil
+	}
+	return progress.record("start %s", backupName)
+}
+
+// Extracted records that member or partition of backup is completely extracted
+func (progress *FetchProgress) Extracted(backupName, name string) error {
+	if progress == nil {
+		return nil
+	}
+	progress.mutex.Lock()
+	defer progress.mutex.Unlock()
+	progress.markExtracted(backupName, name)
+	return progress.record("file %s %s", backupName, name)
+}
+
+// Done records that backup is completely restored
+func (progress *FetchProgress) Done(backupName string) error {
+	if progress == nil {
+		return nil
+	}
+	progress.done[backupName] = true
+	return progress.record("done %s", backupName)
+}
+
+// Close closes marker, which is kept for backup-fetch --resume
+// unless nothing was extracted
+func (progress *FetchProgress) Close() error {
+	if progress == nil {
+		return nil
+	}
+	if progress.records == 0 {
+		return progress.Remove()
+	}
+	return progress.file.Close()
+}
+
+// Remove deletes marker of completed restore
+func (progress *FetchProgress) Remove() error {
+	if progress == nil {
+		return nil
+	}
+	progress.file.Close()
+	err := os.Remove(progress.path)
+	if err != nil {
+		return errors.Wrap(err, "FetchProgress: failed to remove progress marker")
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package walg_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/wal-g/wal-g"
+)
+
+// interruptingStorage fails download of partitions containing failKey, as if fetch was killed
+type interruptingStorage struct {
+	*mapStorage
+	failKey   string
+	mutex     sync.Mutex
+	downloads []string
+}
+
+func (s *interruptingStorage) GetArchive(key string) (io.ReadCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if strings.Contains(key, "tar_partitions") {
+		s.downloads = append(s.downloads, key)
+	}
+	if s.failKey != "" && strings.Contains(key, s.failKey) {
+		return nil, errors.New("connection lost")
+	}
+	return s.mapStorage.GetArchive(key)
+}
+
+func TestBackupFetchResume(t *testing.T) {
+	storage := &interruptingStorage{mapStorage: &mapStorage{objects: make(map[string][]byte)}}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	os.Setenv("WALG_DOWNLOAD_CONCURRENCY", "1")
+	defer os.Unsetenv("WALG_DOWNLOAD_CONCURRENCY")
+
+	dir, err := ioutil.TempDir("", "walg_resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	files := map[string]string{
+		"base/1/1259":       "first relation",
+		"base/1/1260":       "second relation",
+		"base/1/1261":       "third relation",
+		"base/1/1262":       "fourth relation",
+		"global/pg_control": "control",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(data, name)), 0700)
+		if err := ioutil.WriteFile(filepath.Join(data, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backupName := "base_000000010000000000000002_00000040"
+	bundle := &walg.Bundle{MinSize: 10, Files: &sync.Map{}}
+	bundle.Tbm = &walg.S3TarBallMaker{BaseDir: "data", Trim: data, BkupName: backupName, Tu: tu}
+	bundle.StartQueue()
+	if err = filepath.Walk(data, bundle.TarWalker); err != nil {
+		t.Fatal(err)
+	}
+	if err = bundle.FinishQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if err = bundle.HandleSentinel(); err != nil {
+		t.Fatal(err)
+	}
+	tu.Finish()
+	storage.objects["server/basebackups_005/"+backupName+walg.SentinelSuffix] = []byte("{}")
+	var partitions int
+	for key := range storage.objects {
+		if strings.Contains(key, "tar_partitions") {
+			partitions++
+		}
+	}
+	if partitions < 3 {
+		t.Fatalf("resume: expected backup of several partitions but got %d", partitions)
+	}
+
+	// Fetch dies on the second partition, leaving a partially written file behind
+	storage.failKey = "part_002.tar"
+	restored := filepath.Join(dir, "restored")
+	_, err = walg.HandleBackupFetch(backupName, pre, restored, false, walg.BackupFetchOptions{})
+	if err == nil {
+		t.Fatalf("resume: interrupted fetch succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(restored, walg.FetchProgressFileName)); err != nil {
+		t.Fatalf("resume: progress of interrupted fetch is not kept: %v", err)
+	}
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(restored, name)); os.IsNotExist(err) {
+			ioutil.WriteFile(filepath.Join(restored, name), []byte("partial"), 0600)
+			break
+		}
+	}
+
+	_, err = walg.HandleBackupFetch(backupName, pre, restored, false, walg.BackupFetchOptions{})
+	if err == nil || !strings.Contains(err.Error(), "--resume") {
+		t.Errorf("resume: fetch over unfinished restore expected to fail but got %v", err)
+	}
+
+	storage.failKey = ""
+	storage.downloads = nil
+	_, err = walg.HandleBackupFetch(backupName, pre, restored, false, walg.BackupFetchOptions{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pg_control is extracted after all partitions, so interrupted fetch has not reached it
+	if len(storage.downloads) != 2 || !strings.Contains(storage.downloads[0], "part_002.tar") {
+		t.Errorf("resume: expected only the interrupted partition and pg_control to be downloaded again but got %v", storage.downloads)
+	}
+	for name, content := range files {
+		if fetched, _ := ioutil.ReadFile(filepath.Join(restored, name)); string(fetched) != content {
+			t.Errorf("resume: restored %s differs: %q", name, fetched)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(restored, walg.FetchProgressFileName)); !os.IsNotExist(err) {
+		t.Errorf("resume: progress marker is left after complete restore")
+	}
+}
+
+func TestFetchProgressCutRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg_resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	records := "start base_1\nfile base_1 base/1/1259\nfile base_1 base/1/12"
+	err = ioutil.WriteFile(filepath.Join(dir, walg.FetchProgressFileName), []byte(records), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err := walg.OpenFetchProgress(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer progress.Close()
+	if !progress.IsResumed("base_1") || progress.IsDone("base_1") {
+		t.Errorf("resume: expected base_1 to be started but not done")
+	}
+	if !progress.IsExtracted("base_1", "base/1/1259") {
+		t.Errorf("resume: recorded member is not extracted")
+	}
+	if progress.IsExtracted("base_1", "base/1/12") {
+		t.Errorf("resume: member of cut record is trusted")
+	}
+}
@@ -0,0 +1,85 @@
+package walg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoBackupForTargetLSN happens when all backups finished after recovery target
+var ErrNoBackupForTargetLSN = errors.New("No backup finished before target LSN")
+
+// ParseTargetLSN parses LSN given to backup-fetch --target-lsn in Postgres format, e.g. 0/3000028
+func ParseTargetLSN(lsnStr string) (uint64, error) {
+	if !strings.Contains(lsnStr, "/") {
+		return 0, errors.Errorf("ParseTargetLSN: invalid LSN '%s', expected format like 0/3000028", lsnStr)
+	}
+	return ParseLsn(lsnStr)
+}
+
+// CheckBackupTargetLSN fails if recovery of backup cannot stop at target. Backup is
+// consistent only once WAL is replayed up to its FinishLSN, recovery stopping before
+// that leaves an inconsistent cluster. Backups without LSNs in sentinel are not checked.
+func CheckBackupTargetLSN(backupName string, sentinel S3TarBallSentinelDto, target uint64) error {
+	if sentinel.LSN == nil || sentinel.FinishLSN == nil {
+		fmt.Printf("WARNING: sentinel of %v has no LSNs, it is not checked against target LSN\n", backupName)
+		return nil
+	}
+	if *sentinel.FinishLSN > target {
+		return errors.Errorf("Backup %v finished at LSN %x after target LSN %x, recovery cannot stop at the target", backupName, *sentinel.FinishLSN, target)
+	}
+	return nil
+}
+
+// FindTargetLSNBackup chooses the latest backup which became consistent at or before target.
+// Backups without LSNs in sentinel cannot be correlated and are not chosen.
+func FindTargetLSNBackup(sentinels map[string]S3TarBallSentinelDto, target uint64) (string, error) {
+	found := ""
+	var foundLSN uint64
+	for name, sentinel := range sentinels {
+		if sentinel.LSN == nil || sentinel.FinishLSN == nil || *sentinel.FinishLSN > target {
+			continue
+		}
+		if found == "" || *sentinel.FinishLSN > foundLSN {
+			found = name
+			foundLSN = *sentinel.FinishLSN
+		}
+	}
+	if found == "" {
+		return "", ErrNoBackupForTargetLSN
+	}
+	return found, nil
+}
+
+// resolveTargetLSNBackup checks backup against target LSN, LATEST is resolved to the
+// latest backup suitable for the target
+func resolveTargetLSNBackup(backupName string, pre *Prefix, target uint64) (string, error) {
+	bk := &Backup{Prefix: pre, Path: GetBackupPath(pre)}
+	if backupName != "LATEST" {
+		sentinel, err := readSentinel(backupName, bk, pre)
+		if err != nil {
+			return "", err
+		}
+		return backupName, CheckBackupTargetLSN(backupName, sentinel, target)
+	}
+
+	backups, err := bk.GetBackups()
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, len(backups))
+	for i, b := range backups {
+		names[i] = b.Name
+	}
+	sentinels, err := FetchSentinels(names, bk, pre)
+	if err != nil {
+		return "", err
+	}
+	backupName, err = FindTargetLSNBackup(sentinels, target)
+	if err != nil {
+		return "", errors.Wrapf(err, "target LSN %x", target)
+	}
+	fmt.Printf("Backup %v is the latest finished before target LSN %x\n", backupName, target)
+	return backupName, nil
+}
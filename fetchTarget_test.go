@@ -0,0 +1,67 @@
+package walg_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestBackupFetchTargetLSN(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_target_lsn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	older := "base_20181017T090000Z_000000010000000000000002"
+	newer := "base_20181017T100000Z_000000010000000000000004"
+	for i, name := range []string{older, newer} {
+		data := filepath.Join(dir, "data"+name)
+		os.MkdirAll(filepath.Join(data, "global"), 0700)
+		if err = ioutil.WriteFile(filepath.Join(data, "PG_VERSION"), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(data, "global", "pg_control"), []byte("control"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		pushTestBackup(t, tu, pre, data, name)
+		lsn := uint64(0x2000028 + i*0x2000000)
+		sentinel := fmt.Sprintf(`{"LSN": %d, "FinishLSN": %d}`, lsn, lsn+0x100)
+		storage.objects["server/basebackups_005/"+name+walg.SentinelSuffix] = []byte(sentinel)
+	}
+
+	if _, err = walg.ParseTargetLSN("3000000"); err == nil {
+		t.Errorf("targetLSN: parsed LSN without '/'")
+	}
+	// Newer backup starts before target, but becomes consistent after it
+	target, err := walg.ParseTargetLSN("0/4000100")
+	if err != nil || target != 0x4000100 {
+		t.Fatalf("targetLSN: expected %x but got %x, %v", 0x4000100, target, err)
+	}
+	options := walg.BackupFetchOptions{TargetLSN: &target}
+	_, err = walg.HandleBackupFetch(newer, pre, filepath.Join(dir, "refused"), false, options)
+	if err == nil {
+		t.Errorf("targetLSN: backup finished after target is fetched")
+	}
+
+	restored := filepath.Join(dir, "restored")
+	lsn, err := walg.HandleBackupFetch("LATEST", pre, restored, false, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := ioutil.ReadFile(filepath.Join(restored, "PG_VERSION")); string(version) != older || *lsn != 0x2000028 {
+		t.Errorf("targetLSN: expected %s to be fetched as LATEST but got %s", older, version)
+	}
+
+	target = 0x2000000
+	_, err = walg.HandleBackupFetch("LATEST", pre, filepath.Join(dir, "none"), false, options)
+	if err == nil {
+		t.Errorf("targetLSN: expected no backup before LSN %x", target)
+	}
+}
@@ -0,0 +1,198 @@
+package walg
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// fileStorageTmpPrefix starts names of files being written by FileStorage.Put,
+// they are not objects until renamed
+const fileStorageTmpPrefix = ".walg-tmp-"
+
+// FileStorage keeps objects as files under Root, e.g. on a local disk or NFS mount,
+// object key is the path of file relative to Root. Files are fsynced together with
+// their directories, so a written object survives a crash.
+type FileStorage struct {
+	Root string
+}
+
+// NewFileStorage creates storage of directory root
+func NewFileStorage(root string) *FileStorage {
+	return &FileStorage{Root: root}
+}
+
+func (s *FileStorage) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(key))
+}
+
+func (s *FileStorage) key(path string) (string, error) {
+	rel, err := filepath.Rel(s.Root, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// GetArchive opens file of key
+func (s *FileStorage) GetArchive(key string) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "FileStorage GetArchive: failed to open %s", key)
+	}
+	return file, nil
+}
+
+// Put writes object under temporary name and renames it once it is synced,
+// so readers never see a partial object
+func (s *FileStorage) Put(key string, r io.Reader) error {
+	path := s.path(key)
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "FileStorage Put: failed to create directory of %s", key)
+	}
+	tmp, err := ioutil.TempFile(dir, fileStorageTmpPrefix)
+	if err != nil {
+		return errors.Wrapf(err, "FileStorage Put: failed to create %s", key)
+	}
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "FileStorage Put: failed to write %s", key)
+	}
+	return syncDir(dir)
+}
+
+// Exists tells whether file of key exists
+func (s *FileStorage) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "FileStorage Exists: failed to stat %s", key)
+	}
+	return true, nil
+}
+
+// listDir splits prefix, which may end in the middle of file name like WAL files
+// of a timeline, into directory and the start of names
+func (s *FileStorage) listDir(prefix string) string {
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		return s.path(prefix[:i])
+	}
+	return s.Root
+}
+
+func (s *FileStorage) object(path string, info os.FileInfo) (StorageObject, error) {
+	key, err := s.key(path)
+	if err != nil {
+		return StorageObject{}, errors.Wrapf(err, "FileStorage: %s is outside of %s", path, s.Root)
+	}
+	return StorageObject{Key: key, LastModified: info.ModTime(), Size: info.Size()}, nil
+}
+
+// List returns files directly under prefix
+func (s *FileStorage) List(prefix string) ([]StorageObject, error) {
+	prefix = sanitizePath(prefix)
+	dir := s.listDir(prefix)
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "FileStorage List: failed to read %s", dir)
+	}
+	var objects []StorageObject
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), fileStorageTmpPrefix) {
+			continue
+		}
+		object, err := s.object(filepath.Join(dir, info.Name()), info)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(object.Key, prefix) {
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// ListAll returns files under prefix at any depth
+func (s *FileStorage) ListAll(prefix string) ([]StorageObject, error) {
+	prefix = sanitizePath(prefix)
+	dir := s.listDir(prefix)
+	var objects []StorageObject
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), fileStorageTmpPrefix) {
+			return nil
+		}
+		object, err := s.object(path, info)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(object.Key, prefix) {
+			objects = append(objects, object)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "FileStorage ListAll: failed to walk %s", dir)
+	}
+	return objects, nil
+}
+
+// Delete removes files of keys and directories left empty by them
+func (s *FileStorage) Delete(keys []string) error {
+	for _, key := range keys {
+		path := s.path(key)
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "FileStorage Delete: failed to remove %s", key)
+		}
+		// Removal of directory which is not empty fails, which ends the cleanup
+		for dir := filepath.Dir(path); dir != filepath.Clean(s.Root) && strings.HasPrefix(dir, s.Root); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// configureFileStorage creates uploader and prefix of file:///path URL,
+// objects are kept in the directory of path
+func configureFileStorage(u *url.URL) (*TarUploader, *Prefix, error) {
+	if u.Path == "" || u.Path == "/" {
+		return nil, nil, errors.Errorf("configureFileStorage: no directory in %s", u)
+	}
+	root := filepath.FromSlash(strings.TrimSuffix(u.Path, "/"))
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "configureFileStorage: failed to create %s", root)
+	}
+	upload, pre := ConfigureStorageBackend(NewFileStorage(root), "")
+	return upload, pre, nil
+}
@@ -0,0 +1,184 @@
+package walg_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+// pushTestBackup uploads files of data directory as backup with empty sentinel
+func pushTestBackup(t *testing.T, tu *walg.TarUploader, pre *walg.Prefix, data string, name string) {
+	bundle := &walg.Bundle{MinSize: 10, Files: &sync.Map{}}
+	bundle.Tbm = &walg.S3TarBallMaker{BaseDir: "data", Trim: data, BkupName: name, Tu: tu}
+	bundle.StartQueue()
+	if err := filepath.Walk(data, bundle.TarWalker); err != nil {
+		t.Fatal(err)
+	}
+	if err := bundle.FinishQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bundle.HandleSentinel(); err != nil {
+		t.Fatal(err)
+	}
+	tu.Finish()
+	err := pre.Storage().Put(*walg.GetBackupPath(pre)+name+walg.SentinelSuffix, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStorageCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg_file_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("WALE_S3_PREFIX", "file://"+filepath.ToSlash(filepath.Join(dir, "storage")))
+	defer os.Unsetenv("WALE_S3_PREFIX")
+	tu, pre, err := walg.Configure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := filepath.Join(dir, "data")
+	files := map[string]string{
+		"base/1/1259":       "first relation",
+		"base/1/1260":       "second relation",
+		"global/pg_control": "control",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(data, name)), 0700)
+		if err := ioutil.WriteFile(filepath.Join(data, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	older := "base_20181017T090000Z_000000010000000000000002"
+	newer := "base_20181017T100000Z_000000010000000000000004"
+	pushTestBackup(t, tu, pre, data, older)
+	pushTestBackup(t, tu, pre, data, newer)
+
+	walName := "000000010000000000000004"
+	wal := make([]byte, walg.WalSegmentSize)
+	copy(wal, "wal-g")
+	if err = ioutil.WriteFile(filepath.Join(dir, walName), wal, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tu.UploadWal(filepath.Join(dir, walName), pre, false); err != nil {
+		t.Fatal(err)
+	}
+
+	bk := &walg.Backup{Prefix: pre, Path: walg.GetBackupPath(pre)}
+	backups, err := bk.GetBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].Name != newer {
+		t.Fatalf("fileStorage: expected both backups listed but got %v", backups)
+	}
+	bk.Name = &newer
+	keys, err := bk.GetKeys()
+	if err != nil || len(keys) == 0 {
+		t.Errorf("fileStorage: expected partitions of %s but got %v, %v", newer, keys, err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if _, err = walg.HandleBackupFetch("LATEST", pre, restored, false, walg.BackupFetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if fetched, _ := ioutil.ReadFile(filepath.Join(restored, name)); string(fetched) != content {
+			t.Errorf("fileStorage: restored %s differs: %q", name, fetched)
+		}
+	}
+	location := filepath.Join(dir, "fetched")
+	if found, err := walg.DownloadWALFile(pre, walName, location); err != nil || !found {
+		t.Fatalf("fileStorage: uploaded WAL is not found: %v", err)
+	}
+	if fetched, _ := ioutil.ReadFile(location); !bytes.Equal(wal, fetched) {
+		t.Errorf("fileStorage: fetched WAL differs from uploaded one")
+	}
+
+	walg.HandleDelete(tu, pre, []string{"delete", "retain", "1", "--confirm"})
+	backups, err = bk.GetBackups()
+	if err != nil || len(backups) != 1 || backups[0].Name != newer {
+		t.Errorf("fileStorage: expected only %s after delete but got %v, %v", newer, backups, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "storage", "basebackups_005", older)); !os.IsNotExist(err) {
+		t.Errorf("fileStorage: directory of deleted backup is left: %v", err)
+	}
+}
+
+func TestCopyBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg_copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tu, src, err := walg.ConfigurePrefix("file://" + filepath.ToSlash(filepath.Join(dir, "src")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstTu, dst, err := walg.ConfigurePrefix("file://" + filepath.ToSlash(filepath.Join(dir, "dst")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := filepath.Join(dir, "data")
+	files := map[string]string{
+		"base/1/1259":       "relation",
+		"global/pg_control": "control",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(data, name)), 0700)
+		if err := ioutil.WriteFile(filepath.Join(data, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := "base_20181017T090000Z_000000010000000000000002"
+	delta := "base_20181017T100000Z_000000010000000000000004_D_000000010000000000000002"
+	other := "base_20181017T110000Z_000000010000000000000006"
+	pushTestBackup(t, tu, src, data, base)
+	pushTestBackup(t, tu, src, data, delta)
+	pushTestBackup(t, tu, src, data, other)
+	sentinel := fmt.Sprintf(`{"DeltaFrom":%q}`, base)
+	err = src.Storage().Put(*walg.GetBackupPath(src)+delta+walg.SentinelSuffix, strings.NewReader(sentinel))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = walg.HandleCopy(src, dstTu, dst, delta, true); err != nil {
+		t.Fatal(err)
+	}
+	bk := &walg.Backup{Prefix: dst, Path: walg.GetBackupPath(dst)}
+	backups, err := bk.GetBackups()
+	if err != nil || len(backups) != 2 || backups[0].Name != delta || backups[1].Name != base {
+		t.Fatalf("copy: expected delta and its base in destination but got %v, %v", backups, err)
+	}
+
+	if err = walg.HandleCopy(src, dstTu, dst, "LATEST", false); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(dir, "restored")
+	if _, err = walg.HandleBackupFetch(other, dst, restored, false, walg.BackupFetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if fetched, _ := ioutil.ReadFile(filepath.Join(restored, name)); string(fetched) != content {
+			t.Errorf("copy: restored %s differs: %q", name, fetched)
+		}
+	}
+
+	if err = walg.HandleCopy(src, dstTu, dst, walg.CopyAllBackups, false); err != nil {
+		t.Fatal(err)
+	}
+	if backups, err = bk.GetBackups(); err != nil || len(backups) != 3 {
+		t.Errorf("copy: expected all backups in destination but got %v, %v", backups, err)
+	}
+}
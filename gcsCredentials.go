@@ -0,0 +1,214 @@
+package walg
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gcsScope            = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsDefaultTokenURI  = "https://oauth2.googleapis.com/token"
+	gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	// Token is refreshed this long before it expires
+	gcsTokenSlack = time.Minute
+)
+
+// GCSCredentials is the JSON file GOOGLE_APPLICATION_CREDENTIALS points to,
+// either of a service account or of a user authorized by gcloud
+type GCSCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type gcsTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// gcsCachedToken keeps access token until it is about to expire
+type gcsCachedToken struct {
+	mutex  sync.Mutex
+	fetch  func() (gcsTokenResponse, error)
+	token  string
+	expiry time.Time
+}
+
+func (c *gcsCachedToken) Token() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.token != "" && time.Now().Add(gcsTokenSlack).Before(c.expiry) {
+		return c.token, nil
+	}
+	response, err := c.fetch()
+	if err != nil {
+		return "", err
+	}
+	if response.AccessToken == "" {
+		return "", errors.New("Token: no access token in response")
+	}
+	c.token = response.AccessToken
+	c.expiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// newGCSTokenSource reads credentials of GOOGLE_APPLICATION_CREDENTIALS, without it
+// tokens are requested from metadata server of GCE instance
+func newGCSTokenSource(client *http.Client) (func() (string, error), error) {
+	path, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS")
+	if !ok || path == "" {
+		cache := &gcsCachedToken{fetch: func() (gcsTokenResponse, error) {
+			return fetchGCSMetadataToken(client, gcsMetadataTokenURL)
+		}}
+		return cache.Token, nil
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "newGCSTokenSource: failed to read GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	var credentials GCSCredentials
+	err = json.Unmarshal(body, &credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "newGCSTokenSource: failed to parse GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	return NewGCSCredentialsTokenSource(client, credentials)
+}
+
+// NewGCSCredentialsTokenSource creates source of access tokens of credentials
+func NewGCSCredentialsTokenSource(client *http.Client, credentials GCSCredentials) (func() (string, error), error) {
+	if credentials.TokenURI == "" {
+		credentials.TokenURI = gcsDefaultTokenURI
+	}
+	var fetch func() (gcsTokenResponse, error)
+	switch credentials.Type {
+	case "service_account":
+		key, err := parseGCSPrivateKey(credentials.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		fetch = func() (gcsTokenResponse, error) {
+			assertion, err := signGCSAssertion(credentials, key, time.Now())
+			if err != nil {
+				return gcsTokenResponse{}, err
+			}
+			return fetchGCSToken(client, credentials.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	case "authorized_user":
+		fetch = func() (gcsTokenResponse, error) {
+			return fetchGCSToken(client, credentials.TokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {credentials.ClientID},
+				"client_secret": {credentials.ClientSecret},
+				"refresh_token": {credentials.RefreshToken},
+			})
+		}
+	default:
+		return nil, errors.Errorf("NewGCSCredentialsTokenSource: unsupported type of credentials '%s'", credentials.Type)
+	}
+	cache := &gcsCachedToken{fetch: fetch}
+	return cache.Token, nil
+}
+
+func parseGCSPrivateKey(privateKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, errors.New("parseGCSPrivateKey: private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parseGCSPrivateKey: failed to parse private key")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("parseGCSPrivateKey: private key is not RSA")
+	}
+	return key, nil
+}
+
+// signGCSAssertion creates JWT of service account to exchange for access token
+func signGCSAssertion(credentials GCSCredentials, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   credentials.ClientEmail,
+		"scope": gcsScope,
+		"aud":   credentials.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "signGCSAssertion: failed to sign")
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func fetchGCSToken(client *http.Client, tokenURI string, form url.Values) (gcsTokenResponse, error) {
+	resp, err := client.Post(tokenURI, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return gcsTokenResponse{}, errors.Wrap(err, "fetchGCSToken: token request failed")
+	}
+	return parseGCSTokenResponse(resp)
+}
+
+func fetchGCSMetadataToken(client *http.Client, tokenURL string) (gcsTokenResponse, error) {
+	req, err := http.NewRequest(http.MethodGet, tokenURL, nil)
+	if err != nil {
+		return gcsTokenResponse{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return gcsTokenResponse{}, errors.Wrap(err, "fetchGCSMetadataToken: metadata server is not available, set GOOGLE_APPLICATION_CREDENTIALS outside of GCE")
+	}
+	return parseGCSTokenResponse(resp)
+}
+
+func parseGCSTokenResponse(resp *http.Response) (gcsTokenResponse, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gcsTokenResponse{}, errors.Wrap(err, "parseGCSTokenResponse: failed to read response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcsTokenResponse{}, GCSError{resp.StatusCode, strings.TrimSpace(string(body))}
+	}
+	var token gcsTokenResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return gcsTokenResponse{}, errors.Wrap(err, "parseGCSTokenResponse: failed to parse response")
+	}
+	return token, nil
+}
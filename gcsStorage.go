@@ -0,0 +1,349 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultGCSEndpoint is the JSON API of Google Cloud Storage
+	DefaultGCSEndpoint = "https://storage.googleapis.com"
+	// Chunks of resumable upload must be multiples of 256KB, except the last one
+	gcsUploadChunkSize = 32 * 256 * 1024
+	gcsChunkRetries    = 5
+	gcsRetryDelay      = 100 * time.Millisecond
+)
+
+// GCSStorage is StorageBackend of Google Cloud Storage bucket, accessed with JSON API.
+// Objects are uploaded with resumable uploads chunk by chunk, so that a network
+// failure only resends the chunk instead of the whole tar member.
+type GCSStorage struct {
+	Bucket   string
+	Endpoint string
+	Client   *http.Client
+	// Token returns OAuth2 access token for requests
+	Token     func() (string, error)
+	ChunkSize int
+}
+
+// NewGCSStorage creates storage of bucket authorized with GOOGLE_APPLICATION_CREDENTIALS,
+// or with the service account of GCE instance if it is not set
+func NewGCSStorage(bucket string) (*GCSStorage, error) {
+	client := &http.Client{}
+	token, err := newGCSTokenSource(client)
+	if err != nil {
+		return nil, err
+	}
+	return &GCSStorage{
+		Bucket:    bucket,
+		Endpoint:  DefaultGCSEndpoint,
+		Client:    client,
+		Token:     token,
+		ChunkSize: gcsUploadChunkSize,
+	}, nil
+}
+
+// GCSError is returned for unexpected response of GCS
+type GCSError struct {
+	Status int
+	Body   string
+}
+
+func (err GCSError) Error() string {
+	return fmt.Sprintf("GCS responded with status %d: %s", err.Status, err.Body)
+}
+
+func isRetryableGCSError(err error) bool {
+	if gcsErr, ok := errors.Cause(err).(GCSError); ok {
+		return gcsErr.Status >= 500 || gcsErr.Status == http.StatusTooManyRequests
+	}
+	_, ok := errors.Cause(err).(*url.Error)
+	return ok
+}
+
+func (s *GCSStorage) objectURL(key string) string {
+	return s.Endpoint + "/storage/v1/b/" + url.PathEscape(s.Bucket) + "/o/" + url.PathEscape(key)
+}
+
+// do sends authorized request, responses with other status than expected ones are errors
+func (s *GCSStorage) do(req *http.Request, expected ...int) (*http.Response, error) {
+	token, err := s.Token()
+	if err != nil {
+		return nil, errors.Wrap(err, "GCSStorage: failed to get access token")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	return nil, GCSError{resp.StatusCode, strings.TrimSpace(string(body))}
+}
+
+// GetArchive downloads object
+func (s *GCSStorage) GetArchive(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GCSStorage GetArchive: failed to get '%s'", key)
+	}
+	return resp.Body, nil
+}
+
+// Exists gets metadata of object
+func (s *GCSStorage) Exists(key string) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if gcsErr, ok := err.(GCSError); ok && gcsErr.Status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "GCSStorage Exists: failed to check '%s'", key)
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+type gcsObjectList struct {
+	Items []struct {
+		Name    string
+		Size    string
+		Updated time.Time
+	}
+	NextPageToken string
+}
+
+// List lists objects page by page with "/" delimiter
+func (s *GCSStorage) List(prefix string) ([]StorageObject, error) {
+	return s.list(url.Values{"prefix": {prefix}, "delimiter": {"/"}})
+}
+
+// ListAll lists objects page by page without delimiter
+func (s *GCSStorage) ListAll(prefix string) ([]StorageObject, error) {
+	return s.list(url.Values{"prefix": {prefix}})
+}
+
+func (s *GCSStorage) list(query url.Values) ([]StorageObject, error) {
+	prefix := query.Get("prefix")
+	var objects []StorageObject
+	pageToken := ""
+	for {
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest(http.MethodGet, s.Endpoint+"/storage/v1/b/"+url.PathEscape(s.Bucket)+"/o?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, http.StatusOK)
+		if err != nil {
+			return nil, errors.Wrapf(err, "GCSStorage List: failed to list '%s'", prefix)
+		}
+		var page gcsObjectList
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "GCSStorage List: failed to parse listing of '%s'", prefix)
+		}
+		for _, item := range page.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			objects = append(objects, StorageObject{Key: item.Name, LastModified: item.Updated, Size: size})
+		}
+		if page.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// Delete removes objects one by one
+func (s *GCSStorage) Delete(keys []string) error {
+	for _, key := range keys {
+		req, err := http.NewRequest(http.MethodDelete, s.objectURL(key), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req, http.StatusNoContent, http.StatusOK)
+		if gcsErr, ok := err.(GCSError); ok && gcsErr.Status == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "GCSStorage Delete: failed to delete '%s'", key)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Put uploads object with resumable upload
+func (s *GCSStorage) Put(key string, r io.Reader) error {
+	session, err := s.startUpload(key)
+	if err != nil {
+		return errors.Wrapf(err, "GCSStorage Put: failed to start upload of '%s'", key)
+	}
+
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = gcsUploadChunkSize
+	}
+	chunk := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return errors.Wrapf(err, "GCSStorage Put: failed to read content of '%s'", key)
+		}
+		err = s.putChunk(session, chunk[:n], offset, last)
+		if err != nil {
+			return errors.Wrapf(err, "GCSStorage Put: failed to upload '%s' at offset %d", key, offset)
+		}
+		offset += int64(n)
+		if last {
+			return nil
+		}
+	}
+}
+
+// startUpload creates resumable upload session and returns its URI
+func (s *GCSStorage) startUpload(key string) (string, error) {
+	query := url.Values{"uploadType": {"resumable"}, "name": {key}}
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint+"/upload/storage/v1/b/"+url.PathEscape(s.Bucket)+"/o?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", errors.New("startUpload: no session URI in response")
+	}
+	return session, nil
+}
+
+// putChunk sends chunk starting at offset of object. After failure it asks
+// how much of the object is persisted and resends only the rest of chunk.
+func (s *GCSStorage) putChunk(session string, chunk []byte, offset int64, last bool) error {
+	var sent int64
+	var err error
+	for attempt := 0; attempt < gcsChunkRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("GCSStorage: retrying chunk at offset %d after error: %v\n", offset, err)
+			time.Sleep(gcsRetryDelay << uint(attempt-1))
+			var persisted int64
+			var complete bool
+			persisted, complete, err = s.queryUpload(session)
+			if err != nil {
+				if !isRetryableGCSError(err) {
+					return err
+				}
+				continue
+			}
+			if complete {
+				return nil
+			}
+			sent = persisted - offset
+			if sent < 0 || sent > int64(len(chunk)) {
+				return errors.Errorf("putChunk: storage persisted %d bytes, outside of chunk at offset %d", persisted, offset)
+			}
+		}
+		err = s.sendChunk(session, chunk[sent:], offset+sent, last)
+		if err == nil || !isRetryableGCSError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *GCSStorage) sendChunk(session string, data []byte, offset int64, last bool) error {
+	total := "*"
+	if last {
+		total = strconv.FormatInt(offset+int64(len(data)), 10)
+	}
+	contentRange := fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(data))-1, total)
+	if len(data) == 0 {
+		contentRange = "bytes */" + total
+	}
+	req, err := http.NewRequest(http.MethodPut, session, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Range", contentRange)
+	expected := http.StatusPermanentRedirect
+	if last {
+		expected = http.StatusOK
+	}
+	resp, err := s.do(req, expected, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// queryUpload returns number of bytes persisted by upload session, or tells it is complete
+func (s *GCSStorage) queryUpload(session string) (persisted int64, complete bool, err error) {
+	req, err := http.NewRequest(http.MethodPut, session, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Range", "bytes */*")
+	resp, err := s.do(req, http.StatusPermanentRedirect, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		return 0, true, nil
+	}
+	// Range is "bytes=0-N", absent if nothing is persisted yet
+	persistedRange := resp.Header.Get("Range")
+	if persistedRange == "" {
+		return 0, false, nil
+	}
+	end, err := strconv.ParseInt(persistedRange[strings.LastIndex(persistedRange, "-")+1:], 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "queryUpload: failed to parse range '%s'", persistedRange)
+	}
+	return end + 1, false, nil
+}
+
+// configureGCSStorage creates uploader and prefix of gs://bucket/path URL
+func configureGCSStorage(u *url.URL) (*TarUploader, *Prefix, error) {
+	storage, err := NewGCSStorage(u.Host)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "configureGCSStorage: failed to configure credentials")
+	}
+	if endpoint := os.Getenv("WALG_GCS_ENDPOINT"); endpoint != "" {
+		storage.Endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+	upload, pre := ConfigureStorageBackend(storage, strings.TrimSuffix(u.Path, "/"))
+	return upload, pre, nil
+}
@@ -0,0 +1,306 @@
+package walg_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+// fakeGCS serves the subset of JSON API used by GCSStorage
+type fakeGCS struct {
+	t       *testing.T
+	mutex   sync.Mutex
+	objects map[string][]byte
+	// uploads in progress by session id
+	uploads map[string][]byte
+	names   map[string]string
+	// failChunks makes that many chunk requests persist half of data and fail
+	failChunks int
+	pageSize   int
+}
+
+func newFakeGCS(t *testing.T) (*fakeGCS, *httptest.Server, *walg.GCSStorage) {
+	fake := &fakeGCS{
+		t:        t,
+		objects:  make(map[string][]byte),
+		uploads:  make(map[string][]byte),
+		names:    make(map[string]string),
+		pageSize: 1000,
+	}
+	server := httptest.NewServer(fake)
+	storage := &walg.GCSStorage{
+		Bucket:    "bucket",
+		Endpoint:  server.URL,
+		Client:    server.Client(),
+		Token:     func() (string, error) { return "test-token", nil },
+		ChunkSize: 256 * 1024,
+	}
+	return fake, server, storage
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method == http.MethodPost && path == "/upload/storage/v1/b/bucket/o":
+		id := strconv.Itoa(len(f.names))
+		f.names[id] = r.URL.Query().Get("name")
+		f.uploads[id] = nil
+		w.Header().Set("Location", "http://"+r.Host+"/session/"+id)
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/session/"):
+		f.serveChunk(w, r, strings.TrimPrefix(path, "/session/"))
+	case r.Method == http.MethodGet && path == "/storage/v1/b/bucket/o":
+		f.serveList(w, r)
+	case strings.HasPrefix(path, "/storage/v1/b/bucket/o/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "/storage/v1/b/bucket/o/"))
+		body, ok := f.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Get("alt") == "media":
+			w.Write(body)
+		default:
+			fmt.Fprintf(w, `{"name": %q}`, name)
+		}
+	default:
+		f.t.Errorf("gcsStorage: unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeGCS) serveChunk(w http.ResponseWriter, r *http.Request, id string) {
+	data, _ := ioutil.ReadAll(r.Body)
+	persisted, ok := f.uploads[id]
+	if !ok {
+		// Completed upload
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var start, end int
+	var total string
+	contentRange := r.Header.Get("Content-Range")
+	if strings.HasPrefix(contentRange, "bytes */") {
+		total = strings.TrimPrefix(contentRange, "bytes */")
+		start = len(persisted)
+	} else {
+		fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &total)
+		if start != len(persisted) || end-start+1 != len(data) {
+			f.t.Errorf("gcsStorage: chunk %s does not continue %d persisted bytes", contentRange, len(persisted))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if f.failChunks > 0 {
+			f.failChunks--
+			f.uploads[id] = append(persisted, data[:len(data)/2]...)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		f.uploads[id] = append(persisted, data...)
+	}
+	if total != "*" && strconv.Itoa(len(f.uploads[id])) == total {
+		f.objects[f.names[id]] = f.uploads[id]
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if len(f.uploads[id]) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(f.uploads[id])-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func (f *fakeGCS) serveList(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if r.URL.Query().Get("delimiter") != "/" {
+		f.t.Errorf("gcsStorage: expected listing with delimiter")
+	}
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) && !strings.Contains(name[len(prefix):], "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	page := map[string]interface{}{}
+	var items []map[string]string
+	for i := start; i < len(names) && i < start+f.pageSize; i++ {
+		items = append(items, map[string]string{
+			"name":    names[i],
+			"size":    strconv.Itoa(len(f.objects[names[i]])),
+			"updated": "2018-03-01T10:00:00.000Z",
+		})
+	}
+	page["items"] = items
+	if start+f.pageSize < len(names) {
+		page["nextPageToken"] = strconv.Itoa(start + f.pageSize)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func TestGCSStorage(t *testing.T) {
+	fake, server, storage := newFakeGCS(t)
+	defer server.Close()
+	fake.pageSize = 2
+
+	// Several chunks with incomplete last one, chunk boundary of empty last chunk and empty object
+	contents := map[string][]byte{
+		"server/wal_005/000000010000000000000001.lz4":               make([]byte, 256*1024*3+1000),
+		"server/wal_005/000000010000000000000002.lz4":               make([]byte, 256*1024*2),
+		"server/wal_005/000000010000000000000003.lz4":               {},
+		"server/basebackups_005/base/tar_partitions/part_1.tar.lz4": []byte("part"),
+	}
+	for key, content := range contents {
+		rand.Read(content)
+		err := storage.Put(key, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("gcsStorage: failed to put %s: %v", key, err)
+		}
+	}
+	for key, content := range contents {
+		if !bytes.Equal(fake.objects[key], content) {
+			t.Errorf("gcsStorage: %s is stored with %d bytes instead of %d", key, len(fake.objects[key]), len(content))
+		}
+		reader, err := storage.GetArchive(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if !bytes.Equal(body, content) {
+			t.Errorf("gcsStorage: %s is read with %d different bytes", key, len(body))
+		}
+	}
+
+	objects, err := storage.List("server/wal_005/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 3 || objects[0].Size != 256*1024*3+1000 || objects[0].LastModified.Year() != 2018 {
+		t.Errorf("gcsStorage: expected 3 WAL files of all pages to be listed but got %v", objects)
+	}
+	objects, err = storage.List("server/basebackups_005/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("gcsStorage: expected partitions under deeper level not to be listed but got %v", objects)
+	}
+
+	key := "server/wal_005/000000010000000000000001.lz4"
+	exists, err := storage.Exists(key)
+	if err != nil || !exists {
+		t.Errorf("gcsStorage: expected %s to exist but got %v, %v", key, exists, err)
+	}
+	err = storage.Delete([]string{key, "server/wal_005/missing"})
+	if err != nil {
+		t.Errorf("gcsStorage: expected delete of missing object to succeed but got %v", err)
+	}
+	exists, err = storage.Exists(key)
+	if err != nil || exists {
+		t.Errorf("gcsStorage: expected %s to be deleted but got %v, %v", key, exists, err)
+	}
+	_, err = storage.GetArchive(key)
+	if err == nil {
+		t.Errorf("gcsStorage: expected error for missing object but got `<nil>`")
+	}
+}
+
+func TestGCSStorageResumesChunk(t *testing.T) {
+	fake, server, storage := newFakeGCS(t)
+	defer server.Close()
+	fake.failChunks = 2
+
+	content := make([]byte, 256*1024*4+10)
+	rand.Read(content)
+	err := storage.Put("server/basebackups_005/base/tar_partitions/part_1.tar.lz4", bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("gcsStorage: expected failed chunks to be resumed but got %v", err)
+	}
+	if !bytes.Equal(fake.objects["server/basebackups_005/base/tar_partitions/part_1.tar.lz4"], content) {
+		t.Errorf("gcsStorage: resumed upload stored wrong content")
+	}
+}
+
+func TestGCSServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+			t.Errorf("gcsStorage: unexpected token request %v", r.PostForm)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("gcsStorage: assertion signature is invalid: %v", err)
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if !bytes.Contains(claims, []byte(`"iss":"backup@project.iam.gserviceaccount.com"`)) {
+			t.Errorf("gcsStorage: unexpected claims %s", claims)
+		}
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600}`, requests)
+	}))
+	defer server.Close()
+
+	token, err := walg.NewGCSCredentialsTokenSource(server.Client(), walg.GCSCredentials{
+		Type:        "service_account",
+		ClientEmail: "backup@project.iam.gserviceaccount.com",
+		PrivateKey:  string(keyPEM),
+		TokenURI:    server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		value, err := token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "token-1" {
+			t.Errorf("gcsStorage: expected cached token-1 but got %s", value)
+		}
+	}
+
+	_, err = walg.NewGCSCredentialsTokenSource(server.Client(), walg.GCSCredentials{Type: "external_account"})
+	if err == nil {
+		t.Errorf("gcsStorage: expected unsupported credentials to fail but got `<nil>`")
+	}
+}
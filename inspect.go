@@ -0,0 +1,74 @@
+package walg
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// InspectMarkerName is left in data directory restored with backup-fetch --inspect
+const InspectMarkerName = "WALG_INSPECT"
+
+// PrepareInspection marks directory restored from backup as inspection copy
+// and prints commands starting isolated read-only instance on it.
+// Restored files, including pg_control, are not modified.
+func PrepareInspection(dirArc string, backupName string, sentinel S3TarBallSentinelDto) error {
+	marker := fmt.Sprintf("Restored by wal-g backup-fetch --inspect from %s at %s.\n"+
+		"This directory is meant for read-only examination, do not use it as a replica or primary.\n",
+		backupName, time.Now().UTC().Format(time.RFC3339))
+	err := ioutil.WriteFile(filepath.Join(dirArc, InspectMarkerName), []byte(marker), 0600)
+	if err != nil {
+		return errors.Wrap(err, "PrepareInspection: failed to write marker")
+	}
+
+	port, err := getFreePort()
+	if err != nil {
+		return errors.Wrap(err, "PrepareInspection: failed to find free port")
+	}
+	fmt.Print(getInspectInstructions(dirArc, backupName, sentinel.PgVersion, port))
+	return nil
+}
+
+func getFreePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// getInspectInstructions recovers instance to the consistent point of backup and pauses there,
+// so that it stays in hot standby and never writes WAL or archives anything.
+// Unknown version means backup was made before PgVersion was stored in sentinel, i.e. before 12.
+func getInspectInstructions(dirArc string, backupName string, pgVersion int, port int) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "\nBackup %s is restored for inspection into %s.\n", backupName, dirArc)
+	fmt.Fprintf(&b, "To start an isolated read-only instance on port %d run:\n\n", port)
+
+	options := fmt.Sprintf("-c port=%d -c listen_addresses='' -c unix_socket_directories='/tmp'"+
+		" -c hot_standby=on -c default_transaction_read_only=on -c archive_mode=off", port)
+	restoreCommand := "restore_command='wal-g wal-fetch %f %p'"
+
+	if pgVersion >= 120000 {
+		fmt.Fprintf(&b, "\ttouch '%s'\n", filepath.Join(dirArc, "recovery.signal"))
+		options += " -c " + restoreCommand + " -c recovery_target=immediate -c recovery_target_action=pause"
+	} else {
+		fmt.Fprintf(&b, "\tcat > '%s' <<'EOF'\n", filepath.Join(dirArc, "recovery.conf"))
+		fmt.Fprintf(&b, "\t%s\n\trecovery_target = 'immediate'\n", restoreCommand)
+		if pgVersion != 0 && pgVersion < 90500 {
+			fmt.Fprintf(&b, "\tpause_at_recovery_target = true\n")
+		} else {
+			fmt.Fprintf(&b, "\trecovery_target_action = 'pause'\n")
+		}
+		fmt.Fprintf(&b, "\tEOF\n")
+	}
+	fmt.Fprintf(&b, "\tpg_ctl -D '%s' -o \"%s\" start\n\n", dirArc, options)
+	fmt.Fprintf(&b, "Then connect with:\n\n\tpsql -h /tmp -p %d\n\n", port)
+	return b.String()
+}
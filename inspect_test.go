@@ -0,0 +1,33 @@
+package walg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetInspectInstructions(t *testing.T) {
+	tests := []struct {
+		pgVersion int
+		expected  []string
+		absent    []string
+	}{
+		{120003, []string{"recovery.signal", "-c recovery_target=immediate -c recovery_target_action=pause"}, []string{"recovery.conf"}},
+		{100004, []string{"recovery.conf", "recovery_target_action = 'pause'"}, []string{"recovery.signal"}},
+		{90400, []string{"recovery.conf", "pause_at_recovery_target = true"}, []string{"recovery_target_action"}},
+		{0, []string{"recovery.conf", "recovery_target_action = 'pause'"}, []string{"recovery.signal"}},
+	}
+	for _, test := range tests {
+		instructions := getInspectInstructions("/data", "base_000000010000000000000002", test.pgVersion, 5433)
+		expected := append(test.expected, "pg_ctl -D '/data'", "-c port=5433", "default_transaction_read_only=on", "psql -h /tmp -p 5433")
+		for _, s := range expected {
+			if !strings.Contains(instructions, s) {
+				t.Errorf("inspect: instructions for %d do not contain %s:\n%s", test.pgVersion, s, instructions)
+			}
+		}
+		for _, s := range test.absent {
+			if strings.Contains(instructions, s) {
+				t.Errorf("inspect: instructions for %d contain %s:\n%s", test.pgVersion, s, instructions)
+			}
+		}
+	}
+}
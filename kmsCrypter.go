@@ -0,0 +1,210 @@
+package walg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/pkg/errors"
+)
+
+// kmsHeader is the first byte of objects and data keys encrypted by KMSCrypter,
+// see aesHeader. Objects are followed by length and KMS ciphertext of their key.
+const kmsHeader byte = 0x02
+
+// getKMSKeyId reads WALG_KMS_CMK_ID, id or alias of KMS customer master key
+func getKMSKeyId() string {
+	return os.Getenv("WALG_KMS_CMK_ID")
+}
+
+// KMSCrypter encrypts objects with AES-256-GCM by data keys made by AWS KMS.
+// Objects of a backup share the data key set by SetDataKey, which is kept in the
+// sentinel encrypted by KMS. Other objects, such as WAL files, get a key of their
+// own, kept encrypted by KMS in the header of the object. Plaintext keys are only
+// held in memory. Objects encrypted by WALG_AES_KEY or WALE_GPG_KEY_ID before
+// WALG_KMS_CMK_ID was set are decrypted by AESCrypter.
+type KMSCrypter struct {
+	configured bool
+	keyId      string
+	client     kmsiface.KMSAPI
+
+	// generated is the last data key made by GenerateDataKey, generatedBlob is its ciphertext
+	generated     []byte
+	generatedBlob []byte
+
+	aes AESCrypter
+}
+
+// NewKMSCrypter creates crypter with customer master key keyId of client instead of WALG_KMS_CMK_ID
+func NewKMSCrypter(keyId string, client kmsiface.KMSAPI) *KMSCrypter {
+	return &KMSCrypter{configured: true, keyId: keyId, client: client}
+}
+
+// IsUsed is to check necessity of Crypter use
+// Must be called prior to any other crypter call
+func (crypter *KMSCrypter) IsUsed() bool {
+	if !crypter.configured {
+		crypter.configured = true
+		crypter.keyId = getKMSKeyId()
+	}
+	crypter.aes.IsUsed()
+	return crypter.keyId != ""
+}
+
+func (crypter *KMSCrypter) getClient() (kmsiface.KMSAPI, error) {
+	if !crypter.configured {
+		return nil, ErrCrypterUseMischief
+	}
+	if crypter.client != nil {
+		return crypter.client, nil
+	}
+	config := defaults.Get().Config
+	config.MaxRetries = &MAXRETRIES
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		config = config.WithRegion(region)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "KMSCrypter: failed to create new session")
+	}
+	crypter.client = kms.New(sess)
+	return crypter.client, nil
+}
+
+// newKey makes data key by KMS, returns it with its ciphertext
+func (crypter *KMSCrypter) newKey() ([]byte, []byte, error) {
+	client, err := crypter.getClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	output, err := client.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(crypter.keyId),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "KMSCrypter: failed to generate data key")
+	}
+	return output.Plaintext, output.CiphertextBlob, nil
+}
+
+// decryptKey decrypts data key by KMS
+func (crypter *KMSCrypter) decryptKey(blob []byte) ([]byte, error) {
+	client, err := crypter.getClient()
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.Decrypt(&kms.DecryptInput{CiphertextBlob: blob})
+	if err != nil {
+		return nil, errors.Wrap(err, "KMSCrypter: failed to decrypt data key")
+	}
+	if len(output.Plaintext) != dataKeySize {
+		return nil, errors.New("Unwrapped data key has wrong size")
+	}
+	return output.Plaintext, nil
+}
+
+// Encrypt creates encryption writer from ordinary writer.
+// Without data key of a backup each object gets its own key by KMS.
+func (crypter *KMSCrypter) Encrypt(writer io.WriteCloser) (io.WriteCloser, error) {
+	if !crypter.configured {
+		return nil, ErrCrypterUseMischief
+	}
+	if crypter.aes.dataKey != nil {
+		return crypter.aes.Encrypt(writer)
+	}
+	key, blob, err := crypter.newKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 3, 3+len(blob))
+	prefix[0] = kmsHeader
+	binary.BigEndian.PutUint16(prefix[1:], uint16(len(blob)))
+	return newAESWriter(writer, aead, append(prefix, blob...))
+}
+
+// Decrypt creates decrypted reader from ordinary reader
+func (crypter *KMSCrypter) Decrypt(reader io.ReadCloser) (io.Reader, error) {
+	if !crypter.configured {
+		return nil, ErrCrypterUseMischief
+	}
+	buffered := bufio.NewReader(reader)
+	first, err := buffered.Peek(1)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decrypt: failed to read header")
+	}
+	if first[0] != kmsHeader {
+		return crypter.aes.Decrypt(&ReadCascadeClose{buffered, reader})
+	}
+
+	header := make([]byte, 3)
+	_, err = io.ReadFull(buffered, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decrypt: failed to read header")
+	}
+	blob := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	_, err = io.ReadFull(buffered, blob)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decrypt: failed to read data key")
+	}
+	key, err := crypter.decryptKey(blob)
+	if err != nil {
+		return nil, err
+	}
+	objectCrypter := &AESCrypter{configured: true, key: key}
+	return objectCrypter.Decrypt(&ReadCascadeClose{buffered, reader})
+}
+
+// GenerateDataKey creates data key for one backup by KMS
+func (crypter *KMSCrypter) GenerateDataKey() ([]byte, error) {
+	key, blob, err := crypter.newKey()
+	if err != nil {
+		return nil, err
+	}
+	crypter.generated, crypter.generatedBlob = key, blob
+	return key, nil
+}
+
+// WrapDataKey encrypts data key by KMS. Key made by GenerateDataKey is already encrypted.
+func (crypter *KMSCrypter) WrapDataKey(key []byte) ([]byte, error) {
+	blob := crypter.generatedBlob
+	if blob == nil || !bytes.Equal(key, crypter.generated) {
+		client, err := crypter.getClient()
+		if err != nil {
+			return nil, err
+		}
+		output, err := client.Encrypt(&kms.EncryptInput{KeyId: aws.String(crypter.keyId), Plaintext: key})
+		if err != nil {
+			return nil, errors.Wrap(err, "KMSCrypter: failed to encrypt data key")
+		}
+		blob = output.CiphertextBlob
+	}
+	return append([]byte{kmsHeader}, blob...), nil
+}
+
+// UnwrapDataKey decrypts data key by KMS.
+// Data keys of backups made with other crypters are passed to AESCrypter.
+func (crypter *KMSCrypter) UnwrapDataKey(wrapped []byte) ([]byte, error) {
+	if !crypter.configured {
+		return nil, ErrCrypterUseMischief
+	}
+	if len(wrapped) == 0 || wrapped[0] != kmsHeader {
+		return crypter.aes.UnwrapDataKey(wrapped)
+	}
+	return crypter.decryptKey(wrapped[1:])
+}
+
+// SetDataKey makes Encrypt and Decrypt use symmetric data key of a backup
+func (crypter *KMSCrypter) SetDataKey(key []byte) {
+	crypter.aes.SetDataKey(key)
+}
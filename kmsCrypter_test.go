@@ -0,0 +1,136 @@
+package walg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// MockKMSClient keeps data keys in memory, ciphertext of a key is its number
+type MockKMSClient struct {
+	kmsiface.KMSAPI
+
+	mutex sync.Mutex
+	keys  map[string][]byte
+	// Calls counts requests by operation
+	Calls map[string]int
+}
+
+func NewMockKMSClient() *MockKMSClient {
+	return &MockKMSClient{keys: make(map[string][]byte), Calls: make(map[string]int)}
+}
+
+func (client *MockKMSClient) store(key []byte) []byte {
+	blob := fmt.Sprintf("kms-key-%d", len(client.keys))
+	client.keys[blob] = append([]byte{}, key...)
+	return []byte(blob)
+}
+
+func (client *MockKMSClient) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.Calls["GenerateDataKey"]++
+	key := make([]byte, dataKeySize)
+	rand.Read(key)
+	return &kms.GenerateDataKeyOutput{KeyId: input.KeyId, Plaintext: key, CiphertextBlob: client.store(key)}, nil
+}
+
+func (client *MockKMSClient) Encrypt(input *kms.EncryptInput) (*kms.EncryptOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.Calls["Encrypt"]++
+	return &kms.EncryptOutput{KeyId: input.KeyId, CiphertextBlob: client.store(input.Plaintext)}, nil
+}
+
+func (client *MockKMSClient) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.Calls["Decrypt"]++
+	key, ok := client.keys[string(input.CiphertextBlob)]
+	if !ok {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "unknown ciphertext", nil)
+	}
+	return &kms.DecryptOutput{Plaintext: key}, nil
+}
+
+func TestKMSCrypterObjectKeys(t *testing.T) {
+	client := NewMockKMSClient()
+	crypter := NewKMSCrypter("alias/walg", client)
+	if !crypter.IsUsed() {
+		t.Fatalf("kmsCrypter: crypter with key id is not used")
+	}
+
+	plain := bytes.Repeat([]byte("wal"), aesChunkSize)
+	first := aesEncrypt(t, crypter, plain)
+	second := aesEncrypt(t, crypter, plain)
+	if first[0] != kmsHeader {
+		t.Errorf("kmsCrypter: object starts with %x", first[0])
+	}
+	if client.Calls["GenerateDataKey"] != 2 {
+		t.Errorf("kmsCrypter: expected key per object but got %d keys", client.Calls["GenerateDataKey"])
+	}
+	for _, key := range client.keys {
+		if bytes.Contains(first, key) || bytes.Contains(second, key) {
+			t.Errorf("kmsCrypter: plaintext key is stored in object")
+		}
+	}
+
+	// Fetch is made by another process
+	fetcher := NewKMSCrypter("alias/walg", client)
+	fetcher.IsUsed()
+	for _, sealed := range [][]byte{first, second} {
+		decrypted, err := aesDecrypt(fetcher, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("kmsCrypter: decrypted object differs")
+		}
+	}
+
+	if _, err := aesDecrypt(NewKMSCrypter("alias/walg", NewMockKMSClient()), first); err == nil {
+		t.Errorf("kmsCrypter: object decrypted without its key in KMS")
+	}
+}
+
+func TestKMSCrypterDataKey(t *testing.T) {
+	client := NewMockKMSClient()
+	crypter := NewKMSCrypter("alias/walg", client)
+	crypter.IsUsed()
+	dataKey, err := crypter.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := crypter.WrapDataKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Calls["Encrypt"] != 0 {
+		t.Errorf("kmsCrypter: generated data key is encrypted again")
+	}
+	if bytes.Contains(wrapped, dataKey) {
+		t.Errorf("kmsCrypter: wrapped data key contains plaintext")
+	}
+	crypter.SetDataKey(dataKey)
+	sealed := aesEncrypt(t, crypter, []byte("backup"))
+	if client.Calls["GenerateDataKey"] != 1 {
+		t.Errorf("kmsCrypter: objects of backup got keys of their own")
+	}
+
+	fetcher := NewKMSCrypter("alias/walg", client)
+	fetcher.IsUsed()
+	unwrapped, err := fetcher.UnwrapDataKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher.SetDataKey(unwrapped)
+	if decrypted, err := aesDecrypt(fetcher, sealed); err != nil || string(decrypted) != "backup" {
+		t.Errorf("kmsCrypter: object of data key is not decrypted: %v", err)
+	}
+}
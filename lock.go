@@ -0,0 +1,275 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// BackupPushLockName is the name of lock object stored next to basebackups_005
+const BackupPushLockName = "backup_push.lock"
+
+// DefaultBackupPushLockTTL is how long lock is kept without refresh, unless WALG_BACKUP_PUSH_LOCK_TTL is set
+const DefaultBackupPushLockTTL = 15 * time.Minute
+
+// maxBackupPushLockSettleTime bounds wait of getBackupPushLockSettleTime with long TTL
+const maxBackupPushLockSettleTime = 5 * time.Second
+
+// BackupPushLockDescription is the content of lock object
+type BackupPushLockDescription struct {
+	Hostname string    `json:"hostname"`
+	Pid      int       `json:"pid"`
+	Time     time.Time `json:"time"`
+	// Refreshed is updated by running backup-push, lock not refreshed for TTL is abandoned
+	Refreshed time.Time `json:"refreshed,omitempty"`
+}
+
+// expiresAt is when lock is abandoned unless refreshed again. Locks of older versions
+// are never refreshed, so they expire TTL after push started.
+func (description BackupPushLockDescription) expiresAt(ttl time.Duration) time.Time {
+	if description.Refreshed.After(description.Time) {
+		return description.Refreshed.Add(ttl)
+	}
+	return description.Time.Add(ttl)
+}
+
+// BackupPushLockedError happens when another backup-push holds the lock
+type BackupPushLockedError struct {
+	Owner   BackupPushLockDescription
+	Expires time.Time
+}
+
+func (e BackupPushLockedError) Error() string {
+	return fmt.Sprintf("Another backup-push is in progress: started by pid %d on %s at %s. "+
+		"If it is not running anymore use --force to override the lock, or wait until it expires at %s.",
+		e.Owner.Pid, e.Owner.Hostname, e.Owner.Time.Format(time.RFC3339), e.Expires.Format(time.RFC3339))
+}
+
+// BackupPushLock is an advisory lock object in the bucket which prevents
+// concurrent backup-push of the same cluster. Storage does not provide
+// atomic create-if-absent, so push reads the lock again a while after
+// uploading it and backs off if another push has overwritten it meanwhile.
+// Of pushes started together only the last writer keeps the lock.
+// Holder refreshes the lock while it runs, so lock left by killed push
+// expires after TTL.
+type BackupPushLock struct {
+	archive     *Archive
+	tu          *TarUploader
+	description BackupPushLockDescription
+	stop        chan Empty
+	stopOnce    sync.Once
+	done        sync.WaitGroup
+}
+
+// getBackupPushLockTTL returns TTL of backup-push lock of WALG_BACKUP_PUSH_LOCK_TTL
+func getBackupPushLockTTL() time.Duration {
+	ttlStr, ok := os.LookupEnv("WALG_BACKUP_PUSH_LOCK_TTL")
+	if !ok {
+		return DefaultBackupPushLockTTL
+	}
+	ttl, err := time.ParseDuration(ttlStr)
+	if err != nil || ttl <= 0 {
+		log.Fatal("Unable to parse WALG_BACKUP_PUSH_LOCK_TTL ", ttlStr)
+	}
+	return ttl
+}
+
+// getBackupPushLockSettleTime is how long push waits after uploading lock before it checks that
+// the lock is still its own. A push started at the same moment uploads its lock by then.
+func getBackupPushLockSettleTime(ttl time.Duration) time.Duration {
+	settle := ttl / 100
+	if settle > maxBackupPushLockSettleTime {
+		return maxBackupPushLockSettleTime
+	}
+	return settle
+}
+
+func getBackupPushLockKey(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/" + BackupPushLockName)
+}
+
+// AcquireBackupPushLock checks that no other backup-push holds the lock and takes it.
+// With force lock of another process is overridden, expired lock is taken without force.
+// Lock is refreshed in background until it is released.
+func AcquireBackupPushLock(tu *TarUploader, pre *Prefix, force bool) (*BackupPushLock, error) {
+	ttl := getBackupPushLockTTL()
+	lock := &BackupPushLock{
+		archive: &Archive{
+			Prefix:  pre,
+			Archive: aws.String(getBackupPushLockKey(pre)),
+		},
+		tu:   tu.Clone(),
+		stop: make(chan Empty),
+	}
+
+	exists, err := lock.archive.CheckExistence()
+	if err != nil {
+		return nil, errors.Wrap(err, "AcquireBackupPushLock: failed to check lock existence")
+	}
+	if exists {
+		owner, err := lock.readDescription()
+		if err != nil {
+			return nil, err
+		}
+		expires := owner.expiresAt(ttl)
+		if time.Now().After(expires) {
+			fmt.Printf("Taking backup-push lock of pid %d on %s expired at %s\n", owner.Pid, owner.Hostname, expires.Format(time.RFC3339))
+		} else if !force {
+			return nil, BackupPushLockedError{owner, expires}
+		} else {
+			fmt.Printf("Overriding backup-push lock of pid %d on %s\n", owner.Pid, owner.Hostname)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	lock.description = BackupPushLockDescription{
+		Hostname: hostname,
+		Pid:      os.Getpid(),
+		Time:     time.Now().UTC(),
+	}
+	err = lock.upload()
+	if err != nil {
+		return nil, errors.Wrap(err, "AcquireBackupPushLock: failed to upload lock")
+	}
+
+	// Another push may have checked the lock before it was uploaded and overwritten it since
+	time.Sleep(getBackupPushLockSettleTime(ttl))
+	owner, err := lock.readDescription()
+	if err != nil {
+		return nil, errors.Wrap(err, "AcquireBackupPushLock: failed to check lock after upload")
+	}
+	if !lock.isOwnedBy(owner) {
+		return nil, BackupPushLockedError{owner, owner.expiresAt(ttl)}
+	}
+	lock.startRefresh(ttl / 4)
+	return lock, nil
+}
+
+func (lock *BackupPushLock) upload() error {
+	body, err := json.Marshal(lock.description)
+	if err != nil {
+		return err
+	}
+	return lock.tu.put(*lock.archive.Archive, bytes.NewReader(body))
+}
+
+// startRefresh uploads lock with new refresh time every interval until Release.
+// Refresh stops once another push took the lock over.
+func (lock *BackupPushLock) startRefresh(interval time.Duration) {
+	lock.done.Add(1)
+	go func() {
+		defer lock.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				owner, err := lock.readDescription()
+				if err != nil {
+					// Next refresh may succeed before lock expires
+					log.Printf("BackupPushLock: failed to check lock before refresh: %v\n", err)
+					continue
+				}
+				if !lock.isOwnedBy(owner) {
+					log.Printf("BackupPushLock: lock was taken over by pid %d on %s, refresh stopped\n", owner.Pid, owner.Hostname)
+					return
+				}
+				lock.description.Refreshed = time.Now().UTC()
+				err = lock.upload()
+				if err != nil {
+					// Next refresh may succeed before lock expires
+					log.Printf("BackupPushLock: failed to refresh lock: %v\n", err)
+				}
+			case <-lock.stop:
+				return
+			}
+		}
+	}()
+}
+
+// isOwnedBy tells whether owner described by lock object is this push. Push started
+// later with --force takes the lock over, even one of the same process.
+func (lock *BackupPushLock) isOwnedBy(owner BackupPushLockDescription) bool {
+	return owner.Hostname == lock.description.Hostname && owner.Pid == lock.description.Pid &&
+		owner.Time.Equal(lock.description.Time)
+}
+
+func (lock *BackupPushLock) readDescription() (description BackupPushLockDescription, err error) {
+	reader, err := lock.archive.GetArchive()
+	if err != nil {
+		return description, errors.Wrap(err, "BackupPushLock: failed to read lock")
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return description, errors.Wrap(err, "BackupPushLock: failed to read lock")
+	}
+	err = json.Unmarshal(body, &description)
+	if err != nil {
+		return description, errors.Wrap(err, "BackupPushLock: failed to parse lock")
+	}
+	return description, nil
+}
+
+// Release stops refresh and removes lock object, unless another push took the lock over
+func (lock *BackupPushLock) Release() error {
+	lock.stopOnce.Do(func() {
+		close(lock.stop)
+		lock.done.Wait()
+	})
+	exists, err := lock.archive.CheckExistence()
+	if err != nil {
+		return errors.Wrap(err, "BackupPushLock: failed to check lock existence")
+	}
+	if !exists {
+		return nil
+	}
+	owner, err := lock.readDescription()
+	if err != nil {
+		return err
+	}
+	if !lock.isOwnedBy(owner) {
+		log.Printf("BackupPushLock: lock was taken over by pid %d on %s, it is left to its owner\n", owner.Pid, owner.Hostname)
+		return nil
+	}
+	err = lock.archive.Prefix.Storage().Delete([]string{*lock.archive.Archive})
+	if err != nil {
+		return errors.Wrap(err, "BackupPushLock: failed to delete lock")
+	}
+	return nil
+}
+
+// ReleaseOnSignal releases lock and exits when push is interrupted or terminated, which skips
+// deferred Release. Otherwise the next push would be refused until lock expires.
+// Returned function stops handling of signals, it is called once before lock is released normally.
+func (lock *BackupPushLock) ReleaseOnSignal() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan Empty)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("BackupPushLock: %v received, releasing lock\n", sig)
+			if err := lock.Release(); err != nil {
+				log.Printf("BackupPushLock: %+v\n", err)
+			}
+			os.Exit(1)
+		case <-stopped:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(stopped)
+	}
+}
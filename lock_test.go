@@ -0,0 +1,321 @@
+package walg_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/wal-g/wal-g"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// In-memory S3 bucket. Includes these methods:
+// ListObjectsV2Pages(*ListObjectsV2Input, func(*ListObjectsV2Output, bool) bool)
+// HeadObject(*HeadObjectInput)
+// GetObject(*GetObjectInput)
+// DeleteObject(*DeleteObjectInput)
+// Upload(*UploadInput, ...func(*s3manager.Uploader))
+type memoryS3Client struct {
+	s3iface.S3API
+	s3manageriface.UploaderAPI
+	mutex    sync.Mutex
+	objects  map[string][]byte
+	readOnly bool
+}
+
+func newMemoryS3Client() *memoryS3Client {
+	return &memoryS3Client{objects: make(map[string][]byte)}
+}
+
+func memoryETag(body []byte) *string {
+	return aws.String(fmt.Sprintf("\"%x\"", md5.Sum(body)))
+}
+
+func (m *memoryS3Client) ListObjectsV2Pages(input *s3.ListObjectsV2Input, callback func(*s3.ListObjectsV2Output, bool) bool) error {
+	m.mutex.Lock()
+	output := &s3.ListObjectsV2Output{}
+	for key, body := range m.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			output.Contents = append(output.Contents, &s3.Object{
+				Key:  aws.String(key),
+				Size: aws.Int64(int64(len(body))),
+				ETag: memoryETag(body),
+			})
+		}
+	}
+	m.mutex.Unlock()
+	callback(output, true)
+	return nil
+}
+
+func (m *memoryS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	body, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New("NotFound", "object not found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(body))), ETag: memoryETag(body)}, nil
+}
+
+func (m *memoryS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	body, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, awserr.New("NoSuchKey", "object not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (m *memoryS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.objects, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *memoryS3Client) Upload(input *s3manager.UploadInput, f ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	if m.readOnly {
+		return nil, awserr.New("AccessDenied", "access denied", nil)
+	}
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.objects[*input.Key] = body
+	return &s3manager.UploadOutput{Location: *input.Key}, nil
+}
+
+func newMemoryStorage() (*walg.TarUploader, *walg.Prefix, *memoryS3Client) {
+	client := newMemoryS3Client()
+	pre := &walg.Prefix{
+		Svc:    client,
+		Bucket: aws.String("bucket"),
+		Server: aws.String("server"),
+	}
+	tu := walg.NewTarUploader(client, "bucket", "server", "region")
+	tu.Upl = client
+	return tu, pre, client
+}
+
+func TestBackupPushLock(t *testing.T) {
+	tu, pre, client := newMemoryStorage()
+	// Short TTL keeps wait after upload of lock short
+	os.Setenv("WALG_BACKUP_PUSH_LOCK_TTL", "1s")
+	defer os.Unsetenv("WALG_BACKUP_PUSH_LOCK_TTL")
+
+	lock, err := walg.AcquireBackupPushLock(tu, pre, false)
+	if err != nil {
+		t.Fatalf("lock: failed to acquire free lock: %v", err)
+	}
+	if _, ok := client.objects["server/"+walg.BackupPushLockName]; !ok {
+		t.Fatalf("lock: lock object was not uploaded")
+	}
+
+	_, err = walg.AcquireBackupPushLock(tu, pre, false)
+	if _, ok := err.(walg.BackupPushLockedError); !ok {
+		t.Errorf("lock: expected BackupPushLockedError but got %v", err)
+	}
+
+	forced, err := walg.AcquireBackupPushLock(tu, pre, true)
+	if err != nil {
+		t.Errorf("lock: failed to override lock with force: %v", err)
+	}
+
+	err = forced.Release()
+	if err != nil {
+		t.Errorf("lock: failed to release lock: %v", err)
+	}
+	lock, err = walg.AcquireBackupPushLock(tu, pre, false)
+	if err != nil {
+		t.Errorf("lock: failed to acquire released lock: %v", err)
+	}
+	lock.Release()
+}
+
+func TestBackupPushLockExpires(t *testing.T) {
+	tu, pre, client := newMemoryStorage()
+
+	os.Setenv("WALG_BACKUP_PUSH_LOCK_TTL", "40ms")
+	defer os.Unsetenv("WALG_BACKUP_PUSH_LOCK_TTL")
+
+	// Lock of push killed hours ago which never refreshed it
+	client.objects["server/"+walg.BackupPushLockName] = []byte(`{"hostname":"db1","pid":42,"time":"2018-10-17T10:00:00Z"}`)
+	lock, err := walg.AcquireBackupPushLock(tu, pre, false)
+	if err != nil {
+		t.Fatalf("lock: failed to take expired lock: %v", err)
+	}
+	lock.Release()
+	lock, err = walg.AcquireBackupPushLock(tu, pre, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Running push refreshes its lock, so it does not expire
+	time.Sleep(100 * time.Millisecond)
+	_, err = walg.AcquireBackupPushLock(tu, pre, false)
+	if locked, ok := err.(walg.BackupPushLockedError); !ok || locked.Expires.Before(time.Now()) {
+		t.Errorf("lock: expected refreshed lock to be held but got %v", err)
+	}
+	if err = lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err = lock.Release(); err != nil {
+		t.Errorf("lock: failed to release lock twice: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if _, ok := client.objects["server/"+walg.BackupPushLockName]; ok {
+		t.Errorf("lock: released lock is uploaded again")
+	}
+}
+
+func TestBackupPushLockTakenOver(t *testing.T) {
+	tu, pre, client := newMemoryStorage()
+	key := "server/" + walg.BackupPushLockName
+	readLock := func() walg.BackupPushLockDescription {
+		client.mutex.Lock()
+		defer client.mutex.Unlock()
+		var description walg.BackupPushLockDescription
+		if err := json.Unmarshal(client.objects[key], &description); err != nil {
+			t.Fatal(err)
+		}
+		return description
+	}
+
+	os.Setenv("WALG_BACKUP_PUSH_LOCK_TTL", "40ms")
+	defer os.Unsetenv("WALG_BACKUP_PUSH_LOCK_TTL")
+	stale, err := walg.AcquireBackupPushLock(tu, pre, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forced, err := walg.AcquireBackupPushLock(tu, pre, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := readLock()
+
+	// Refresh of push which lost the lock does not overwrite it
+	time.Sleep(100 * time.Millisecond)
+	if refreshed := readLock(); !refreshed.Time.Equal(owner.Time) || !refreshed.Refreshed.After(owner.Time) {
+		t.Errorf("lock: expected lock of %v refreshed by its owner but got %+v", owner.Time, refreshed)
+	}
+	if err = stale.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if released := readLock(); !released.Time.Equal(owner.Time) {
+		t.Errorf("lock: push which lost the lock released lock of %v", released.Time)
+	}
+	if err = forced.Release(); err != nil {
+		t.Fatal(err)
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if _, ok := client.objects[key]; ok {
+		t.Errorf("lock: owner did not release lock")
+	}
+}
+
+// barrierS3Client holds responses to the first waiting HEAD requests until all of them are made,
+// so pushes see the same state of the lock
+type barrierS3Client struct {
+	*memoryS3Client
+	checked sync.WaitGroup
+	waiting int32
+	heads   int32
+}
+
+func (c *barrierS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	output, err := c.memoryS3Client.HeadObject(input)
+	if head := atomic.AddInt32(&c.heads, 1); head <= c.waiting {
+		c.checked.Done()
+		c.checked.Wait()
+	}
+	return output, err
+}
+
+func TestBackupPushLockConcurrentAcquire(t *testing.T) {
+	client := &barrierS3Client{memoryS3Client: newMemoryS3Client(), waiting: 2}
+	client.checked.Add(2)
+	pre := &walg.Prefix{Svc: client, Bucket: aws.String("bucket"), Server: aws.String("server")}
+	tu := walg.NewTarUploader(client, "bucket", "server", "region")
+	tu.Upl = client.memoryS3Client
+	os.Setenv("WALG_BACKUP_PUSH_LOCK_TTL", "10s")
+	defer os.Unsetenv("WALG_BACKUP_PUSH_LOCK_TTL")
+
+	// Both pushes find no lock and upload their own, only the one whose lock is kept proceeds
+	locks := make([]*walg.BackupPushLock, 2)
+	errs := make([]error, 2)
+	var done sync.WaitGroup
+	for i := range locks {
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			locks[i], errs[i] = walg.AcquireBackupPushLock(tu, pre, false)
+		}(i)
+	}
+	done.Wait()
+
+	acquired := 0
+	for i, err := range errs {
+		if err == nil {
+			acquired++
+			defer locks[i].Release()
+		} else if _, ok := err.(walg.BackupPushLockedError); !ok {
+			t.Errorf("lock: expected BackupPushLockedError but got %v", err)
+		}
+	}
+	if acquired != 1 {
+		t.Errorf("lock: expected exactly one of concurrent pushes to acquire lock but got %d", acquired)
+	}
+}
+
+func TestBackupPushReleasesLockOnError(t *testing.T) {
+	tu, pre, client := newMemoryStorage()
+	os.Setenv("WALG_BACKUP_PUSH_LOCK_TTL", "1s")
+	defer os.Unsetenv("WALG_BACKUP_PUSH_LOCK_TTL")
+	dir, err := ioutil.TempDir("", "walg_lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Invalid setting is reported before the lock is taken
+	os.Setenv("WALG_COMPRESSION_METHOD", "bogus")
+	err = walg.HandleBackupPush(dir, tu, pre, false, false)
+	os.Unsetenv("WALG_COMPRESSION_METHOD")
+	if err == nil {
+		t.Errorf("lock: expected push with invalid compression method to fail")
+	}
+	if _, ok := client.objects["server/"+walg.BackupPushLockName]; ok {
+		t.Errorf("lock: lock is left after push failed on settings")
+	}
+
+	// Postgres is not reachable, push fails once the lock is taken
+	os.Setenv("PGHOST", dir)
+	os.Setenv("PGPORT", "1")
+	defer os.Unsetenv("PGHOST")
+	defer os.Unsetenv("PGPORT")
+	err = walg.HandleBackupPush(dir, tu, pre, false, false)
+	if err == nil || !strings.Contains(err.Error(), "Connect") {
+		t.Fatalf("lock: expected push without postgres to fail on connection but got %v", err)
+	}
+	if _, ok := client.objects["server/"+walg.BackupPushLockName]; ok {
+		t.Errorf("lock: lock is left after push failed")
+	}
+}
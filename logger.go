@@ -0,0 +1,99 @@
+package walg
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Formats of WALG_LOG_FORMAT
+const (
+	TextLogFormat = "text"
+	JSONLogFormat = "json"
+)
+
+// getLogFormat reads WALG_LOG_FORMAT, plain text by default
+func getLogFormat() string {
+	format, ok := os.LookupEnv("WALG_LOG_FORMAT")
+	if !ok || format == "" {
+		return TextLogFormat
+	}
+	if format != TextLogFormat && format != JSONLogFormat {
+		log.Fatal("WALG_LOG_FORMAT must be one of "+TextLogFormat+", "+JSONLogFormat+", got ", format)
+	}
+	return format
+}
+
+// Logger writes log entries of one operation, such as wal-fetch. Entries are
+// plain text of stdlib log unless WALG_LOG_FORMAT is json, then each entry is
+// a JSON object on its own line with time, level, op, msg, fields set by With
+// and error taken from arguments of the message.
+type Logger struct {
+	op     string
+	fields map[string]interface{}
+}
+
+// NewLogger creates logger of operation op
+func NewLogger(op string) *Logger {
+	return &Logger{op: op, fields: map[string]interface{}{}}
+}
+
+// With returns logger adding field key to entries, such as wal_file or backup_name
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{op: l.op, fields: fields}
+}
+
+// Printf writes informational entry
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.output("info", format, v...)
+}
+
+// Warnf writes entry about failure the operation recovers from
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output("warning", format, v...)
+}
+
+// Fatalf writes entry and exits with code 1, as log.Fatalf does
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.output("fatal", format, v...)
+	os.Exit(1)
+}
+
+func (l *Logger) output(level string, format string, v ...interface{}) {
+	if getLogFormat() != JSONLogFormat {
+		log.Printf(format, v...)
+		return
+	}
+	log.Writer().Write(l.formatJSON(time.Now(), level, format, v...))
+}
+
+// formatJSON encodes entry as one line. Stack traces of %+v are left out of msg.
+func (l *Logger) formatJSON(now time.Time, level string, format string, v ...interface{}) []byte {
+	entry := make(map[string]interface{}, len(l.fields)+5)
+	for k, value := range l.fields {
+		entry[k] = value
+	}
+	entry["time"] = now.UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["op"] = l.op
+	entry["msg"] = strings.TrimSpace(fmt.Sprintf(strings.Replace(format, "%+v", "%v", -1), v...))
+	for _, arg := range v {
+		if err, ok := arg.(error); ok {
+			entry["error"] = err.Error()
+			break
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": level, "op": l.op, "msg": fmt.Sprintf(format, v...)})
+	}
+	return append(line, '\n')
+}
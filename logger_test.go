@@ -0,0 +1,68 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	logger := NewLogger("wal-fetch").With("wal_file", "000000010000000000000001")
+	err := errors.New("DownloadWALFile: object not found")
+	line := logger.With("attempt", 2).formatJSON(time.Unix(0, 0), "fatal", "%+v\n", err)
+
+	if bytes.Count(line, []byte("\n")) != 1 || line[len(line)-1] != '\n' {
+		t.Errorf("logger: expected entry on one line, got %q", line)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		t.Fatalf("logger: invalid JSON entry %q: %v", line, err)
+	}
+	expected := map[string]interface{}{
+		"time":     "1970-01-01T00:00:00Z",
+		"level":    "fatal",
+		"op":       "wal-fetch",
+		"wal_file": "000000010000000000000001",
+		"attempt":  float64(2),
+		"msg":      "DownloadWALFile: object not found",
+		"error":    "DownloadWALFile: object not found",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("logger: expected %s %v, got %v", key, value, entry[key])
+		}
+	}
+	if _, ok := NewLogger("wal-fetch").fields["wal_file"]; ok {
+		t.Errorf("logger: With changed fields of parent logger")
+	}
+}
+
+func TestLoggerFormat(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	logger := NewLogger("wal-push").With("wal_file", "000000010000000000000001")
+	logger.Printf("upload: could not upload '%s'\n", "wal_005/000000010000000000000001.lz4")
+	if !strings.HasSuffix(buf.String(), "upload: could not upload 'wal_005/000000010000000000000001.lz4'\n") || strings.Contains(buf.String(), "{") {
+		t.Errorf("logger: expected plain text entry by default, got %q", buf.String())
+	}
+
+	buf.Reset()
+	os.Setenv("WALG_LOG_FORMAT", "json")
+	defer os.Unsetenv("WALG_LOG_FORMAT")
+	logger.Warnf("Prefetched file contain errors %v", errors.New("wrong size"))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("logger: expected JSON entry, got %q", buf.String())
+	}
+	if entry["level"] != "warning" || entry["op"] != "wal-push" || entry["error"] != "wrong size" {
+		t.Errorf("logger: unexpected entry %q", buf.String())
+	}
+}
@@ -0,0 +1,221 @@
+package walg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// durationBuckets are upper bounds in seconds of duration histograms,
+// from a single WAL file to a backup of a large cluster
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600, 4 * 3600}
+
+// Metrics are counters and histograms of operations served to Prometheus.
+// When metrics are not configured registry is nil and all methods do nothing,
+// so callers never have to check whether metrics are enabled.
+type Metrics struct {
+	mutex             sync.Mutex
+	uploadedBytes     int64
+	walSegmentsPushed int64
+	uploadFailures    map[string]int64
+	pushDuration      map[string]*durationHistogram
+	fetchDuration     map[string]*durationHistogram
+}
+
+type durationHistogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func (h *durationHistogram) observe(seconds float64) {
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+var (
+	metrics     *Metrics
+	metricsOnce sync.Once
+)
+
+// getMetrics starts serving metrics at WALG_METRICS_ADDR on first call.
+// Returns nil if WALG_METRICS_ADDR is not set.
+func getMetrics() *Metrics {
+	metricsOnce.Do(func() {
+		addr, ok := os.LookupEnv("WALG_METRICS_ADDR")
+		if !ok || addr == "" {
+			return
+		}
+		metrics = NewMetrics()
+		err := metrics.Serve(addr)
+		if err != nil {
+			// Metrics never fail the operation itself
+			log.Printf("Unable to serve metrics at %s: %v\n", addr, err)
+		}
+	})
+	return metrics
+}
+
+// NewMetrics creates empty registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		uploadFailures: make(map[string]int64),
+		pushDuration:   make(map[string]*durationHistogram),
+		fetchDuration:  make(map[string]*durationHistogram),
+	}
+}
+
+// Serve starts serving metrics at /metrics of addr in background
+func (m *Metrics) Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// ServeHTTP writes metrics in Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// AddUploadedBytes counts bytes read by storage from bodies of uploads
+func (m *Metrics) AddUploadedBytes(n int64) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.uploadedBytes += n
+}
+
+// IncWALSegmentsPushed counts WAL segment successfully uploaded
+func (m *Metrics) IncWALSegmentsPushed() {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.walSegmentsPushed++
+}
+
+// IncUploadFailures counts failed upload of operation, such as wal-push
+func (m *Metrics) IncUploadFailures(operation string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.uploadFailures[operation]++
+}
+
+// ObservePushDuration records duration of successful push operation
+func (m *Metrics) ObservePushDuration(operation string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.observe(m.pushDuration, operation, d)
+}
+
+// ObserveFetchDuration records duration of successful fetch operation
+func (m *Metrics) ObserveFetchDuration(operation string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.observe(m.fetchDuration, operation, d)
+}
+
+func (m *Metrics) observe(histograms map[string]*durationHistogram, operation string, d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, ok := histograms[operation]
+	if !ok {
+		h = &durationHistogram{counts: make([]int64, len(durationBuckets))}
+		histograms[operation] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// WriteTo writes metrics in Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cw := &writeCounter{Writer: w}
+	fmt.Fprintln(cw, "# HELP walg_uploaded_bytes_total Bytes uploaded to storage, after compression and encryption.")
+	fmt.Fprintln(cw, "# TYPE walg_uploaded_bytes_total counter")
+	fmt.Fprintf(cw, "walg_uploaded_bytes_total %d\n", m.uploadedBytes)
+	fmt.Fprintln(cw, "# HELP walg_wal_segments_pushed_total WAL segments uploaded to storage.")
+	fmt.Fprintln(cw, "# TYPE walg_wal_segments_pushed_total counter")
+	fmt.Fprintf(cw, "walg_wal_segments_pushed_total %d\n", m.walSegmentsPushed)
+	fmt.Fprintln(cw, "# HELP walg_upload_failures_total Failed uploads by operation.")
+	fmt.Fprintln(cw, "# TYPE walg_upload_failures_total counter")
+	for _, operation := range sortedKeys(m.uploadFailures) {
+		fmt.Fprintf(cw, "walg_upload_failures_total{operation=%q} %d\n", operation, m.uploadFailures[operation])
+	}
+	writeHistograms(cw, "walg_push_duration_seconds", "Duration of successful push operations.", m.pushDuration)
+	writeHistograms(cw, "walg_fetch_duration_seconds", "Duration of successful fetch operations.", m.fetchDuration)
+	return cw.n, nil
+}
+
+func writeHistograms(w io.Writer, name, help string, histograms map[string]*durationHistogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	operations := make([]string, 0, len(histograms))
+	for operation := range histograms {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		h := histograms[operation]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "%s_bucket{operation=%q,le=%q} %d\n", name, operation, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{operation=%q,le=\"+Inf\"} %d\n", name, operation, h.count)
+		fmt.Fprintf(w, "%s_sum{operation=%q} %g\n", name, operation, h.sum)
+		fmt.Fprintf(w, "%s_count{operation=%q} %d\n", name, operation, h.count)
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// uploadCountingReader counts bytes of upload body as storage reads them
+type uploadCountingReader struct {
+	internal io.Reader
+	metrics  *Metrics
+}
+
+func (r *uploadCountingReader) Read(p []byte) (int, error) {
+	n, err := r.internal.Read(p)
+	r.metrics.AddUploadedBytes(int64(n))
+	return n, err
+}
+
+// fatalUploadFailure counts failure of operation of logger before exiting as log.Fatalf does
+func fatalUploadFailure(logger *Logger, format string, v ...interface{}) {
+	getMetrics().IncUploadFailures(logger.op)
+	logger.Fatalf(format, v...)
+}
@@ -0,0 +1,63 @@
+package walg
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	var nilMetrics *Metrics
+	nilMetrics.AddUploadedBytes(1)
+	nilMetrics.IncUploadFailures("wal-push")
+	nilMetrics.ObservePushDuration("wal-push", time.Second)
+
+	m := NewMetrics()
+	m.AddUploadedBytes(100)
+	m.IncWALSegmentsPushed()
+	m.IncUploadFailures("backup-push")
+	m.ObservePushDuration("wal-push", 2*time.Second)
+	m.ObserveFetchDuration("backup-fetch", 20*time.Minute)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE walg_uploaded_bytes_total counter",
+		"walg_uploaded_bytes_total 100",
+		"walg_wal_segments_pushed_total 1",
+		`walg_upload_failures_total{operation="backup-push"} 1`,
+		"# TYPE walg_push_duration_seconds histogram",
+		`walg_push_duration_seconds_bucket{operation="wal-push",le="1"} 0`,
+		`walg_push_duration_seconds_bucket{operation="wal-push",le="5"} 1`,
+		`walg_push_duration_seconds_bucket{operation="wal-push",le="+Inf"} 1`,
+		`walg_push_duration_seconds_sum{operation="wal-push"} 2`,
+		`walg_fetch_duration_seconds_bucket{operation="backup-fetch",le="900"} 0`,
+		`walg_fetch_duration_seconds_bucket{operation="backup-fetch",le="3600"} 1`,
+		`walg_fetch_duration_seconds_count{operation="backup-fetch"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics: expected line %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsCountUploadedBytes(t *testing.T) {
+	getMetrics()
+	metrics = NewMetrics()
+	defer func() { metrics = nil }()
+
+	tu, _ := ConfigureStorageBackend(discardStorage{}, "server")
+	err := tu.put("server/wal_005/000000010000000000000001.lz4", bytes.NewReader(make([]byte, 1000)))
+	if err != nil {
+		t.Fatalf("metrics: upload failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	if !strings.Contains(buf.String(), "walg_uploaded_bytes_total 1000\n") {
+		t.Errorf("metrics: expected 1000 uploaded bytes in\n%s", buf.String())
+	}
+}
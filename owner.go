@@ -0,0 +1,78 @@
+package walg
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FileOwner is the owner given to restored files and directories
+type FileOwner struct {
+	Uid int
+	Gid int
+}
+
+// ParseFileOwner parses owner in form uid:gid
+func ParseFileOwner(owner string) (*FileOwner, error) {
+	parts := strings.Split(owner, ":")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("ParseFileOwner: owner '%s' is not in form uid:gid", owner)
+	}
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil || uid < 0 {
+		return nil, errors.Errorf("ParseFileOwner: invalid uid '%s'", parts[0])
+	}
+	gid, err := strconv.Atoi(parts[1])
+	if err != nil || gid < 0 {
+		return nil, errors.Errorf("ParseFileOwner: invalid gid '%s'", parts[1])
+	}
+	return &FileOwner{uid, gid}, nil
+}
+
+// chownRestored gives restored path the configured owner. Without explicit owner
+// ownership recorded in tar header is restored only with PreserveOwner.
+func (ti *FileTarInterpreter) chownRestored(targetPath string, hdr *tar.Header) error {
+	uid, gid := hdr.Uid, hdr.Gid
+	if ti.Owner != nil {
+		uid, gid = ti.Owner.Uid, ti.Owner.Gid
+	} else if !ti.PreserveOwner {
+		return nil
+	}
+
+	err := os.Lchown(targetPath, uid, gid)
+	if err != nil {
+		return errors.Wrapf(err, "Interpret: failed to chown %s to %d:%d", targetPath, uid, gid)
+	}
+	return nil
+}
+
+// createParentDirs creates missing directories of restored member like prepareDirs
+func (ti *FileTarInterpreter) createParentDirs(fileName string, targetPath string, hdr *tar.Header) error {
+	return ti.mkdirAllRestored(strings.TrimSuffix(targetPath, filepath.Base(fileName)), hdr)
+}
+
+// mkdirAllRestored creates dir with missing parents, directories it creates inside of
+// restored directory are given owner of member hdr they are created for
+func (ti *FileTarInterpreter) mkdirAllRestored(dir string, hdr *tar.Header) error {
+	var created []string
+	for current := filepath.Clean(dir); strings.HasPrefix(current, filepath.Clean(ti.NewDir)+"/"); current = filepath.Dir(current) {
+		if _, err := os.Lstat(current); !os.IsNotExist(err) {
+			break
+		}
+		created = append(created, current)
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, path := range created {
+		if err = ti.chownRestored(path, hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
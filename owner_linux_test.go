@@ -0,0 +1,148 @@
+package walg
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func checkOwner(t *testing.T, dir string, owner *FileOwner, names ...string) {
+	for _, name := range names {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if int(stat.Uid) != owner.Uid || int(stat.Gid) != owner.Gid {
+			t.Errorf("owner: %s is owned by %d:%d instead of %d:%d", name, stat.Uid, stat.Gid, owner.Uid, owner.Gid)
+		}
+	}
+}
+
+func TestChownRestoredFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	owner := &FileOwner{os.Getuid(), os.Getgid()}
+	if os.Getuid() == 0 {
+		owner = &FileOwner{999, 998}
+	}
+	interpreter := &FileTarInterpreter{NewDir: dir, Owner: owner}
+
+	err = interpreter.Interpret(nil, &tar.Header{Name: "global", Mode: 0700, Typeflag: tar.TypeDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = interpreter.Interpret(strings.NewReader(""), &tar.Header{Name: "global/pg_control", Mode: 0600, Typeflag: tar.TypeReg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Directories of file extracted before their own members are created implicitly
+	err = interpreter.Interpret(strings.NewReader(""), &tar.Header{Name: "base/1/1", Mode: 0600, Typeflag: tar.TypeReg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkOwner(t, dir, owner, "global", "global/pg_control", "base", "base/1", "base/1/1")
+}
+
+func TestChownIncrementedFiles(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("owner: ownership of files can be changed only by root")
+	}
+	dir, err := ioutil.TempDir("", "chown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	incrementBase := filepath.Join(dir, "increment_base")
+	for _, name := range []string{"base/1/1", "base/1/2"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(incrementBase, name)), 0755)
+		if err = ioutil.WriteFile(filepath.Join(incrementBase, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Increment of empty file without changed pages
+	increment := func() *bytes.Buffer {
+		b := bytes.NewBuffer([]byte{'w', 'i', '1', signatureMagicNumber})
+		binary.Write(b, binary.LittleEndian, uint64(0))
+		binary.Write(b, binary.LittleEndian, uint32(0))
+		return b
+	}
+
+	owner := &FileOwner{999, 998}
+	from, lsn, count := "base_000000010000000000000002", uint64(0x2000028), 1
+	interpreter := &FileTarInterpreter{
+		NewDir:             dir,
+		IncrementalBaseDir: incrementBase,
+		Owner:              owner,
+		Sentinel: S3TarBallSentinelDto{
+			IncrementFrom:     &from,
+			IncrementFromLSN:  &lsn,
+			IncrementFullName: &from,
+			IncrementCount:    &count,
+			Files: BackupFileList{
+				"base/1/1": {IsIncremented: true},
+				"base/1/2": {IsIncremented: true},
+			},
+		},
+	}
+	if err = interpreter.Interpret(increment(), &tar.Header{Name: "base/1/1", Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	// Increment already moved by interrupted fetch is applied in place
+	interpreter.BackupName = "base_000000010000000000000004"
+	interrupted, err := OpenFetchProgress(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = interrupted.Start(interpreter.BackupName); err != nil {
+		t.Fatal(err)
+	}
+	interrupted.Close()
+	interpreter.Progress, err = OpenFetchProgress(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer interpreter.Progress.Close()
+	os.Rename(filepath.Join(incrementBase, "base/1/2"), filepath.Join(dir, "base/1/2"))
+	if err = interpreter.Interpret(increment(), &tar.Header{Name: "base/1/2", Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkOwner(t, dir, owner, "base", "base/1", "base/1/1", "base/1/2")
+}
+
+func TestPreserveOwnerIsOptIn(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("owner: ownership of files can be changed only by root")
+	}
+	dir, err := ioutil.TempDir("", "chown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	member := &tar.Header{Name: "base/1/1", Mode: 0600, Typeflag: tar.TypeReg, Uid: 999, Gid: 998}
+	interpreter := &FileTarInterpreter{NewDir: filepath.Join(dir, "default")}
+	if err = interpreter.Interpret(strings.NewReader(""), member); err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, interpreter.NewDir, &FileOwner{0, 0}, "base", "base/1", "base/1/1")
+
+	interpreter = &FileTarInterpreter{NewDir: filepath.Join(dir, "preserved"), PreserveOwner: true}
+	if err = interpreter.Interpret(strings.NewReader(""), member); err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, interpreter.NewDir, &FileOwner{999, 998}, "base", "base/1", "base/1/1")
+}
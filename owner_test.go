@@ -0,0 +1,20 @@
+package walg
+
+import "testing"
+
+func TestParseFileOwner(t *testing.T) {
+	owner, err := ParseFileOwner("999:998")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.Uid != 999 || owner.Gid != 998 {
+		t.Errorf("owner: expected 999:998 but got %d:%d", owner.Uid, owner.Gid)
+	}
+
+	for _, invalid := range []string{"", "999", "postgres:postgres", "1:2:3", "-1:5"} {
+		_, err = ParseFileOwner(invalid)
+		if err == nil {
+			t.Errorf("owner: expected error for '%s'", invalid)
+		}
+	}
+}
@@ -223,10 +223,10 @@ func (pr *IncrementalPageReader) initialize() (size int64, err error) {
 // ReadDatabaseFile tries to read file as an incremental data file if possible, otherwise just open the file
 func ReadDatabaseFile(fileName string, lsn *uint64, isNew bool) (io.ReadCloser, bool, int64, error) {
 	info, err := os.Stat(fileName)
-	fileSize := info.Size()
 	if err != nil {
-		return nil, false, fileSize, err
+		return nil, false, 0, err
 	}
+	fileSize := info.Size()
 
 	file, err := os.Open(fileName)
 	if err != nil {
@@ -234,7 +234,7 @@ func ReadDatabaseFile(fileName string, lsn *uint64, isNew bool) (io.ReadCloser,
 	}
 
 	if lsn == nil || isNew || !IsPagedFile(info, fileName) {
-		return file, false, fileSize, nil
+		return NewSparseFileReader(file, fileSize), false, fileSize, nil
 	}
 
 	lim := &io.LimitedReader{
@@ -252,7 +252,7 @@ func ReadDatabaseFile(fileName string, lsn *uint64, isNew bool) (io.ReadCloser,
 			if err != nil {
 				return nil, false, fileSize, err
 			}
-			return file, false, fileSize, nil
+			return NewSparseFileReader(file, fileSize), false, fileSize, nil
 		}
 
 		return nil, false, fileSize, err
@@ -260,8 +260,11 @@ func ReadDatabaseFile(fileName string, lsn *uint64, isNew bool) (io.ReadCloser,
 	return reader, true, incrSize, nil
 }
 
-// ApplyFileIncrement changes pages according to supplied change map file
-func ApplyFileIncrement(fileName string, increment io.Reader) error {
+// ApplyFileIncrement changes pages according to supplied change map file.
+// If baseLSN is given, pages of fileName which are not changed by increment
+// must not be newer than it, otherwise fileName is not the base of increment.
+// Nil baseLSN skips the check.
+func ApplyFileIncrement(fileName string, increment io.Reader, baseLSN *uint64) error {
 	fmt.Println("Incrementing " + fileName)
 	header := make([]byte, sizeofInt32)
 	fileSizeBytes := make([]byte, sizeofInt64)
@@ -304,6 +307,13 @@ func ApplyFileIncrement(fileName string, increment io.Reader) error {
 	defer file.Close()
 	defer file.Sync()
 
+	if baseLSN != nil {
+		err = checkIncrementBasePages(file, fileSize, diffMap, *baseLSN)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = file.Truncate(int64(fileSize))
 	if err != nil {
 		return err
@@ -331,6 +341,38 @@ func ApplyFileIncrement(fileName string, increment io.Reader) error {
 	return nil
 }
 
+// checkIncrementBasePages verifies that pages of base file kept by increment are not
+// newer than baseLSN. Page changed after the LSN delta was taken from is in increment,
+// unless file is not the base of delta. Pages with invalid header, e.g. zeroed, are not checked.
+func checkIncrementBasePages(file *os.File, fileSize uint64, diffMap []byte, baseLSN uint64) error {
+	changed := make(map[uint32]bool, len(diffMap)/sizeofInt32)
+	for i := 0; i < len(diffMap); i += sizeofInt32 {
+		changed[binary.LittleEndian.Uint32(diffMap[i:i+sizeofInt32])] = true
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+	if fileSize < size {
+		size = fileSize
+	}
+	page := make([]byte, BlockSize)
+	for blockNo := uint32(0); uint64(blockNo+1)*uint64(BlockSize) <= size; blockNo++ {
+		if changed[blockNo] {
+			continue
+		}
+		_, err = file.ReadAt(page, int64(blockNo)*int64(BlockSize))
+		if err != nil {
+			return err
+		}
+		if lsn, valid := ParsePageHeader(page); valid && lsn > baseLSN {
+			return fmt.Errorf("Page %d of %s has LSN %x after LSN %x delta was taken from, file is not the base of delta", blockNo, file.Name(), lsn, baseLSN)
+		}
+	}
+	return nil
+}
+
 func allZero(s []byte) bool {
 	for _, v := range s {
 		if v != 0 {
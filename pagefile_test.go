@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -68,7 +69,7 @@ func postgresFileTest(loclLSN uint64, t *testing.T) {
 	tmpFile.WriteAt(make([]byte, 12345), 477421568-12345)
 	tmpFile.Close()
 	newReader := bytes.NewReader(buf)
-	err = ApplyFileIncrement(tmpFileName, newReader)
+	err = ApplyFileIncrement(tmpFileName, newReader, &loclLSN)
 	if err != nil {
 		t.Error(err)
 	}
@@ -144,3 +145,39 @@ func deepCompare(file1, file2 string) bool {
 		chunkNumber++
 	}
 }
+
+func TestApplyIncrementChecksBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "base_increment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Delta from LSN 0x200 has the second page only
+	deltaFrom := uint64(0x200)
+	current := filepath.Join(dir, "current")
+	ioutil.WriteFile(current, append(makeTestPage(0x100, 1), makeTestPage(0x300, 2)...), 0600)
+	reader, isPaged, _, err := ReadDatabaseFile(current, &deltaFrom, false)
+	if err != nil || !isPaged {
+		t.Fatalf("increment: failed to read increment %v", err)
+	}
+	increment, _ := ioutil.ReadAll(reader)
+	reader.Close()
+
+	for _, test := range []struct {
+		firstPageLSN uint64
+		baseLSN      *uint64
+		valid        bool
+	}{
+		{0x100, &deltaFrom, true},
+		{0x250, &deltaFrom, false},
+		{0x250, nil, true},
+	} {
+		base := filepath.Join(dir, "base")
+		ioutil.WriteFile(base, append(makeTestPage(test.firstPageLSN, 3), makeTestPage(0x150, 4)...), 0600)
+		err = ApplyFileIncrement(base, bytes.NewReader(increment), test.baseLSN)
+		if (err == nil) != test.valid {
+			t.Errorf("increment: base with page of LSN %x, expected valid=%v, got %v", test.firstPageLSN, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package walg
+
+import (
+	"encoding/binary"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pierrec/lz4"
+	"github.com/pierrec/xxHash/xxHash32"
+	"github.com/pkg/errors"
+)
+
+const (
+	lz4FrameMagic = 0x184D2204
+	// Version 01, independent blocks, content checksum
+	lz4FrameFlags = 1<<6 | 1<<5 | 1<<2
+	// Maximal block size of 4MB, the default of lz4.Writer
+	lz4FrameBlockSize = 4 << 20
+)
+
+// lz4BlockSizeIDs are block sizes allowed in LZ4 frame with their descriptor bits
+var lz4BlockSizeIDs = map[int]byte{
+	64 << 10:  4 << 4,
+	256 << 10: 5 << 4,
+	1 << 20:   6 << 4,
+	4 << 20:   7 << 4,
+}
+
+// ParallelLz4Writer writes LZ4 frame compressing its independent blocks concurrently.
+// Blocks are written in order of input, so the output is a single frame which
+// any LZ4 reader decompresses linearly.
+type ParallelLz4Writer struct {
+	dst       io.Writer
+	blockSize int
+	buf       []byte
+	checksum  hash.Hash32
+	header    bool
+	// Blocks are compressed with HC algorithm if set
+	highCompression bool
+
+	// Compressed blocks in order of input, capacity limits blocks in flight
+	pending chan chan []byte
+	done    chan struct{}
+
+	mutex sync.Mutex
+	err   error
+}
+
+// NewParallelLz4Writer creates writer compressing up to threads blocks at once
+func NewParallelLz4Writer(dst io.Writer, threads int) *ParallelLz4Writer {
+	z := &ParallelLz4Writer{
+		dst:       dst,
+		blockSize: lz4FrameBlockSize,
+		checksum:  xxHash32.New(0),
+		pending:   make(chan chan []byte, threads),
+		done:      make(chan struct{}),
+	}
+	go z.writeBlocks()
+	return z
+}
+
+func (z *ParallelLz4Writer) failure() error {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	return z.err
+}
+
+func (z *ParallelLz4Writer) fail(err error) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	if z.err == nil {
+		z.err = err
+	}
+}
+
+// writeBlocks writes compressed blocks as they are ready, keeping their order
+func (z *ParallelLz4Writer) writeBlocks() {
+	defer close(z.done)
+	for result := range z.pending {
+		block := <-result
+		// Blocks are still drained after failure, so Write and Close do not block
+		if z.failure() != nil {
+			continue
+		}
+		_, err := z.dst.Write(block)
+		if err != nil {
+			z.fail(err)
+		}
+	}
+}
+
+func (z *ParallelLz4Writer) writeHeader() error {
+	z.header = true
+	header := make([]byte, 7)
+	binary.LittleEndian.PutUint32(header, lz4FrameMagic)
+	header[4] = lz4FrameFlags
+	header[5] = lz4BlockSizeIDs[z.blockSize]
+	header[6] = byte(xxHash32.Checksum(header[4:6], 0) >> 8)
+	_, err := z.dst.Write(header)
+	return err
+}
+
+// compressLz4Block makes frame block of data: its size and compressed content,
+// or data as is if it does not compress
+func compressLz4Block(data []byte, highCompression bool) []byte {
+	block := make([]byte, 4+len(data))
+	compress := lz4.CompressBlock
+	if highCompression {
+		compress = lz4.CompressBlockHC
+	}
+	n, err := compress(data, block[4:], 0)
+	if err != nil || n == 0 || n >= len(data) {
+		binary.LittleEndian.PutUint32(block, uint32(len(data))|1<<31)
+		copy(block[4:], data)
+		return block
+	}
+	binary.LittleEndian.PutUint32(block, uint32(n))
+	return block[:4+n]
+}
+
+func (z *ParallelLz4Writer) dispatch() {
+	data := z.buf
+	z.buf = nil
+	result := make(chan []byte, 1)
+	z.pending <- result
+	go func() {
+		result <- compressLz4Block(data, z.highCompression)
+	}()
+}
+
+// Write buffers p and starts compression of each filled block
+func (z *ParallelLz4Writer) Write(p []byte) (int, error) {
+	if err := z.failure(); err != nil {
+		return 0, err
+	}
+	if !z.header {
+		if err := z.writeHeader(); err != nil {
+			z.fail(err)
+			return 0, err
+		}
+	}
+	z.checksum.Write(p)
+	written := 0
+	for written < len(p) {
+		if z.buf == nil {
+			z.buf = make([]byte, 0, z.blockSize)
+		}
+		n := len(p) - written
+		if free := z.blockSize - len(z.buf); n > free {
+			n = free
+		}
+		z.buf = append(z.buf, p[written:written+n]...)
+		written += n
+		if len(z.buf) == z.blockSize {
+			z.dispatch()
+		}
+	}
+	return written, nil
+}
+
+// Close compresses the rest of input, waits for all blocks to be written and ends the frame
+func (z *ParallelLz4Writer) Close() error {
+	if len(z.buf) > 0 {
+		z.dispatch()
+	}
+	close(z.pending)
+	<-z.done
+	if err := z.failure(); err != nil {
+		return err
+	}
+	if !z.header {
+		if err := z.writeHeader(); err != nil {
+			return err
+		}
+	}
+	end := make([]byte, 8)
+	binary.LittleEndian.PutUint32(end[4:], z.checksum.Sum32())
+	_, err := z.dst.Write(end)
+	return err
+}
+
+// newLz4Writer creates LZ4 writer of WALG_COMPRESSION_THREADS compression threads,
+// with blocks of WALG_LZ4_BLOCK_SIZE compressed by HC algorithm if WALG_LZ4_HC is set
+func newLz4Writer(dst io.Writer) io.WriteCloser {
+	blockSize := getLz4BlockSize()
+	highCompression := getLz4HighCompression()
+	if threads := getCompressionThreads(); threads > 1 {
+		z := NewParallelLz4Writer(dst, threads)
+		z.blockSize = blockSize
+		z.highCompression = highCompression
+		return z
+	}
+	lzw := lz4.NewWriter(dst)
+	lzw.Header.BlockMaxSize = blockSize
+	lzw.Header.HighCompression = highCompression
+	return lzw
+}
+
+// getLz4BlockSize reads WALG_LZ4_BLOCK_SIZE in bytes, one of 64KB, 256KB, 1MB and 4MB
+func getLz4BlockSize() int {
+	blockSize, err := parseLz4BlockSize()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return blockSize
+}
+
+func parseLz4BlockSize() (int, error) {
+	blockSizeStr, ok := os.LookupEnv("WALG_LZ4_BLOCK_SIZE")
+	if !ok {
+		return lz4FrameBlockSize, nil
+	}
+	blockSize, err := strconv.Atoi(blockSizeStr)
+	if err != nil {
+		return 0, errors.Wrap(err, "Unable to parse WALG_LZ4_BLOCK_SIZE")
+	}
+	if _, ok := lz4BlockSizeIDs[blockSize]; !ok {
+		return 0, errors.Errorf("WALG_LZ4_BLOCK_SIZE must be one of 65536, 262144, 1048576 and 4194304, got %d", blockSize)
+	}
+	return blockSize, nil
+}
+
+// getLz4HighCompression reads WALG_LZ4_HC, which trades speed of compression for ratio
+func getLz4HighCompression() bool {
+	hc, err := parseLz4HighCompression()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hc
+}
+
+func parseLz4HighCompression() (bool, error) {
+	hcStr, ok := os.LookupEnv("WALG_LZ4_HC")
+	if !ok {
+		return false, nil
+	}
+	hc, err := strconv.ParseBool(hcStr)
+	if err != nil {
+		return false, errors.Wrap(err, "Unable to parse WALG_LZ4_HC")
+	}
+	return hc, nil
+}
+
+// getCompressionThreads reads number of threads compressing one stream, 1 by default
+func getCompressionThreads() int {
+	threads, err := parseCompressionThreads()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return threads
+}
+
+func parseCompressionThreads() (int, error) {
+	threadsStr, ok := os.LookupEnv("WALG_COMPRESSION_THREADS")
+	if !ok {
+		return 1, nil
+	}
+	threads, err := strconv.Atoi(threadsStr)
+	if err != nil {
+		return 0, errors.Wrap(err, "Unable to parse WALG_COMPRESSION_THREADS")
+	}
+	if threads < 1 {
+		return 0, errors.Errorf("WALG_COMPRESSION_THREADS must be positive, got %d", threads)
+	}
+	return threads, nil
+}
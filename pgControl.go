@@ -0,0 +1,113 @@
+package walg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// PgControlCheckpoint is the last checkpoint recorded in pg_control
+type PgControlCheckpoint struct {
+	// Location of checkpoint record
+	CheckPoint uint64
+	// Redo pointer of checkpoint, recovery starts here
+	Redo uint64
+}
+
+// Offsets in ControlFileData. Fields before checkPoint are the same
+// since 9.3, where XLogRecPtr became plain uint64. Version 11 removed
+// prevCheckPoint, so checkPointCopy which starts with redo moved up.
+const (
+	pgControlCheckPointOffset = 32
+	pgControlRedoOffset       = 48
+	pgControlRedoOffset110000 = 40
+	pgControlMinVersion       = 90300
+)
+
+// ParsePgControl reads checkpoint from content of pg_control written by Postgres of given version.
+// pg_control is in native byte order, only little-endian machines are supported.
+func ParsePgControl(data []byte, pgVersion int) (PgControlCheckpoint, error) {
+	var checkpoint PgControlCheckpoint
+	if pgVersion < pgControlMinVersion {
+		return checkpoint, errors.Errorf("ParsePgControl: unsupported Postgres version %d", pgVersion)
+	}
+	redoOffset := pgControlRedoOffset
+	if pgVersion >= 110000 {
+		redoOffset = pgControlRedoOffset110000
+	}
+	if len(data) < redoOffset+8 {
+		return checkpoint, errors.Errorf("ParsePgControl: pg_control is too short: %d bytes", len(data))
+	}
+	checkpoint.CheckPoint = binary.LittleEndian.Uint64(data[pgControlCheckPointOffset:])
+	checkpoint.Redo = binary.LittleEndian.Uint64(data[redoOffset:])
+	return checkpoint, nil
+}
+
+// CheckPgControl compares checkpoint of restored pg_control with the sentinel.
+// pg_control is copied after pg_start_backup() and before pg_stop_backup(),
+// so its redo cannot precede start LSN and its checkpoint cannot follow finish LSN.
+// Returns description of inconsistency or empty string if pg_control matches backup.
+func CheckPgControl(checkpoint PgControlCheckpoint, sentinel S3TarBallSentinelDto) string {
+	if sentinel.LSN != nil && checkpoint.Redo < *sentinel.LSN {
+		return fmt.Sprintf("checkpoint redo %x precedes backup start LSN %x", checkpoint.Redo, *sentinel.LSN)
+	}
+	if sentinel.FinishLSN != nil && checkpoint.CheckPoint > *sentinel.FinishLSN {
+		return fmt.Sprintf("checkpoint %x follows backup finish LSN %x", checkpoint.CheckPoint, *sentinel.FinishLSN)
+	}
+	return ""
+}
+
+// VerifyRestoredPgControl checks pg_control in restored directory against the sentinel
+// and warns if backup seems to be assembled from wrong parts.
+// Backups without Postgres version in sentinel are not checked.
+func VerifyRestoredPgControl(dirArc string, sentinel S3TarBallSentinelDto) error {
+	if sentinel.PgVersion < pgControlMinVersion {
+		fmt.Printf("WARNING: pg_control is not verified, Postgres version %d of backup is unknown or unsupported\n", sentinel.PgVersion)
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dirArc, "global", "pg_control"))
+	if err != nil {
+		return errors.Wrap(err, "VerifyRestoredPgControl: failed to read pg_control")
+	}
+	checkpoint, err := ParsePgControl(data, sentinel.PgVersion)
+	if err != nil {
+		return err
+	}
+	if problem := CheckPgControl(checkpoint, sentinel); problem != "" {
+		fmt.Printf("WARNING: restored pg_control does not match backup: %s\n", problem)
+		return nil
+	}
+	fmt.Printf("pg_control matches backup: checkpoint %x, redo %x\n", checkpoint.CheckPoint, checkpoint.Redo)
+	return nil
+}
+
+// CheckIncrementBase verifies that base restored in dirArc is the backup delta was taken from:
+// start LSN recorded for the base must equal DeltaFromLSN of the delta, and pg_control
+// of restored base must match the base. pg_control is not read if Postgres version is unknown.
+func CheckIncrementBase(dirArc string, baseName string, base S3TarBallSentinelDto, delta S3TarBallSentinelDto) error {
+	if delta.IncrementFromLSN == nil {
+		return nil
+	}
+	if base.LSN == nil || *base.LSN != *delta.IncrementFromLSN {
+		return errors.Errorf("CheckIncrementBase: delta is taken from LSN %x, but base %s starts at %s",
+			*delta.IncrementFromLSN, baseName, formatOptionalLSN(base.LSN))
+	}
+	if base.PgVersion < pgControlMinVersion {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dirArc, "global", "pg_control"))
+	if err != nil {
+		return errors.Wrap(err, "CheckIncrementBase: failed to read pg_control of base")
+	}
+	checkpoint, err := ParsePgControl(data, base.PgVersion)
+	if err != nil {
+		return err
+	}
+	if problem := CheckPgControl(checkpoint, base); problem != "" {
+		return errors.Errorf("CheckIncrementBase: pg_control in %s does not belong to base %s: %s", dirArc, baseName, problem)
+	}
+	return nil
+}
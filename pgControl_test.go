@@ -0,0 +1,100 @@
+package walg
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makePgControl(checkPoint uint64, redo uint64, redoOffset int) []byte {
+	data := make([]byte, 8192)
+	binary.LittleEndian.PutUint64(data[pgControlCheckPointOffset:], checkPoint)
+	binary.LittleEndian.PutUint64(data[redoOffset:], redo)
+	return data
+}
+
+func TestParsePgControl(t *testing.T) {
+	checkpoint, err := ParsePgControl(makePgControl(0x3000060, 0x3000028, 40), 110000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.CheckPoint != 0x3000060 || checkpoint.Redo != 0x3000028 {
+		t.Errorf("pg_control: unexpected checkpoint %x redo %x for 11", checkpoint.CheckPoint, checkpoint.Redo)
+	}
+
+	checkpoint, err = ParsePgControl(makePgControl(0x3000060, 0x3000028, 48), 90600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Redo != 0x3000028 {
+		t.Errorf("pg_control: unexpected redo %x for 9.6", checkpoint.Redo)
+	}
+
+	if _, err = ParsePgControl(makePgControl(1, 1, 48), 90200); err == nil {
+		t.Errorf("pg_control: expected error for 9.2")
+	}
+	if _, err = ParsePgControl(make([]byte, 20), 100000); err == nil {
+		t.Errorf("pg_control: expected error for truncated file")
+	}
+}
+
+func TestCheckPgControl(t *testing.T) {
+	start, finish := uint64(0x3000028), uint64(0x3000130)
+	sentinel := S3TarBallSentinelDto{LSN: &start, FinishLSN: &finish, PgVersion: 100000}
+
+	if problem := CheckPgControl(PgControlCheckpoint{CheckPoint: 0x3000060, Redo: 0x3000028}, sentinel); problem != "" {
+		t.Errorf("pg_control: consistent checkpoint reported as %s", problem)
+	}
+	if problem := CheckPgControl(PgControlCheckpoint{CheckPoint: 0x2000060, Redo: 0x2000028}, sentinel); problem == "" {
+		t.Errorf("pg_control: checkpoint of older backup is not reported")
+	}
+	if problem := CheckPgControl(PgControlCheckpoint{CheckPoint: 0x4000060, Redo: 0x4000028}, sentinel); problem == "" {
+		t.Errorf("pg_control: checkpoint of newer backup is not reported")
+	}
+
+	sentinel.FinishLSN = nil
+	if problem := CheckPgControl(PgControlCheckpoint{CheckPoint: 0x4000060, Redo: 0x4000028}, sentinel); problem != "" {
+		t.Errorf("pg_control: backup without finish LSN reported as %s", problem)
+	}
+}
+
+func TestCheckIncrementBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg-delta-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.Mkdir(filepath.Join(dir, "global"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "global", "pg_control"), makePgControl(0x3000060, 0x3000028, 48), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, finish := uint64(0x3000028), uint64(0x3000130)
+	base := S3TarBallSentinelDto{LSN: &start, FinishLSN: &finish, PgVersion: 100000}
+	deltaFrom := start
+	delta := S3TarBallSentinelDto{IncrementFromLSN: &deltaFrom}
+	if err = CheckIncrementBase(dir, "base", base, delta); err != nil {
+		t.Errorf("delta base: matching base rejected: %v", err)
+	}
+
+	deltaFrom = 0x5000028
+	if err = CheckIncrementBase(dir, "base", base, delta); err == nil {
+		t.Errorf("delta base: base with other LSN is accepted")
+	}
+
+	// Sentinel of the right base, but another backup restored on disk
+	deltaFrom = start
+	err = ioutil.WriteFile(filepath.Join(dir, "global", "pg_control"), makePgControl(0x2000060, 0x2000028, 48), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckIncrementBase(dir, "base", base, delta); err == nil {
+		t.Errorf("delta base: mismatching pg_control is accepted")
+	}
+}
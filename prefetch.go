@@ -10,35 +10,90 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
-// HandleWALPrefetch is invoked by wal-fetch command to speed up database restoration
+// HandleWALPrefetch is invoked by wal-fetch command to speed up database restoration.
+// WALG_PREFETCH_COUNT segments after walFileName are downloaded, see prefetchFiles.
+// Size of segments is read from header of walFileName fetched to location.
 func HandleWALPrefetch(pre *Prefix, walFileName string, location string) {
-	var fileName = walFileName
-	var err error
+	segmentSize := readWALFileSegmentSize(location)
 	location = path.Dir(location)
-	wg := &sync.WaitGroup{}
-	for i := 0; i < getMaxDownloadConcurrency(8); i++ {
-		fileName, err = NextWALFileName(fileName)
-		if err != nil {
-			log.Println("WAL-prefetch failed: ", err, " file: ", fileName)
+	count := getPrefetchCount()
+	segment, err := ParseWalSegmentName(walFileName, segmentSize)
+	if err != nil {
+		log.Println("WAL-prefetch failed: ", err, " file: ", walFileName)
+		count = 0
+	}
+	names := make([]string, count)
+	for i := range names {
+		segment = segment.Next()
+		names[i] = segment.String()
+	}
+	prefetchFiles(location, pre, names, count)
+}
+
+// HandleWALPrefetchRange is invoked by wal-prefetch --count to warm up prefetch directory of
+// walDirectory, e.g. before a planned failover. count segments starting with walFileName are
+// downloaded where wal-fetch of walDirectory looks for them. Returns how many of them are
+// prefetched, including ones prefetched before; segments missing in storage are not.
+// Size of segments is read from header of a segment in walDirectory.
+func HandleWALPrefetchRange(pre *Prefix, walFileName string, count int, walDirectory string) (int, error) {
+	if count <= 0 {
+		return 0, errors.Errorf("HandleWALPrefetchRange: number of segments must be positive, got %d", count)
+	}
+	walDirectory = ResolveSymlink(walDirectory)
+	segment, err := ParseWalSegmentName(walFileName, findWALDirSegmentSize(walDirectory))
+	if err != nil {
+		return 0, errors.Wrapf(err, "HandleWALPrefetchRange: invalid start segment %s", walFileName)
+	}
+	names := make([]string, count)
+	for i := range names {
+		names[i] = segment.String()
+		segment = segment.Next()
+	}
+	// Long range is not downloaded at once unless WALG_PREFETCH_CONCURRENCY asks for it
+	prefetchFiles(walDirectory, pre, names, min(count, getMaxDownloadConcurrency(8)))
+
+	prefetched := 0
+	for _, name := range names {
+		_, _, _, fetchedFile := getPrefetchLocations(walDirectory, name)
+		if _, err := os.Stat(fetchedFile); err == nil {
+			prefetched++
 		}
-		wg.Add(1)
-		go prefetchFile(location, pre, fileName, wg)
-		time.Sleep(10 * time.Millisecond) // ramp up in order
 	}
+	return prefetched, nil
+}
+
+// prefetchFiles downloads segments with names, WALG_PREFETCH_CONCURRENCY or defaultConcurrency
+// at once. Workers take segments in order, so the nearest ones are downloaded first.
+func prefetchFiles(location string, pre *Prefix, names []string, defaultConcurrency int) {
+	queue := make(chan string, len(names))
+	for _, name := range names {
+		queue <- name
+	}
+	close(queue)
 
-	go cleanupPrefetchDirectories(walFileName, location, FileSystemCleaner{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < getPrefetchConcurrency(defaultConcurrency); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				prefetchFile(location, pre, name)
+			}
+		}()
+	}
 
 	wg.Wait()
 }
 
-func prefetchFile(location string, pre *Prefix, walFileName string, wg *sync.WaitGroup) {
+func prefetchFile(location string, pre *Prefix, walFileName string) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println("Prefetch unsuccessful ", walFileName, r)
 		}
-		wg.Done()
 	}()
 
 	_, runningLocation, oldPath, newPath := getPrefetchLocations(location, walFileName)
@@ -53,19 +108,54 @@ func prefetchFile(location string, pre *Prefix, walFileName string, wg *sync.Wai
 	log.Println("WAL-prefetch file: ", walFileName)
 	os.MkdirAll(runningLocation, 0755)
 
-	DownloadWALFile(pre, walFileName, oldPath)
+	_, err := DownloadWALFile(pre, walFileName, oldPath)
+	if os.IsExist(errors.Cause(err)) {
+		// Prefetch forked by another wal-fetch started the same file after it was checked,
+		// its download is left alone
+		return
+	}
+	if err != nil {
+		log.Println("WAL-prefetch failed: ", err, " file: ", walFileName)
+		os.Remove(oldPath)
+		return
+	}
 
-	_, errO = os.Stat(oldPath)
+	// wal-fetch takes prefetched file without further waiting, so it is
+	// moved out of running only when it is completely written and valid
+	errO = checkPrefetchedWALFile(oldPath, getWALDirPgVersion(location))
 	_, errN = os.Stat(newPath)
 	if errO == nil && os.IsNotExist(errN) {
 		os.Rename(oldPath, newPath)
 	} else {
+		if errO != nil && !os.IsNotExist(errO) {
+			log.Println("WAL-prefetch discarded file: ", walFileName, errO)
+		}
 		os.Remove(oldPath) // error is ignored
 	}
 }
 
+// checkPrefetchedWALFile verifies size and magic of downloaded segment
+// and flushes it to disk before it is renamed
+func checkPrefetchedWALFile(prefetched string, pgVersion int) error {
+	err := checkWALFile(prefetched, pgVersion)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(prefetched)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// getPrefetchLocations returns directory of prefetched segments of WAL directory location,
+// .wal-g/prefetch in it unless WALG_PREFETCH_DIR is set, and paths of walFileName in it
 func getPrefetchLocations(location string, walFileName string) (prefetchLocation string, runningLocation string, runningFile string, fetchedFile string) {
 	prefetchLocation = path.Join(location, ".wal-g", "prefetch")
+	if dir, ok := os.LookupEnv("WALG_PREFETCH_DIR"); ok && dir != "" {
+		prefetchLocation = dir
+	}
 	runningLocation = path.Join(prefetchLocation, "running")
 	oldPath := path.Join(runningLocation, walFileName)
 	newPath := path.Join(prefetchLocation, walFileName)
@@ -75,7 +165,7 @@ func getPrefetchLocations(location string, walFileName string) (prefetchLocation
 func forkPrefetch(walFileName string, location string) {
 	if strings.Contains(walFileName, "history") ||
 		strings.Contains(walFileName, "partial") ||
-		getMaxDownloadConcurrency(16) == 1 {
+		getPrefetchCount() == 0 {
 		return // There will be nothing ot prefetch anyway
 	}
 	cmd := exec.Command(os.Args[0], "wal-prefetch", walFileName, location)
@@ -117,30 +207,84 @@ func (c FileSystemCleaner) Remove(file string) {
 	os.Remove(file)
 }
 
+// cleanupPrefetchDirectories removes prefetched and running segments which precede walFileName,
+// including all segments of earlier timelines. Replay never asks for them after walFileName,
+// e.g. when it switched to a new timeline, so they would be left forever.
+// Segments are compared by timeline and number, not by name.
 func cleanupPrefetchDirectories(walFileName string, location string, cleaner Cleaner) {
-	timelineId, logSegNo, err := ParseWALFileName(walFileName)
+	current, err := parseWalSegmentOrder(walFileName)
 	if err != nil {
 		log.Println("WAL-prefetch cleanup failed: ", err, " file: ", walFileName)
 		return
 	}
 	prefetchLocation, runningLocation, _, _ := getPrefetchLocations(location, walFileName)
-	cleanupPrefetchDirectory(prefetchLocation, timelineId, logSegNo, cleaner)
-	cleanupPrefetchDirectory(runningLocation, timelineId, logSegNo, cleaner)
+	cleanupPrefetchDirectory(prefetchLocation, current, cleaner)
+	cleanupPrefetchDirectory(runningLocation, current, cleaner)
 }
 
-func cleanupPrefetchDirectory(directory string, timelineId uint32, logSegNo uint64, cleaner Cleaner) {
+func cleanupPrefetchDirectory(directory string, current WalSegmentName, cleaner Cleaner) {
 	files, err := cleaner.GetFiles(directory)
+	if os.IsNotExist(err) {
+		// Nothing was prefetched yet
+		return
+	}
 	if err != nil {
 		log.Println("WAL-prefetch cleanup failed, : ", err, " cannot enumerate files in dir: ", directory)
 	}
 
 	for _, f := range files {
-		fileTimelineId, fileLogSegNo, err := ParseWALFileName(f)
+		segment, err := parseWalSegmentOrder(f)
 		if err != nil {
 			continue
 		}
-		if fileTimelineId < timelineId || (fileTimelineId == timelineId && fileLogSegNo < logSegNo) {
+		if segment.Less(current) {
 			cleaner.Remove(path.Join(directory, f))
 		}
 	}
 }
+
+// DefaultPrefetchCleanAge is the age after which prefetch artifacts are considered abandoned
+const DefaultPrefetchCleanAge = time.Hour
+
+// CleanPrefetchDirectory removes files in prefetch directory of walDir which were not modified
+// for olderThan: segments prefetched but never taken by wal-fetch and downloads left in running
+// by crashed prefetchers. Active download writes its file constantly, so it is never that old.
+// WAL in walDir itself is not touched. Returns removed files.
+func CleanPrefetchDirectory(walDir string, olderThan time.Duration, now time.Time) ([]string, error) {
+	prefetchLocation, runningLocation, _, _ := getPrefetchLocations(walDir, "")
+	var removed []string
+	for _, directory := range []string{prefetchLocation, runningLocation} {
+		fileInfos, err := ioutil.ReadDir(directory)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return removed, errors.Wrapf(err, "CleanPrefetchDirectory: cannot enumerate files in %s", directory)
+		}
+		for _, fileInfo := range fileInfos {
+			if !fileInfo.Mode().IsRegular() || now.Sub(fileInfo.ModTime()) < olderThan {
+				continue
+			}
+			file := path.Join(directory, fileInfo.Name())
+			err = os.Remove(file)
+			if err != nil && !os.IsNotExist(err) {
+				return removed, errors.Wrapf(err, "CleanPrefetchDirectory: failed to remove %s", file)
+			}
+			removed = append(removed, file)
+		}
+	}
+	return removed, nil
+}
+
+// HandleWALPrefetchClean is invoked to perform wal-g wal-prefetch-clean
+func HandleWALPrefetchClean(walDir string, olderThan time.Duration) error {
+	removed, err := CleanPrefetchDirectory(ResolveSymlink(walDir), olderThan, time.Now())
+	for _, file := range removed {
+		fmt.Printf("removed %s\n", file)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d prefetch files older than %v removed\n", len(removed), olderThan)
+	return nil
+}
@@ -1,6 +1,13 @@
 package walg
 
-import "testing"
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
 
 type MockCleaner struct {
 	deleted []string
@@ -38,3 +45,73 @@ func TestCleanup(t *testing.T) {
 		t.Fatal("Prefetch cleaner didnot deleted files")
 	}
 }
+
+func TestCheckPrefetchedWALFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	segment := make([]byte, WalSegmentSize)
+	binary.LittleEndian.PutUint32(segment, 0xD097)
+	complete := path.Join(dir, "000000010000000100000056")
+	partial := path.Join(dir, "000000010000000100000057")
+	ioutil.WriteFile(complete, segment, 0600)
+	ioutil.WriteFile(partial, segment[:WalSegmentSize/2], 0600)
+
+	if err := checkPrefetchedWALFile(complete, 0); err != nil {
+		t.Errorf("prefetch: complete segment rejected: %v", err)
+	}
+	if err := checkPrefetchedWALFile(partial, 0); err == nil {
+		t.Errorf("prefetch: partially written segment accepted")
+	}
+	if err := checkPrefetchedWALFile(path.Join(dir, "missing"), 0); !os.IsNotExist(err) {
+		t.Errorf("prefetch: expected not exist error, got %v", err)
+	}
+}
+
+func TestCleanPrefetchDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	prefetchLocation, runningLocation, _, _ := getPrefetchLocations(dir, "")
+	os.MkdirAll(runningLocation, 0755)
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	files := map[string]time.Time{
+		path.Join(prefetchLocation, "000000010000000100000056"): old,
+		path.Join(runningLocation, "000000010000000100000057"):  old,
+		path.Join(prefetchLocation, "000000010000000100000058"): now,
+		path.Join(runningLocation, "000000010000000100000059"):  now,
+		path.Join(dir, "000000010000000100000050"):              old,
+	}
+	for file, modified := range files {
+		ioutil.WriteFile(file, []byte("wal"), 0600)
+		os.Chtimes(file, modified, modified)
+	}
+
+	removed, err := CleanPrefetchDirectory(dir, time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("prefetch clean: expected 2 removed files, got %v", removed)
+	}
+	for file, modified := range files {
+		_, err := os.Stat(file)
+		shouldBeRemoved := modified == old && path.Dir(file) != dir
+		if shouldBeRemoved != os.IsNotExist(err) {
+			t.Errorf("prefetch clean: unexpected state of %s: %v", file, err)
+		}
+	}
+
+	// Missing prefetch directory is not an error
+	removed, err = CleanPrefetchDirectory(path.Join(dir, "none"), time.Hour, now)
+	if err != nil || len(removed) != 0 {
+		t.Errorf("prefetch clean: unexpected result for missing directory %v %v", removed, err)
+	}
+}
@@ -0,0 +1,33 @@
+package walg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// writeProbeDir keeps probe objects out of basebackups_005 listing
+const writeProbeDir = "write_probe/"
+
+// CheckWritable puts and deletes a tiny object next to base backups. It is
+// called before backup is started, so that wrong credentials or bucket policy
+// are reported immediately instead of after walking the whole cluster
+// with Postgres left in backup mode.
+func CheckWritable(tu *TarUploader, pre *Prefix) error {
+	hostname, _ := os.Hostname()
+	key := *GetBackupPath(pre) + writeProbeDir + fmt.Sprintf("%s_%d", hostname, os.Getpid())
+
+	uploader := tu.Clone()
+	err := uploader.put(key, bytes.NewReader([]byte("wal-g")))
+	if err != nil {
+		return errors.Wrapf(err, "CheckWritable: storage is not writable, failed to put '%s'", key)
+	}
+
+	err = pre.Storage().Delete([]string{key})
+	if err != nil {
+		return errors.Wrapf(err, "CheckWritable: failed to delete '%s'", key)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package walg_test
+
+import (
+	"github.com/wal-g/wal-g"
+	"testing"
+)
+
+func TestCheckWritable(t *testing.T) {
+	tu, pre, client := newMemoryStorage()
+
+	err := walg.CheckWritable(tu, pre)
+	if err != nil {
+		t.Errorf("probe: writable storage reported as %v", err)
+	}
+	if len(client.objects) != 0 {
+		t.Errorf("probe: probe object was left in storage: %v", client.objects)
+	}
+
+	client.readOnly = true
+	err = walg.CheckWritable(tu, pre)
+	if err == nil {
+		t.Errorf("probe: read-only storage was not detected")
+	}
+}
@@ -0,0 +1,175 @@
+package walg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is printed every progressTTYInterval on a terminal. When output is not a terminal,
+// e.g. a log file, it is printed only if asked by --progress and less often.
+const (
+	progressTTYInterval    = 5 * time.Second
+	progressNonTTYInterval = 30 * time.Second
+)
+
+// ProgressReporter periodically prints files and bytes processed by backup-push or
+// backup-fetch with ETA estimated from total size. A nil ProgressReporter prints nothing.
+type ProgressReporter struct {
+	op         string
+	totalBytes int64
+	files      int64
+	bytes      int64
+	start      time.Time
+	out        io.Writer
+	stop       chan Empty
+	stopOnce   sync.Once
+	done       sync.WaitGroup
+}
+
+// progressInterval tells how often progress is printed, and whether it is printed at all.
+// Without forced, progress is printed only on a terminal.
+func progressInterval(forced bool) (time.Duration, bool) {
+	if isTerminal(os.Stdout) {
+		return progressTTYInterval, true
+	}
+	return progressNonTTYInterval, forced
+}
+
+// StartProgress starts printing progress of op, totalBytes is the estimated size of all
+// files, zero if unknown. Returns nil if progress is not printed, see progressInterval.
+func StartProgress(op string, totalBytes int64, forced bool) *ProgressReporter {
+	interval, shown := progressInterval(forced)
+	if !shown {
+		return nil
+	}
+	reporter := NewProgressReporter(op, totalBytes, os.Stdout)
+	reporter.done.Add(1)
+	go func() {
+		defer reporter.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintln(reporter.out, reporter.Line(time.Now()))
+			case <-reporter.stop:
+				return
+			}
+		}
+	}()
+	return reporter
+}
+
+// NewProgressReporter creates reporter which prints to out only when stopped
+func NewProgressReporter(op string, totalBytes int64, out io.Writer) *ProgressReporter {
+	return &ProgressReporter{
+		op:         op,
+		totalBytes: totalBytes,
+		start:      time.Now(),
+		out:        out,
+		stop:       make(chan Empty),
+	}
+}
+
+// AddFile accounts a processed file of size bytes, safe for concurrent use
+func (reporter *ProgressReporter) AddFile(size int64) {
+	if reporter == nil {
+		return
+	}
+	atomic.AddInt64(&reporter.files, 1)
+	atomic.AddInt64(&reporter.bytes, size)
+}
+
+// Stop stops periodic output and prints final progress
+func (reporter *ProgressReporter) Stop() {
+	if reporter == nil {
+		return
+	}
+	reporter.stopOnce.Do(func() {
+		close(reporter.stop)
+		reporter.done.Wait()
+		fmt.Fprintln(reporter.out, reporter.Line(time.Now()))
+	})
+}
+
+// Line formats progress at now. ETA assumes the rest is processed at the average rate so far.
+func (reporter *ProgressReporter) Line(now time.Time) string {
+	files := atomic.LoadInt64(&reporter.files)
+	bytes := atomic.LoadInt64(&reporter.bytes)
+	elapsed := now.Sub(reporter.start)
+	if reporter.totalBytes <= 0 {
+		return fmt.Sprintf("%s: %d files, %s, elapsed %v", reporter.op, files, formatBytes(bytes), elapsed.Round(time.Second))
+	}
+	// Files may grow during backup-push, progress does not go beyond the estimate
+	if bytes > reporter.totalBytes {
+		bytes = reporter.totalBytes
+	}
+	line := fmt.Sprintf("%s: %d files, %s of %s (%d%%), elapsed %v", reporter.op, files,
+		formatBytes(bytes), formatBytes(reporter.totalBytes), bytes*100/reporter.totalBytes, elapsed.Round(time.Second))
+	if bytes == 0 {
+		return line
+	}
+	eta := time.Duration(float64(elapsed) * float64(reporter.totalBytes-bytes) / float64(bytes))
+	return fmt.Sprintf("%s, ETA %v", line, eta.Round(time.Second))
+}
+
+// formatBytes prints size in binary units, e.g. 1.5GB
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// isTerminal tells whether f is a character device, so output is seen by a person
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// estimateBackupSize sums sizes of regular files under dir, which backup-push walks.
+// Contents of excluded directories are not counted.
+func estimateBackupSize(dir string) int64 {
+	var total int64
+	Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files deleted during estimation are left to the real walk
+			return nil
+		}
+		if _, excluded := EXCLUDE[info.Name()]; excluded && info.IsDir() {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// restoredSize sums sizes of files of sentinel restored by backup-fetch, files unchanged
+// by delta are moved from the base and not counted
+func restoredSize(files BackupFileList, databaseOID uint32, tablespaces *TablespaceFilter) int64 {
+	var total int64
+	for name, fd := range files {
+		if fd.IsSkipped || isOtherDatabaseFile(name, databaseOID) || tablespaces.skips(name) {
+			continue
+		}
+		total += fd.Size
+	}
+	return total
+}
@@ -0,0 +1,33 @@
+package walg_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestProgressReporterLine(t *testing.T) {
+	var out bytes.Buffer
+	reporter := walg.NewProgressReporter("backup-push", 4<<30, &out)
+	start := time.Now()
+	reporter.AddFile(1 << 30)
+	reporter.AddFile(0)
+
+	line := reporter.Line(start.Add(time.Minute))
+	if !strings.HasPrefix(line, "backup-push: 2 files, 1.0GB of 4.0GB (25%), elapsed 1m0s, ETA 3m0s") {
+		t.Errorf("progress: unexpected line %q", line)
+	}
+
+	reporter.Stop()
+	reporter.Stop()
+	if strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("progress: expected final line printed once but got %q", out.String())
+	}
+
+	var nilReporter *walg.ProgressReporter
+	nilReporter.AddFile(1)
+	nilReporter.Stop()
+}
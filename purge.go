@@ -0,0 +1,182 @@
+package walg
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PurgeTarget is one part of storage removed by delete everything
+type PurgeTarget struct {
+	Name  string
+	Count int
+	Bytes int64
+	keys  []string
+}
+
+// ListPurgeTargets lists every object of backups, of WAL and delete marks of prefix,
+// including objects of unfinished backups, which have no sentinel. Other objects of wal-g,
+// backup-push lock and restore points, are listed last by their exact keys. Anything else
+// under prefix, e.g. another cluster stored deeper, is not listed.
+func ListPurgeTargets(pre *Prefix) ([]PurgeTarget, error) {
+	targets := []PurgeTarget{
+		{Name: "backups"},
+		{Name: "WAL"},
+		{Name: "delete marks"},
+		{Name: "other wal-g objects"},
+	}
+	prefixes := []string{*GetBackupPath(pre), GetWALPath(*pre.Server), GetDeleteMarksPath(pre)}
+	// WALG_WAL_SUBPATH may place WAL inside another listed folder
+	listed := make(map[string]bool)
+	for i, prefix := range prefixes {
+		objects, err := pre.Storage().ListAll(prefix)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ListPurgeTargets: failed to list %s", prefix)
+		}
+		targets[i].add(objects, listed)
+	}
+
+	others, err := listPurgedObjects(pre)
+	if err != nil {
+		return nil, err
+	}
+	targets[3].add(others, listed)
+	return targets, nil
+}
+
+// listPurgedObjects lists backup-push lock and restore points of prefix, only keys wal-g writes itself
+func listPurgedObjects(pre *Prefix) ([]StorageObject, error) {
+	lockKey := getBackupPushLockKey(pre)
+	// Listing by the key itself does not reach objects next to the lock
+	objects, err := pre.Storage().ListAll(lockKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ListPurgeTargets: failed to list %s", lockKey)
+	}
+	var listed []StorageObject
+	for _, object := range objects {
+		if object.Key == lockKey {
+			listed = append(listed, object)
+		}
+	}
+
+	points, err := pre.Storage().List(GetRestorePointsPath(pre))
+	if err != nil {
+		return nil, errors.Wrap(err, "ListPurgeTargets: failed to list restore points")
+	}
+	for _, object := range points {
+		if strings.HasSuffix(object.Key, RestorePointSuffix) {
+			listed = append(listed, object)
+		}
+	}
+	return listed, nil
+}
+
+// add includes objects in target, unless they are listed by another target
+func (target *PurgeTarget) add(objects []StorageObject, listed map[string]bool) {
+	for _, object := range objects {
+		if listed[object.Key] {
+			continue
+		}
+		listed[object.Key] = true
+		target.keys = append(target.keys, object.Key)
+		target.Count++
+		target.Bytes += object.Size
+	}
+}
+
+// HandlePurge is invoked to perform wal-g delete everything. It removes all backups and WAL
+// of prefix at once. Only lists what would be removed on dry run. Permanent backups are
+// removed only with force. With marker, backups are only marked for delete-expired.
+func HandlePurge(pre *Prefix, marker *TarUploader, force bool, dryRun bool) error {
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	backups, err := bk.GetBackups()
+	if err != nil && err != ErrLatestNotFound {
+		return err
+	}
+	var permanent []string
+	for _, b := range backups {
+		isPermanent, err := IsBackupPermanent(pre, b.Name)
+		if err != nil {
+			return err
+		}
+		if isPermanent {
+			permanent = append(permanent, b.Name)
+		}
+	}
+	if len(permanent) > 0 && !force {
+		return errors.Errorf("HandlePurge: backups %s are permanent, add FORCE to delete them too", strings.Join(permanent, ", "))
+	}
+	if marker != nil {
+		return markEverything(pre, marker, backups, permanent, dryRun)
+	}
+
+	targets, err := ListPurgeTargets(pre)
+	if err != nil {
+		return err
+	}
+	var count int
+	var bytes int64
+	for _, target := range targets {
+		count += target.Count
+		bytes += target.Bytes
+	}
+
+	if dryRun {
+		for _, target := range targets {
+			log.Printf("%d objects of %s, %d bytes, will be deleted\n", target.Count, target.Name, target.Bytes)
+		}
+		log.Printf("Deletion would free %d bytes of %d objects.\n", bytes, count)
+		log.Printf("Dry run finished. Use --confirm to delete everything.\n")
+		return nil
+	}
+
+	for _, target := range targets {
+		if target.Count == 0 {
+			continue
+		}
+		// Backend deletes keys in batches as large as its API allows
+		err = pre.Storage().Delete(target.keys)
+		if err != nil {
+			return errors.Wrapf(err, "HandlePurge: failed to delete %s", target.Name)
+		}
+		log.Printf("Deleted %d objects of %s, %d bytes.\n", target.Count, target.Name, target.Bytes)
+	}
+	log.Printf("Deleted %d objects, %d bytes.\n", count, bytes)
+	return nil
+}
+
+// markEverything marks all backups for deletion by delete-expired, as delete does with WALG_SOFT_DELETE.
+// Permanent marks are removed, otherwise delete-expired would keep such backups.
+func markEverything(pre *Prefix, marker *TarUploader, backups []BackupTime, permanent []string, dryRun bool) error {
+	if dryRun {
+		for _, name := range permanent {
+			log.Printf("Permanent mark of %v will be removed\n", name)
+		}
+		for _, b := range backups {
+			log.Printf("%v will be marked for deletion\n", b.Name)
+		}
+		log.Printf("Dry run finished. Use --confirm to mark everything.\n")
+		return nil
+	}
+
+	for _, name := range permanent {
+		err := MarkBackup(marker, pre, name, false)
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for _, b := range backups {
+		err := MarkBackupForDeletion(marker, pre, b.Name, now, DeleteMarkOptions{Everything: true})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Marked %d backups for deletion, delete-expired removes them with WAL and everything else of prefix.\n", len(backups))
+	return nil
+}
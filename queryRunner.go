@@ -20,6 +20,9 @@ type QueryRunner interface {
 type PgQueryRunner struct {
 	connection *pgx.Conn
 	Version    int
+	// NoArchiveWait makes stop backup return without waiting for WAL of backup
+	// to be archived, supported since Postgres 10
+	NoArchiveWait bool
 }
 
 // BuildGetVersion formats a query to retrieve PostgreSQL numeric version
@@ -32,6 +35,9 @@ func (queryRunner *PgQueryRunner) BuildStartBackup() (string, error) {
 	// TODO: rewrite queries for older versions to remove pg_is_in_recovery()
 	// where pg_start_backup() will fail on standby anyway
 	switch {
+	case queryRunner.Version >= 150000:
+		// Exclusive backups are removed, so is the argument choosing them
+		return "SELECT case when pg_is_in_recovery() then '' else (pg_walfile_name_offset(lsn)).file_name end, lsn::text, pg_is_in_recovery() FROM pg_backup_start($1, true) lsn", nil
 	case queryRunner.Version >= 100000:
 		return "SELECT case when pg_is_in_recovery() then '' else (pg_walfile_name_offset(lsn)).file_name end, lsn::text, pg_is_in_recovery() FROM pg_start_backup($1, true, false) lsn", nil
 	case queryRunner.Version >= 90600:
@@ -48,6 +54,11 @@ func (queryRunner *PgQueryRunner) BuildStartBackup() (string, error) {
 // BuildStopBackup formats a query that stops backup according to server features and version
 func (queryRunner *PgQueryRunner) BuildStopBackup() (string, error) {
 	switch {
+	case queryRunner.Version >= 150000:
+		// Columns are selected by name, as pg_backup_stop() returns lsn first
+		return fmt.Sprintf("SELECT labelfile, spcmapfile, lsn::text FROM pg_backup_stop(%v)", !queryRunner.NoArchiveWait), nil
+	case queryRunner.Version >= 100000 && queryRunner.NoArchiveWait:
+		return "SELECT labelfile, spcmapfile, lsn FROM pg_stop_backup(false, false)", nil
 	case queryRunner.Version >= 90600:
 		return "SELECT labelfile, spcmapfile, lsn FROM pg_stop_backup(false)", nil
 	case queryRunner.Version >= 90000:
@@ -89,7 +100,7 @@ func (queryRunner *PgQueryRunner) StartBackup(backup string) (backupName string,
 	}
 
 	if err = conn.QueryRow(startBackupQuery, backup).Scan(&backupName, &lsnString, &inRecovery); err != nil {
-		return "", "", false, errors.Wrap(err, "QueryRunner StartBackup: pg_start_backup() failed")
+		return "", "", false, errors.Wrap(err, "QueryRunner StartBackup: start backup failed")
 	}
 
 	return backupName, lsnString, inRecovery, nil
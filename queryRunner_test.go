@@ -1,6 +1,7 @@
 package walg_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/wal-g/wal-g"
@@ -37,6 +38,12 @@ func TestBuildStartBackup(t *testing.T) {
 	if queryString != "SELECT case when pg_is_in_recovery() then '' else (pg_walfile_name_offset(lsn)).file_name end, lsn::text, pg_is_in_recovery() FROM pg_start_backup($1, true, false) lsn" {
 		t.Errorf("Got wrong query string for BuildStartBackup with version 100000, got %s", queryString)
 	}
+
+	queryBuilder.Version = 150000
+	queryString, err = queryBuilder.BuildStartBackup()
+	if queryString != "SELECT case when pg_is_in_recovery() then '' else (pg_walfile_name_offset(lsn)).file_name end, lsn::text, pg_is_in_recovery() FROM pg_backup_start($1, true) lsn" {
+		t.Errorf("Got wrong query string for BuildStartBackup with version 150000, got %s", queryString)
+	}
 }
 
 // Tests building stop backup query
@@ -70,4 +77,46 @@ func TestBuildStopBackup(t *testing.T) {
 	if queryString != "SELECT labelfile, spcmapfile, lsn FROM pg_stop_backup(false)" {
 		t.Errorf("Got wrong query string for BuildStopBackup with version 100000, got %s", queryString)
 	}
+
+	queryBuilder.Version = 150000
+	queryString, err = queryBuilder.BuildStopBackup()
+	if queryString != "SELECT labelfile, spcmapfile, lsn::text FROM pg_backup_stop(true)" {
+		t.Errorf("Got wrong query string for BuildStopBackup with version 150000, got %s", queryString)
+	}
+}
+
+// Tests stop backup query without waiting for WAL archiving
+func TestBuildStopBackupNoArchiveWait(t *testing.T) {
+	queryBuilder := &walg.PgQueryRunner{Version: 90600, NoArchiveWait: true}
+	queryString, _ := queryBuilder.BuildStopBackup()
+	if queryString != "SELECT labelfile, spcmapfile, lsn FROM pg_stop_backup(false)" {
+		t.Errorf("Got wrong query string for BuildStopBackup with version 90600 without archive wait, got %s", queryString)
+	}
+
+	queryBuilder.Version = 100000
+	queryString, _ = queryBuilder.BuildStopBackup()
+	if queryString != "SELECT labelfile, spcmapfile, lsn FROM pg_stop_backup(false, false)" {
+		t.Errorf("Got wrong query string for BuildStopBackup with version 100000 without archive wait, got %s", queryString)
+	}
+
+	queryBuilder.Version = 150000
+	queryString, _ = queryBuilder.BuildStopBackup()
+	if queryString != "SELECT labelfile, spcmapfile, lsn::text FROM pg_backup_stop(false)" {
+		t.Errorf("Got wrong query string for BuildStopBackup with version 150000 without archive wait, got %s", queryString)
+	}
+}
+
+// Tests that exclusive backup functions are not used since Postgres 15, where they are removed
+func TestBuildBackupQueriesAroundPostgres15(t *testing.T) {
+	for version, expected := range map[int]string{140005: "pg_start_backup(", 150000: "pg_backup_start(", 160002: "pg_backup_start(", 170000: "pg_backup_start("} {
+		queryBuilder := &walg.PgQueryRunner{Version: version}
+		startQuery, err := queryBuilder.BuildStartBackup()
+		if err != nil || !strings.Contains(startQuery, expected) {
+			t.Errorf("Got wrong start backup query for version %d: %s, %v", version, startQuery, err)
+		}
+		stopQuery, err := queryBuilder.BuildStopBackup()
+		if err != nil || strings.Contains(stopQuery, "pg_backup_stop(") != (version >= 150000) {
+			t.Errorf("Got wrong stop backup query for version %d: %s, %v", version, stopQuery, err)
+		}
+	}
 }
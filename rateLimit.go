@@ -0,0 +1,126 @@
+package walg
+
+import (
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket of bytes shared by concurrent users.
+// Bucket holds up to one second of rate; taking more than available
+// puts bucket in debt and caller sleeps until it is repaid.
+type RateLimiter struct {
+	rate float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter creates limiter of bytesPerSecond, nil if it is not positive
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// Wait takes n bytes from bucket, sleeping if they are not available
+func (l *RateLimiter) Wait(n int) {
+	l.mutex.Lock()
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// Reader limits reading from r, nil limiter returns r as is
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateLimitedReader{r, l}
+}
+
+type rateLimitedReader struct {
+	internal io.Reader
+	limiter  *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// Chunks larger than bucket would always sleep for full second
+	if len(p) > int(r.limiter.rate) {
+		p = p[:int(r.limiter.rate)]
+	}
+	n, err := r.internal.Read(p)
+	if n > 0 {
+		r.limiter.Wait(n)
+	}
+	return n, err
+}
+
+// getRestoreDiskRateLimit reads limit of bytes per second written to disk by backup-fetch,
+// zero means unlimited
+func getRestoreDiskRateLimit() int64 {
+	limitStr, ok := os.LookupEnv("WALG_RESTORE_DISK_RATE_LIMIT")
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.ParseInt(limitStr, 10, 64)
+	if err != nil {
+		log.Fatal("Unable to parse WALG_RESTORE_DISK_RATE_LIMIT ", err)
+	}
+	return limit
+}
+
+// getNetworkRateLimit reads limit of bytes per second uploaded by all concurrent
+// uploads of WAL-G process, zero means unlimited
+func getNetworkRateLimit() int64 {
+	limitStr, ok := os.LookupEnv("WALG_NETWORK_RATE_LIMIT")
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.ParseInt(limitStr, 10, 64)
+	if err != nil {
+		log.Fatal("Unable to parse WALG_NETWORK_RATE_LIMIT ", err)
+	}
+	return limit
+}
+
+// getDownloadRateLimit reads limit of bytes per second downloaded by all concurrent
+// downloads of WAL-G process, zero means unlimited
+func getDownloadRateLimit() int64 {
+	limitStr, ok := os.LookupEnv("WALG_DOWNLOAD_RATE_LIMIT")
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.ParseInt(limitStr, 10, 64)
+	if err != nil {
+		log.Fatal("Unable to parse WALG_DOWNLOAD_RATE_LIMIT ", err)
+	}
+	return limit
+}
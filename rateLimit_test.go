@@ -0,0 +1,200 @@
+package walg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if NewRateLimiter(0) != nil {
+		t.Errorf("rate limit: expected zero limit to be unlimited")
+	}
+	var nilLimiter *RateLimiter
+	r := bytes.NewReader(nil)
+	if nilLimiter.Reader(r) != r {
+		t.Errorf("rate limit: expected nil limiter to return reader as is")
+	}
+
+	now := time.Unix(0, 0)
+	var mutex sync.Mutex
+	var slept time.Duration
+	limiter := NewRateLimiter(1000)
+	limiter.last = now
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(d time.Duration) {
+		mutex.Lock()
+		slept += d
+		mutex.Unlock()
+	}
+
+	// Full bucket lets first second through, the rest is paid by sleeping
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content, err := ioutil.ReadAll(limiter.Reader(bytes.NewReader(make([]byte, 1000))))
+			if err != nil || len(content) != 1000 {
+				t.Errorf("rate limit: read %v bytes, error %v", len(content), err)
+			}
+		}()
+	}
+	wg.Wait()
+	if slept < 3*time.Second {
+		t.Errorf("rate limit: expected concurrent readers to sleep at least 3s in total, slept %v", slept)
+	}
+
+	// Bucket refills with time, but not over its size
+	now = now.Add(time.Hour)
+	slept = 0
+	limiter.Wait(1000)
+	limiter.Wait(500)
+	if slept != 500*time.Millisecond {
+		t.Errorf("rate limit: expected 500ms sleep after refill, slept %v", slept)
+	}
+}
+
+// discardStorage drops bodies of uploads and serves zeros, other methods are not used
+type discardStorage struct {
+	StorageBackend
+}
+
+// GetArchive returns 1000 zero bytes for any key
+func (discardStorage) GetArchive(key string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(make([]byte, 1000))), nil
+}
+
+func (discardStorage) Put(key string, r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// rereadStorage reads body again after rewinding it, as upload retried after transient failure does
+type rereadStorage struct {
+	StorageBackend
+	bodies []string
+}
+
+func (s *rereadStorage) Put(key string, r io.Reader) error {
+	for i := 0; i < 2; i++ {
+		seeker, ok := r.(io.Seeker)
+		if !ok {
+			return errors.New("body is not seekable")
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		s.bodies = append(s.bodies, string(body))
+	}
+	return nil
+}
+
+func TestRateLimitedUploadIsRetried(t *testing.T) {
+	os.Setenv("WALG_NETWORK_RATE_LIMIT", "1000000")
+	defer os.Unsetenv("WALG_NETWORK_RATE_LIMIT")
+	storage := &rereadStorage{}
+	tu, _ := ConfigureStorageBackend(storage, "server")
+	tu.NetworkRateLimiter.sleep = func(time.Duration) {}
+
+	if err := tu.put("sentinel", bytes.NewReader([]byte("{}"))); err != nil {
+		t.Fatalf("rate limit: seekable body is hidden by limiter: %v", err)
+	}
+	if len(storage.bodies) != 2 || storage.bodies[1] != "{}" {
+		t.Errorf("rate limit: expected body read again after rewind but got %q", storage.bodies)
+	}
+}
+
+func TestNetworkRateLimit(t *testing.T) {
+	os.Setenv("WALG_NETWORK_RATE_LIMIT", "1000")
+	defer os.Unsetenv("WALG_NETWORK_RATE_LIMIT")
+
+	tu, _ := ConfigureStorageBackend(discardStorage{}, "server")
+	if tu.NetworkRateLimiter == nil {
+		t.Fatalf("rate limit: expected uploader to be limited by WALG_NETWORK_RATE_LIMIT")
+	}
+	var mutex sync.Mutex
+	var slept time.Duration
+	now := time.Unix(0, 0)
+	tu.NetworkRateLimiter.last = now
+	tu.NetworkRateLimiter.now = func() time.Time { return now }
+	tu.NetworkRateLimiter.sleep = func(d time.Duration) {
+		mutex.Lock()
+		slept += d
+		mutex.Unlock()
+	}
+
+	// Clones upload concurrently, as BgUploader does, within the same limit
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(clone *TarUploader) {
+			defer wg.Done()
+			if err := clone.put("wal", bytes.NewReader(make([]byte, 1000))); err != nil {
+				t.Errorf("rate limit: upload failed: %v", err)
+			}
+		}(tu.Clone())
+	}
+	wg.Wait()
+	if slept < 2*time.Second {
+		t.Errorf("rate limit: expected concurrent uploads to sleep at least 2s in total, slept %v", slept)
+	}
+
+	os.Unsetenv("WALG_NETWORK_RATE_LIMIT")
+	tu, _ = ConfigureStorageBackend(discardStorage{}, "server")
+	if tu.NetworkRateLimiter != nil {
+		t.Errorf("rate limit: expected uploads to be unlimited without WALG_NETWORK_RATE_LIMIT")
+	}
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	os.Setenv("WALG_DOWNLOAD_RATE_LIMIT", "1000")
+	defer os.Unsetenv("WALG_DOWNLOAD_RATE_LIMIT")
+
+	_, pre := ConfigureStorageBackend(discardStorage{}, "server")
+	if pre.DownloadRateLimiter == nil {
+		t.Fatalf("rate limit: expected prefix to be limited by WALG_DOWNLOAD_RATE_LIMIT")
+	}
+	var mutex sync.Mutex
+	var slept time.Duration
+	now := time.Unix(0, 0)
+	pre.DownloadRateLimiter.last = now
+	pre.DownloadRateLimiter.now = func() time.Time { return now }
+	pre.DownloadRateLimiter.sleep = func(d time.Duration) {
+		mutex.Lock()
+		slept += d
+		mutex.Unlock()
+	}
+
+	// Prefetch workers read their files concurrently within the same limit
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			archive, err := pre.Storage().GetArchive("wal")
+			if err != nil {
+				t.Errorf("rate limit: download failed: %v", err)
+				return
+			}
+			defer archive.Close()
+			content, err := ioutil.ReadAll(archive)
+			if err != nil || len(content) != 1000 {
+				t.Errorf("rate limit: read %v bytes, error %v", len(content), err)
+			}
+		}()
+	}
+	wg.Wait()
+	if slept < 2*time.Second {
+		t.Errorf("rate limit: expected concurrent downloads to sleep at least 2s in total, slept %v", slept)
+	}
+}
@@ -0,0 +1,216 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// RestorePointSuffix is the suffix of restore point description objects
+const RestorePointSuffix = ".json"
+
+// RestorePoint describes named restore point created with pg_create_restore_point()
+type RestorePoint struct {
+	Name     string    `json:"name"`
+	LSN      uint64    `json:"lsn"`
+	Timeline uint32    `json:"timeline"`
+	Time     time.Time `json:"time"`
+}
+
+// RestorePointBackup is the base backup and WAL needed to recover to restore point
+type RestorePointBackup struct {
+	BackupName   string
+	FirstSegment string
+	LastSegment  string
+}
+
+// ErrNoBackupForRestorePoint happens when all backups finished after restore point
+var ErrNoBackupForRestorePoint = errors.New("No backup finished before restore point")
+
+// GetRestorePointsPath returns prefix of restore point descriptions in storage
+func GetRestorePointsPath(pre *Prefix) string {
+	return sanitizePath(*pre.Server + "/restore_points_005/")
+}
+
+// BuildCreateRestorePoint formats a query that creates restore point and returns its LSN and WAL file
+func (queryRunner *PgQueryRunner) BuildCreateRestorePoint() (string, error) {
+	switch {
+	case queryRunner.Version >= 100000:
+		return "SELECT lsn::text, pg_walfile_name(lsn) FROM pg_create_restore_point($1) lsn", nil
+	case queryRunner.Version >= 90100:
+		return "SELECT lsn::text, pg_xlogfile_name(lsn) FROM pg_create_restore_point($1) lsn", nil
+	case queryRunner.Version == 0:
+		return "", errors.New("Postgres version not set, cannot determine create restore point query")
+	default:
+		return "", errors.New("Could not determine create restore point query for version " + fmt.Sprintf("%d", queryRunner.Version))
+	}
+}
+
+// CreateRestorePoint creates named restore point in WAL
+func (queryRunner *PgQueryRunner) CreateRestorePoint(name string) (point RestorePoint, err error) {
+	query, err := queryRunner.BuildCreateRestorePoint()
+	if err != nil {
+		return point, errors.Wrap(err, "QueryRunner CreateRestorePoint: Building create restore point query failed")
+	}
+
+	var lsnStr, walFileName string
+	err = queryRunner.connection.QueryRow(query, name).Scan(&lsnStr, &walFileName)
+	if err != nil {
+		return point, errors.Wrap(err, "QueryRunner CreateRestorePoint: pg_create_restore_point() failed")
+	}
+
+	point.Name = name
+	point.Time = time.Now().UTC()
+	point.LSN, err = ParseLsn(lsnStr)
+	if err != nil {
+		return point, errors.Wrap(err, "QueryRunner CreateRestorePoint: failed to parse LSN")
+	}
+	point.Timeline, err = ParseWALFileName(walFileName)
+	if err != nil {
+		return point, errors.Wrap(err, "QueryRunner CreateRestorePoint: failed to parse WAL file name")
+	}
+	return point, nil
+}
+
+// FindRestorePointBackup chooses the latest backup which became consistent before restore point.
+// Backups on timelines after the one of restore point cannot reach it.
+func FindRestorePointBackup(point RestorePoint, sentinels map[string]S3TarBallSentinelDto) (RestorePointBackup, error) {
+	var found RestorePointBackup
+	var foundLSN uint64
+	for name, sentinel := range sentinels {
+		walRange, err := GetBackupWALRange(name, sentinel)
+		if err != nil {
+			// Backups without LSN range cannot be correlated
+			continue
+		}
+		if walRange.Timeline > point.Timeline || *sentinel.FinishLSN > point.LSN {
+			continue
+		}
+		if found.BackupName == "" || *sentinel.FinishLSN > foundLSN {
+			foundLSN = *sentinel.FinishLSN
+			found = RestorePointBackup{
+				BackupName:   name,
+				FirstSegment: walRange.First(),
+				LastSegment:  formatWALFileName(point.Timeline, getPreviousSegmentNo(point.LSN, walRange.GetSegmentSize()), walRange.GetSegmentSize()),
+			}
+		}
+	}
+	if found.BackupName == "" {
+		return found, ErrNoBackupForRestorePoint
+	}
+	return found, nil
+}
+
+// HandleRestorePointCreate is invoked to perform wal-g restore-point-create
+func HandleRestorePointCreate(tu *TarUploader, pre *Prefix, name string) error {
+	if strings.Contains(name, "/") {
+		return errors.Errorf("HandleRestorePointCreate: restore point name '%s' must not contain '/'", name)
+	}
+
+	conn, err := Connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	queryRunner, err := NewPgQueryRunner(conn)
+	if err != nil {
+		return err
+	}
+	point, err := queryRunner.CreateRestorePoint(name)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(point)
+	if err != nil {
+		return err
+	}
+	key := GetRestorePointsPath(pre) + name + RestorePointSuffix
+	err = tu.put(key, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "HandleRestorePointCreate: failed to upload restore point")
+	}
+	fmt.Printf("Restore point '%s' created at LSN %x on timeline %d.\n", name, point.LSN, point.Timeline)
+	return nil
+}
+
+// GetRestorePoints fetches descriptions of all restore points in storage
+func GetRestorePoints(pre *Prefix) ([]RestorePoint, error) {
+	var keys []string
+	objects, err := pre.Storage().List(GetRestorePointsPath(pre))
+	if err != nil {
+		return nil, errors.Wrap(err, "GetRestorePoints: failed to list restore points")
+	}
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, RestorePointSuffix) {
+			keys = append(keys, object.Key)
+		}
+	}
+
+	points := make([]RestorePoint, 0, len(keys))
+	for _, key := range keys {
+		archive := &Archive{Prefix: pre, Archive: aws.String(key)}
+		reader, err := archive.GetArchive()
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetRestorePoints: failed to fetch %s", key)
+		}
+		body, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetRestorePoints: failed to fetch %s", key)
+		}
+		var point RestorePoint
+		err = json.Unmarshal(body, &point)
+		if err != nil {
+			return nil, errors.Wrapf(err, "GetRestorePoints: failed to parse %s", key)
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// HandleRestorePointList is invoked to perform wal-g restore-point-list
+func HandleRestorePointList(pre *Prefix) error {
+	points, err := GetRestorePoints(pre)
+	if err != nil {
+		return err
+	}
+
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	backups, err := bk.GetBackups()
+	if err != nil && err != ErrLatestNotFound {
+		return err
+	}
+	names := make([]string, len(backups))
+	for i, b := range backups {
+		names[i] = b.Name
+	}
+	sentinels, err := FetchSentinels(names, bk, pre)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "name\tlsn\ttime\tbackup\tfirst_segment\tlast_segment")
+	for _, point := range points {
+		backup, err := FindRestorePointBackup(point, sentinels)
+		if err != nil {
+			backup = RestorePointBackup{"-", "-", "-"}
+		}
+		fmt.Fprintf(w, "%v\t%x\t%v\t%v\t%v\t%v\n", point.Name, point.LSN, point.Time.Format(time.RFC3339),
+			backup.BackupName, backup.FirstSegment, backup.LastSegment)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package walg
+
+import "testing"
+
+func TestFindRestorePointBackup(t *testing.T) {
+	lsn := func(v uint64) *uint64 { return &v }
+	sentinels := map[string]S3TarBallSentinelDto{
+		"base_000000010000000000000002": {LSN: lsn(0x2000028), FinishLSN: lsn(0x2000130)},
+		"base_000000010000000000000005": {LSN: lsn(0x5000028), FinishLSN: lsn(0x6000100)},
+		"base_000000020000000000000009": {LSN: lsn(0x9000028), FinishLSN: lsn(0x9000130)},
+		"base_000000010000000000000001": {},
+	}
+
+	backup, err := FindRestorePointBackup(RestorePoint{Name: "before_migration", LSN: 0x7000060, Timeline: 1}, sentinels)
+	if err != nil {
+		t.Fatalf("restore point: failed to find backup: %v", err)
+	}
+	expected := RestorePointBackup{"base_000000010000000000000005", "000000010000000000000005", "000000010000000000000007"}
+	if backup != expected {
+		t.Errorf("restore point: expected %v but got %v", expected, backup)
+	}
+
+	// Backup of later timeline can not be used to reach restore point of earlier one
+	backup, err = FindRestorePointBackup(RestorePoint{LSN: 0xA000000, Timeline: 1}, sentinels)
+	if err != nil || backup.BackupName != "base_000000010000000000000005" {
+		t.Errorf("restore point: expected backup on timeline 1 but got %v, %v", backup, err)
+	}
+
+	// Restore point inside backup is not reachable
+	_, err = FindRestorePointBackup(RestorePoint{LSN: 0x2000100, Timeline: 1}, sentinels)
+	if err != ErrNoBackupForRestorePoint {
+		t.Errorf("restore point: expected ErrNoBackupForRestorePoint but got %v", err)
+	}
+}
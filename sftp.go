@@ -0,0 +1,470 @@
+package walg
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Packet types and constants of SFTP version 3, draft-ietf-secsh-filexfer-02
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpProtocol = 3
+
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+
+	sftpAttrSize        = 0x00000001
+	sftpAttrUIDGID      = 0x00000002
+	sftpAttrPermissions = 0x00000004
+	sftpAttrACModTime   = 0x00000008
+	sftpAttrExtended    = 0x80000000
+
+	sftpModeDir = 0040000
+	sftpModeFmt = 0170000
+
+	// Servers must accept reads and writes of this size
+	sftpChunkSize = 32 * 1024
+)
+
+// sftpStatusError is SSH_FXP_STATUS with failure code
+type sftpStatusError struct {
+	code    uint32
+	message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return "sftp: " + e.message
+}
+
+func isSFTPNotExist(err error) bool {
+	statusErr, ok := errors.Cause(err).(*sftpStatusError)
+	return ok && statusErr.code == sftpNoSuchFile
+}
+
+// sftpFileInfo holds attributes of a file used by WAL-G
+type sftpFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// sftpClient speaks SFTP version 3 over connection to sftp-server, e.g. stdio of `ssh -s sftp`.
+// Requests are sent one at a time, so the client is safe for concurrent use.
+type sftpClient struct {
+	conn   io.ReadWriteCloser
+	mutex  sync.Mutex
+	nextID uint32
+}
+
+func newSFTPClient(conn io.ReadWriteCloser) (*sftpClient, error) {
+	c := &sftpClient{conn: conn}
+	err := c.writePacket(sftpInit, marshalUint32(nil, sftpProtocol))
+	if err != nil {
+		return nil, errors.Wrap(err, "newSFTPClient: failed to send init")
+	}
+	packetType, _, err := c.readPacket()
+	if err != nil {
+		return nil, errors.Wrap(err, "newSFTPClient: failed to read version")
+	}
+	if packetType != sftpVersion {
+		return nil, errors.Errorf("newSFTPClient: unexpected packet %d instead of version", packetType)
+	}
+	return c, nil
+}
+
+func marshalUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func marshalUint64(b []byte, v uint64) []byte {
+	return marshalUint32(marshalUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func marshalString(b []byte, s string) []byte {
+	return append(marshalUint32(b, uint32(len(s))), s...)
+}
+
+// sftpBuffer consumes fields of received packet
+type sftpBuffer struct {
+	data []byte
+	err  error
+}
+
+func (b *sftpBuffer) uint32() uint32 {
+	if len(b.data) < 4 {
+		b.err = errors.New("sftp: packet is too short")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(b.data)
+	b.data = b.data[4:]
+	return v
+}
+
+func (b *sftpBuffer) uint64() uint64 {
+	return uint64(b.uint32())<<32 | uint64(b.uint32())
+}
+
+func (b *sftpBuffer) string() string {
+	n := b.uint32()
+	if uint32(len(b.data)) < n {
+		b.err = errors.New("sftp: packet is too short")
+		return ""
+	}
+	s := string(b.data[:n])
+	b.data = b.data[n:]
+	return s
+}
+
+func (b *sftpBuffer) attrs(name string) sftpFileInfo {
+	info := sftpFileInfo{name: name}
+	flags := b.uint32()
+	if flags&sftpAttrSize != 0 {
+		info.size = int64(b.uint64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		b.uint32()
+		b.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		info.isDir = b.uint32()&sftpModeFmt == sftpModeDir
+	}
+	if flags&sftpAttrACModTime != 0 {
+		b.uint32()
+		info.modTime = time.Unix(int64(b.uint32()), 0)
+	}
+	if flags&sftpAttrExtended != 0 {
+		count := b.uint32()
+		for i := uint32(0); i < count && b.err == nil; i++ {
+			b.string()
+			b.string()
+		}
+	}
+	return info
+}
+
+func (c *sftpClient) writePacket(packetType byte, payload []byte) error {
+	packet := marshalUint32(make([]byte, 0, 5+len(payload)), uint32(1+len(payload)))
+	packet = append(packet, packetType)
+	_, err := c.conn.Write(append(packet, payload...))
+	return err
+}
+
+func (c *sftpClient) readPacket() (byte, *sftpBuffer, error) {
+	var header [5]byte
+	_, err := io.ReadFull(c.conn, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 1<<24 {
+		return 0, nil, errors.Errorf("sftp: invalid packet length %d", length)
+	}
+	data := make([]byte, length-1)
+	_, err = io.ReadFull(c.conn, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[4], &sftpBuffer{data: data}, nil
+}
+
+// request sends packet and returns type and payload of response after request id
+func (c *sftpClient) request(packetType byte, payload []byte) (byte, *sftpBuffer, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nextID++
+	id := c.nextID
+	err := c.writePacket(packetType, append(marshalUint32(nil, id), payload...))
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "sftp: failed to send request")
+	}
+	responseType, response, err := c.readPacket()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "sftp: failed to read response")
+	}
+	if response.uint32() != id {
+		return 0, nil, errors.New("sftp: response to unexpected request")
+	}
+	if responseType == sftpStatus {
+		code := response.uint32()
+		message := response.string()
+		if response.err != nil {
+			return 0, nil, response.err
+		}
+		if code != sftpOK {
+			return 0, nil, &sftpStatusError{code, message}
+		}
+	}
+	return responseType, response, nil
+}
+
+// requestStatus sends request which is answered only by status
+func (c *sftpClient) requestStatus(packetType byte, payload []byte) error {
+	responseType, _, err := c.request(packetType, payload)
+	if err == nil && responseType != sftpStatus {
+		err = errors.Errorf("sftp: unexpected packet %d instead of status", responseType)
+	}
+	return err
+}
+
+func (c *sftpClient) requestHandle(packetType byte, payload []byte) (string, error) {
+	responseType, response, err := c.request(packetType, payload)
+	if err != nil {
+		return "", err
+	}
+	if responseType != sftpHandle {
+		return "", errors.Errorf("sftp: unexpected packet %d instead of handle", responseType)
+	}
+	handle := response.string()
+	return handle, response.err
+}
+
+func (c *sftpClient) open(filePath string, flags uint32) (string, error) {
+	payload := marshalUint32(marshalString(nil, filePath), flags)
+	handle, err := c.requestHandle(sftpOpen, marshalUint32(payload, 0))
+	return handle, errors.Wrapf(err, "sftp: failed to open %s", filePath)
+}
+
+func (c *sftpClient) closeHandle(handle string) error {
+	return c.requestStatus(sftpClose, marshalString(nil, handle))
+}
+
+// Stat returns attributes of file
+func (c *sftpClient) Stat(filePath string) (sftpFileInfo, error) {
+	responseType, response, err := c.request(sftpStat, marshalString(nil, filePath))
+	if err != nil {
+		return sftpFileInfo{}, errors.Wrapf(err, "sftp: failed to stat %s", filePath)
+	}
+	if responseType != sftpAttrs {
+		return sftpFileInfo{}, errors.Errorf("sftp: unexpected packet %d instead of attributes", responseType)
+	}
+	info := response.attrs(path.Base(filePath))
+	return info, response.err
+}
+
+// ReadDir lists directory
+func (c *sftpClient) ReadDir(dir string) ([]sftpFileInfo, error) {
+	handle, err := c.requestHandle(sftpOpendir, marshalString(nil, dir))
+	if err != nil {
+		return nil, errors.Wrapf(err, "sftp: failed to open directory %s", dir)
+	}
+	defer c.closeHandle(handle)
+
+	var infos []sftpFileInfo
+	for {
+		responseType, response, err := c.request(sftpReaddir, marshalString(nil, handle))
+		if statusErr, ok := errors.Cause(err).(*sftpStatusError); ok && statusErr.code == sftpEOF {
+			return infos, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "sftp: failed to read directory %s", dir)
+		}
+		if responseType != sftpName {
+			return nil, errors.Errorf("sftp: unexpected packet %d instead of names", responseType)
+		}
+		count := response.uint32()
+		for i := uint32(0); i < count && response.err == nil; i++ {
+			name := response.string()
+			response.string() // long name
+			info := response.attrs(name)
+			if name != "." && name != ".." {
+				infos = append(infos, info)
+			}
+		}
+		if response.err != nil {
+			return nil, response.err
+		}
+	}
+}
+
+// MkdirAll creates directory with missing parents
+func (c *sftpClient) MkdirAll(dir string) error {
+	info, err := c.Stat(dir)
+	if err == nil {
+		if !info.isDir {
+			return errors.Errorf("sftp: %s is not a directory", dir)
+		}
+		return nil
+	}
+	if !isSFTPNotExist(err) {
+		return err
+	}
+	if parent := path.Dir(dir); parent != dir {
+		err = c.MkdirAll(parent)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.requestStatus(sftpMkdir, marshalUint32(marshalString(nil, dir), 0))
+	if err != nil {
+		// Directory could be created concurrently
+		if info, statErr := c.Stat(dir); statErr == nil && info.isDir {
+			return nil
+		}
+		return errors.Wrapf(err, "sftp: failed to create directory %s", dir)
+	}
+	return nil
+}
+
+// Remove deletes file
+func (c *sftpClient) Remove(filePath string) error {
+	return errors.Wrapf(c.requestStatus(sftpRemove, marshalString(nil, filePath)), "sftp: failed to remove %s", filePath)
+}
+
+// WriteFile stores content of reader to file. Content is written to a temporary file
+// which replaces filePath only when it is complete, so readers never see partial file.
+func (c *sftpClient) WriteFile(filePath string, reader io.Reader) error {
+	err := c.MkdirAll(path.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	tmpPath := filePath + ".tmp"
+	handle, err := c.open(tmpPath, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, sftpChunkSize)
+	offset := uint64(0)
+	for {
+		n, readErr := io.ReadFull(reader, buf)
+		if n > 0 {
+			payload := marshalUint64(marshalString(nil, handle), offset)
+			err = c.requestStatus(sftpWrite, append(marshalUint32(payload, uint32(n)), buf[:n]...))
+			if err != nil {
+				c.closeHandle(handle)
+				return errors.Wrapf(err, "sftp: failed to write %s", tmpPath)
+			}
+			offset += uint64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			c.closeHandle(handle)
+			return readErr
+		}
+	}
+	err = c.closeHandle(handle)
+	if err != nil {
+		return errors.Wrapf(err, "sftp: failed to close %s", tmpPath)
+	}
+
+	// Rename of version 3 does not overwrite existing file
+	err = c.Remove(filePath)
+	if err != nil && !isSFTPNotExist(err) {
+		return err
+	}
+	err = c.requestStatus(sftpRename, marshalString(marshalString(nil, tmpPath), filePath))
+	return errors.Wrapf(err, "sftp: failed to rename %s", tmpPath)
+}
+
+// sftpFileReader reads remote file sequentially
+type sftpFileReader struct {
+	client *sftpClient
+	handle string
+	offset uint64
+}
+
+// Open opens remote file for reading
+func (c *sftpClient) Open(filePath string) (io.ReadCloser, error) {
+	handle, err := c.open(filePath, sftpFlagRead)
+	if err != nil {
+		if isSFTPNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	return &sftpFileReader{client: c, handle: handle}, nil
+}
+
+func (r *sftpFileReader) Read(p []byte) (int, error) {
+	if len(p) > sftpChunkSize {
+		p = p[:sftpChunkSize]
+	}
+	payload := marshalUint64(marshalString(nil, r.handle), r.offset)
+	responseType, response, err := r.client.request(sftpRead, marshalUint32(payload, uint32(len(p))))
+	if statusErr, ok := errors.Cause(err).(*sftpStatusError); ok && statusErr.code == sftpEOF {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if responseType != sftpData {
+		return 0, errors.Errorf("sftp: unexpected packet %d instead of data", responseType)
+	}
+	data := response.string()
+	if response.err != nil {
+		return 0, response.err
+	}
+	n := copy(p, data)
+	r.offset += uint64(n)
+	return n, nil
+}
+
+func (r *sftpFileReader) Close() error {
+	return r.client.closeHandle(r.handle)
+}
+
+// Walk lists regular files under dir recursively, names are relative to dir
+func (c *sftpClient) Walk(dir string) ([]sftpFileInfo, error) {
+	infos, err := c.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []sftpFileInfo
+	for _, info := range infos {
+		if !info.isDir {
+			files = append(files, info)
+			continue
+		}
+		nested, err := c.Walk(path.Join(dir, info.name))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range nested {
+			file.name = info.name + "/" + file.name
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// Close terminates connection
+func (c *sftpClient) Close() error {
+	return c.conn.Close()
+}
+
+// isSFTPTemporary tells whether file is an unfinished upload of WriteFile
+func isSFTPTemporary(name string) bool {
+	return strings.HasSuffix(name, ".tmp")
+}
@@ -0,0 +1,169 @@
+package walg
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SFTPStorage keeps objects as files on SSH server, object key is the path of file
+// relative to the root of server filesystem.
+type SFTPStorage struct {
+	client *sftpClient
+}
+
+// NewSFTPStorage creates storage speaking SFTP over conn
+func NewSFTPStorage(conn io.ReadWriteCloser) (*SFTPStorage, error) {
+	client, err := newSFTPClient(conn)
+	if err != nil {
+		return nil, err
+	}
+	return &SFTPStorage{client: client}, nil
+}
+
+// sshConn is stdio of ssh process running sftp subsystem on the server
+type sshConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *sshConn) Close() error {
+	c.WriteCloser.Close()
+	return c.cmd.Wait()
+}
+
+// sshCommand builds ssh invocation of sftp subsystem for ssh://[user@]host[:port]/path prefix.
+// Key file is taken from WALG_SSH_KEY, host key is checked against known_hosts of the user.
+func sshCommand(u *url.URL) *exec.Cmd {
+	args := []string{"-o", "BatchMode=yes"}
+	if key := os.Getenv("WALG_SSH_KEY"); key != "" {
+		args = append(args, "-i", key)
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	destination := u.Hostname()
+	if u.User != nil {
+		destination = u.User.Username() + "@" + destination
+	}
+	args = append(args, "-s", destination, "sftp")
+	return exec.Command("ssh", args...)
+}
+
+// configureSFTPStorage connects to SSH server given by WALE_S3_PREFIX=ssh://user@host/path
+func configureSFTPStorage(u *url.URL) (*TarUploader, *Prefix, error) {
+	cmd := sshCommand(u)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "configureSFTPStorage: failed to create pipe")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "configureSFTPStorage: failed to create pipe")
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "configureSFTPStorage: failed to start ssh")
+	}
+	storage, err := NewSFTPStorage(&sshConn{stdout, stdin, cmd})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "configureSFTPStorage: failed to connect to %s", u.Host)
+	}
+
+	server := strings.Trim(u.Path, "/")
+	upload, pre := ConfigureStorageBackend(storage, server)
+	return upload, pre, nil
+}
+
+func sftpPath(key string) string {
+	return "/" + strings.TrimPrefix(key, "/")
+}
+
+// Put writes object to file
+func (s *SFTPStorage) Put(key string, r io.Reader) error {
+	err := s.client.WriteFile(sftpPath(key), r)
+	if err != nil {
+		return errors.Wrap(err, "SFTPStorage Put")
+	}
+	return nil
+}
+
+// GetArchive streams file
+func (s *SFTPStorage) GetArchive(key string) (io.ReadCloser, error) {
+	reader, err := s.client.Open(sftpPath(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "SFTPStorage GetArchive: failed to open %s", key)
+	}
+	return reader, nil
+}
+
+// listObjects lists files with keys starting with prefix, unfinished uploads are skipped
+func (s *SFTPStorage) listObjects(prefix string) ([]StorageObject, error) {
+	// Prefix may end in the middle of file name, e.g. WAL files of a timeline
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+	files, err := s.client.Walk(sftpPath(dir))
+	if isSFTPNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "SFTPStorage list")
+	}
+	var objects []StorageObject
+	for _, file := range files {
+		key := file.name
+		if dir != "" {
+			key = dir + "/" + key
+		}
+		if !strings.HasPrefix(key, prefix) || isSFTPTemporary(key) {
+			continue
+		}
+		objects = append(objects, StorageObject{Key: key, Size: file.size, LastModified: file.modTime})
+	}
+	return objects, nil
+}
+
+// List returns files directly under prefix
+func (s *SFTPStorage) List(prefix string) ([]StorageObject, error) {
+	objects, err := s.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterByDelimiter(objects, prefix), nil
+}
+
+// ListAll returns files under prefix at any depth
+func (s *SFTPStorage) ListAll(prefix string) ([]StorageObject, error) {
+	return s.listObjects(prefix)
+}
+
+// Exists tells whether file of key exists
+func (s *SFTPStorage) Exists(key string) (bool, error) {
+	_, err := s.client.Stat(sftpPath(key))
+	if isSFTPNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "SFTPStorage Exists")
+	}
+	return true, nil
+}
+
+// Delete removes files one by one, missing file is not an error
+func (s *SFTPStorage) Delete(keys []string) error {
+	for _, key := range keys {
+		err := s.client.Remove(sftpPath(key))
+		if err != nil && !isSFTPNotExist(err) {
+			return errors.Wrapf(err, "SFTPStorage Delete: failed to remove %s", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package walg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// testSFTPServer serves subset of SFTP used by sftpClient from directory root
+type testSFTPServer struct {
+	root    string
+	conn    net.Conn
+	handles map[string]*os.File
+	dirs    map[string][]os.FileInfo
+}
+
+func (s *testSFTPServer) status(id uint32, err error) []byte {
+	code := uint32(sftpOK)
+	if os.IsNotExist(err) {
+		code = sftpNoSuchFile
+	} else if err == io.EOF {
+		code = sftpEOF
+	} else if err != nil {
+		code = 4 // SSH_FX_FAILURE
+	}
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	return append([]byte{sftpStatus}, marshalString(marshalString(marshalUint32(marshalUint32(nil, id), code), message), "")...)
+}
+
+func testSFTPAttrs(b []byte, info os.FileInfo) []byte {
+	mode := uint32(0100644)
+	if info.IsDir() {
+		mode = sftpModeDir | 0755
+	}
+	b = marshalUint32(b, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime)
+	b = marshalUint64(b, uint64(info.Size()))
+	b = marshalUint32(b, mode)
+	b = marshalUint32(b, uint32(info.ModTime().Unix()))
+	return marshalUint32(b, uint32(info.ModTime().Unix()))
+}
+
+func (s *testSFTPServer) handle(packetType byte, request *sftpBuffer) []byte {
+	id := request.uint32()
+	localPath := func() string { return filepath.Join(s.root, request.string()) }
+	switch packetType {
+	case sftpOpen:
+		name := localPath()
+		flags := request.uint32()
+		var f *os.File
+		var err error
+		if flags&sftpFlagWrite != 0 {
+			f, err = os.Create(name)
+		} else {
+			f, err = os.Open(name)
+		}
+		if err != nil {
+			return s.status(id, err)
+		}
+		handle := strconv.Itoa(len(s.handles) + len(s.dirs))
+		s.handles[handle] = f
+		return append([]byte{sftpHandle}, marshalString(marshalUint32(nil, id), handle)...)
+	case sftpOpendir:
+		infos, err := ioutil.ReadDir(localPath())
+		if err != nil {
+			return s.status(id, err)
+		}
+		handle := "dir" + strconv.Itoa(len(s.handles)+len(s.dirs))
+		s.dirs[handle] = infos
+		return append([]byte{sftpHandle}, marshalString(marshalUint32(nil, id), handle)...)
+	case sftpReaddir:
+		handle := request.string()
+		infos := s.dirs[handle]
+		if len(infos) == 0 {
+			return s.status(id, io.EOF)
+		}
+		// Two entries at a time to exercise repeated READDIR
+		if len(infos) > 2 {
+			infos = infos[:2]
+		}
+		s.dirs[handle] = s.dirs[handle][len(infos):]
+		response := marshalUint32(marshalUint32(nil, id), uint32(len(infos)))
+		for _, info := range infos {
+			response = testSFTPAttrs(marshalString(marshalString(response, info.Name()), info.Name()), info)
+		}
+		return append([]byte{sftpName}, response...)
+	case sftpClose:
+		handle := request.string()
+		if f, ok := s.handles[handle]; ok {
+			f.Close()
+		}
+		return s.status(id, nil)
+	case sftpRead:
+		f := s.handles[request.string()]
+		offset := request.uint64()
+		buf := make([]byte, request.uint32())
+		n, err := f.ReadAt(buf, int64(offset))
+		if n == 0 {
+			return s.status(id, err)
+		}
+		return append([]byte{sftpData}, marshalString(marshalUint32(nil, id), string(buf[:n]))...)
+	case sftpWrite:
+		f := s.handles[request.string()]
+		offset := request.uint64()
+		_, err := f.WriteAt([]byte(request.string()), int64(offset))
+		return s.status(id, err)
+	case sftpStat:
+		info, err := os.Stat(localPath())
+		if err != nil {
+			return s.status(id, err)
+		}
+		return append([]byte{sftpAttrs}, testSFTPAttrs(marshalUint32(nil, id), info)...)
+	case sftpMkdir:
+		return s.status(id, os.Mkdir(localPath(), 0755))
+	case sftpRemove:
+		return s.status(id, os.Remove(localPath()))
+	case sftpRename:
+		from := localPath()
+		to := localPath()
+		if _, err := os.Stat(to); err == nil {
+			return s.status(id, os.ErrExist)
+		}
+		return s.status(id, os.Rename(from, to))
+	}
+	return s.status(id, os.ErrInvalid)
+}
+
+func (s *testSFTPServer) serve() {
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[:4])-1)
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return
+		}
+		var response []byte
+		if header[4] == sftpInit {
+			response = append([]byte{sftpVersion}, marshalUint32(nil, sftpProtocol)...)
+		} else {
+			response = s.handle(header[4], &sftpBuffer{data: data})
+		}
+		s.conn.Write(append(marshalUint32(nil, uint32(len(response))), response...))
+	}
+}
+
+func newTestSFTPStorage(t *testing.T) (*SFTPStorage, string) {
+	root, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	server := &testSFTPServer{root: root, conn: serverConn, handles: make(map[string]*os.File), dirs: make(map[string][]os.FileInfo)}
+	go server.serve()
+	storage, err := NewSFTPStorage(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage, root
+}
+
+func TestSFTPStorage(t *testing.T) {
+	storage, root := newTestSFTPStorage(t)
+	defer os.RemoveAll(root)
+	defer storage.client.Close()
+
+	// Larger than one chunk to exercise sequential reads and writes
+	content := bytes.Repeat([]byte("wal-g"), 20000)
+	keys := []string{
+		"server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json",
+		"server/basebackups_005/base_000000010000000000000002/tar_partitions/part_1.tar.lz4",
+		"server/wal_005/000000010000000000000002.lz4",
+		"server/wal_005/000000010000000000000003.lz4",
+	}
+	for _, key := range keys {
+		err := storage.Put(key, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("sftp: put of %s failed: %v", key, err)
+		}
+	}
+	// Repeated put replaces object
+	err := storage.Put(keys[2], bytes.NewReader(content[:10]))
+	if err != nil {
+		t.Fatalf("sftp: second put failed: %v", err)
+	}
+
+	if exists, err := storage.Exists(keys[2]); err != nil || !exists {
+		t.Errorf("sftp: expected %s to exist, got %v, %v", keys[2], exists, err)
+	}
+	if exists, err := storage.Exists("server/missing"); err != nil || exists {
+		t.Errorf("sftp: expected missing object not to exist, got %v, %v", exists, err)
+	}
+
+	archive, err := storage.GetArchive(keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := ioutil.ReadAll(archive)
+	archive.Close()
+	if err != nil || !bytes.Equal(fetched, content) {
+		t.Errorf("sftp: fetched content differs, error %v", err)
+	}
+	if _, err = storage.GetArchive("server/missing"); errors.Cause(err) != os.ErrNotExist {
+		t.Errorf("sftp: expected not exist error for missing object, got %v", err)
+	}
+
+	list := func(objects []StorageObject, err error) []string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		var listed []string
+		for _, object := range objects {
+			listed = append(listed, object.Key)
+		}
+		sort.Strings(listed)
+		return listed
+	}
+	if listed := list(storage.ListAll("server/")); len(listed) != 4 {
+		t.Errorf("sftp: expected all objects, got %v", listed)
+	}
+	if listed := list(storage.List("server/basebackups_005/")); len(listed) != 1 || listed[0] != keys[0] {
+		t.Errorf("sftp: expected only sentinel directly under backups, got %v", listed)
+	}
+	if listed := list(storage.ListAll("server/wal_005/000000010000000000000003")); len(listed) != 1 || listed[0] != keys[3] {
+		t.Errorf("sftp: expected one WAL file for partial name, got %v", listed)
+	}
+	if listed := list(storage.ListAll("other/")); len(listed) != 0 {
+		t.Errorf("sftp: expected nothing in missing directory, got %v", listed)
+	}
+
+	err = storage.Delete([]string{keys[2], "server/missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed := list(storage.ListAll("server/wal_005/")); len(listed) != 1 {
+		t.Errorf("sftp: expected one WAL file after delete, got %v", listed)
+	}
+}
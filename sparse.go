@@ -0,0 +1,155 @@
+package walg
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errSparseUnsupported = errors.New("SEEK_DATA/SEEK_HOLE is not supported")
+	errNoMoreData        = errors.New("No more data extents in file")
+)
+
+// SparseFileReader reads a file answering holes with zeroes
+// instead of reading them from disk. Data extents are found with
+// SEEK_DATA/SEEK_HOLE where the platform supports it, otherwise
+// the file is read as is.
+type SparseFileReader struct {
+	file    *os.File
+	size    int64
+	offset  int64
+	dataEnd int64
+	holeEnd int64
+	plain   bool
+}
+
+// NewSparseFileReader wraps file of known size into SparseFileReader.
+func NewSparseFileReader(file *os.File, size int64) *SparseFileReader {
+	return &SparseFileReader{file: file, size: size}
+}
+
+// Read implements io.Reader.
+func (r *SparseFileReader) Read(p []byte) (int, error) {
+	if r.plain {
+		return r.file.Read(p)
+	}
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.offset >= r.dataEnd && r.offset >= r.holeEnd {
+		err := r.locateExtent()
+		if err != nil {
+			return 0, err
+		}
+		if r.plain {
+			return r.file.Read(p)
+		}
+	}
+
+	if r.offset < r.holeEnd {
+		n := len(p)
+		if int64(n) > r.holeEnd-r.offset {
+			n = int(r.holeEnd - r.offset)
+		}
+		for i := 0; i < n; i++ {
+			p[i] = 0
+		}
+		r.offset += int64(n)
+		return n, nil
+	}
+
+	if int64(len(p)) > r.dataEnd-r.offset {
+		p = p[:r.dataEnd-r.offset]
+	}
+	n, err := r.file.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset >= r.dataEnd {
+		// End of extent, not of the file
+		err = nil
+	}
+	return n, err
+}
+
+// locateExtent finds the extent of file which starts at current offset
+func (r *SparseFileReader) locateExtent() error {
+	dataStart, err := seekData(r.file, r.offset)
+	if err == errSparseUnsupported {
+		r.plain = true
+		_, err = r.file.Seek(r.offset, io.SeekStart)
+		return err
+	}
+	if err == errNoMoreData {
+		// Trailing hole up to the end of file
+		r.holeEnd = r.size
+		r.dataEnd = r.offset
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "SparseFileReader: failed to find data extent")
+	}
+
+	if dataStart > r.offset {
+		r.holeEnd = dataStart
+		r.dataEnd = dataStart
+		return nil
+	}
+
+	holeStart, err := seekHole(r.file, dataStart)
+	if err != nil {
+		return errors.Wrap(err, "SparseFileReader: failed to find hole")
+	}
+	r.dataEnd = holeStart
+	_, err = r.file.Seek(r.offset, io.SeekStart)
+	return err
+}
+
+// ReadAt reads underlying file regardless of current position
+func (r *SparseFileReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.file.ReadAt(p, off)
+}
+
+// Close underlying file
+func (r *SparseFileReader) Close() error {
+	return r.file.Close()
+}
+
+// CopySparse copies src to file dst skipping blocks of zeroes,
+// so that zero runs become holes on filesystems supporting them.
+// Size of dst is set to exact number of bytes copied, thus
+// zero-length and trailing-hole files are reproduced exactly.
+func CopySparse(dst *os.File, src io.Reader) (int64, error) {
+	buf := make([]byte, BlockSize)
+	var written int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if allZero(buf[:n]) {
+				_, seekErr := dst.Seek(int64(n), io.SeekCurrent)
+				if seekErr != nil {
+					return written, errors.Wrap(seekErr, "CopySparse: seek failed")
+				}
+			} else {
+				_, writeErr := dst.Write(buf[:n])
+				if writeErr != nil {
+					return written, errors.Wrap(writeErr, "CopySparse: write failed")
+				}
+			}
+			written += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	// Seeking past the end does not extend the file, truncate does
+	err := dst.Truncate(written)
+	if err != nil {
+		return written, errors.Wrap(err, "CopySparse: truncate failed")
+	}
+	return written, nil
+}
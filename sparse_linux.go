@@ -0,0 +1,36 @@
+package walg
+
+import (
+	"os"
+	"syscall"
+)
+
+// Values of whence for lseek(2) on Linux, see linux/fs.h
+const (
+	seekWhenceData = 3
+	seekWhenceHole = 4
+)
+
+func seekData(file *os.File, offset int64) (int64, error) {
+	return seekExtent(file, offset, seekWhenceData)
+}
+
+func seekHole(file *os.File, offset int64) (int64, error) {
+	return seekExtent(file, offset, seekWhenceHole)
+}
+
+func seekExtent(file *os.File, offset int64, whence int) (int64, error) {
+	position, err := file.Seek(offset, whence)
+	if err == nil {
+		return position, nil
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		switch pathErr.Err {
+		case syscall.ENXIO:
+			return 0, errNoMoreData
+		case syscall.EINVAL, syscall.EOPNOTSUPP:
+			return 0, errSparseUnsupported
+		}
+	}
+	return 0, err
+}
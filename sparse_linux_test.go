@@ -0,0 +1,50 @@
+package walg_test
+
+import (
+	"archive/tar"
+	"github.com/wal-g/wal-g"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestRestoredFileIsSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	createSparseFile(t, source)
+	f, err := os.Open(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interpreter := &walg.FileTarInterpreter{NewDir: filepath.Join(dir, "restore")}
+	hdr := &tar.Header{Name: "target", Mode: 0600, Size: info.Size(), Typeflag: tar.TypeReg}
+	err = interpreter.Interpret(f, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := os.Stat(filepath.Join(dir, "restore", "target"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Size() != info.Size() {
+		t.Fatalf("sparse: restored size %d instead of %d", restored.Size(), info.Size())
+	}
+	allocated := restored.Sys().(*syscall.Stat_t).Blocks * 512
+	if allocated >= restored.Size() {
+		t.Errorf("sparse: restored file allocates %d bytes for %d bytes of content", allocated, restored.Size())
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package walg
+
+import (
+	"os"
+)
+
+func seekData(file *os.File, offset int64) (int64, error) {
+	return 0, errSparseUnsupported
+}
+
+func seekHole(file *os.File, offset int64) (int64, error) {
+	return 0, errSparseUnsupported
+}
@@ -0,0 +1,114 @@
+package walg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/wal-g/wal-g"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Creates a file with a hole in the middle and a trailing hole.
+func createSparseFile(t *testing.T, path string) []byte {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	data := bytes.Repeat([]byte{0x55}, 3*int(walg.BlockSize))
+	_, err = f.WriteAt(data, 64*int64(walg.BlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := 128 * int64(walg.BlockSize)
+	err = f.Truncate(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make([]byte, size)
+	copy(expected[64*int(walg.BlockSize):], data)
+	return expected
+}
+
+func TestSparseFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sparsePath := filepath.Join(dir, "sparse")
+	expected := createSparseFile(t, sparsePath)
+	emptyPath := filepath.Join(dir, "empty")
+	err = ioutil.WriteFile(emptyPath, []byte{}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tarBuffer := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuffer)
+	for _, name := range []string{"sparse", "empty"} {
+		reader, isPaged, size, err := walg.ReadDatabaseFile(filepath.Join(dir, name), nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isPaged {
+			t.Errorf("sparse: file %v must not be read incrementally", name)
+		}
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.Close()
+		if int64(len(content)) != size {
+			t.Errorf("sparse: read %d bytes of %v instead of %d", len(content), name, size)
+		}
+		if name == "sparse" && !bytes.Equal(content, expected) {
+			t.Errorf("sparse: content of sparse file was not read correctly")
+		}
+
+		err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	restoreDir := filepath.Join(dir, "restore")
+	interpreter := &walg.FileTarInterpreter{NewDir: restoreDir}
+	tr := tar.NewReader(tarBuffer)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		err = interpreter.Interpret(tr, hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored, err := ioutil.ReadFile(filepath.Join(restoreDir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, expected) {
+		t.Errorf("sparse: restored sparse file differs from original")
+	}
+
+	info, err := os.Stat(filepath.Join(restoreDir, "empty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("sparse: restored empty file has size %d", info.Size())
+	}
+}
@@ -0,0 +1,330 @@
+package walg
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// ErrNotS3Storage is returned by operations relying on features of S3 on other backends
+var ErrNotS3Storage = errors.New("operation is supported only by S3 storage")
+
+// StorageObject describes one listed object of storage
+type StorageObject struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+	// ETag and StorageClass are known on S3 only
+	ETag         string
+	StorageClass string
+}
+
+// StorageBackend is the object storage backups and WAL are kept in.
+// Keys are full names of objects, including the server path of prefix.
+type StorageBackend interface {
+	// GetArchive opens object for reading
+	GetArchive(key string) (io.ReadCloser, error)
+	// Put writes object, replacing existing one
+	Put(key string, r io.Reader) error
+	// Exists tells whether object exists, missing object is not an error
+	Exists(key string) (bool, error)
+	// List returns objects directly under prefix, keys under deeper "/" levels are not included
+	List(prefix string) ([]StorageObject, error)
+	// ListAll returns all objects under prefix, at any "/" level
+	ListAll(prefix string) ([]StorageObject, error)
+	// Delete removes objects, missing objects are not an error
+	Delete(keys []string) error
+}
+
+// S3Backend is StorageBackend of a bucket, it works with any implementation of S3 API
+type S3Backend struct {
+	Svc    s3iface.S3API
+	Bucket *string
+	// uploader writes objects with its storage class and encryption settings
+	uploader *TarUploader
+}
+
+// NewS3Backend creates backend of bucket, which writes objects with uploader
+func NewS3Backend(svc s3iface.S3API, bucket string, uploader *TarUploader) *S3Backend {
+	return &S3Backend{Svc: svc, Bucket: aws.String(bucket), uploader: uploader}
+}
+
+// s3RetryDelay is the first delay between attempts of S3 request, doubled by each retry
+var s3RetryDelay = 100 * time.Millisecond
+
+// getS3MaxRetries reads WALG_S3_MAX_RETRIES, how many times S3 request failed
+// with transient error is retried
+func getS3MaxRetries() int {
+	value, ok := os.LookupEnv("WALG_S3_MAX_RETRIES")
+	if !ok {
+		return MAXRETRIES
+	}
+	retries, err := strconv.Atoi(value)
+	if err != nil || retries < 0 {
+		log.Fatal("Unable to parse WALG_S3_MAX_RETRIES ", value)
+	}
+	return retries
+}
+
+// withS3MaxRetries lets SDK retry request, which is not retried by retryS3, as the session does not
+func withS3MaxRetries(maxRetries int) request.Option {
+	return func(r *request.Request) {
+		r.Retryer = client.DefaultRetryer{NumMaxRetries: maxRetries}
+	}
+}
+
+// isRetryableS3Error tells transient errors, such as throttling, 5xx responses
+// and reset connections, from errors a retry would not fix, like missing object
+func isRetryableS3Error(err error) bool {
+	cause := errors.Cause(err)
+	if failure, ok := cause.(awserr.RequestFailure); ok {
+		status := failure.StatusCode()
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+			return true
+		}
+	}
+	if awsErr, ok := cause.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "Throttling", "ThrottlingException", "SlowDown", "RequestLimitExceeded",
+			"RequestTimeout", "InternalError", "ServiceUnavailable", "RequestError":
+			return true
+		}
+		return false
+	}
+	_, ok := cause.(net.Error)
+	return ok
+}
+
+// retryS3 calls request until it succeeds, fails with error which is not transient
+// or WALG_S3_MAX_RETRIES is exhausted. Delays grow exponentially with random jitter.
+func retryS3(operation string, request func() error) error {
+	maxRetries := getS3MaxRetries()
+	err := request()
+	for retry := 1; retry <= maxRetries && err != nil && isRetryableS3Error(err); retry++ {
+		delay := s3RetryDelay << uint(retry-1)
+		delay += time.Duration(rand.Int63n(int64(delay)))
+		log.Printf("S3Backend: retry %d of %d of %s after %v: %v\n", retry, maxRetries, operation, delay, err)
+		time.Sleep(delay)
+		err = request()
+	}
+	return err
+}
+
+// GetArchive downloads object
+func (b *S3Backend) GetArchive(key string) (io.ReadCloser, error) {
+	var output *s3.GetObjectOutput
+	err := retryS3("GetObject "+key, func() (err error) {
+		output, err = b.Svc.GetObject(&s3.GetObjectInput{
+			Bucket: b.Bucket,
+			Key:    aws.String(key),
+		})
+		return
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "S3Backend GetArchive: s3.GetObject failed")
+	}
+	return output.Body, nil
+}
+
+// Put uploads object
+func (b *S3Backend) Put(key string, r io.Reader) error {
+	if b.uploader == nil {
+		return errors.Errorf("S3Backend Put: no uploader to write '%s'", key)
+	}
+	return b.uploader.upload(b.uploader.createUploadInput(key, r), key)
+}
+
+// Exists checks object with HEAD request
+func (b *S3Backend) Exists(key string) (bool, error) {
+	err := retryS3("HeadObject "+key, func() error {
+		_, err := b.Svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: b.Bucket,
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NotFound" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetETag reads ETag of object with HEAD request, which unlike listing sees new objects at once
+func (b *S3Backend) GetETag(key string) (*string, error) {
+	var output *s3.HeadObjectOutput
+	err := retryS3("HeadObject "+key, func() (err error) {
+		output, err = b.Svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: b.Bucket,
+			Key:    aws.String(key),
+		})
+		return
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "S3Backend GetETag: s3.HeadObject failed")
+	}
+	return output.ETag, nil
+}
+
+// List lists objects with "/" delimiter
+func (b *S3Backend) List(prefix string) ([]StorageObject, error) {
+	return b.list(prefix, aws.String("/"))
+}
+
+// ListAll lists objects without delimiter
+func (b *S3Backend) ListAll(prefix string) ([]StorageObject, error) {
+	return b.list(prefix, nil)
+}
+
+func (b *S3Backend) list(prefix string, delimiter *string) ([]StorageObject, error) {
+	var objects []StorageObject
+	err := retryS3("ListObjectsV2 "+prefix, func() error {
+		// Listing is restarted from the first page on retry
+		objects = nil
+		return b.Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket:    b.Bucket,
+			Prefix:    aws.String(prefix),
+			Delimiter: delimiter,
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				objects = append(objects, StorageObject{
+					Key:          aws.StringValue(object.Key),
+					LastModified: aws.TimeValue(object.LastModified),
+					Size:         aws.Int64Value(object.Size),
+					ETag:         aws.StringValue(object.ETag),
+					StorageClass: aws.StringValue(object.StorageClass),
+				})
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "S3Backend List: s3.ListObjectsV2 failed")
+	}
+	return objects, nil
+}
+
+// Delete removes objects in batches of 1000, the limit of one S3 request.
+// Single object is deleted with DeleteObject, which every S3 compatible storage supports.
+func (b *S3Backend) Delete(keys []string) error {
+	if len(keys) == 1 {
+		err := retryS3("DeleteObject "+keys[0], func() error {
+			_, err := b.Svc.DeleteObject(&s3.DeleteObjectInput{Bucket: b.Bucket, Key: aws.String(keys[0])})
+			return err
+		})
+		if err != nil {
+			return errors.Wrap(err, "S3Backend Delete: s3.DeleteObject failed")
+		}
+		return nil
+	}
+	for _, part := range partition(keys, 1000) {
+		err := retryS3("DeleteObjects", func() error {
+			_, err := b.Svc.DeleteObjects(&s3.DeleteObjectsInput{Bucket: b.Bucket, Delete: &s3.Delete{
+				Objects: partitionToObjects(part),
+			}})
+			return err
+		})
+		if err != nil {
+			return errors.Wrap(err, "S3Backend Delete: s3.DeleteObjects failed")
+		}
+	}
+	return nil
+}
+
+func partitionToObjects(keys []string) []*s3.ObjectIdentifier {
+	objs := make([]*s3.ObjectIdentifier, len(keys))
+	for i, k := range keys {
+		objs[i] = &s3.ObjectIdentifier{Key: aws.String(k)}
+	}
+	return objs
+}
+
+// Storage returns backend of prefix, the bucket of Svc unless Backend is set.
+// Archives are read no faster than DownloadRateLimiter allows.
+func (p *Prefix) Storage() StorageBackend {
+	var storage StorageBackend = &S3Backend{Svc: p.Svc, Bucket: p.Bucket}
+	if p.Backend != nil {
+		storage = p.Backend
+	}
+	if p.DownloadRateLimiter != nil {
+		return &rateLimitedStorage{storage, p.DownloadRateLimiter}
+	}
+	return storage
+}
+
+// rateLimitedStorage throttles reading of archives of backend
+type rateLimitedStorage struct {
+	StorageBackend
+	limiter *RateLimiter
+}
+
+// eTagStorage is implemented by backends which keep ETags of objects, S3 only
+type eTagStorage interface {
+	GetETag(key string) (*string, error)
+}
+
+func (s *rateLimitedStorage) GetArchive(key string) (io.ReadCloser, error) {
+	archive, err := s.StorageBackend.GetArchive(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadCascadeClose{s.limiter.Reader(archive), archive}, nil
+}
+
+// storage returns backend uploads are written to, the bucket of uploader unless Backend is set
+func (tu *TarUploader) storage() StorageBackend {
+	if tu.Backend != nil {
+		return tu.Backend
+	}
+	return &S3Backend{Svc: tu.svc, Bucket: aws.String(tu.bucket), uploader: tu}
+}
+
+// put writes object to storage of uploader, no faster than NetworkRateLimiter allows
+func (tu *TarUploader) put(key string, r io.Reader) error {
+	body := r
+	if metrics := getMetrics(); metrics != nil {
+		body = &uploadCountingReader{body, metrics}
+	}
+	body = tu.NetworkRateLimiter.Reader(body)
+	// Wrappers keep no position, so seekable body is still rewound to retry upload, see upload
+	if seeker, ok := r.(io.Seeker); ok {
+		body = &seekableReader{body, seeker}
+	}
+	return tu.storage().Put(key, body)
+}
+
+// seekableReader reads through wrappers of body and seeks body itself
+type seekableReader struct {
+	io.Reader
+	io.Seeker
+}
+
+// ConfigureStorageBackend creates uploader and prefix working with backend other than S3.
+// Commands relying on S3 features, like ETag and storage classes, are not available.
+func ConfigureStorageBackend(backend StorageBackend, server string) (*TarUploader, *Prefix) {
+	server = sanitizePath(server)
+	pre := &Prefix{
+		Backend:             backend,
+		Bucket:              aws.String(""),
+		Server:              aws.String(server),
+		DownloadRateLimiter: NewRateLimiter(getDownloadRateLimit()),
+	}
+	upload := NewTarUploader(nil, "", server, "")
+	upload.Backend = backend
+	return upload, pre
+}
@@ -0,0 +1,172 @@
+package walg
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// BackupStorageReport describes storage classes of objects of one backup
+type BackupStorageReport struct {
+	Name string
+	Time time.Time
+	// Number of objects of backup by storage class
+	Classes map[string]int
+	// Cold is set if some object is, or after transition would be, in archive storage
+	Cold bool
+	// DeltaFrom is the base of delta backup, empty for full backup
+	DeltaFrom string
+	// ColdBase is the first cold backup in delta chain of this backup
+	ColdBase string
+}
+
+// Restorable tells whether backup can be fetched without restoring objects from archive storage first
+func (r BackupStorageReport) Restorable() bool {
+	return !r.Cold && r.ColdBase == ""
+}
+
+// isColdStorageClass tells whether objects of class must be restored before they can be read
+func isColdStorageClass(class string) bool {
+	return class == s3.ObjectStorageClassGlacier || class == "DEEP_ARCHIVE"
+}
+
+// findDeltaBase finds base of delta by the WAL file name after "_D_" in its name
+func findDeltaBase(delta BackupTime, backups []BackupTime) string {
+	parts := strings.SplitN(delta.Name, "_D_", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	for _, b := range backups {
+		if b.Name != delta.Name && b.WalFileName == parts[1] {
+			return b.Name
+		}
+	}
+	return ""
+}
+
+// BuildBackupStorageReport groups listed objects of backups directory by backup.
+// Objects modified more than coldAfter before now are treated as already transitioned
+// to archive storage, zero coldAfter considers only current storage classes.
+// Delta chains are followed by backup names, so sentinels in archive storage are not read.
+func BuildBackupStorageReport(backups []BackupTime, objects []StorageObject, backupsPath string, coldAfter time.Duration, now time.Time) []BackupStorageReport {
+	reports := make(map[string]*BackupStorageReport, len(backups))
+	for _, b := range backups {
+		reports[b.Name] = &BackupStorageReport{
+			Name:      b.Name,
+			Time:      b.Time,
+			Classes:   make(map[string]int),
+			DeltaFrom: findDeltaBase(b, backups),
+		}
+	}
+
+	for _, object := range objects {
+		key := strings.TrimPrefix(object.Key, backupsPath)
+		name := strings.SplitN(key, "/", 2)[0]
+		name = strings.TrimSuffix(name, SentinelSuffix)
+		report, ok := reports[name]
+		if !ok {
+			continue
+		}
+		class := object.StorageClass
+		if class == "" {
+			class = s3.ObjectStorageClassStandard
+		}
+		report.Classes[class]++
+		if isColdStorageClass(class) {
+			report.Cold = true
+		}
+		if coldAfter > 0 && !object.LastModified.IsZero() && now.Sub(object.LastModified) > coldAfter {
+			report.Cold = true
+		}
+	}
+
+	result := make([]BackupStorageReport, 0, len(backups))
+	for _, b := range backups {
+		report := reports[b.Name]
+		// Guard against cycles of broken names
+		for base, depth := report.DeltaFrom, 0; base != "" && depth < len(backups); depth++ {
+			baseReport, ok := reports[base]
+			if !ok {
+				break
+			}
+			if baseReport.Cold {
+				report.ColdBase = base
+				break
+			}
+			base = baseReport.DeltaFrom
+		}
+		result = append(result, *report)
+	}
+	return result
+}
+
+func formatStorageClasses(classes map[string]int) string {
+	names := make([]string, 0, len(classes))
+	for class := range classes {
+		names = append(names, class)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, class := range names {
+		parts[i] = fmt.Sprintf("%s:%d", class, classes[class])
+	}
+	return strings.Join(parts, ",")
+}
+
+// hasStorageClasses tells whether listing comes from storage with storage classes, S3 only
+func hasStorageClasses(objects []StorageObject) bool {
+	for _, object := range objects {
+		if object.StorageClass != "" {
+			return true
+		}
+	}
+	return len(objects) == 0
+}
+
+// HandleBackupStorageReport is invoked to perform wal-g backup-storage-report.
+// It only lists objects, so it is safe to run against any bucket.
+func HandleBackupStorageReport(pre *Prefix, coldAfter time.Duration) error {
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+	backups, err := bk.GetBackups()
+	if err != nil {
+		return err
+	}
+
+	objects, err := pre.Storage().ListAll(*bk.Path)
+	if err != nil {
+		return errors.Wrap(err, "HandleBackupStorageReport: failed to list backups")
+	}
+	if !hasStorageClasses(objects) {
+		return errors.Wrap(ErrNotS3Storage, "HandleBackupStorageReport: storage classes are reported")
+	}
+
+	reports := BuildBackupStorageReport(backups, objects, *bk.Path, coldAfter, time.Now())
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "name\tlast_modified\tstorage_classes\tcold\tdelta_from\trestorable")
+	for i := len(reports) - 1; i >= 0; i-- {
+		r := reports[i]
+		deltaFrom := "-"
+		if r.DeltaFrom != "" {
+			deltaFrom = r.DeltaFrom
+		}
+		restorable := "yes"
+		if r.Cold {
+			restorable = "no"
+		} else if !r.Restorable() {
+			restorable = "no, base " + r.ColdBase + " is cold"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", r.Name, r.Time.Format(time.RFC3339),
+			formatStorageClasses(r.Classes), r.Cold, deltaFrom, restorable)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package walg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildBackupStorageReport(t *testing.T) {
+	now := time.Date(2018, 10, 17, 12, 0, 0, 0, time.UTC)
+	path := "server/basebackups_005/"
+	backups := []BackupTime{
+		{"base_000000010000000000000008_D_000000010000000000000006", now.Add(-1 * time.Hour), "000000010000000000000008"},
+		{"base_000000010000000000000006_D_000000010000000000000002", now.Add(-24 * time.Hour), "000000010000000000000006"},
+		{"base_000000010000000000000004", now.Add(-48 * time.Hour), "000000010000000000000004"},
+		{"base_000000010000000000000002", now.Add(-40 * 24 * time.Hour), "000000010000000000000002"},
+	}
+	object := func(key string, class string, age time.Duration) StorageObject {
+		return StorageObject{Key: path + key, LastModified: now.Add(-age), StorageClass: class}
+	}
+	objects := []StorageObject{
+		object(backups[0].Name+SentinelSuffix, "", time.Hour),
+		object(backups[0].Name+"/tar_partitions/part_1.tar.lz4", "STANDARD", time.Hour),
+		object(backups[1].Name+SentinelSuffix, "", 24*time.Hour),
+		object(backups[2].Name+SentinelSuffix, "", 48*time.Hour),
+		object(backups[2].Name+"/tar_partitions/part_1.tar.lz4", "STANDARD_IA", 48*time.Hour),
+		object(backups[3].Name+SentinelSuffix, "", 40*24*time.Hour),
+		object(backups[3].Name+"/tar_partitions/part_1.tar.lz4", "GLACIER", 40*24*time.Hour),
+		object(backups[3].Name+"/tar_partitions/part_2.tar.lz4", "GLACIER", 40*24*time.Hour),
+	}
+
+	reports := BuildBackupStorageReport(backups, objects, path, 0, now)
+	if len(reports) != 4 {
+		t.Fatalf("storage report: expected 4 backups, got %v", reports)
+	}
+	if reports[0].DeltaFrom != backups[1].Name || reports[1].DeltaFrom != backups[3].Name || reports[2].DeltaFrom != "" {
+		t.Errorf("storage report: wrong delta bases %v", reports)
+	}
+	if !reports[3].Cold || reports[3].Classes["GLACIER"] != 2 || reports[3].Classes["STANDARD"] != 1 {
+		t.Errorf("storage report: expected full backup in GLACIER to be cold, got %v", reports[3])
+	}
+	// Both deltas depend on the backup in GLACIER
+	if reports[0].Restorable() || reports[0].ColdBase != backups[3].Name || reports[1].ColdBase != backups[3].Name {
+		t.Errorf("storage report: expected deltas to be stranded by cold base, got %v %v", reports[0], reports[1])
+	}
+	if !reports[2].Restorable() || formatStorageClasses(reports[2].Classes) != "STANDARD:1,STANDARD_IA:1" {
+		t.Errorf("storage report: expected full backup in STANDARD_IA to be restorable, got %v", reports[2])
+	}
+
+	// Projected transition of objects older than 30h makes full backup of 48h cold too
+	reports = BuildBackupStorageReport(backups, objects, path, 30*time.Hour, now)
+	if !reports[2].Cold || reports[1].Cold || reports[0].Cold {
+		t.Errorf("storage report: unexpected projection %v", reports)
+	}
+}
@@ -0,0 +1,1271 @@
+package walg_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/wal-g/wal-g"
+)
+
+// mapStorage is StorageBackend keeping objects in memory
+type mapStorage struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *mapStorage) GetArchive(key string) (io.ReadCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, ok := s.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
+
+func (s *mapStorage) Put(key string, r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.objects[key] = body
+	return nil
+}
+
+func (s *mapStorage) Exists(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.objects[key]
+	return ok, nil
+}
+
+func (s *mapStorage) List(prefix string) ([]walg.StorageObject, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var objects []walg.StorageObject
+	for key, body := range s.objects {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") {
+			objects = append(objects, walg.StorageObject{Key: key, LastModified: time.Now(), Size: int64(len(body))})
+		}
+	}
+	return objects, nil
+}
+
+func (s *mapStorage) ListAll(prefix string) ([]walg.StorageObject, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var objects []walg.StorageObject
+	for key, body := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, walg.StorageObject{Key: key, LastModified: time.Now(), Size: int64(len(body))})
+		}
+	}
+	return objects, nil
+}
+
+func (s *mapStorage) Delete(keys []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range keys {
+		delete(s.objects, key)
+	}
+	return nil
+}
+
+func TestStorageBackend(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	walName := "000000010000000000000002"
+	wal := make([]byte, walg.WalSegmentSize)
+	copy(wal, "wal-g")
+	err = ioutil.WriteFile(filepath.Join(dir, walName), wal, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := tu.UploadWal(filepath.Join(dir, walName), pre, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storage.objects[key]; !ok || key != "server/wal_005/"+walName+".lz4" {
+		t.Errorf("storage: expected WAL to be uploaded to backend but got key %s", key)
+	}
+
+	location := filepath.Join(dir, "fetched")
+	if found, err := walg.DownloadWALFile(pre, walName, location); err != nil || !found {
+		t.Fatalf("storage: uploaded WAL is not found in backend")
+	}
+	fetched, err := ioutil.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wal, fetched) {
+		t.Errorf("storage: fetched WAL differs from uploaded one")
+	}
+
+	storage.objects["server/basebackups_005/base_000000010000000000000002"+walg.SentinelSuffix] = []byte("{}")
+	storage.objects["server/basebackups_005/base_000000010000000000000002/tar_partitions/part_1.tar.lz4"] = nil
+	storage.objects["server/basebackups_005/base_000000010000000000000002/tar_partitions/part_2.tar.lz4"] = nil
+	bk := &walg.Backup{Prefix: pre, Path: walg.GetBackupPath(pre), Name: aws.String("base_000000010000000000000002")}
+	backups, err := bk.GetBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Name != "base_000000010000000000000002" {
+		t.Errorf("storage: expected only the sentinel to be listed as backup but got %v", backups)
+	}
+	keys, err := bk.GetKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || !strings.HasSuffix(keys[0], "part_1.tar.lz4") {
+		t.Errorf("storage: expected 2 partitions but got %v", keys)
+	}
+}
+
+func TestBackupFetchStraySentinel(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(data, "global"), 0700)
+	if err = ioutil.WriteFile(filepath.Join(data, "global", "pg_control"), []byte("control"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(data, "PG_VERSION"), []byte("10"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backupName := "base_000000010000000000000002"
+	pushTestBackup(t, tu, pre, data, backupName)
+	// Sorts before partitions and pg_control
+	storage.objects["server/basebackups_005/"+backupName+"/tar_partitions/a"+walg.SentinelSuffix] = []byte("{}")
+
+	bk := &walg.Backup{Prefix: pre, Path: walg.GetBackupPath(pre), Name: aws.String(backupName)}
+	partitions, pgControl, err := bk.GetTarPartitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) == 0 || !strings.HasSuffix(pgControl, "pg_control.tar.lz4") {
+		t.Errorf("storage: expected partitions and pg_control but got %v, %s", partitions, pgControl)
+	}
+	for _, key := range partitions {
+		if strings.HasSuffix(key, walg.SentinelSuffix) || key == pgControl {
+			t.Errorf("storage: %s is listed as data partition", key)
+		}
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if _, err = walg.HandleBackupFetch(backupName, pre, restored, false, walg.BackupFetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if fetched, _ := ioutil.ReadFile(filepath.Join(restored, "global", "pg_control")); string(fetched) != "control" {
+		t.Errorf("storage: restored pg_control differs: %q", fetched)
+	}
+}
+
+func TestBackupFetchMissingPgControl(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(data, "global"), 0700)
+	if err = ioutil.WriteFile(filepath.Join(data, "global", "pg_control"), []byte("control"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(data, "PG_VERSION"), []byte("10"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backups of WAL-G, with start time in name or without, always have pg_control
+	for _, backupName := range []string{"base_20181017T090000Z_000000010000000000000002", "base_000000010000000000000004"} {
+		pushTestBackup(t, tu, pre, data, backupName)
+		delete(storage.objects, "server/basebackups_005/"+backupName+"/tar_partitions/pg_control.tar.lz4")
+		_, err = walg.HandleBackupFetch(backupName, pre, filepath.Join(dir, backupName), false, walg.BackupFetchOptions{})
+		if err == nil || !strings.Contains(err.Error(), "missing pg_control") {
+			t.Errorf("storage: expected missing pg_control of %s to be reported but got %v", backupName, err)
+		}
+	}
+
+	// Backups of WAL-E keep pg_control among other files
+	backupName := "base_000000010000000000000006_00000040"
+	pushTestBackup(t, tu, pre, data, backupName)
+	delete(storage.objects, "server/basebackups_005/"+backupName+"/tar_partitions/pg_control.tar.lz4")
+	_, err = walg.HandleBackupFetch(backupName, pre, filepath.Join(dir, backupName), false, walg.BackupFetchOptions{})
+	if err != nil {
+		t.Errorf("storage: backup of WAL-E without pg_control partition is refused: %v", err)
+	}
+}
+
+func TestBackupFetchDatabaseRestoresPlaceholders(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	files := map[string]string{
+		"PG_VERSION":        "10",
+		"global/pg_control": "control",
+		"base/16384/1259":   "restored database",
+		"base/16500/1259":   "other database",
+		"base/16500/16501":  "other relation",
+		"pg_tblspc/16400/PG_10_201707211/16500/16502": "other database in tablespace",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(data, name)), 0700)
+		if err := ioutil.WriteFile(filepath.Join(data, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backupName := "base_000000010000000000000002"
+	pushTestBackup(t, tu, pre, data, backupName)
+
+	restored := filepath.Join(dir, "restored")
+	_, err = walg.HandleBackupFetch(backupName, pre, restored, false, walg.BackupFetchOptions{DatabaseOID: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		fetched, err := ioutil.ReadFile(filepath.Join(restored, name))
+		if err != nil {
+			t.Errorf("storage: %s is not restored: %v", name, err)
+			continue
+		}
+		if !strings.Contains(name, "16500") {
+			if string(fetched) != content {
+				t.Errorf("storage: restored %s differs: %q", name, fetched)
+			}
+		} else if !bytes.Equal(fetched, make([]byte, len(content))) {
+			t.Errorf("storage: expected %s of other database to be zeroes of its size but got %q", name, fetched)
+		}
+	}
+}
+
+func TestStorageBackendMixedCompression(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "server")
+
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wals := map[string][]byte{}
+	for i, method := range []string{"lz4", "zstd"} {
+		os.Setenv("WALG_COMPRESSION_METHOD", method)
+		walName := fmt.Sprintf("00000001000000000000000%d", i+1)
+		wal := make([]byte, walg.WalSegmentSize)
+		copy(wal, method)
+		wals[walName] = wal
+		err = ioutil.WriteFile(filepath.Join(dir, walName), wal, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tu.UploadWal(filepath.Join(dir, walName), pre, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Unsetenv("WALG_COMPRESSION_METHOD")
+	if _, ok := storage.objects["server/wal_005/000000010000000000000002.zst"]; !ok {
+		t.Errorf("storage: expected zstd WAL to have .zst extension")
+	}
+
+	// Older LZ4 segments are fetched as well after switching to zstd
+	for walName, wal := range wals {
+		location := filepath.Join(dir, walName+".fetched")
+		if found, err := walg.DownloadWALFile(pre, walName, location); err != nil || !found {
+			t.Fatalf("storage: uploaded WAL %s is not found", walName)
+		}
+		fetched, err := ioutil.ReadFile(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(wal, fetched) {
+			t.Errorf("storage: fetched WAL %s differs from uploaded one", walName)
+		}
+	}
+}
+
+func TestGetDeletedSize(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	_, pre := walg.ConfigureStorageBackend(storage, "/server")
+	for key, size := range map[string]int{
+		"server/basebackups_005/base_000000010000000000000002" + walg.SentinelSuffix:                                    10,
+		"server/basebackups_005/base_000000010000000000000002/" + walg.BackupIndexName:                                  20,
+		"server/basebackups_005/base_000000010000000000000002/tar_partitions/part_1.tar.lz4":                            300,
+		"server/basebackups_005/base_000000010000000000000002/tar_partitions/pg_control.tar.lz4":                        40,
+		"server/basebackups_005/base_000000010000000000000008" + walg.SentinelSuffix:                                    1,
+		"server/basebackups_005/base_000000010000000000000008/tar_partitions/part_1.tar.lz4":                            5000,
+		"server/basebackups_005/base_000000010000000000000004_D_000000010000000000000002/tar_partitions/part_1.tar.lz4": 7,
+		"server/wal_005/000000010000000000000002.lz4":                                                                   100,
+		"server/wal_005/000000010000000000000003.lz4":                                                                   100,
+		"server/wal_005/000000010000000000000008.lz4":                                                                   100,
+	} {
+		storage.objects[key] = make([]byte, size)
+	}
+
+	backupBytes, walBytes, err := walg.GetDeletedSize(pre,
+		[]string{"base_000000010000000000000002", "base_000000010000000000000004_D_000000010000000000000002"},
+		"000000010000000000000008", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupBytes != 377 || walBytes != 200 {
+		t.Errorf("delete: expected 377 bytes of backups and 200 bytes of WAL but got %d and %d", backupBytes, walBytes)
+	}
+}
+
+func TestFetchMissingReturnsError(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	_, pre := walg.ConfigureStorageBackend(storage, "/server")
+
+	dir, err := ioutil.TempDir("", "walg_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backupName := "base_000000010000000000000002"
+	_, err = walg.HandleBackupFetch(backupName, pre, filepath.Join(dir, "data"), false, walg.BackupFetchOptions{})
+	if missing, ok := err.(walg.BackupNonExistenceError); !ok || missing.Name != backupName {
+		t.Errorf("storage: expected missing backup error but got %v", err)
+	}
+
+	walName := "000000010000000000000002"
+	err = walg.HandleWALFetch(pre, walName, filepath.Join(dir, walName), false)
+	if missing, ok := err.(walg.ArchiveNonExistenceError); !ok || missing.Name != walName {
+		t.Errorf("storage: expected missing WAL error but got %v", err)
+	}
+}
+
+func TestListArchivedWALSegments(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	_, pre := walg.ConfigureStorageBackend(storage, "/server")
+	for _, key := range []string{
+		"server/wal_005/000000010000000000000001.lz4",
+		"server/wal_005/000000010000000000000002.lzo",
+		"server/wal_005/000000010000000000000003.lz4",
+		"server/wal_005/00000002.history.lz4",
+		"server/wal_005/000000010000000000000004.partial",
+	} {
+		storage.objects[key] = []byte("wal")
+	}
+	// Segment lost from the archive
+	delete(storage.objects, "server/wal_005/000000010000000000000003.lz4")
+
+	archived, err := walg.ListArchivedWALSegments(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{"000000010000000000000001": true, "000000010000000000000002": true}
+	if !reflect.DeepEqual(archived, expected) {
+		t.Errorf("storage: expected archived segments %v but got %v", expected, archived)
+	}
+
+	names, err := walg.GetWALSegmentsInRange("000000010000000000000001", "000000010000000000000004", nil, walg.WalSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := walg.GetWALSegmentRuns(names, archived)
+	if len(runs) != 2 || !runs[1].Missing || runs[1].First != "000000010000000000000003" || runs[1].Count != 2 {
+		t.Errorf("storage: expected segments 3 and 4 to be missing but got %v", runs)
+	}
+
+	if err = walg.HandleWALVerify(pre, "000000010000000000000001", "000000010000000000000002"); err != nil {
+		t.Errorf("storage: wal-verify of archived segments failed: %v", err)
+	}
+	if err = walg.HandleWALVerify(pre, "000000010000000000000001", "000000010000000000000004"); err == nil {
+		t.Errorf("storage: wal-verify of segments with gap succeeded")
+	}
+
+	// Backup of cluster with 64MB segments, whose logical WAL file ends after segment 3F
+	storage.objects["server/basebackups_005/base_00000001000000010000003F"+walg.SentinelSuffix] = []byte(`{"WalSegmentSize":67108864}`)
+	storage.objects["server/wal_005/00000001000000010000003F.lz4"] = []byte("wal")
+	storage.objects["server/wal_005/000000010000000200000000.lz4"] = []byte("wal")
+	if err = walg.HandleWALVerify(pre, "00000001000000010000003F", "000000010000000200000000"); err != nil {
+		t.Errorf("storage: wal-verify of archived 64MB segments failed: %v", err)
+	}
+}
+
+func TestWALVerifyBetweenBackups(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	_, pre := walg.ConfigureStorageBackend(storage, "/server")
+	storage.objects["server/basebackups_005/base_000000010000000000000002"+walg.SentinelSuffix] = []byte(`{"LSN": 33554472, "FinishLSN": 33554688}`)
+	storage.objects["server/basebackups_005/base_000000010000000000000005"+walg.SentinelSuffix] = []byte(`{"LSN": 83886120, "FinishLSN": 83886336}`)
+	for _, segment := range []string{"2", "3", "5"} {
+		storage.objects["server/wal_005/00000001000000000000000"+segment+".lz4"] = []byte("wal")
+	}
+
+	err := walg.HandleWALVerifyBetween(pre, "base_000000010000000000000002", "base_000000010000000000000005")
+	if err == nil || !strings.Contains(err.Error(), "1 of 4 segments are missing") {
+		t.Errorf("storage: expected gap of segment 4 but got %v", err)
+	}
+	storage.objects["server/wal_005/000000010000000000000004.lz4"] = []byte("wal")
+	if err = walg.HandleWALVerifyBetween(pre, "base_000000010000000000000002", "base_000000010000000000000005"); err != nil {
+		t.Errorf("storage: wal-verify-between of complete WAL failed: %v", err)
+	}
+	if err = walg.HandleWALVerifyBetween(pre, "base_000000010000000000000003", "base_000000010000000000000005"); err == nil {
+		t.Errorf("storage: wal-verify-between from missing backup succeeded")
+	}
+	if err = walg.HandleBackupWALRange(pre, "base_000000010000000000000003"); err == nil {
+		t.Errorf("storage: backup-wal-range of missing backup succeeded")
+	}
+}
+
+func TestTimelineHistoryFetch(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+
+	dir, err := ioutil.TempDir("", "walg_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Replica promoted in the middle of segment 3 of timeline 1
+	for name, content := range map[string]string{
+		"00000002.history": "1\t0/3000100\tno recovery target specified\n",
+		"00000003.history": "broken",
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tu.UploadWal(filepath.Join(dir, name), pre, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"000000010000000000000002", "000000010000000000000003", "000000020000000000000003", "000000020000000000000004"} {
+		storage.objects["server/wal_005/"+name+".lz4"] = []byte("wal")
+	}
+
+	location := filepath.Join(dir, "fetched.history")
+	if found, err := walg.DownloadWALFile(pre, "00000002.history", location); err != nil || !found {
+		t.Fatalf("storage: history file is not fetched: %v", err)
+	}
+	fetched, _ := ioutil.ReadFile(location)
+	if string(fetched) != "1\t0/3000100\tno recovery target specified\n" {
+		t.Errorf("storage: fetched history differs: %q", fetched)
+	}
+	if _, err := walg.DownloadWALFile(pre, "00000003.history", filepath.Join(dir, "broken.history")); err == nil {
+		t.Errorf("storage: expected invalid history to be rejected")
+	}
+
+	if err = walg.HandleTimelineList(pre); err == nil {
+		t.Errorf("storage: expected timeline-list to fail on invalid history")
+	}
+	delete(storage.objects, "server/wal_005/00000003.history.lz4")
+	if err = walg.HandleTimelineList(pre); err != nil {
+		t.Errorf("storage: timeline-list failed: %v", err)
+	}
+	timelines, err := walg.ListTimelines(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []walg.TimelineInfo{
+		{Timeline: 1, SegmentCount: 2, FirstSegment: "000000010000000000000002", LastSegment: "000000010000000000000003"},
+		{Timeline: 2, HasHistory: true, Parent: 1, SwitchLSN: 0x3000100, SegmentCount: 2, FirstSegment: "000000020000000000000003", LastSegment: "000000020000000000000004"},
+	}
+	if !reflect.DeepEqual(timelines, expected) {
+		t.Errorf("storage: expected timelines %+v but got %+v", expected, timelines)
+	}
+}
+
+func TestWALShow(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Promoted in the middle of segment 5 of timeline 1, segments are compressed by different versions
+	history := filepath.Join(dir, "00000002.history")
+	if err = ioutil.WriteFile(history, []byte("1\t0/5000100\tno recovery target specified\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tu.UploadWal(history, pre, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"000000010000000000000002.lzo", "000000010000000000000003.lz4", "000000010000000000000005.lz4",
+		"000000020000000000000005.lz4", "000000020000000000000006.lz4", "000000020000000000000009.lz4",
+	} {
+		storage.objects["server/wal_005/"+name] = []byte("wal")
+	}
+
+	timelines, err := walg.ShowWAL(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []walg.WALShowTimeline{
+		{
+			TimelineInfo: walg.TimelineInfo{Timeline: 1, SegmentCount: 3, FirstSegment: "000000010000000000000002", LastSegment: "000000010000000000000005"},
+			Gaps:         []walg.WALSegmentRun{{First: "000000010000000000000004", Last: "000000010000000000000004", Count: 1, Missing: true}},
+		},
+		{
+			TimelineInfo: walg.TimelineInfo{Timeline: 2, HasHistory: true, Parent: 1, SwitchLSN: 0x5000100, SegmentCount: 3, FirstSegment: "000000020000000000000005", LastSegment: "000000020000000000000009"},
+			HistoryFile:  "00000002.history",
+			Gaps:         []walg.WALSegmentRun{{First: "000000020000000000000007", Last: "000000020000000000000008", Count: 2, Missing: true}},
+		},
+	}
+	if !reflect.DeepEqual(timelines, expected) {
+		t.Errorf("storage: expected WAL %+v but got %+v", expected, timelines)
+	}
+
+	if err = walg.HandleWALShow(pre, true); err != nil {
+		t.Errorf("storage: wal-show failed: %v", err)
+	}
+	storage.objects["server/wal_005/00000003.history.lz4"] = []byte("broken")
+	if err = walg.HandleWALShow(pre, false); err == nil {
+		t.Errorf("storage: expected wal-show to fail on unreadable history")
+	}
+}
+
+func TestWALShowOfOtherSegmentSize(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Without backups size is read from header of the first segment, 1MB with long header of first page
+	wal := make([]byte, 1<<20)
+	binary.LittleEndian.PutUint16(wal[2:], 0x0002)
+	binary.LittleEndian.PutUint32(wal[32:], 1<<20)
+	if err = ioutil.WriteFile(filepath.Join(dir, "0000000100000001000000FF"), wal, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tu.UploadWal(filepath.Join(dir, "0000000100000001000000FF"), pre, false); err != nil {
+		t.Fatal(err)
+	}
+	storage.objects["server/wal_005/000000010000000100000101.lz4"] = []byte("wal")
+	timelines, err := walg.ShowWAL(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []walg.WALSegmentRun{{First: "000000010000000100000100", Last: "000000010000000100000100", Count: 1, Missing: true}}
+	if len(timelines) != 1 || !reflect.DeepEqual(timelines[0].Gaps, expected) {
+		t.Errorf("storage: expected gap of 1MB segment %+v but got %+v", expected, timelines)
+	}
+
+	// Sentinel of backup tells size of segments, 64 of 64MB make a logical WAL file
+	for key := range storage.objects {
+		delete(storage.objects, key)
+	}
+	storage.objects["server/basebackups_005/base_00000001000000010000003F"+walg.SentinelSuffix] = []byte(`{"WalSegmentSize":67108864}`)
+	storage.objects["server/wal_005/00000001000000010000003F.lz4"] = []byte("wal")
+	storage.objects["server/wal_005/000000010000000200000000.lz4"] = []byte("wal")
+	if timelines, err = walg.ShowWAL(pre); err != nil {
+		t.Fatal(err)
+	}
+	if len(timelines) != 1 || len(timelines[0].Gaps) != 0 {
+		t.Errorf("storage: expected no gaps between 64MB segments but got %+v", timelines)
+	}
+}
+
+func TestRestorePointHandlersReturnErrors(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+
+	if err := walg.HandleRestorePointCreate(tu, pre, "before/upgrade"); err == nil {
+		t.Errorf("storage: expected restore point name with '/' to be rejected")
+	}
+	storage.objects["server/restore_points_005/before_upgrade.json"] = []byte(`{"name":"before_upgrade","lsn":83886336,"timeline":1}`)
+	if err := walg.HandleRestorePointList(pre); err != nil {
+		t.Errorf("storage: restore-point-list failed: %v", err)
+	}
+	storage.objects["server/restore_points_005/broken.json"] = []byte("broken")
+	if err := walg.HandleRestorePointList(pre); err == nil {
+		t.Errorf("storage: expected restore-point-list to fail on unreadable restore point")
+	}
+}
+
+func TestBackupStorageReportWithoutStorageClasses(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	_, pre := walg.ConfigureStorageBackend(storage, "/server")
+	storage.objects["server/basebackups_005/base_000000010000000000000002"+walg.SentinelSuffix] = []byte("{}")
+
+	err := walg.HandleBackupStorageReport(pre, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), walg.ErrNotS3Storage.Error()) {
+		t.Errorf("storage: expected report without storage classes to fail with %v but got %v", walg.ErrNotS3Storage, err)
+	}
+}
+
+func TestWALPrefetchConcurrency(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walDir := filepath.Join(dir, "pg_wal")
+	prefetchDir := filepath.Join(dir, "prefetch")
+	os.MkdirAll(walDir, 0700)
+	os.Setenv("WALG_PREFETCH_DIR", prefetchDir)
+	defer os.Unsetenv("WALG_PREFETCH_DIR")
+	os.Setenv("WALG_PREFETCH_COUNT", "4")
+	defer os.Unsetenv("WALG_PREFETCH_COUNT")
+	os.Setenv("WALG_PREFETCH_CONCURRENCY", "2")
+	defer os.Unsetenv("WALG_PREFETCH_CONCURRENCY")
+
+	segment := make([]byte, walg.WalSegmentSize)
+	segment[0], segment[1] = 0x97, 0xD0
+	names := []string{"000000010000000000000003", "000000010000000000000004", "000000010000000000000005", "000000010000000000000006", "000000010000000000000007"}
+	for _, name := range names {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), segment, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tu.UploadWal(filepath.Join(dir, name), pre, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Segment 5 is being downloaded by prefetch of another wal-fetch
+	running := filepath.Join(prefetchDir, "running", names[3])
+	os.MkdirAll(filepath.Dir(running), 0700)
+	if err = ioutil.WriteFile(running, []byte("in progress"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	walg.HandleWALPrefetch(pre, names[0], filepath.Join(walDir, "RECOVERYXLOG"))
+
+	for _, name := range []string{names[1], names[2], names[4]} {
+		if _, err := os.Stat(filepath.Join(prefetchDir, name)); err != nil {
+			t.Errorf("prefetch: %s is not prefetched: %v", name, err)
+		}
+	}
+	if content, _ := ioutil.ReadFile(running); string(content) != "in progress" {
+		t.Errorf("prefetch: download of another prefetch is disturbed: %q", content)
+	}
+
+	location := filepath.Join(walDir, names[1])
+	if err = walg.HandleWALFetch(pre, names[1], location, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(prefetchDir, names[1])); !os.IsNotExist(err) {
+		t.Errorf("prefetch: prefetched segment is not taken by wal-fetch: %v", err)
+	}
+}
+
+func TestWALFetchCleansPrefetchAfterTimelineSwitch(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walDir := filepath.Join(dir, "pg_wal")
+	prefetchDir := filepath.Join(walDir, ".wal-g", "prefetch")
+	os.MkdirAll(filepath.Join(prefetchDir, "running"), 0700)
+
+	segment := make([]byte, walg.WalSegmentSize)
+	segment[0], segment[1] = 0x97, 0xD0
+	walName := "000000020000000100000000"
+	if err = ioutil.WriteFile(filepath.Join(dir, walName), segment, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tu.UploadWal(filepath.Join(dir, walName), pre, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay switched to timeline 2 at the end of log 0, prefetch of timeline 1 went on
+	files := map[string]bool{
+		"0000000100000000000000FF":         false,
+		"000000010000000100000000":         false,
+		"running/000000010000000100000001": false,
+		"0000000200000000000000FF":         false,
+		"000000020000000100000001":         true,
+		"running/000000020000000100000002": true,
+		"00000003.history":                 true,
+	}
+	for name := range files {
+		if err = ioutil.WriteFile(filepath.Join(prefetchDir, name), []byte("wal"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = walg.HandleWALFetch(pre, walName, filepath.Join(walDir, walName), false); err != nil {
+		t.Fatal(err)
+	}
+	for name, kept := range files {
+		if _, err := os.Stat(filepath.Join(prefetchDir, name)); os.IsNotExist(err) == kept {
+			t.Errorf("prefetch: expected %s kept %v, but got %v", name, kept, err)
+		}
+	}
+}
+
+func TestAESPushFetch(t *testing.T) {
+	os.Setenv("WALG_AES_KEY", strings.Repeat("42", 32))
+	defer os.Unsetenv("WALG_AES_KEY")
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+
+	dir, err := ioutil.TempDir("", "walg_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "1\t0/3000100\tno recovery target specified\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "00000002.history"), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tu.UploadWal(filepath.Join(dir, "00000002.history"), pre, false); err != nil {
+		t.Fatal(err)
+	}
+	for key, body := range storage.objects {
+		if len(body) == 0 || body[0] != 0x01 || bytes.Contains(body, []byte("recovery")) {
+			t.Errorf("storage: %s is not encrypted by AES", key)
+		}
+	}
+
+	location := filepath.Join(dir, "fetched.history")
+	if found, err := walg.DownloadWALFile(pre, "00000002.history", location); err != nil || !found {
+		t.Fatalf("storage: AES encrypted file is not fetched: %v", err)
+	}
+	fetched, _ := ioutil.ReadFile(location)
+	if string(fetched) != content {
+		t.Errorf("storage: fetched file differs: %q", fetched)
+	}
+}
+
+// Backup pushed with KMS is restored, while its data key is stored only encrypted by KMS
+func TestKMSBackupPushFetch(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+
+	dir, err := ioutil.TempDir("", "walg_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	files := map[string]string{"base/1/1259": "relation", "global/pg_control": "control"}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(data, name)), 0700)
+		if err := ioutil.WriteFile(filepath.Join(data, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := walg.NewMockKMSClient()
+	crypter := walg.NewKMSCrypter("alias/walg", client)
+	crypter.IsUsed()
+	dataKey, err := crypter.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := crypter.WrapDataKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypter.SetDataKey(dataKey)
+
+	backupName := "base_000000010000000000000002"
+	bundle := &walg.Bundle{MinSize: 10, Files: &sync.Map{}, Crypter: crypter}
+	bundle.Tbm = &walg.S3TarBallMaker{BaseDir: "data", Trim: data, BkupName: backupName, Tu: tu}
+	bundle.StartQueue()
+	if err = filepath.Walk(data, bundle.TarWalker); err != nil {
+		t.Fatal(err)
+	}
+	if err = bundle.FinishQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if err = bundle.HandleSentinel(); err != nil {
+		t.Fatal(err)
+	}
+	tu.Finish()
+
+	for key, body := range storage.objects {
+		if bytes.Contains(body, dataKey) {
+			t.Errorf("storage: plaintext data key is stored in %s", key)
+		}
+	}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if content, _ := ioutil.ReadFile(path); bytes.Contains(content, dataKey) {
+			t.Errorf("storage: plaintext data key is written to %s", path)
+		}
+		return nil
+	})
+
+	// Restore as backup-fetch does, with data key decrypted by KMS
+	fetcher := walg.NewKMSCrypter("alias/walg", client)
+	fetcher.IsUsed()
+	key, err := fetcher.UnwrapDataKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher.SetDataKey(key)
+	bk := &walg.Backup{Prefix: pre, Path: walg.GetBackupPath(pre), Name: aws.String(backupName)}
+	keys, err := bk.GetKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partitions []walg.ReaderMaker
+	for _, key := range keys {
+		partitions = append(partitions, &walg.S3ReaderMaker{Backup: bk, Key: aws.String(key), FileFormat: "lz4"})
+	}
+	restored := filepath.Join(dir, "restored")
+	err = walg.ExtractBackup(&walg.FileTarInterpreter{NewDir: restored}, partitions, nil, fetcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if fetched, _ := ioutil.ReadFile(filepath.Join(restored, name)); string(fetched) != content {
+			t.Errorf("storage: restored %s differs: %q", name, fetched)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	_, pre := walg.ConfigureStorageBackend(storage, "/server")
+	for key, size := range map[string]int{
+		"server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json":     10,
+		"server/basebackups_005/base_000000010000000000000002/tar_partitions/part_1.tar.lz4": 100,
+		// Unfinished backup has no sentinel
+		"server/basebackups_005/base_000000010000000000000004/tar_partitions/part_1.tar.lz4": 100,
+		"server/wal_005/000000010000000000000002.lz4":                                        50,
+		"server/wal_005/000000010000000000000003.lz4":                                        50,
+		"server/delete_marks_005/base_000000010000000000000002.json":                         5,
+		"server/backup_push.lock":                                                            20,
+		"server/restore_points_005/before_upgrade.json":                                      10,
+		"other_server/wal_005/000000010000000000000002.lz4":                                  50,
+		// Another cluster nested in prefix and objects of other tools are not wal-g's to purge
+		"server/nested/wal_005/000000010000000000000002.lz4": 50,
+		"server/notes.txt": 5,
+	} {
+		storage.objects[key] = make([]byte, size)
+	}
+
+	targets, err := walg.ListPurgeTargets(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	var bytes int64
+	for _, target := range targets {
+		count += target.Count
+		bytes += target.Bytes
+	}
+	if count != 8 || bytes != 345 {
+		t.Errorf("purge: expected 8 objects of 345 bytes but got %d of %d", count, bytes)
+	}
+
+	if err = walg.HandlePurge(pre, nil, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.objects) != 11 {
+		t.Errorf("purge: dry run deleted %d objects", 11-len(storage.objects))
+	}
+
+	if err = walg.HandlePurge(pre, nil, false, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{
+		"other_server/wal_005/000000010000000000000002.lz4",
+		"server/nested/wal_005/000000010000000000000002.lz4",
+		"server/notes.txt",
+	} {
+		if storage.objects[key] == nil {
+			t.Errorf("purge: expected %s kept", key)
+		}
+	}
+	if len(storage.objects) != 3 {
+		t.Errorf("purge: expected only objects other than wal-g's kept but got %d objects", len(storage.objects))
+	}
+}
+
+func TestPurgePermanentBackups(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	for _, key := range []string{
+		"server/basebackups_005/base_000000010000000000000002_backup_stop_sentinel.json",
+		"server/basebackups_005/base_000000010000000000000002/tar_partitions/part_1.tar.lz4",
+		"server/basebackups_005/base_000000010000000000000004_backup_stop_sentinel.json",
+		"server/basebackups_005/base_000000010000000000000004/tar_partitions/part_1.tar.lz4",
+		"server/wal_005/000000010000000000000002.lz4",
+	} {
+		storage.objects[key] = []byte("{}")
+	}
+	if err := walg.MarkBackup(tu, pre, "base_000000010000000000000002", true); err != nil {
+		t.Fatal(err)
+	}
+	objects := len(storage.objects)
+
+	err := walg.HandlePurge(pre, nil, false, false)
+	if err == nil || !strings.Contains(err.Error(), "base_000000010000000000000002") {
+		t.Errorf("purge: expected permanent backup to be refused but got %v", err)
+	}
+	if len(storage.objects) != objects {
+		t.Errorf("purge: %d objects deleted despite permanent backup", objects-len(storage.objects))
+	}
+
+	// Soft delete only marks backups, permanent one loses its mark with force
+	if err = walg.HandlePurge(pre, tu, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.objects) != objects+1 {
+		t.Errorf("purge: expected soft delete to replace permanent mark with 2 delete marks, got %d objects instead of %d", len(storage.objects), objects+1)
+	}
+	marks, err := walg.GetDeleteMarks(pre)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 2 {
+		t.Errorf("purge: expected both backups to be marked but got %v", marks)
+	}
+	if permanent, _ := walg.IsBackupPermanent(pre, "base_000000010000000000000002"); permanent {
+		t.Errorf("purge: permanent mark is kept with force")
+	}
+
+	if err = walg.HandlePurge(pre, nil, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.objects) != 0 {
+		t.Errorf("purge: expected everything deleted with force but got %d objects", len(storage.objects))
+	}
+}
+
+// throttlingS3Client fails that many HEAD and GET requests with SlowDown before serving them
+type throttlingS3Client struct {
+	*memoryS3Client
+	throttle int
+	calls    int
+}
+
+func (c *throttlingS3Client) throttled() error {
+	c.calls++
+	if c.throttle > 0 {
+		c.throttle--
+		return awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "request")
+	}
+	return nil
+}
+
+func (c *throttlingS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if err := c.throttled(); err != nil {
+		return nil, err
+	}
+	return c.memoryS3Client.HeadObject(input)
+}
+
+func (c *throttlingS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if err := c.throttled(); err != nil {
+		return nil, err
+	}
+	return c.memoryS3Client.GetObject(input)
+}
+
+func TestS3RetryThrottling(t *testing.T) {
+	client := &throttlingS3Client{memoryS3Client: newMemoryS3Client()}
+	client.objects["server/wal_005/000000010000000000000001.lz4"] = []byte("wal")
+	pre := &walg.Prefix{Svc: client, Bucket: aws.String("bucket"), Server: aws.String("server")}
+	archive := &walg.Archive{Prefix: pre, Archive: aws.String("server/wal_005/000000010000000000000001.lz4")}
+
+	client.throttle = 2
+	exists, err := archive.CheckExistence()
+	if err != nil || !exists {
+		t.Errorf("storage: throttled CheckExistence returned %v, %v", exists, err)
+	}
+	if client.calls != 3 {
+		t.Errorf("storage: expected 3 HEAD requests but got %d", client.calls)
+	}
+
+	client.throttle, client.calls = 2, 0
+	reader, err := archive.GetArchive()
+	if err != nil {
+		t.Fatalf("storage: throttled GetArchive failed: %v", err)
+	}
+	if body, _ := ioutil.ReadAll(reader); string(body) != "wal" {
+		t.Errorf("storage: GetArchive returned %q", body)
+	}
+
+	// Missing object is not retried
+	client.calls = 0
+	missing := &walg.Archive{Prefix: pre, Archive: aws.String("server/wal_005/000000010000000000000002.lz4")}
+	exists, err = missing.CheckExistence()
+	if err != nil || exists {
+		t.Errorf("storage: missing object CheckExistence returned %v, %v", exists, err)
+	}
+	if client.calls != 1 {
+		t.Errorf("storage: missing object was requested %d times", client.calls)
+	}
+
+	os.Setenv("WALG_S3_MAX_RETRIES", "1")
+	defer os.Unsetenv("WALG_S3_MAX_RETRIES")
+	client.throttle, client.calls = 5, 0
+	if _, err = archive.CheckExistence(); err == nil {
+		t.Errorf("storage: CheckExistence succeeded beyond WALG_S3_MAX_RETRIES")
+	}
+	if client.calls != 2 {
+		t.Errorf("storage: expected 2 HEAD requests with WALG_S3_MAX_RETRIES=1 but got %d", client.calls)
+	}
+}
+
+// retryOptionsS3Uploader records how many retries the client of uploader makes for each uploaded key
+type retryOptionsS3Uploader struct {
+	mockS3Uploader
+	retries map[string]int
+}
+
+func (u *retryOptionsS3Uploader) Upload(input *s3manager.UploadInput, f ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	uploader := &s3manager.Uploader{}
+	for _, option := range f {
+		option(uploader)
+	}
+	req := &request.Request{Retryer: client.DefaultRetryer{}}
+	for _, option := range uploader.RequestOptions {
+		option(req)
+	}
+	u.retries[*input.Key] = req.MaxRetries()
+	return u.mockS3Uploader.Upload(input, f...)
+}
+
+func TestS3RetriesInOneLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg_retries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walName := "000000010000000000000001"
+	if err = ioutil.WriteFile(filepath.Join(dir, walName), make([]byte, 1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("WALG_S3_MAX_RETRIES", "3")
+	defer os.Unsetenv("WALG_S3_MAX_RETRIES")
+
+	uploader := &retryOptionsS3Uploader{retries: make(map[string]int)}
+	tu := walg.NewTarUploader(&mockS3Client{}, "bucket", "server", "region")
+	tu.Upl = uploader
+	key, err := tu.UploadWal(filepath.Join(dir, walName), nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streamed WAL is retried by SDK only, its small checksum is seekable and retried by wal-g only
+	for uploaded, retries := range uploader.retries {
+		expected := 0
+		if uploaded == key {
+			expected = 3
+		}
+		if retries != expected {
+			t.Errorf("storage: expected %d SDK retries of %s but got %d", expected, uploaded, retries)
+		}
+	}
+	if _, ok := uploader.retries[key]; !ok || len(uploader.retries) < 2 {
+		t.Errorf("storage: expected WAL and its checksum uploaded but got %v", uploader.retries)
+	}
+}
+
+// corruptOnceStorage serves corrupted body of key for the first download only
+type corruptOnceStorage struct {
+	*mapStorage
+	key     string
+	body    []byte
+	corrupt bool
+}
+
+func (s *corruptOnceStorage) GetArchive(key string) (io.ReadCloser, error) {
+	if key == s.key && !s.corrupt {
+		s.corrupt = true
+		return ioutil.NopCloser(bytes.NewReader(s.body)), nil
+	}
+	return s.mapStorage.GetArchive(key)
+}
+
+func TestWALFetchVerifiesChecksum(t *testing.T) {
+	storage := &corruptOnceStorage{mapStorage: &mapStorage{objects: make(map[string][]byte)}}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	walName := "000000010000000000000003"
+	segment := make([]byte, walg.WalSegmentSize)
+	segment[0], segment[1] = 0x97, 0xD0
+	if err = ioutil.WriteFile(filepath.Join(dir, walName), segment, 0600); err != nil {
+		t.Fatal(err)
+	}
+	archivePath, err := tu.UploadWal(filepath.Join(dir, walName), pre, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksumKey := "server/wal_005/" + walName + ".crc32"
+	checksum, ok := storage.objects[checksumKey]
+	if !ok {
+		t.Fatalf("storage: checksum of %s is not uploaded", walName)
+	}
+	archive := storage.objects[archivePath]
+	original := append([]byte(nil), segment...)
+
+	// Archive of segment with valid header but other bytes in the middle
+	copy(segment[walg.WalSegmentSize/2:], "corrupted")
+	if err = ioutil.WriteFile(filepath.Join(dir, walName), segment, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tu.UploadWal(filepath.Join(dir, walName), pre, false); err != nil {
+		t.Fatal(err)
+	}
+	storage.objects[checksumKey] = checksum
+
+	location := filepath.Join(dir, "fetched")
+	err = walg.HandleWALFetch(pre, walName, location, false)
+	if _, ok := err.(walg.WALChecksumMismatchError); !ok {
+		t.Errorf("storage: expected WALChecksumMismatchError but got %v", err)
+	}
+	if _, err = os.Stat(location); !os.IsNotExist(err) {
+		t.Errorf("storage: corrupted file is left at %s: %v", location, err)
+	}
+
+	// Corruption on the way is fixed by downloading again
+	storage.key, storage.body = archivePath, storage.objects[archivePath]
+	storage.objects[archivePath] = archive
+	if found, err := walg.DownloadWALFile(pre, walName, location); err != nil || !found {
+		t.Fatalf("storage: expected file to be downloaded again but got %v", err)
+	}
+	fetched, _ := ioutil.ReadFile(location)
+	if !storage.corrupt || !bytes.Equal(fetched, original) {
+		t.Errorf("storage: expected fetched file to be downloaded again without corruption")
+	}
+}
+
+func TestWALPrefetchRange(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walDir := filepath.Join(dir, "pg_wal")
+	if err = os.MkdirAll(walDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"000000010000000000000003", "000000010000000000000004", "000000010000000000000005"}
+	segment := make([]byte, walg.WalSegmentSize)
+	segment[0], segment[1] = 0x97, 0xD0
+	for _, name := range names {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), segment, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tu.UploadWal(filepath.Join(dir, name), pre, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = walg.HandleWALPrefetchRange(pre, names[0], 0, walDir); err == nil {
+		t.Errorf("prefetch: expected error for zero segments")
+	}
+	// Segment after the archived ones is not there yet
+	prefetched, err := walg.HandleWALPrefetchRange(pre, names[0], len(names)+1, walDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefetched != len(names) {
+		t.Errorf("prefetch: expected %d segments prefetched but got %d", len(names), prefetched)
+	}
+
+	// Restoration takes segments from the cache without storage
+	for key := range storage.objects {
+		delete(storage.objects, key)
+	}
+	for _, name := range names {
+		location := filepath.Join(walDir, "RECOVERYXLOG")
+		if err = walg.HandleWALFetch(pre, name, location, false); err != nil {
+			t.Fatalf("prefetch: %s is not fetched from cache: %v", name, err)
+		}
+		if info, err := os.Stat(location); err != nil || info.Size() != int64(walg.WalSegmentSize) {
+			t.Errorf("prefetch: unexpected file fetched for %s: %v", name, err)
+		}
+		os.Remove(location)
+	}
+}
+
+func TestWALSubpath(t *testing.T) {
+	os.Setenv("WALG_WAL_SUBPATH", "/archive/wal/")
+	defer os.Unsetenv("WALG_WAL_SUBPATH")
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_subpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	walName := "000000010000000000000003"
+	segment := make([]byte, walg.WalSegmentSize)
+	segment[0], segment[1] = 0x97, 0xD0
+	if err = ioutil.WriteFile(filepath.Join(dir, walName), segment, 0600); err != nil {
+		t.Fatal(err)
+	}
+	archivePath, err := tu.UploadWal(filepath.Join(dir, walName), pre, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(archivePath, "server/archive/wal/"+walName+".") {
+		t.Errorf("storage: expected WAL pushed to server/archive/wal/ but got %s", archivePath)
+	}
+	for key := range storage.objects {
+		if strings.Contains(key, "wal_005") {
+			t.Errorf("storage: %s is pushed to default WAL folder", key)
+		}
+	}
+
+	location := filepath.Join(dir, "fetched")
+	if err = walg.HandleWALFetch(pre, walName, location, false); err != nil {
+		t.Fatal(err)
+	}
+	if fetched, _ := ioutil.ReadFile(location); !bytes.Equal(fetched, segment) {
+		t.Errorf("storage: fetched WAL differs from pushed one")
+	}
+	if segments, err := walg.ListArchivedWALSegments(pre); err != nil || len(segments) != 1 {
+		t.Errorf("storage: expected pushed segment listed but got %v, %v", segments, err)
+	}
+}
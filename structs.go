@@ -9,11 +9,10 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 	"github.com/pkg/errors"
 )
@@ -58,13 +57,21 @@ type TarBundle interface {
 	NewTarBall(dedicatedUploader bool)
 	GetIncrementBaseLsn() *uint64
 	GetIncrementBaseFiles() BackupFileList
+	IsStrictDelta() bool
+	IsCatchup() bool
 
 	StartQueue()
 	Deque() TarBall
 	EnqueueBack(tb TarBall, parallelOpInProgress *bool)
 	CheckSizeAndEnqueueBack(tb TarBall) error
+	IsSmallFile(size int64) bool
+	PackSmallFile(pack func(TarBall) error) error
 	FinishQueue() error
+	ReportWorkerError(err error)
 	GetFiles() *sync.Map
+	GetManifest() *BackupManifest
+	GetTornPageDetector() *TornPageDetector
+	GetProgress() *ProgressReporter
 }
 
 // A Bundle represents the directory to
@@ -72,17 +79,31 @@ type TarBundle interface {
 // if walk has started. Each TarBall will be at least
 // MinSize bytes. The Sentinel is used to ensure complete
 // uploaded backups; in this case, pg_control is used as
-// the sentinel.
+// the sentinel. Files smaller than SmallFileSize are packed
+// together into their own partitions, zero disables this.
 type Bundle struct {
 	MinSize            int64
+	SmallFileSize      int64
 	Sen                *Sentinel
 	Tb                 TarBall
 	Tbm                TarBallMaker
-	Crypter            OpenPGPCrypter
+	Crypter            Crypter
 	Timeline           uint32
 	Replica            bool
+	WalSegmentSize     uint64
 	IncrementFromLsn   *uint64
 	IncrementFromFiles BackupFileList
+	StrictDelta        bool
+	// Catchup packs changed pages of all paged files, the base is a replica whose files are unknown
+	Catchup bool
+	// Manifest collects checksums of files for backup_manifest, nil if it is not made
+	Manifest *BackupManifest
+	// TornPages checks pages of relation files read during walk, nil if it is disabled
+	TornPages *TornPageDetector
+	// Progress accounts files walked, nil if progress is not reported
+	Progress *ProgressReporter
+	// Tablespaces maps OIDs of tablespaces linked from pg_tblspc to their locations
+	Tablespaces map[uint32]string
 
 	tarballQueue     chan (TarBall)
 	uploadQueue      chan (TarBall)
@@ -90,16 +111,28 @@ type Bundle struct {
 	maxUploadQueue   int
 	mutex            sync.Mutex
 	started          bool
+	tarSize          int64
+	smallTarBall     TarBall
+	smallMutex       sync.Mutex
+	// workerErr is the first failure of files packed in background, see ReportWorkerError
+	workerErr   error
+	workerMutex sync.Mutex
 
 	Files *sync.Map
 }
 
 func (b *Bundle) GetFiles() *sync.Map { return b.Files }
 
+// TarSize returns number of bytes written to closed tarballs so far
+func (b *Bundle) TarSize() int64 { return atomic.LoadInt64(&b.tarSize) }
+
 func (b *Bundle) StartQueue() {
 	if b.started {
 		panic("Trying to start already started Queue")
 	}
+	if b.Crypter == nil {
+		b.Crypter = NewCrypter()
+	}
 	b.parallelTarballs = getMaxUploadDiskConcurrency()
 	b.maxUploadQueue = getMaxUploadQueue()
 	b.tarballQueue = make(chan (TarBall), b.parallelTarballs)
@@ -124,15 +157,6 @@ func (b *Bundle) FinishQueue() error {
 	}
 	b.started = false
 
-	// At this point no new tarballs should be put into uploadQueue
-	for len(b.uploadQueue) > 0 {
-		select {
-		case otb := <-b.uploadQueue:
-			otb.AwaitUploads()
-		default:
-		}
-	}
-
 	// We have to deque exactly this count of workers
 	for i := 0; i < b.parallelTarballs; i++ {
 		tb := <-b.tarballQueue
@@ -140,13 +164,47 @@ func (b *Bundle) FinishQueue() error {
 			// This had written nothing
 			continue
 		}
+		atomic.AddInt64(&b.tarSize, tb.Size())
 		err := tb.CloseTar()
 		if err != nil {
 			return errors.Wrap(err, "TarWalker: failed to close tarball")
 		}
 		tb.AwaitUploads()
 	}
-	return nil
+
+	// Workers have returned their tarballs, so no new tarballs are put into uploadQueue.
+	// A worker may have queued a full tarball just before returning, it is awaited too.
+	for len(b.uploadQueue) > 0 {
+		otb := <-b.uploadQueue
+		otb.AwaitUploads()
+	}
+
+	if b.smallTarBall != nil {
+		atomic.AddInt64(&b.tarSize, b.smallTarBall.Size())
+		err := b.smallTarBall.CloseTar()
+		if err != nil {
+			return errors.Wrap(err, "TarWalker: failed to close tarball of small files")
+		}
+		b.smallTarBall.AwaitUploads()
+		b.smallTarBall = nil
+	}
+	return b.workerError()
+}
+
+// ReportWorkerError records failure of file packed in background. Walk stops at the
+// next file and FinishQueue returns the first failure once all workers are done.
+func (b *Bundle) ReportWorkerError(err error) {
+	b.workerMutex.Lock()
+	defer b.workerMutex.Unlock()
+	if b.workerErr == nil {
+		b.workerErr = err
+	}
+}
+
+func (b *Bundle) workerError() error {
+	b.workerMutex.Lock()
+	defer b.workerMutex.Unlock()
+	return b.workerErr
 }
 
 func (b *Bundle) EnqueueBack(tb TarBall, parallelOpInProgress *bool) {
@@ -160,18 +218,11 @@ func (b *Bundle) CheckSizeAndEnqueueBack(tb TarBall) error {
 		b.mutex.Lock()
 		defer b.mutex.Unlock()
 
-		err := tb.CloseTar()
+		err := b.closeAndQueueUpload(tb)
 		if err != nil {
-			return errors.Wrap(err, "TarWalker: failed to close tarball")
-		}
-
-		b.uploadQueue <- tb
-		for len(b.uploadQueue) > b.maxUploadQueue {
-			select {
-			case otb := <-b.uploadQueue:
-				otb.AwaitUploads()
-			default:
-			}
+			// FinishQueue waits for every tarball, even a failed one
+			b.tarballQueue <- tb
+			return err
 		}
 
 		b.NewTarBall(true)
@@ -181,6 +232,57 @@ func (b *Bundle) CheckSizeAndEnqueueBack(tb TarBall) error {
 	return nil
 }
 
+// closeAndQueueUpload finishes full tarball and waits if too many are being uploaded.
+// Must be called with b.mutex held.
+func (b *Bundle) closeAndQueueUpload(tb TarBall) error {
+	atomic.AddInt64(&b.tarSize, tb.Size())
+	err := tb.CloseTar()
+	if err != nil {
+		return errors.Wrap(err, "TarWalker: failed to close tarball")
+	}
+
+	b.uploadQueue <- tb
+	for len(b.uploadQueue) > b.maxUploadQueue {
+		select {
+		case otb := <-b.uploadQueue:
+			otb.AwaitUploads()
+		default:
+		}
+	}
+	return nil
+}
+
+// IsSmallFile tells whether file of given size goes to partition of small files
+func (b *Bundle) IsSmallFile(size int64) bool { return size < b.SmallFileSize }
+
+// PackSmallFile writes small file with pack into partition dedicated to small files.
+// Catalogs and small relations packed next to each other compress better than
+// spread over all parallel partitions, and do not leave many half-empty partitions.
+func (b *Bundle) PackSmallFile(pack func(TarBall) error) error {
+	b.smallMutex.Lock()
+	defer b.smallMutex.Unlock()
+
+	if b.smallTarBall == nil {
+		b.mutex.Lock()
+		b.smallTarBall = b.Tbm.Make(true)
+		b.mutex.Unlock()
+		b.smallTarBall.SetUp(b.Crypter)
+	}
+
+	err := pack(b.smallTarBall)
+	if err != nil {
+		return err
+	}
+
+	if b.smallTarBall.Size() > b.MinSize {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		err = b.closeAndQueueUpload(b.smallTarBall)
+		b.smallTarBall = nil
+	}
+	return err
+}
+
 // NewTarBall starts writing new tarball
 func (b *Bundle) NewTarBall(dedicatedUploader bool) {
 	ntb := b.Tbm.Make(dedicatedUploader)
@@ -194,6 +296,20 @@ func (b *Bundle) GetIncrementBaseLsn() *uint64 { return b.IncrementFromLsn }
 // GetIncrementBaseFiles returns list of Files from previous backup
 func (b *Bundle) GetIncrementBaseFiles() BackupFileList { return b.IncrementFromFiles }
 
+// GetManifest returns manifest of backup, nil if backup_manifest is not made
+func (b *Bundle) GetManifest() *BackupManifest { return b.Manifest }
+
+func (b *Bundle) GetTornPageDetector() *TornPageDetector { return b.TornPages }
+
+// GetProgress returns reporter of backup-push progress, nil if it is not reported
+func (b *Bundle) GetProgress() *ProgressReporter { return b.Progress }
+
+// IsStrictDelta tells that files unchanged by mtime and size must be read anyway
+func (b *Bundle) IsStrictDelta() bool { return b.StrictDelta }
+
+// IsCatchup tells that all files are in base, see Bundle.Catchup
+func (b *Bundle) IsCatchup() bool { return b.Catchup }
+
 // Sentinel is used to signal completion of a walked
 // directory.
 type Sentinel struct {
@@ -240,14 +356,14 @@ type S3TarBall struct {
 // SetUp creates a new tar writer and starts upload to S3.
 // Upload will block until the tar file is finished writing.
 // If a name for the file is not given, default name is of
-// the form `part_....tar.lz4`.
+// the form `part_....tar.lz4`, or `.zst` with zstd compression.
 func (s *S3TarBall) SetUp(crypter Crypter, names ...string) {
 	if s.tw == nil {
 		var name string
 		if len(names) > 0 {
 			name = names[0]
 		} else {
-			name = "part_" + fmt.Sprintf("%0.3d", s.number) + ".tar.lz4"
+			name = "part_" + fmt.Sprintf("%0.3d", s.number) + ".tar." + compressionFileFormat(getCompressionMethod())
 		}
 		w := s.StartUpload(name, crypter)
 
@@ -292,6 +408,22 @@ type S3TarBallSentinelDto struct {
 	PgVersion int
 	FinishLSN *uint64
 
+	// Size of WAL segments of the cluster, absent in sentinels of older versions made of 16MB segments
+	WalSegmentSize uint64 `json:",omitempty"`
+
+	// Compression of tar partitions, absent in sentinels of older versions
+	CompressionMethod string `json:",omitempty"`
+	CompressionLevel  int    `json:",omitempty"`
+
+	// Symmetric key of the backup encrypted to the long-term key, absent if objects are encrypted to the long-term key
+	WrappedDataKey []byte `json:",omitempty"`
+
+	// Number of pages suspected to be read while being written, counted only with WALG_DETECT_TORN_PAGES
+	TornPages int64 `json:",omitempty"`
+
+	// Locations of tablespaces linked from pg_tblspc by OID, absent in sentinels of older versions
+	Tablespaces map[uint32]string `json:",omitempty"`
+
 	UserData interface{} `json:"UserData,omitempty"`
 }
 
@@ -310,6 +442,30 @@ type BackupFileDescription struct {
 	IsIncremented bool // should never be both incremented and Skipped
 	IsSkipped     bool
 	MTime         time.Time
+	Size          int64 `json:",omitempty"`
+	// CRC32C of tar member, absent in sentinels of older versions
+	Crc32c *uint32 `json:",omitempty"`
+}
+
+// GetPartitionFormat selects decompressor of partition of backup. Method recorded
+// at push time wins over extension of object. For sentinels without it extension
+// is used, and objects without known extension are LZ4 as all WAL-G backups were.
+func (dto *S3TarBallSentinelDto) GetPartitionFormat(key string) string {
+	if dto.CompressionMethod != "" {
+		return compressionFileFormat(dto.CompressionMethod)
+	}
+	if format := CheckType(key); format == "tar" || GetDecompressor(format) != nil {
+		return format
+	}
+	return Lz4CompressionMethod
+}
+
+// GetWalSegmentSize returns size of WAL segments of the backed up cluster
+func (dto *S3TarBallSentinelDto) GetWalSegmentSize() uint64 {
+	if dto.WalSegmentSize == 0 {
+		return WalSegmentSize
+	}
+	return dto.WalSegmentSize
 }
 
 // IsIncremental checks that sentinel represents delta backup
@@ -340,40 +496,24 @@ func (s *S3TarBall) Finish(sentinel *S3TarBallSentinelDto) error {
 
 	//If other parts are successful in uploading, upload json file.
 	if tupl.Success && sentinel != nil {
+		// Index lists parts before sentinel marks backup complete
+		err = tupl.uploadBackupIndex(s.bkupName)
+		if err != nil {
+			return err
+		}
+
 		sentinel.UserData = GetSentinelUserData()
 		dtoBody, err := json.Marshal(*sentinel)
 		if err != nil {
 			return err
 		}
 		path := tupl.server + "/basebackups_005/" + name
-		input := &s3manager.UploadInput{
-			Bucket:       aws.String(tupl.bucket),
-			Key:          aws.String(path),
-			Body:         bytes.NewReader(dtoBody),
-			StorageClass: aws.String(tupl.StorageClass),
-		}
-
-		if tupl.ServerSideEncryption != "" {
-			input.ServerSideEncryption = aws.String(tupl.ServerSideEncryption)
 
-			if tupl.SSEKMSKeyId != "" {
-				// Only aws:kms implies sseKmsKeyId, checked during validation
-				input.SSEKMSKeyId = aws.String(tupl.SSEKMSKeyId)
-			}
+		// Sentinel is the last object of backup, it is uploaded after all others are done
+		err = tupl.put(path, bytes.NewReader(dtoBody))
+		if err != nil {
+			return errors.Wrapf(err, "S3TarBall Finish: failed to upload sentinel '%s'", path)
 		}
-
-		tupl.wg.Add(1)
-		go func() {
-			defer tupl.wg.Done()
-
-			e := tupl.upload(input, path)
-			if e != nil {
-				log.Printf("upload: could not upload '%s'\n", path)
-				log.Fatalf("S3TarBall Finish: json failed to upload")
-			}
-		}()
-
-		tupl.Finish()
 	} else {
 		log.Printf("Uploaded %d compressed tar Files.\n", s.number)
 		log.Printf("Sentinel was not uploaded %v", name)
@@ -411,15 +551,26 @@ func (s *S3TarBall) Tw() *tar.Writer { return s.tw }
 // Multiple tarballs can share one uploader. Must call CreateUploader()
 // in 'upload.go'.
 type TarUploader struct {
+	// Upl is multipart upload manager of S3, see CreateUploader
 	Upl                  s3manageriface.UploaderAPI
 	ServerSideEncryption string
 	SSEKMSKeyId          string
 	StorageClass         string
+	WALStorageClass      string
 	Success              bool
 	bucket               string
 	server               string
 	region               string
+	svc                  s3iface.S3API
 	wg                   *sync.WaitGroup
+	// successMutex guards Success, set by background uploads of this uploader
+	successMutex *sync.Mutex
+	// Backend replaces the bucket as destination of uploads when set
+	Backend StorageBackend
+	// NetworkRateLimiter throttles bodies of all uploads, shared by clones, nil is unlimited
+	NetworkRateLimiter *RateLimiter
+	// partitionChecksums maps keys of uploaded tar partitions to CRC32C of their stored bodies, shared by clones
+	partitionChecksums *sync.Map
 }
 
 // NewTarUploader creates a new tar uploader without the actual
@@ -431,7 +582,12 @@ func NewTarUploader(svc s3iface.S3API, bucket, server, region string) *TarUpload
 		bucket:       bucket,
 		server:       server,
 		region:       region,
+		svc:          svc,
 		wg:           &sync.WaitGroup{},
+		successMutex: &sync.Mutex{},
+
+		NetworkRateLimiter: NewRateLimiter(getNetworkRateLimit()),
+		partitionChecksums: &sync.Map{},
 	}
 }
 
@@ -444,6 +600,13 @@ func (tu *TarUploader) Finish() {
 	}
 }
 
+// markSuccess records upload finished by background goroutine of uploader
+func (tu *TarUploader) markSuccess() {
+	tu.successMutex.Lock()
+	defer tu.successMutex.Unlock()
+	tu.Success = true
+}
+
 // Clone creates similar TarUploader with new WaitGroup
 func (tu *TarUploader) Clone() *TarUploader {
 	return &TarUploader{
@@ -451,10 +614,16 @@ func (tu *TarUploader) Clone() *TarUploader {
 		tu.ServerSideEncryption,
 		tu.SSEKMSKeyId,
 		tu.StorageClass,
+		tu.WALStorageClass,
 		tu.Success,
 		tu.bucket,
 		tu.server,
 		tu.region,
+		tu.svc,
 		&sync.WaitGroup{},
+		&sync.Mutex{},
+		tu.Backend,
+		tu.NetworkRateLimiter,
+		tu.partitionChecksums,
 	}
 }
@@ -2,6 +2,7 @@ package walg_test
 
 import (
 	"archive/tar"
+	"errors"
 	"testing"
 
 	"github.com/wal-g/wal-g"
@@ -165,6 +166,32 @@ func TestEmptyBundleQueue(t *testing.T) {
 	}
 }
 
+func TestBundleQueueReturnsWorkerError(t *testing.T) {
+	bundle := &walg.Bundle{
+		MinSize: 100,
+	}
+	tu := walg.NewTarUploader(&mockS3Client{}, "bucket", "server", "region")
+	tu.Upl = &mockS3Uploader{}
+	bundle.Tbm = &walg.S3TarBallMaker{
+		BaseDir:  "mockDirectory",
+		Trim:     "",
+		BkupName: "mockBackup",
+		Tu:       tu,
+	}
+	bundle.StartQueue()
+
+	// Failure of file packed in background stops walk and fails the backup instead of panic
+	workerErr := errors.New("mock worker error")
+	bundle.ReportWorkerError(workerErr)
+	bundle.ReportWorkerError(errors.New("later worker error"))
+	if err := bundle.TarWalker("mockDirectory/file", nil, nil); err != workerErr {
+		t.Errorf("structs: expected walk to stop with worker error but got %v", err)
+	}
+	if err := bundle.FinishQueue(); err != workerErr {
+		t.Errorf("structs: expected FinishQueue to return first worker error but got %v", err)
+	}
+}
+
 func TestBundleQueue(t *testing.T) {
 
 	queueTest(t)
@@ -262,3 +289,27 @@ func TestUserData(t *testing.T) {
 
 	os.Unsetenv("WALG_UPLOAD_CONCURRENCY")
 }
+
+func TestGetPartitionFormat(t *testing.T) {
+	legacy := &walg.S3TarBallSentinelDto{}
+	for key, format := range map[string]string{
+		"base/tar_partitions/part_001.tar.lz4": "lz4",
+		"base/tar_partitions/part_001.tar.lzo": "lzo",
+		"base/tar_partitions/part_001.tar.zst": "zst",
+		"base/tar_partitions/part_001.tar":     "tar",
+		"base/tar_partitions/part_001":         "lz4",
+	} {
+		if actual := legacy.GetPartitionFormat(key); actual != format {
+			t.Errorf("structs: expected format %s of %s in sentinel without compression, got %s", format, key, actual)
+		}
+	}
+
+	recorded := &walg.S3TarBallSentinelDto{CompressionMethod: walg.LzoCompressionMethod}
+	if actual := recorded.GetPartitionFormat("base/tar_partitions/part_001.tar.lz4"); actual != "lzo" {
+		t.Errorf("structs: recorded compression method must win over extension, got %s", actual)
+	}
+	zstd := &walg.S3TarBallSentinelDto{CompressionMethod: walg.ZstdCompressionMethod}
+	if actual := zstd.GetPartitionFormat("base/tar_partitions/part_001.tar.zst"); actual != walg.ZstdFileFormat {
+		t.Errorf("structs: expected zstd method to be read as %s, got %s", walg.ZstdFileFormat, actual)
+	}
+}
@@ -0,0 +1,250 @@
+package walg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ParseTablespaceLocations parses comma separated list of OID=DIR given to
+// backup-fetch --tablespace-location. A tablespace is given by its OID or by its
+// link in data directory, pg_tblspc/OID. New locations must be absolute.
+func ParseTablespaceLocations(list string) (map[uint32]string, error) {
+	locations := make(map[uint32]string)
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("ParseTablespaceLocations: '%s' is not in form OID=DIR", item)
+		}
+		name := strings.TrimPrefix(strings.Trim(parts[0], "/"), "pg_tblspc/")
+		oid, err := strconv.ParseUint(name, 10, 32)
+		if err != nil || oid == 0 {
+			return nil, errors.Errorf("ParseTablespaceLocations: invalid tablespace '%s'", parts[0])
+		}
+		if !filepath.IsAbs(parts[1]) {
+			return nil, errors.Errorf("ParseTablespaceLocations: location '%s' of tablespace %d is not absolute", parts[1], oid)
+		}
+		locations[uint32(oid)] = filepath.Clean(parts[1])
+	}
+	return locations, nil
+}
+
+// tablespaceOfLink returns OID of tablespace if path is its link in pg_tblspc.
+// Tablespaces created inside data directory are plain directories, not links.
+func tablespaceOfLink(path string, info os.FileInfo) (uint32, bool) {
+	if info.Mode()&os.ModeSymlink == 0 || filepath.Base(filepath.Dir(path)) != "pg_tblspc" {
+		return 0, false
+	}
+	oid, err := strconv.ParseUint(info.Name(), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(oid), true
+}
+
+// tablespaceLocation returns directory tablespace is restored to: the new one
+// if it is given, otherwise the location at backup time. Relative location is of link.
+func tablespaceLocation(dir string, oid uint32, sentinel S3TarBallSentinelDto, locations map[uint32]string) string {
+	if location, ok := locations[oid]; ok {
+		return location
+	}
+	location := sentinel.Tablespaces[oid]
+	if !filepath.IsAbs(location) {
+		location = filepath.Join(dir, "pg_tblspc", location)
+	}
+	return location
+}
+
+// createTablespaceLinks creates directories of tablespaces recorded in sentinel and
+// links to them in pg_tblspc, so their members are extracted through the links.
+// Tablespace is restored to an empty directory unless a delta is applied to it.
+// Links created by interrupted backup-fetch are kept.
+func createTablespaceLinks(dir string, sentinel S3TarBallSentinelDto, options BackupFetchOptions, resumed bool) error {
+	for oid := range sentinel.Tablespaces {
+		link := path.Join(dir, "pg_tblspc", strconv.FormatUint(uint64(oid), 10))
+		if options.Tablespaces.skips(link[len(dir):]) {
+			continue
+		}
+		location := tablespaceLocation(dir, oid, sentinel, options.TablespaceLocations)
+		if current, err := os.Readlink(link); err == nil && current == location {
+			continue
+		}
+		if !sentinel.hasIncrementBase() && !resumed {
+			empty, err := isDirectoryEmpty(location)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return errors.Errorf("Directory %v for tablespace %d must be empty", location, oid)
+			}
+		}
+		fmt.Printf("Tablespace %d is restored to %v\n", oid, location)
+		err := os.MkdirAll(location, 0700)
+		if err != nil {
+			return errors.Wrapf(err, "createTablespaceLinks: failed to create %s", location)
+		}
+		err = os.MkdirAll(path.Dir(link), 0700)
+		if err != nil {
+			return errors.Wrap(err, "createTablespaceLinks: failed to create pg_tblspc")
+		}
+		os.Remove(link)
+		err = os.Symlink(location, link)
+		if err != nil {
+			return errors.Wrapf(err, "createTablespaceLinks: failed to link tablespace %d", oid)
+		}
+	}
+	return nil
+}
+
+// moveTablespacesToIncrementBase moves content of tablespaces linked from increment base
+// into increment_base directory inside them, and links increment base to it. Content is
+// moved within the same directory, so it works for tablespaces mounted on their own.
+func moveTablespacesToIncrementBase(incrementBase string) error {
+	links := path.Join(incrementBase, "pg_tblspc")
+	infos, err := ioutil.ReadDir(links)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "moveTablespacesToIncrementBase: failed to read pg_tblspc")
+	}
+	for _, info := range infos {
+		link := path.Join(links, info.Name())
+		if _, ok := tablespaceOfLink(link, info); !ok {
+			continue
+		}
+		location, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			return errors.Wrapf(err, "moveTablespacesToIncrementBase: failed to resolve %s", link)
+		}
+		names, err := readDirNames(location)
+		if err != nil {
+			return errors.Wrapf(err, "moveTablespacesToIncrementBase: failed to read %s", location)
+		}
+		base := path.Join(location, "increment_base")
+		err = os.Mkdir(base, 0700)
+		if err != nil {
+			return errors.Wrapf(err, "moveTablespacesToIncrementBase: failed to create %s", base)
+		}
+		for _, name := range names {
+			if _, ok := benignDirectoryEntries[name]; ok {
+				continue
+			}
+			err = os.Rename(path.Join(location, name), path.Join(base, name))
+			if err != nil {
+				return errors.Wrap(err, "moveTablespacesToIncrementBase: failed to move tablespace to increment base")
+			}
+		}
+		if err = os.Remove(link); err != nil {
+			return errors.Wrapf(err, "moveTablespacesToIncrementBase: failed to remove %s", link)
+		}
+		if err = os.Symlink(base, link); err != nil {
+			return errors.Wrapf(err, "moveTablespacesToIncrementBase: failed to link %s", link)
+		}
+	}
+	return nil
+}
+
+// removeTablespaceIncrementBases removes content of tablespaces moved aside by
+// moveTablespacesToIncrementBase. Links themselves are removed with increment base.
+func removeTablespaceIncrementBases(incrementBase string) error {
+	infos, err := ioutil.ReadDir(path.Join(incrementBase, "pg_tblspc"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "removeTablespaceIncrementBases: failed to read pg_tblspc")
+	}
+	for _, info := range infos {
+		link := path.Join(incrementBase, "pg_tblspc", info.Name())
+		if _, ok := tablespaceOfLink(link, info); !ok {
+			continue
+		}
+		base, err := os.Readlink(link)
+		if err != nil {
+			return errors.Wrapf(err, "removeTablespaceIncrementBases: failed to read %s", link)
+		}
+		if path.Base(base) != "increment_base" {
+			continue
+		}
+		if err = os.RemoveAll(base); err != nil {
+			return errors.Wrapf(err, "removeTablespaceIncrementBases: failed to remove %s", base)
+		}
+	}
+	return nil
+}
+
+// relocateTablespaceMap writes new locations of tablespaces to tablespace_map in
+// restored directory, otherwise recovery links them back to their old locations
+func relocateTablespaceMap(dir string, locations map[uint32]string) error {
+	if len(locations) == 0 {
+		return nil
+	}
+	mapPath := filepath.Join(dir, "tablespace_map")
+	content, err := ioutil.ReadFile(mapPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "relocateTablespaceMap: failed to read tablespace_map")
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	for i, line := range lines {
+		fields := strings.SplitN(line, " ", 2)
+		oid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		if location, ok := locations[uint32(oid)]; ok {
+			lines[i] = fields[0] + " " + location + "\n"
+		}
+	}
+	err = ioutil.WriteFile(mapPath, []byte(strings.Join(lines, "")), 0600)
+	if err != nil {
+		return errors.Wrap(err, "relocateTablespaceMap: failed to write tablespace_map")
+	}
+	return nil
+}
+
+// moveFile renames file, or copies it if target is on another filesystem,
+// e.g. in tablespace restored to a new location on a different mount
+func moveFile(from, to string) error {
+	err := os.Rename(from, to)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = CopySparse(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chtimes(to, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
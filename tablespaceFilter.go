@@ -0,0 +1,110 @@
+package walg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TablespaceFilter selects tablespaces restored by backup-fetch. With Include only
+// tablespaces of OIDs are restored, otherwise all but them. Files outside pg_tblspc/,
+// including default tablespaces, pg_control and backup_label, are always restored.
+// A nil filter restores all tablespaces.
+type TablespaceFilter struct {
+	OIDs    map[uint32]bool
+	Include bool
+}
+
+// ParseTablespaceFilter parses comma separated list of tablespaces given to
+// backup-fetch --tablespaces or --exclude-tablespaces. A tablespace is given
+// by its OID or by its link in data directory, pg_tblspc/OID.
+func ParseTablespaceFilter(list string, include bool) (*TablespaceFilter, error) {
+	filter := &TablespaceFilter{OIDs: make(map[uint32]bool), Include: include}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimPrefix(strings.Trim(strings.TrimSpace(item), "/"), "pg_tblspc/")
+		oid, err := strconv.ParseUint(item, 10, 32)
+		if err != nil || oid == 0 {
+			return nil, errors.Errorf("ParseTablespaceFilter: invalid tablespace '%s'", item)
+		}
+		filter.OIDs[uint32(oid)] = true
+	}
+	return filter, nil
+}
+
+// tablespaceOfFile returns OID of tablespace under pg_tblspc/ which file of backup belongs to
+func tablespaceOfFile(name string) (uint32, bool) {
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if parts[0] != "pg_tblspc" || len(parts) < 2 {
+		return 0, false
+	}
+	oid, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(oid), true
+}
+
+// skips tells whether file of backup belongs to a tablespace which is not restored
+func (filter *TablespaceFilter) skips(name string) bool {
+	if filter == nil {
+		return false
+	}
+	oid, ok := tablespaceOfFile(name)
+	if !ok {
+		return false
+	}
+	return filter.OIDs[oid] != filter.Include
+}
+
+// Validate checks that all tablespaces of filter are in backup. Sentinels of older
+// versions have no file list, they are not checked.
+func (filter *TablespaceFilter) Validate(backupName string, files BackupFileList) error {
+	if filter == nil || len(files) == 0 {
+		return nil
+	}
+	present := make(map[uint32]bool)
+	for name := range files {
+		if oid, ok := tablespaceOfFile(name); ok {
+			present[oid] = true
+		}
+	}
+	for oid := range filter.OIDs {
+		if !present[oid] {
+			return errors.Errorf("Backup %v has no tablespace %d", backupName, oid)
+		}
+	}
+	return nil
+}
+
+// pruneTablespaceMap removes tablespaces which are not restored from tablespace_map
+// in restored directory, so recovery does not link them
+func (filter *TablespaceFilter) pruneTablespaceMap(dir string) error {
+	if filter == nil {
+		return nil
+	}
+	mapPath := filepath.Join(dir, "tablespace_map")
+	content, err := ioutil.ReadFile(mapPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "pruneTablespaceMap: failed to read tablespace_map")
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if filter.skips("pg_tblspc/" + fields[0]) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	err = ioutil.WriteFile(mapPath, []byte(strings.Join(kept, "")), 0600)
+	if err != nil {
+		return errors.Wrap(err, "pruneTablespaceMap: failed to write tablespace_map")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package walg_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestParseTablespaceFilter(t *testing.T) {
+	filter, err := walg.ParseTablespaceFilter("16400, pg_tblspc/16500/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filter.OIDs) != 2 || !filter.OIDs[16400] || !filter.OIDs[16500] || filter.Include {
+		t.Errorf("tablespaces: unexpected filter %+v", filter)
+	}
+	for _, invalid := range []string{"", "0", "16400,", "pg_default", "pg_tblspc"} {
+		if _, err = walg.ParseTablespaceFilter(invalid, true); err == nil {
+			t.Errorf("tablespaces: expected error for '%s'", invalid)
+		}
+	}
+}
+
+func TestBackupFetchExcludeTablespace(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_tablespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	files := map[string]string{
+		"PG_VERSION":        "10",
+		"backup_label":      "START WAL LOCATION: 0/2000028",
+		"tablespace_map":    "16400 /mnt/fast\n16500 /mnt/large\n",
+		"global/pg_control": "control",
+		"base/16384/1259":   "default tablespace",
+		"pg_tblspc/16400/PG_10_201707211/16384/16401": "kept tablespace",
+		"pg_tblspc/16500/PG_10_201707211/16384/16501": "large tablespace",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(data, name)), 0700)
+		if err := ioutil.WriteFile(filepath.Join(data, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backupName := "base_000000010000000000000002"
+	pushTestBackup(t, tu, pre, data, backupName)
+
+	filter, err := walg.ParseTablespaceFilter("16500", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(dir, "restored")
+	_, err = walg.HandleBackupFetch(backupName, pre, restored, false, walg.BackupFetchOptions{Tablespaces: filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		fetched, err := ioutil.ReadFile(filepath.Join(restored, name))
+		switch name {
+		case "pg_tblspc/16500/PG_10_201707211/16384/16501":
+			if !os.IsNotExist(err) {
+				t.Errorf("tablespaces: file of excluded tablespace is restored: %v", err)
+			}
+		case "tablespace_map":
+			if string(fetched) != "16400 /mnt/fast\n" {
+				t.Errorf("tablespaces: expected excluded tablespace to be removed from map but got %q", fetched)
+			}
+		default:
+			if string(fetched) != content {
+				t.Errorf("tablespaces: restored %s differs: %q", name, fetched)
+			}
+		}
+	}
+
+	// Tablespaces of backup are known from its file list
+	storage.objects["server/basebackups_005/"+backupName+walg.SentinelSuffix] =
+		[]byte(`{"Files": {"/pg_tblspc/16400/PG_10_201707211/16384/16401": {}}}`)
+	_, err = walg.HandleBackupFetch(backupName, pre, filepath.Join(dir, "missing"), false, walg.BackupFetchOptions{Tablespaces: filter})
+	if err == nil {
+		t.Errorf("tablespaces: fetch excluding tablespace absent in backup succeeded")
+	}
+}
@@ -0,0 +1,138 @@
+package walg_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestParseTablespaceLocations(t *testing.T) {
+	locations, err := walg.ParseTablespaceLocations("16400=/mnt/fast/, pg_tblspc/16500=/mnt/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 2 || locations[16400] != "/mnt/fast" || locations[16500] != "/mnt/large" {
+		t.Errorf("tablespaces: unexpected locations %v", locations)
+	}
+	for _, invalid := range []string{"", "16400", "16400=relative", "0=/mnt/fast", "pg_default=/mnt/fast"} {
+		if _, err = walg.ParseTablespaceLocations(invalid); err == nil {
+			t.Errorf("tablespaces: expected error for '%s'", invalid)
+		}
+	}
+}
+
+func TestBackupFetchExternalTablespaceToNewLocation(t *testing.T) {
+	storage := &mapStorage{objects: make(map[string][]byte)}
+	tu, pre := walg.ConfigureStorageBackend(storage, "/server")
+	dir, err := ioutil.TempDir("", "walg_tablespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := filepath.Join(dir, "data")
+	external := filepath.Join(dir, "external")
+	files := map[string]string{
+		"PG_VERSION":        "10",
+		"global/pg_control": "control",
+		"base/16384/1259":   "default tablespace",
+		"pg_tblspc/16400/PG_10_201707211/16384/16401": "external tablespace",
+	}
+	for name, content := range files {
+		path := filepath.Join(data, name)
+		if name == "pg_tblspc/16400/PG_10_201707211/16384/16401" {
+			path = filepath.Join(external, "PG_10_201707211/16384/16401")
+		}
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(data, "pg_tblspc"), 0700)
+	if err = os.Symlink(external, filepath.Join(data, "pg_tblspc/16400")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(data, "tablespace_map"), []byte("16400 "+external+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// WAL on another disk is not archived, but restored as an empty directory
+	wal := filepath.Join(dir, "wal")
+	os.MkdirAll(wal, 0700)
+	ioutil.WriteFile(filepath.Join(wal, "000000010000000000000002"), []byte("wal"), 0600)
+	if err = os.Symlink(wal, filepath.Join(data, "pg_wal")); err != nil {
+		t.Fatal(err)
+	}
+
+	backupName := "base_000000010000000000000002"
+	bundle := &walg.Bundle{MinSize: 10, Files: &sync.Map{}}
+	bundle.Tbm = &walg.S3TarBallMaker{BaseDir: "data", Trim: data, BkupName: backupName, Tu: tu}
+	bundle.StartQueue()
+	if err = walg.Walk(data, bundle.TarWalker); err != nil {
+		t.Fatal(err)
+	}
+	if err = bundle.FinishQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if err = bundle.HandleSentinel(); err != nil {
+		t.Fatal(err)
+	}
+	tu.Finish()
+	if len(bundle.Tablespaces) != 1 || bundle.Tablespaces[16400] != external {
+		t.Fatalf("tablespaces: unexpected tablespaces of walk %v", bundle.Tablespaces)
+	}
+	sentinel := walg.S3TarBallSentinelDto{Tablespaces: bundle.Tablespaces}
+	sentinel.SetFiles(bundle.GetFiles())
+	if _, ok := sentinel.Files["/pg_tblspc/16400/PG_10_201707211/16384/16401"]; !ok {
+		t.Fatalf("tablespaces: file of external tablespace is not named under pg_tblspc: %v", sentinel.Files)
+	}
+	content, err := json.Marshal(&sentinel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pre.Storage().Put(*walg.GetBackupPath(pre)+backupName+walg.SentinelSuffix, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	relocated := filepath.Join(dir, "relocated")
+	options := walg.BackupFetchOptions{TablespaceLocations: map[uint32]string{16400: relocated}}
+	_, err = walg.HandleBackupFetch(backupName, pre, restored, false, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(filepath.Join(restored, "pg_tblspc/16400")); err != nil || link != relocated {
+		t.Errorf("tablespaces: expected link to %s but got %s, %v", relocated, link, err)
+	}
+	for name, content := range files {
+		path := filepath.Join(restored, name)
+		if name == "pg_tblspc/16400/PG_10_201707211/16384/16401" {
+			path = filepath.Join(relocated, "PG_10_201707211/16384/16401")
+		}
+		if fetched, err := ioutil.ReadFile(path); string(fetched) != content {
+			t.Errorf("tablespaces: restored %s differs: %q, %v", name, fetched, err)
+		}
+	}
+	if fetched, err := ioutil.ReadFile(filepath.Join(restored, "tablespace_map")); err != nil || string(fetched) != "16400 "+relocated+"\n" {
+		t.Errorf("tablespaces: expected new location in tablespace_map but got %q, %v", fetched, err)
+	}
+	if info, err := os.Lstat(filepath.Join(restored, "pg_wal")); err != nil || !info.IsDir() {
+		t.Errorf("tablespaces: expected pg_wal restored as directory: %v", err)
+	}
+	if names, _ := ioutil.ReadDir(filepath.Join(restored, "pg_wal")); len(names) != 0 {
+		t.Errorf("tablespaces: WAL is restored to pg_wal")
+	}
+
+	// Tablespace is not restored over existing files
+	ioutil.WriteFile(filepath.Join(relocated, "stale"), []byte("stale"), 0600)
+	_, err = walg.HandleBackupFetch(backupName, pre, filepath.Join(dir, "again"), false, options)
+	if err == nil {
+		t.Errorf("tablespaces: restore to non-empty location succeeded")
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"archive/tar"
 	"fmt"
 	"github.com/pkg/errors"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // TarInterpreter behaves differently
@@ -17,11 +21,32 @@ type TarInterpreter interface {
 	Interpret(r io.Reader, hdr *tar.Header) error
 }
 
-// FileTarInterpreter extracts input to disk.
+// FileTarInterpreter extracts input to disk. One interpreter is shared by all
+// partitions extracted concurrently: members are distinct files, and directories
+// shared by partitions are created by whichever of them comes first.
 type FileTarInterpreter struct {
 	NewDir             string
 	Sentinel           S3TarBallSentinelDto
 	IncrementalBaseDir string
+	Owner              *FileOwner
+	// PreserveOwner restores ownership recorded in tar headers when Owner is not set
+	PreserveOwner bool
+	// DatabaseOID limits restored relation files to one database, zero restores all
+	DatabaseOID uint32
+	// Tablespaces limits restored tablespaces under pg_tblspc/, nil restores all
+	Tablespaces *TablespaceFilter
+	// DiskRateLimiter throttles content of restored files across all extractors, nil is unlimited
+	DiskRateLimiter *RateLimiter
+	// VerifyChecksums compares content of restored files with CRC32C recorded by backup-push
+	VerifyChecksums bool
+	// ForceIncrementBase applies increments without checking pages of base against DeltaFromLSN
+	ForceIncrementBase bool
+	// Progress records extracted members of BackupName, members extracted by interrupted
+	// backup-fetch are skipped. Nil records nothing.
+	Progress   *FetchProgress
+	BackupName string
+	// Reporter accounts restored files for progress output, nil if it is not printed
+	Reporter *ProgressReporter
 }
 
 func contains(s *[]string, e string) bool {
@@ -41,25 +66,65 @@ func contains(s *[]string, e string) bool {
 // Returns the first error encountered. Calls fsync after each file
 // is written successfully.
 func (ti *FileTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
+	if ti.Tablespaces.skips(cur.Name) {
+		return nil
+	}
+	if ti.Progress.IsExtracted(ti.BackupName, cur.Name) {
+		return nil
+	}
 	fmt.Println(cur.Name)
 	targetPath := path.Join(ti.NewDir, cur.Name)
 	// this path is only used for increment restoration
 	incrementalPath := path.Join(ti.IncrementalBaseDir, cur.Name)
 	switch cur.Typeflag {
 	case tar.TypeReg, tar.TypeRegA:
+		if isOtherDatabaseFile(cur.Name, ti.DatabaseOID) {
+			if err := ti.restorePlaceholder(targetPath, cur); err != nil {
+				return err
+			}
+			break
+		}
+		tr = ti.DiskRateLimiter.Reader(tr)
 		fd, haveFd := ti.Sentinel.Files[cur.Name]
+		var checksum hash.Hash32
+		if ti.VerifyChecksums && haveFd && fd.Crc32c != nil {
+			checksum = newMemberChecksum()
+			tr = io.TeeReader(tr, checksum)
+		}
 
+		// Pages of base kept by increment must be older than the delta
+		baseLSN := ti.Sentinel.IncrementFromLSN
+		if ti.ForceIncrementBase {
+			baseLSN = nil
+		}
 		// If this file is incremental we use it's base version from incremental path
-		if haveFd && ti.Sentinel.IsIncremental() && fd.IsIncremented {
-			err := ApplyFileIncrement(incrementalPath, tr)
+		if haveFd && ti.Sentinel.hasIncrementBase() && fd.IsIncremented && ti.isIncrementMoved(incrementalPath, targetPath) {
+			// Interrupted backup-fetch moved the file before recording it. Increment
+			// overwrites the same pages, so it is applied again in place.
+			err := ApplyFileIncrement(targetPath, tr, baseLSN)
+			if err != nil {
+				return errors.Wrap(err, "Interpret: failed to apply increment for "+targetPath)
+			}
+			if err = ti.chownRestored(targetPath, cur); err != nil {
+				return err
+			}
+		} else if haveFd && ti.Sentinel.hasIncrementBase() && fd.IsIncremented {
+			err := ApplyFileIncrement(incrementalPath, tr, baseLSN)
 			if err != nil {
 				return errors.Wrap(err, "Interpret: failed to apply increment for "+targetPath)
 			}
 
+			err = ti.createParentDirs(cur.Name, targetPath, cur)
+			if err != nil {
+				return errors.Wrap(err, "Interpret: failed to create all directories")
+			}
 			err = MoveFileAndCreateDirs(incrementalPath, targetPath, cur.Name)
 			if err != nil {
 				return errors.Wrap(err, "Interpret: failed to move increment for "+targetPath)
 			}
+			if err = ti.chownRestored(targetPath, cur); err != nil {
+				return err
+			}
 		} else {
 
 			var f *os.File
@@ -67,7 +132,7 @@ func (ti *FileTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
 			f, err := os.Create(targetPath)
 			dne := os.IsNotExist(err)
 			if dne {
-				err := prepareDirs(cur.Name, targetPath)
+				err := ti.createParentDirs(cur.Name, targetPath, cur)
 				if err != nil {
 					return errors.Wrap(err, "Interpret: failed to create all directories")
 				}
@@ -81,7 +146,8 @@ func (ti *FileTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
 				return errors.Wrapf(err, "Interpret: failed to create new file %s", targetPath)
 			}
 
-			_, err = io.Copy(f, tr)
+			// Zero runs are not written to preserve sparseness of relation files
+			_, err = CopySparse(f, tr)
 			if err != nil {
 				return errors.Wrap(err, "Interpret: copy failed")
 			}
@@ -98,37 +164,115 @@ func (ti *FileTarInterpreter) Interpret(tr io.Reader, cur *tar.Header) error {
 			if err = f.Close(); err != nil {
 				return errors.Wrapf(err, "Interpret: failed to close file %s", targetPath)
 			}
+
+			if err = ti.chownRestored(targetPath, cur); err != nil {
+				return err
+			}
+		}
+		// Size of incremented file is of the whole file, as estimated from sentinel
+		if haveFd {
+			ti.Reporter.AddFile(fd.Size)
+		} else {
+			ti.Reporter.AddFile(cur.Size)
+		}
+		if checksum != nil {
+			// Checksum is of the whole member, which may be not read to the end
+			_, err := io.Copy(ioutil.Discard, tr)
+			if err != nil {
+				return errors.Wrapf(err, "Interpret: failed to read %s", cur.Name)
+			}
+			if checksum.Sum32() != *fd.Crc32c {
+				return ChecksumMismatchError{cur.Name, *fd.Crc32c, checksum.Sum32()}
+			}
 		}
 	case tar.TypeDir:
-		err := os.MkdirAll(targetPath, 0755)
+		err := ti.mkdirAllRestored(targetPath, cur)
 		if err != nil {
 			return errors.Wrapf(err, "Interpret: failed to create all directories in %s", targetPath)
 		}
 		if err = os.Chmod(targetPath, os.FileMode(cur.Mode)); err != nil {
 			return errors.Wrap(err, "Interpret: chmod failed")
 		}
+		if err = ti.chownRestored(targetPath, cur); err != nil {
+			return err
+		}
 	case tar.TypeLink:
+		ti.removeInterrupted(targetPath)
 		if err := os.Link(cur.Name, targetPath); err != nil {
 			return errors.Wrapf(err, "Interpret: failed to create hardlink %s", targetPath)
 		}
 	case tar.TypeSymlink:
-		if err := os.Symlink(cur.Name, targetPath); err != nil {
-			return errors.Wrapf(err, "Interpret: failed to create symlink", targetPath)
+		if ti.isTablespaceLink(cur.Name) {
+			// Link was created before extraction, possibly to a new location
+			location, err := filepath.EvalSymlinks(targetPath)
+			if err != nil {
+				return errors.Wrapf(err, "Interpret: failed to resolve tablespace link %s", targetPath)
+			}
+			if err = ti.chownRestored(location, cur); err != nil {
+				return err
+			}
+		} else {
+			ti.removeInterrupted(targetPath)
+			if err := os.Symlink(cur.Linkname, targetPath); err != nil {
+				return errors.Wrapf(err, "Interpret: failed to create symlink %s", targetPath)
+			}
+		}
+		if err := ti.chownRestored(targetPath, cur); err != nil {
+			return err
 		}
 	}
-	return nil
+	return ti.Progress.Extracted(ti.BackupName, cur.Name)
+}
+
+// PartitionExtracted records that all members of partition are extracted,
+// so backup-fetch --resume does not download it again
+func (ti *FileTarInterpreter) PartitionExtracted(path string) error {
+	return ti.Progress.Extracted(ti.BackupName, path)
+}
+
+// isIncrementMoved tells whether interrupted backup-fetch has already moved
+// incremented file from incremental path to target path
+func (ti *FileTarInterpreter) isIncrementMoved(incrementalPath, targetPath string) bool {
+	if !ti.Progress.IsResumed(ti.BackupName) {
+		return false
+	}
+	if _, err := os.Lstat(incrementalPath); !os.IsNotExist(err) {
+		return false
+	}
+	_, err := os.Lstat(targetPath)
+	return err == nil
+}
+
+// isTablespaceLink tells whether member is link to tablespace recorded in sentinel
+func (ti *FileTarInterpreter) isTablespaceLink(name string) bool {
+	if path.Dir(strings.TrimPrefix(name, "/")) != "pg_tblspc" {
+		return false
+	}
+	oid, err := strconv.ParseUint(path.Base(name), 10, 32)
+	if err != nil {
+		return false
+	}
+	_, ok := ti.Sentinel.Tablespaces[uint32(oid)]
+	return ok
+}
+
+// removeInterrupted removes link created by interrupted backup-fetch before recording it
+func (ti *FileTarInterpreter) removeInterrupted(targetPath string) {
+	if ti.Progress.IsResumed(ti.BackupName) {
+		os.Remove(targetPath)
+	}
 }
 
 // MoveFileAndCreateDirs moves file from incremental folder to target folder, creating necessary folders structure
 func MoveFileAndCreateDirs(incrementalPath string, targetPath string, fileName string) (err error) {
-	err = os.Rename(incrementalPath, targetPath)
+	err = moveFile(incrementalPath, targetPath)
 	if os.IsNotExist(err) {
 		// this path is invoked if this is a first file in a dir
 		err := prepareDirs(fileName, targetPath)
 		if err != nil {
 			return errors.Wrap(err, "MoveFileAndCreateDirs: failed to create all directories")
 		}
-		err = os.Rename(incrementalPath, targetPath)
+		err = moveFile(incrementalPath, targetPath)
 		if err != nil {
 			return errors.Wrap(err, "MoveFileAndCreateDirs: failed to rename incremented file "+targetPath)
 		}
@@ -138,6 +282,59 @@ func MoveFileAndCreateDirs(incrementalPath string, targetPath string, fileName s
 	return nil
 }
 
+// moveSkippedFiles moves files of delta base which are not changed by the delta from
+// incrementBase to their place in targetDir. Moves run concurrently, bounded by
+// WALG_RESTORE_MOVE_CONCURRENCY, and the first failure stops the remaining ones.
+// With resumed, files missing in incrementBase were moved by interrupted fetch.
+func moveSkippedFiles(incrementBase string, targetDir string, fileNames []string, resumed bool) error {
+	for _, fileName := range fileNames {
+		targetPath := path.Join(targetDir, fileName)
+		if targetPath == incrementBase || strings.HasPrefix(targetPath, incrementBase+"/") {
+			return errors.Errorf("moveSkippedFiles: %v would be moved into increment base", fileName)
+		}
+	}
+
+	names := make(chan string)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	workers := getMaxRestoreMoveConcurrency(min(len(fileNames), 16))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fileName := range names {
+				fmt.Printf("Skipped file %v\n", fileName)
+				targetPath := path.Join(targetDir, fileName)
+				incrementalPath := path.Join(incrementBase, fileName)
+				if _, err := os.Lstat(incrementalPath); resumed && os.IsNotExist(err) {
+					continue
+				}
+				err := MoveFileAndCreateDirs(incrementalPath, targetPath, fileName)
+				if err != nil {
+					stopOnce.Do(func() {
+						firstErr = errors.Wrap(err, "Failed to move skipped file for "+targetPath+" "+fileName)
+						close(stop)
+					})
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, fileName := range fileNames {
+		select {
+		case names <- fileName:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(names)
+	wg.Wait()
+	return firstErr
+}
+
 // Make sure all dirs exist
 func prepareDirs(fileName string, targetPath string) error {
 	base := filepath.Base(fileName)
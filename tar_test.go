@@ -0,0 +1,177 @@
+package walg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/wal-g/wal-g"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pipeTarBall streams uncompressed tar into a pipe,
+// so that huge files can be checked without storing them.
+type pipeTarBall struct {
+	trim string
+	size int64
+	w    *io.PipeWriter
+	tw   *tar.Writer
+}
+
+func (p *pipeTarBall) SetUp(crypter walg.Crypter, args ...string) {
+	if p.tw == nil {
+		p.tw = tar.NewWriter(p.w)
+	}
+}
+
+func (p *pipeTarBall) CloseTar() error {
+	err := p.tw.Close()
+	if err != nil {
+		return err
+	}
+	return p.w.Close()
+}
+
+func (p *pipeTarBall) Finish(sentinel *walg.S3TarBallSentinelDto) error { return nil }
+func (p *pipeTarBall) BaseDir() string                                  { return "" }
+func (p *pipeTarBall) Trim() string                                     { return p.trim }
+func (p *pipeTarBall) Nop() bool                                        { return false }
+func (p *pipeTarBall) Number() int                                      { return 1 }
+func (p *pipeTarBall) Size() int64                                      { return p.size }
+func (p *pipeTarBall) AddSize(i int64)                                  { p.size += i }
+func (p *pipeTarBall) Tw() *tar.Writer                                  { return p.tw }
+func (p *pipeTarBall) AwaitUploads()                                    {}
+
+type pipeTarBallMaker struct {
+	tarBall *pipeTarBall
+}
+
+func (m *pipeTarBallMaker) Make(dedicatedUploader bool) walg.TarBall { return m.tarBall }
+
+type pipeReaderMaker struct {
+	r *io.PipeReader
+}
+
+func (m *pipeReaderMaker) Reader() (io.ReadCloser, error) { return m.r, nil }
+func (m *pipeReaderMaker) Format() string                 { return "tar" }
+func (m *pipeReaderMaker) Path() string                   { return "pipe" }
+
+// tarRoundTrip streams files of source through tar and extracts them into restored
+func tarRoundTrip(t *testing.T, source, restored string) {
+	pr, pw := io.Pipe()
+	tarBall := &pipeTarBall{trim: source, w: pw}
+	bundle := &walg.Bundle{
+		MinSize: int64(1) << 62,
+		Files:   &sync.Map{},
+		Tbm:     &pipeTarBallMaker{tarBall},
+	}
+
+	extracted := make(chan error)
+	go func() {
+		err := os.MkdirAll(restored, 0700)
+		if err == nil {
+			err = walg.ExtractAll(&walg.FileTarInterpreter{NewDir: restored}, []walg.ReaderMaker{&pipeReaderMaker{pr}})
+		}
+		extracted <- err
+	}()
+
+	bundle.StartQueue()
+	err := walg.Walk(source, bundle.TarWalker)
+	if err != nil {
+		t.Fatalf("tar: walk failed: %v", err)
+	}
+	err = bundle.FinishQueue()
+	if err != nil {
+		t.Fatalf("tar: failed to finish tarball: %v", err)
+	}
+	err = <-extracted
+	if err != nil {
+		t.Fatalf("tar: extract failed: %v", err)
+	}
+}
+
+func TestLongNameRoundTrip(t *testing.T) {
+	data, err := ioutil.TempDir("", "long_name_tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+	source := filepath.Join(data, "source")
+	restored := filepath.Join(data, "restored")
+
+	// Name alone does not fit into 100 bytes of USTAR header
+	longDir := filepath.Join(source, strings.Repeat("d", 60))
+	longName := filepath.Join(longDir, strings.Repeat("f", 120))
+	err = os.MkdirAll(longDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(longName, []byte("long name"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tarRoundTrip(t, source, restored)
+
+	content, err := ioutil.ReadFile(filepath.Join(restored, strings.TrimPrefix(longName, source)))
+	if err != nil || string(content) != "long name" {
+		t.Errorf("tar: file with long name was not restored: %v", err)
+	}
+}
+
+// TestHugeFileRoundTrip streams more than 8GB, so it runs only with WALG_TEST_HUGE_FILES set
+func TestHugeFileRoundTrip(t *testing.T) {
+	if os.Getenv("WALG_TEST_HUGE_FILES") == "" {
+		t.Skip("streams more than 8GB of zeroes, set WALG_TEST_HUGE_FILES to run")
+	}
+	data, err := ioutil.TempDir("", "large_tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+	source := filepath.Join(data, "source")
+	restored := filepath.Join(data, "restored")
+	err = os.MkdirAll(source, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sparse file over 8GB octal size limit with data at both ends
+	const hugeSize = int64(8<<30) + 4096
+	huge := filepath.Join(source, "huge")
+	chunks := map[int64]string{0: "head", int64(4 << 30): "middle", hugeSize - 4: "tail"}
+	f, err := os.Create(huge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset, chunk := range chunks {
+		_, err = f.WriteAt([]byte(chunk), offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	tarRoundTrip(t, source, restored)
+
+	f, err = os.Open(filepath.Join(restored, "huge"))
+	if err != nil {
+		t.Fatalf("tar: huge file was not restored: %v", err)
+	}
+	defer f.Close()
+	stat, _ := f.Stat()
+	if stat.Size() != hugeSize {
+		t.Errorf("tar: expected huge file of %d bytes, got %d", hugeSize, stat.Size())
+	}
+	for offset, expected := range chunks {
+		actual := make([]byte, len(expected))
+		f.ReadAt(actual, offset)
+		if !bytes.Equal(actual, []byte(expected)) {
+			t.Errorf("tar: expected '%s' at offset %d of huge file, got '%s'", expected, offset, actual)
+		}
+	}
+}
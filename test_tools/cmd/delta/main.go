@@ -96,7 +96,11 @@ func WipeRestore() {
 }
 
 func Fetch(pre *walg.Prefix) *uint64 {
-	return walg.HandleBackupFetch("LATEST", pre, restoreDir, false)
+	lsn, err := walg.HandleBackupFetch("LATEST", pre, restoreDir, false, walg.BackupFetchOptions{})
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
+	return lsn
 }
 
 func Diff(lsn uint64) {
@@ -225,5 +229,8 @@ func SetupBench() {
 	}
 }
 func Backup(tu *walg.TarUploader, pre *walg.Prefix) {
-	walg.HandleBackupPush(baseDir, tu, pre)
+	err := walg.HandleBackupPush(baseDir, tu, pre, false, false)
+	if err != nil {
+		log.Fatalf("%+v\n", err)
+	}
 }
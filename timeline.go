@@ -9,16 +9,38 @@ import (
 )
 
 func readTimeline(conn *pgx.Conn) (timeline uint32, err error) {
-	var bytesPerWalSegment uint32
-
 	// TODO: Check if this logic can be moved to queryRunner or abstracted away somehow
-	err = conn.QueryRow("select timeline_id, bytes_per_wal_segment from pg_control_checkpoint(), pg_control_init()").Scan(&timeline, &bytesPerWalSegment)
-	if err == nil && uint64(bytesPerWalSegment) != WalSegmentSize {
-		return 0, errors.New("bytes_per_wal_segment of the server does not match expected value")
-	}
+	err = conn.QueryRow("select timeline_id from pg_control_checkpoint()").Scan(&timeline)
 	return
 }
 
+// readWalSegmentSize asks the server for size of its WAL segments, chosen at initdb since Postgres 11
+func readWalSegmentSize(conn *pgx.Conn) (uint64, error) {
+	var setting string
+	err := conn.QueryRow("show wal_segment_size").Scan(&setting)
+	if err != nil {
+		return 0, errors.New("readWalSegmentSize: show wal_segment_size failed: " + err.Error())
+	}
+	return parseWalSegmentSize(setting)
+}
+
+// parseWalSegmentSize parses setting like 16MB in units of Postgres
+func parseWalSegmentSize(setting string) (uint64, error) {
+	units := map[string]uint64{"": 1, "B": 1, "kB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}
+	number := strings.TrimRightFunc(setting, func(r rune) bool { return r < '0' || r > '9' })
+	size, err := strconv.ParseUint(number, 10, 64)
+	unit, ok := units[setting[len(number):]]
+	if err != nil || !ok || !isValidWalSegmentSize(size*unit) {
+		return 0, errors.New("Unable to parse wal_segment_size " + setting)
+	}
+	return size * unit, nil
+}
+
+// isValidWalSegmentSize checks size is a power of two from 1MB to 1GB as Postgres requires
+func isValidWalSegmentSize(size uint64) bool {
+	return size >= minWalSegmentSize && size <= 1<<30 && size&(size-1) == 0
+}
+
 const (
 	sizeofInt32bits = sizeofInt32 * 8
 )
@@ -39,31 +61,50 @@ func ParseLsn(lsnStr string) (lsn uint64, err error) {
 }
 
 const (
-	// WalSegmentSize is the size of one WAL file
+	// WalSegmentSize is the default size of one WAL file, the only one before Postgres 11
 	WalSegmentSize = uint64(16 * 1024 * 1024) // xlog.c line 113ß
 
-	walFileFormat         = "%08X%08X%08X"               // xlog_internal.h line 155
-	xLogSegmentsPerXLogId = 0x100000000 / WalSegmentSize // xlog_internal.h line 101
+	// minWalSegmentSize is the least size of WAL file, which has the most segments in one logical file
+	minWalSegmentSize = uint64(1024 * 1024)
+
+	walFileFormat = "%08X%08X%08X" // xlog_internal.h line 155
 )
 
-// WALFileName formats WAL file name using PostgreSQL connection. Essentially reads timeline of the server.
-func WALFileName(lsn uint64, conn *pgx.Conn) (string, uint32, error) {
+// getSegmentsPerXLogId returns number of segments of walSegmentSize in one logical WAL file
+func getSegmentsPerXLogId(walSegmentSize uint64) uint64 {
+	return 0x100000000 / walSegmentSize // xlog_internal.h line 101
+}
+
+// WALFileName formats WAL file name of segments of walSegmentSize using PostgreSQL connection.
+// Essentially reads timeline of the server.
+func WALFileName(lsn uint64, walSegmentSize uint64, conn *pgx.Conn) (string, uint32, error) {
 	timeline, err := readTimeline(conn)
 	if err != nil {
 		return "", 0, err
 	}
 
-	logSegNo := (lsn - uint64(1)) / WalSegmentSize // xlog_internal.h line 121
+	return formatWALFileName(timeline, getPreviousSegmentNo(lsn, walSegmentSize), walSegmentSize), timeline, nil
+}
+
+// getPreviousSegmentNo computes number of WAL segment containing the byte preceding lsn
+func getPreviousSegmentNo(lsn uint64, walSegmentSize uint64) uint64 {
+	return (lsn - uint64(1)) / walSegmentSize // xlog_internal.h line 121
+}
 
-	return formatWALFileName(timeline, logSegNo), timeline, nil
+func formatWALFileName(timeline uint32, logSegNo uint64, walSegmentSize uint64) string {
+	segmentsPerXLogId := getSegmentsPerXLogId(walSegmentSize)
+	return fmt.Sprintf(walFileFormat, timeline, logSegNo/segmentsPerXLogId, logSegNo%segmentsPerXLogId)
 }
 
-func formatWALFileName(timeline uint32, logSegNo uint64) string {
-	return fmt.Sprintf(walFileFormat, timeline, logSegNo/xLogSegmentsPerXLogId, logSegNo%xLogSegmentsPerXLogId)
+// ParseWALFileName extracts timeline from WAL file name of segments of any size.
+// Number of segment depends on their size, see ParseWalSegmentName.
+func ParseWALFileName(name string) (timelineId uint32, err error) {
+	timelineId, _, err = parseWALFileName(name, minWalSegmentSize)
+	return
 }
 
-// ParseWALFileName extracts numeric parts from WAL file name
-func ParseWALFileName(name string) (timelineId uint32, logSegNo uint64, err error) {
+// parseWALFileName extracts numeric parts from name of WAL file of segments of walSegmentSize
+func parseWALFileName(name string, walSegmentSize uint64) (timelineId uint32, logSegNo uint64, err error) {
 	if len(name) != 24 {
 		err = errors.New("Not a WAL file name: " + name)
 		return
@@ -84,22 +125,36 @@ func ParseWALFileName(name string) (timelineId uint32, logSegNo uint64, err erro
 		err = err0
 		return
 	}
-	if logSegNoLo >= xLogSegmentsPerXLogId {
+	segmentsPerXLogId := getSegmentsPerXLogId(walSegmentSize)
+	if logSegNoLo >= segmentsPerXLogId {
 		err = errors.New("Incorrect logSegNoLo in WAL file name: " + name)
 		return
 	}
 
-	logSegNo = logSegNoHi*xLogSegmentsPerXLogId + logSegNoLo
+	logSegNo = logSegNoHi*segmentsPerXLogId + logSegNoLo
 	return
 }
 
-// NextWALFileName computes name of next WAL segment
-func NextWALFileName(name string) (nextname string, err error) {
-	timelineId, logSegNo, err0 := ParseWALFileName(name)
-	if err0 != nil {
-		err = err0
-		return
+// NextWALFileName computes name of next WAL segment of walSegmentSize
+func NextWALFileName(name string, walSegmentSize uint64) (nextname string, err error) {
+	segment, err := ParseWalSegmentName(name, walSegmentSize)
+	if err != nil {
+		return "", err
+	}
+	return segment.Next().String(), nil
+}
+
+// timelineHistorySuffix ends names of timeline history files, NNNNNNNN.history
+const timelineHistorySuffix = ".history"
+
+// ParseTimelineHistoryFileName extracts timeline from name of its history file
+func ParseTimelineHistoryFileName(name string) (timeline uint32, err error) {
+	if len(name) != 8+len(timelineHistorySuffix) || !strings.HasSuffix(name, timelineHistorySuffix) {
+		return 0, errors.New("Not a timeline history file name: " + name)
+	}
+	timeline64, err := strconv.ParseUint(name[:8], 0x10, sizeofInt32bits)
+	if err != nil {
+		return 0, errors.New("Not a timeline history file name: " + name)
 	}
-	logSegNo++
-	return formatWALFileName(uint32(timelineId), logSegNo), nil
+	return uint32(timeline64), nil
 }
@@ -0,0 +1,121 @@
+package walg
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// TimelineInfo describes one timeline found in the archive
+type TimelineInfo struct {
+	Timeline uint32
+	// Timeline this one was forked from and LSN of the switch, known from history file
+	HasHistory bool
+	Parent     uint32
+	SwitchLSN  uint64
+	// Archived segments of the timeline, first and last by name
+	SegmentCount int
+	FirstSegment string
+	LastSegment  string
+}
+
+// checkTimelineHistoryFile verifies that downloaded file is a valid timeline history
+func checkTimelineHistoryFile(file io.ReadSeeker) error {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "checkTimelineHistoryFile: failed to seek")
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return errors.Wrap(err, "checkTimelineHistoryFile: failed to read")
+	}
+	_, err = ParseTimelineHistory(data)
+	return err
+}
+
+// ListTimelines finds timelines of archived segments and history files, sorted by timeline.
+// History files are fetched to find where each timeline was forked.
+func ListTimelines(pre *Prefix) ([]TimelineInfo, error) {
+	names, err := listArchivedWALNames(pre)
+	if err != nil {
+		return nil, err
+	}
+	sortWALFileNames(names)
+	return listTimelinesOf(pre, names)
+}
+
+// listTimelinesOf finds timelines of names listed in folder of WAL, sorted by sortWALFileNames
+func listTimelinesOf(pre *Prefix, names []string) ([]TimelineInfo, error) {
+	timelines := make(map[uint32]*TimelineInfo)
+	get := func(timeline uint32) *TimelineInfo {
+		info, ok := timelines[timeline]
+		if !ok {
+			info = &TimelineInfo{Timeline: timeline}
+			timelines[timeline] = info
+		}
+		return info
+	}
+	for _, name := range names {
+		if timeline, err := ParseWALFileName(name); err == nil {
+			info := get(timeline)
+			if info.SegmentCount == 0 {
+				info.FirstSegment = name
+			}
+			info.LastSegment = name
+			info.SegmentCount++
+		} else if timeline, err := ParseTimelineHistoryFileName(name); err == nil {
+			history, err := fetchTimelineHistory(pre, timeline)
+			if err != nil {
+				return nil, err
+			}
+			info := get(timeline)
+			info.HasHistory = true
+			// The last record is the switch from the parent to this timeline
+			if len(history) > 0 {
+				info.Parent = history[len(history)-1].Timeline
+				info.SwitchLSN = history[len(history)-1].SwitchLSN
+			}
+		}
+	}
+
+	result := make([]TimelineInfo, 0, len(timelines))
+	for _, info := range timelines {
+		result = append(result, *info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Timeline < result[j].Timeline })
+	return result, nil
+}
+
+// HandleTimelineList is invoked to perform wal-g timeline-list
+func HandleTimelineList(pre *Prefix) error {
+	timelines, err := ListTimelines(pre)
+	if err != nil {
+		return err
+	}
+	if len(timelines) == 0 {
+		fmt.Println("No WAL found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "timeline\tparent\tswitch_lsn\tsegments\tfirst_segment\tlast_segment")
+	for _, info := range timelines {
+		parent, switchLSN := "-", "-"
+		if info.HasHistory {
+			parent = fmt.Sprintf("%d", info.Parent)
+			switchLSN = fmt.Sprintf("%x", info.SwitchLSN)
+		}
+		first, last := "-", "-"
+		if info.SegmentCount > 0 {
+			first, last = info.FirstSegment, info.LastSegment
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", info.Timeline, parent, switchLSN, info.SegmentCount, first, last)
+	}
+	return nil
+}
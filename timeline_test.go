@@ -13,40 +13,53 @@ func TestLSNParse(t *testing.T) {
 }
 
 func TestNextWALFileName(t *testing.T) {
-	nextname, err := NextWALFileName("000000010000000000000051")
+	nextname, err := NextWALFileName("000000010000000000000051", WalSegmentSize)
 	if err != nil || nextname != "000000010000000000000052" {
 		t.Fatal("TestNextWALFileName 000000010000000000000051 failed")
 	}
 
-	nextname, err = NextWALFileName("00000001000000000000005F")
+	nextname, err = NextWALFileName("00000001000000000000005F", WalSegmentSize)
 	if err != nil || nextname != "000000010000000000000060" {
 		t.Fatal("TestNextWALFileName 00000001000000000000005F failed")
 	}
 
-	nextname, err = NextWALFileName("0000000100000001000000FF")
+	nextname, err = NextWALFileName("0000000100000001000000FF", WalSegmentSize)
 	if err != nil || nextname != "000000010000000200000000" {
 		t.Fatal("TestNextWALFileName 0000000100000001000000FF failed")
 	}
 
-	_, err = NextWALFileName("0000000100000001000001FF")
+	_, err = NextWALFileName("0000000100000001000001FF", WalSegmentSize)
 	if err == nil {
 		t.Fatal("TestNextWALFileName 0000000100000001000001FF did not failed")
 	}
 
-	_, err = NextWALFileName("00000001000ZZ001000000FF")
+	_, err = NextWALFileName("00000001000ZZ001000000FF", WalSegmentSize)
 	if err == nil {
 		t.Fatal("TestNextWALFileName 00000001000ZZ001000001FF did not failed")
 	}
 
-	_, err = NextWALFileName("00000001000001000000FF")
+	_, err = NextWALFileName("00000001000001000000FF", WalSegmentSize)
 	if err == nil {
 		t.Fatal("TestNextWALFileName 00000001000001000001FF did not failed")
 	}
 
-	_, err = NextWALFileName("asdfasdf")
+	_, err = NextWALFileName("asdfasdf", WalSegmentSize)
 	if err == nil {
 		t.Fatal("TestNextWALFileName asdfasdf did not failed")
 	}
+
+	// Logical WAL file has only 64 segments of 64MB
+	nextname, err = NextWALFileName("00000001000000010000003F", 64<<20)
+	if err != nil || nextname != "000000010000000200000000" {
+		t.Fatal("TestNextWALFileName 00000001000000010000003F of 64MB failed")
+	}
+	_, err = NextWALFileName("000000010000000100000040", 64<<20)
+	if err == nil {
+		t.Fatal("TestNextWALFileName 000000010000000100000040 of 64MB did not failed")
+	}
+	if timeline, err := ParseWALFileName("0000000200000001000001FF"); err != nil || timeline != 2 {
+		t.Fatal("ParseWALFileName 0000000200000001000001FF of 1MB failed")
+	}
 }
 
 func TestPrefetchLocation(t *testing.T) {
@@ -58,3 +71,41 @@ func TestPrefetchLocation(t *testing.T) {
 		t.Fatal("TestPrefetchLocation failed")
 	}
 }
+
+func TestParseWalSegmentSize(t *testing.T) {
+	for setting, expected := range map[string]uint64{"16MB": 16 << 20, "64MB": 64 << 20, "1GB": 1 << 30, "1048576": 1 << 20} {
+		size, err := parseWalSegmentSize(setting)
+		if err != nil || size != expected {
+			t.Errorf("timeline: wal_segment_size %s parsed as %d, %v", setting, size, err)
+		}
+	}
+	for _, setting := range []string{"", "16", "24MB", "2GB", "16XB"} {
+		if _, err := parseWalSegmentSize(setting); err == nil {
+			t.Errorf("timeline: invalid wal_segment_size %s accepted", setting)
+		}
+	}
+}
+
+func TestFormatWALFileNameOf64MBSegments(t *testing.T) {
+	segmentSize := uint64(64 << 20)
+	name := formatWALFileName(1, getPreviousSegmentNo(0x104000000, segmentSize), segmentSize)
+	if name != "000000010000000100000000" {
+		t.Errorf("timeline: expected 000000010000000100000000 but got %s", name)
+	}
+	name = formatWALFileName(1, getPreviousSegmentNo(0xFFFFFFFF, segmentSize), segmentSize)
+	if name != "00000001000000000000003F" {
+		t.Errorf("timeline: expected 00000001000000000000003F but got %s", name)
+	}
+}
+
+func TestParseTimelineHistoryFileName(t *testing.T) {
+	timeline, err := ParseTimelineHistoryFileName("0000001A.history")
+	if err != nil || timeline != 0x1A {
+		t.Errorf("timeline: expected timeline 26 but got %d, %v", timeline, err)
+	}
+	for _, name := range []string{"00000002.history.lz4", "000000010000000000000002", "0000000G.history", "2.history"} {
+		if _, err := ParseTimelineHistoryFileName(name); err == nil {
+			t.Errorf("timeline: expected %s not to be a history file name", name)
+		}
+	}
+}
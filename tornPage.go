@@ -0,0 +1,118 @@
+package walg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// TornPageDetector checks pages of relation files read during backup-push.
+// Page which is not valid or was changed after start of backup could be read
+// while Postgres was writing it, such page is read again. If content differs
+// the read is counted as suspected torn and newer content is packed instead.
+type TornPageDetector struct {
+	StartLSN uint64
+
+	count int64
+}
+
+// NewTornPageDetector creates detector for backup started at startLSN
+func NewTornPageDetector(startLSN uint64) *TornPageDetector {
+	return &TornPageDetector{StartLSN: startLSN}
+}
+
+// Count returns number of suspected torn pages seen so far
+func (d *TornPageDetector) Count() int64 {
+	return atomic.LoadInt64(&d.count)
+}
+
+// Reader checks pages of relation file name read from r, file is used to read them again
+func (d *TornPageDetector) Reader(r io.Reader, file io.ReaderAt, name string) io.Reader {
+	return &tornPageReader{
+		detector: d,
+		name:     name,
+		internal: r,
+		file:     file,
+		page:     make([]byte, BlockSize),
+	}
+}
+
+func (d *TornPageDetector) checkPage(file io.ReaderAt, page []byte, offset int64, name string) error {
+	if allZero(page) {
+		return nil
+	}
+	lsn, valid := ParsePageHeader(page)
+	if valid && lsn < d.StartLSN {
+		return nil
+	}
+
+	reread := make([]byte, len(page))
+	_, err := file.ReadAt(reread, offset)
+	if err == io.EOF {
+		// File was truncated meanwhile, WAL replay takes care of it
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "TornPageDetector: failed to read again page at %d of %s", offset, name)
+	}
+	if bytes.Equal(page, reread) {
+		return nil
+	}
+	atomic.AddInt64(&d.count, 1)
+	fmt.Printf("Suspected torn page %d of %s, it changed while being read\n", offset/int64(BlockSize), name)
+	copy(page, reread)
+	return nil
+}
+
+// tornPageReader passes file through page by page, checking each of them
+type tornPageReader struct {
+	detector *TornPageDetector
+	name     string
+	internal io.Reader
+	file     io.ReaderAt
+	offset   int64
+	page     []byte
+	next     []byte
+}
+
+func (r *tornPageReader) Read(p []byte) (int, error) {
+	if len(r.next) == 0 {
+		n, err := io.ReadFull(r.internal, r.page)
+		if n == 0 {
+			return 0, err
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// Incomplete trailing page is not a page of relation, it is passed as is
+		if n == len(r.page) {
+			err = r.detector.checkPage(r.file, r.page, r.offset, r.name)
+			if err != nil {
+				return 0, err
+			}
+		}
+		r.offset += int64(n)
+		r.next = r.page[:n]
+	}
+	n := copy(p, r.next)
+	r.next = r.next[n:]
+	return n, nil
+}
+
+// getDetectTornPages tells whether WALG_DETECT_TORN_PAGES asks to check pages of relation files during backup-push
+func getDetectTornPages() (bool, error) {
+	detectStr, ok := os.LookupEnv("WALG_DETECT_TORN_PAGES")
+	if !ok {
+		return false, nil
+	}
+	detect, err := strconv.ParseBool(detectStr)
+	if err != nil {
+		return false, errors.Wrap(err, "getDetectTornPages: failed to parse WALG_DETECT_TORN_PAGES")
+	}
+	return detect, nil
+}
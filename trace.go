@@ -0,0 +1,324 @@
+package walg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// otlpTracesPath is appended to OTEL_EXPORTER_OTLP_ENDPOINT as the OTLP/HTTP spec requires
+const otlpTracesPath = "/v1/traces"
+
+// Span is one timed phase of an operation exported to OpenTelemetry collector.
+// When tracing is not configured spans are nil and all methods do nothing,
+// so callers never have to check whether tracing is enabled.
+type Span struct {
+	exporter   *SpanExporter
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	mutex      sync.Mutex
+}
+
+// SpanExporter collects finished spans and sends them to OTLP/HTTP endpoint in JSON encoding.
+type SpanExporter struct {
+	Endpoint    string
+	ServiceName string
+	Headers     map[string]string
+	Client      *http.Client
+
+	spans []*Span
+	mutex sync.Mutex
+}
+
+var (
+	tracer     *SpanExporter
+	tracerOnce sync.Once
+)
+
+// getTracer configures exporter from standard OTEL_* variables.
+// Returns nil if OTEL_EXPORTER_OTLP_ENDPOINT is not set.
+func getTracer() *SpanExporter {
+	tracerOnce.Do(func() {
+		endpoint, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+		if !ok {
+			endpoint, ok = os.LookupEnv("OTEL_EXPORTER_OTLP_ENDPOINT")
+			if !ok || endpoint == "" {
+				return
+			}
+			endpoint = strings.TrimSuffix(endpoint, "/") + otlpTracesPath
+		}
+		tracer = NewSpanExporter(endpoint)
+		if serviceName, ok := os.LookupEnv("OTEL_SERVICE_NAME"); ok && serviceName != "" {
+			tracer.ServiceName = serviceName
+		}
+		if headers, ok := os.LookupEnv("OTEL_EXPORTER_OTLP_HEADERS"); ok {
+			tracer.Headers = parseOTLPHeaders(headers)
+		}
+	})
+	return tracer
+}
+
+// NewSpanExporter creates exporter sending spans to given OTLP/HTTP traces url.
+func NewSpanExporter(endpoint string) *SpanExporter {
+	return &SpanExporter{
+		Endpoint:    endpoint,
+		ServiceName: "wal-g",
+		Headers:     make(map[string]string),
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// parseOTLPHeaders parses "key1=value1,key2=value2" list of OTEL_EXPORTER_OTLP_HEADERS
+func parseOTLPHeaders(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers
+}
+
+func randomHexID(n int) string {
+	id := make([]byte, n)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// StartSpan starts root span of operation. Returns nil if tracing is not configured.
+func StartSpan(name string) *Span {
+	return getTracer().StartSpan(name)
+}
+
+// StartSpan starts new root span exported by e.
+func (e *SpanExporter) StartSpan(name string) *Span {
+	if e == nil {
+		return nil
+	}
+	return &Span{
+		exporter:   e,
+		traceID:    randomHexID(16),
+		spanID:     randomHexID(8),
+		name:       name,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+}
+
+// StartChild starts span nested into s.
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		exporter:   s.exporter,
+		traceID:    s.traceID,
+		spanID:     randomHexID(8),
+		parentID:   s.spanID,
+		name:       name,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+}
+
+// SetAttribute sets string, bool, integer or float attribute of span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes[key] = value
+}
+
+// End finishes span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.end = time.Now()
+	s.mutex.Unlock()
+
+	s.exporter.mutex.Lock()
+	defer s.exporter.mutex.Unlock()
+	s.exporter.spans = append(s.exporter.spans, s)
+}
+
+// FlushTraces sends finished spans to collector. Failure to export is
+// logged but never fails the operation itself.
+func FlushTraces() {
+	err := getTracer().Flush()
+	if err != nil {
+		log.Printf("%+v\n", err)
+	}
+}
+
+// Flush sends all finished spans in one OTLP request.
+func (e *SpanExporter) Flush() error {
+	if e == nil {
+		return nil
+	}
+	e.mutex.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mutex.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return errors.Wrap(err, "Flush: failed to encode spans")
+	}
+	request, err := http.NewRequest(http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Flush: failed to create request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range e.Headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := e.Client.Do(request)
+	if err != nil {
+		return errors.Wrap(err, "Flush: failed to export spans")
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	if response.StatusCode/100 != 2 {
+		return errors.Errorf("Flush: collector responded %s", response.Status)
+	}
+	return nil
+}
+
+// Types below mirror OTLP/JSON encoding of ExportTraceServiceRequest
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+)
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		attribute.Value.StringValue = &v
+	case bool:
+		attribute.Value.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		attribute.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attribute.Value.IntValue = &s
+	case uint32:
+		s := strconv.FormatUint(uint64(v), 10)
+		attribute.Value.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		attribute.Value.IntValue = &s
+	case float64:
+		attribute.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attribute.Value.StringValue = &s
+	}
+	return attribute
+}
+
+func (e *SpanExporter) encode(spans []*Span) otlpTraceRequest {
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = []otlpAttribute{newOTLPAttribute("service.name", e.ServiceName)}
+
+	var scope otlpScopeSpans
+	scope.Scope.Name = "github.com/wal-g/wal-g"
+	for _, s := range spans {
+		s.mutex.Lock()
+		encoded := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{otlpStatusOk},
+		}
+		for key, value := range s.attributes {
+			encoded.Attributes = append(encoded.Attributes, newOTLPAttribute(key, value))
+		}
+		s.mutex.Unlock()
+		scope.Spans = append(scope.Spans, encoded)
+	}
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpTraceRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
@@ -0,0 +1,85 @@
+package walg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSpanExport(t *testing.T) {
+	var received otlpTraceRequest
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpTracesPath {
+			t.Errorf("trace: expected request to %s, got %s", otlpTracesPath, r.URL.Path)
+		}
+		authorization = r.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(r.Body)
+		err := json.Unmarshal(body, &received)
+		if err != nil {
+			t.Errorf("trace: collector failed to parse request: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	exporter := NewSpanExporter(server.URL + otlpTracesPath)
+	exporter.Headers = parseOTLPHeaders("Authorization=Bearer token, broken")
+
+	root := exporter.StartSpan("backup-push")
+	child := root.StartChild("upload")
+	child.SetAttribute("upload.bytes", int64(42))
+	child.SetAttribute("upload.partitions", 3)
+	child.End()
+	root.End()
+
+	err := exporter.Flush()
+	if err != nil {
+		t.Fatalf("trace: flush failed: %v", err)
+	}
+	if authorization != "Bearer token" {
+		t.Errorf("trace: expected header from OTEL_EXPORTER_OTLP_HEADERS, got '%s'", authorization)
+	}
+
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("trace: expected 2 spans, got %d", len(spans))
+	}
+	upload, push := spans[0], spans[1]
+	if upload.Name != "upload" || push.Name != "backup-push" {
+		t.Errorf("trace: unexpected span names %s, %s", upload.Name, push.Name)
+	}
+	if upload.TraceID != push.TraceID || upload.ParentSpanID != push.SpanID || push.ParentSpanID != "" {
+		t.Errorf("trace: upload span is not a child of backup-push")
+	}
+	if len(push.TraceID) != 32 || len(push.SpanID) != 16 {
+		t.Errorf("trace: malformed ids %s %s", push.TraceID, push.SpanID)
+	}
+
+	attributes := make(map[string]string)
+	for _, attribute := range upload.Attributes {
+		attributes[attribute.Key] = *attribute.Value.IntValue
+	}
+	if attributes["upload.bytes"] != "42" || attributes["upload.partitions"] != "3" {
+		t.Errorf("trace: unexpected attributes %v", attributes)
+	}
+
+	// Nothing left to send
+	err = exporter.Flush()
+	if err != nil {
+		t.Errorf("trace: empty flush failed: %v", err)
+	}
+}
+
+func TestNilSpan(t *testing.T) {
+	var exporter *SpanExporter
+	span := exporter.StartSpan("backup-fetch")
+	child := span.StartChild("extract")
+	child.SetAttribute("extract.partitions", 1)
+	child.End()
+	span.End()
+	if err := exporter.Flush(); err != nil {
+		t.Errorf("trace: disabled exporter returned %v", err)
+	}
+}
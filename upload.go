@@ -2,14 +2,18 @@ package walg
 
 import (
 	"archive/tar"
+	"crypto/tls"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/defaults"
@@ -19,11 +23,10 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 	"github.com/jackc/pgx"
-	"github.com/pierrec/lz4"
 	"github.com/pkg/errors"
 )
 
-// MAXRETRIES is the maximum number of retries for upload.
+// MAXRETRIES is the default number of retries of S3 request, see getS3MaxRetries.
 var MAXRETRIES = 7
 
 // Given an S3 bucket name, attempt to determine its region
@@ -57,20 +60,49 @@ func findS3BucketRegion(bucket string, config *aws.Config) (string, error) {
 // Requires these environment variables to be set:
 // WALE_S3_PREFIX
 //
+// If WALG_WRITER_COMMAND is set, objects are kept with commands instead of S3,
+// see CommandStorage. Prefix of gs:// scheme, in WALG_GCS_PREFIX or WALE_S3_PREFIX,
+// keeps them in Google Cloud Storage, see GCSStorage, azure:// in Azure Blob Storage,
+// and file:// in local directory, see FileStorage.
+//
 // Able to configure the upload part size in the S3 uploader.
 func Configure() (*TarUploader, *Prefix, error) {
+	if writerCommand, ok := os.LookupEnv("WALG_WRITER_COMMAND"); ok && writerCommand != "" {
+		return configureCommandStorage(writerCommand)
+	}
+
 	waleS3Prefix := os.Getenv("WALE_S3_PREFIX")
+	if gcsPrefix := os.Getenv("WALG_GCS_PREFIX"); gcsPrefix != "" {
+		waleS3Prefix = gcsPrefix
+	}
 	if waleS3Prefix == "" {
 		return nil, nil, &UnsetEnvVarError{names: []string{"WALE_S3_PREFIX"}}
 	}
+	return ConfigurePrefix(waleS3Prefix)
+}
 
-	u, err := url.Parse(waleS3Prefix)
+// ConfigurePrefix connects to storage at prefixURL, given in the form of WALE_S3_PREFIX,
+// e.g. destination of wal-g copy. Credentials and other settings come from environment.
+func ConfigurePrefix(prefixURL string) (*TarUploader, *Prefix, error) {
+	u, err := url.Parse(prefixURL)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "Configure: failed to parse url '%s'", waleS3Prefix)
+		return nil, nil, errors.Wrapf(err, "Configure: failed to parse url '%s'", prefixURL)
+	}
+	if u.Scheme == "file" {
+		return configureFileStorage(u)
 	}
 	if u.Scheme == "" || u.Host == "" {
 		return nil, nil, fmt.Errorf("Missing url scheme=%q and/or host=%q", u.Scheme, u.Host)
 	}
+	if u.Scheme == "ssh" {
+		return configureSFTPStorage(u)
+	}
+	if u.Scheme == "gs" {
+		return configureGCSStorage(u)
+	}
+	if u.Scheme == "azure" {
+		return configureAzureStorage(u)
+	}
 
 	bucket := u.Host
 	var server = ""
@@ -92,17 +124,9 @@ func Configure() (*TarUploader, *Prefix, error) {
 		return nil, nil, errors.Wrapf(err, "Configure: failed to get AWS credentials; please specify AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
 	}
 
-	if endpoint := os.Getenv("AWS_ENDPOINT"); endpoint != "" {
-		config.Endpoint = aws.String(endpoint)
-	}
-
-	s3ForcePathStyleStr := os.Getenv("AWS_S3_FORCE_PATH_STYLE")
-	if len(s3ForcePathStyleStr) > 0 {
-		s3ForcePathStyle, err := strconv.ParseBool(s3ForcePathStyleStr)
-		if err != nil {
-			return nil, nil, errors.Wrap(err, "Configure: failed parse AWS_S3_FORCE_PATH_STYLE")
-		}
-		config.S3ForcePathStyle = aws.Bool(s3ForcePathStyle)
+	err = configureS3Endpoint(config)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	region := os.Getenv("AWS_REGION")
@@ -115,11 +139,13 @@ func Configure() (*TarUploader, *Prefix, error) {
 	config = config.WithRegion(region)
 
 	pre := &Prefix{
-		Bucket: aws.String(bucket),
-		Server: aws.String(server),
+		Bucket:              aws.String(bucket),
+		Server:              aws.String(server),
+		DownloadRateLimiter: NewRateLimiter(getDownloadRateLimit()),
 	}
 
-	sess, err := session.NewSession(config)
+	// Requests of svc are retried by retryS3 alone, which logs every retry, see upload for streamed bodies
+	sess, err := session.NewSession(config.WithMaxRetries(0))
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "Configure: failed to create new session")
 	}
@@ -133,56 +159,147 @@ func Configure() (*TarUploader, *Prefix, error) {
 	if ok {
 		upload.StorageClass = storageClass
 	}
+	upload.WALStorageClass = os.Getenv("WALG_S3_WAL_STORAGE_CLASS")
 
-	serverSideEncryption, ok := os.LookupEnv("WALG_S3_SSE")
-	if ok {
-		upload.ServerSideEncryption = serverSideEncryption
+	upload.ServerSideEncryption, upload.SSEKMSKeyId, err = getServerSideEncryption()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	sseKmsKeyId, ok := os.LookupEnv("WALG_S3_SSE_KMS_ID")
-	if ok {
-		upload.SSEKMSKeyId = sseKmsKeyId
+	upload.Upl = CreateUploader(pre.Svc, getUploadPartSize(), con) //default 10 concurrency streams at 20MB
+
+	return upload, pre, err
+}
+
+// lookupS3Setting prefers WALG_S3_* variable over its AWS_* counterpart
+func lookupS3Setting(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
 	}
+	return os.Getenv(fallback)
+}
 
-	// Only aws:kms implies sseKmsKeyId
-	if (serverSideEncryption == "aws:kms") == (sseKmsKeyId == "") {
-		return nil, nil, errors.New("Configure: WALG_S3_SSE_KMS_ID must be set iff using aws:kms encryption")
+// getServerSideEncryption reads algorithm of S3 server-side encryption, set on every
+// upload along with the KMS key. It is independent of client-side encryption by
+// WALE_GPG_KEY_ID. aws:kms without key uses the default KMS key of the bucket.
+func getServerSideEncryption() (sse string, kmsKeyID string, err error) {
+	sse = os.Getenv("WALG_S3_SSE")
+	kmsKeyID = os.Getenv("WALG_S3_SSE_KMS_KEY_ID")
+	if kmsKeyID == "" {
+		// Former name of the setting
+		kmsKeyID = os.Getenv("WALG_S3_SSE_KMS_ID")
+	}
+	switch sse {
+	case "", "AES256", "aws:kms":
+	default:
+		return "", "", errors.Errorf("getServerSideEncryption: unknown WALG_S3_SSE '%s', expected AES256 or aws:kms", sse)
+	}
+	if kmsKeyID != "" && sse != "aws:kms" {
+		return "", "", errors.New("getServerSideEncryption: WALG_S3_SSE_KMS_KEY_ID is set but WALG_S3_SSE is not aws:kms")
+	}
+	return sse, kmsKeyID, nil
+}
+
+// configureS3Endpoint points config at S3-compatible service of WALG_S3_ENDPOINT,
+// such as MinIO or Ceph, with path-style addressing of WALG_S3_FORCE_PATH_STYLE.
+// WALG_S3_SKIP_CERT_VERIFY disables TLS verification for certificates of internal CA.
+func configureS3Endpoint(config *aws.Config) error {
+	if endpoint := lookupS3Setting("WALG_S3_ENDPOINT", "AWS_ENDPOINT"); endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
 	}
 
-	upload.Upl = CreateUploader(pre.Svc, 20*1024*1024, con) //default 10 concurrency streams at 20MB
+	if forcePathStyle := lookupS3Setting("WALG_S3_FORCE_PATH_STYLE", "AWS_S3_FORCE_PATH_STYLE"); forcePathStyle != "" {
+		s3ForcePathStyle, err := strconv.ParseBool(forcePathStyle)
+		if err != nil {
+			return errors.Wrap(err, "configureS3Endpoint: failed to parse WALG_S3_FORCE_PATH_STYLE")
+		}
+		config.S3ForcePathStyle = aws.Bool(s3ForcePathStyle)
+	}
 
-	return upload, pre, err
+	if skipVerify := os.Getenv("WALG_S3_SKIP_CERT_VERIFY"); skipVerify != "" {
+		insecure, err := strconv.ParseBool(skipVerify)
+		if err != nil {
+			return errors.Wrap(err, "configureS3Endpoint: failed to parse WALG_S3_SKIP_CERT_VERIFY")
+		}
+		if insecure {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			config.HTTPClient = &http.Client{Transport: transport}
+		}
+	}
+	return nil
+}
+
+// getUploadPartSize reads WALG_UPLOAD_PART_SIZE, size in bytes of parts of multipart
+// uploads. S3 does not accept parts smaller than 5MB, except the last one.
+func getUploadPartSize() int {
+	partSize, ok := os.LookupEnv("WALG_UPLOAD_PART_SIZE")
+	if !ok {
+		return 20 * 1024 * 1024
+	}
+	size, err := strconv.Atoi(partSize)
+	if err != nil {
+		log.Fatal("Unable to parse WALG_UPLOAD_PART_SIZE ", err)
+	}
+	if int64(size) < s3manager.MinUploadPartSize {
+		log.Fatalf("WALG_UPLOAD_PART_SIZE must be at least %d bytes", s3manager.MinUploadPartSize)
+	}
+	return size
 }
 
 // CreateUploader returns an uploader with customizable concurrency
-// and partsize.
+// and partsize. Objects larger than partsize are uploaded by multipart
+// upload, concurrency parts at once. Each part is buffered, so a failed
+// part of streamed body is retried alone, see upload.
 func CreateUploader(svc s3iface.S3API, partsize, concurrency int) s3manageriface.UploaderAPI {
 	up := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
 		u.PartSize = int64(partsize)
 		u.Concurrency = concurrency
+		// Failed multipart upload is aborted, so its parts are not kept and billed
+		u.LeavePartsOnError = false
 	})
 	return up
 }
 
-// Helper function to upload to S3. If an error occurs during upload, retries will
-// occur in exponentially incremental seconds.
+// Helper function to upload to S3. If an error occurs during upload of seekable body,
+// retries will occur in exponentially incremental delays, see retryS3.
 func (tu *TarUploader) upload(input *s3manager.UploadInput, path string) (err error) {
 	upl := tu.Upl
 
-	_, e := upl.Upload(input)
+	var e error
+	if seeker, ok := input.Body.(io.Seeker); ok {
+		e = retryS3("upload "+path, func() error {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			_, err := upl.Upload(input)
+			return err
+		})
+	} else {
+		// Streamed body can't be read again, so its buffered parts are retried instead,
+		// by the client of uploader as many times as retryS3 would
+		_, e = upl.Upload(input, s3manager.WithUploaderRequestOptions(withS3MaxRetries(getS3MaxRetries())))
+	}
 	if e == nil {
-		tu.Success = true
 		return nil
 	}
 
 	if multierr, ok := e.(s3manager.MultiUploadFailure); ok {
-		log.Printf("upload: failed to upload '%s' with UploadID '%s'.", path, multierr.UploadID())
+		log.Printf("upload: failed to upload '%s' with UploadID '%s', incomplete multipart upload is aborted.", path, multierr.UploadID())
 	} else {
 		log.Printf("upload: failed to upload '%s': %s.", path, e.Error())
 	}
 	return e
 }
 
+// storageClassOf tells storage class of object at path, WAL may be kept in other class than backups
+func (tu *TarUploader) storageClassOf(path string) string {
+	if tu.WALStorageClass != "" && strings.HasPrefix(path, GetWALPath(tu.server)) {
+		return tu.WALStorageClass
+	}
+	return tu.StorageClass
+}
+
 // createUploadInput creates a s3manager.UploadInput for a TarUploader using
 // the specified path and reader.
 func (tu *TarUploader) createUploadInput(path string, reader io.Reader) *s3manager.UploadInput {
@@ -190,7 +307,7 @@ func (tu *TarUploader) createUploadInput(path string, reader io.Reader) *s3manag
 		Bucket:       aws.String(tu.bucket),
 		Key:          aws.String(path),
 		Body:         reader,
-		StorageClass: aws.String(tu.StorageClass),
+		StorageClass: aws.String(tu.storageClassOf(path)),
 	}
 
 	if tu.ServerSideEncryption != "" {
@@ -212,7 +329,6 @@ func (s *S3TarBall) StartUpload(name string, crypter Crypter) io.WriteCloser {
 	tupl := s.tu
 
 	path := tupl.server + "/basebackups_005/" + s.bkupName + "/tar_partitions/" + name
-	input := tupl.createUploadInput(path, pr)
 
 	fmt.Printf("Starting part %d ...\n", s.number)
 
@@ -220,7 +336,15 @@ func (s *S3TarBall) StartUpload(name string, crypter Crypter) io.WriteCloser {
 	go func() {
 		defer tupl.wg.Done()
 
-		err := tupl.upload(input, path)
+		// Checksum of stored body goes to backup index, see uploadBackupIndex
+		checksum := newMemberChecksum()
+		err := tupl.put(path, io.TeeReader(pr, checksum))
+		if err == nil {
+			tupl.markSuccess()
+			if tupl.partitionChecksums != nil {
+				tupl.partitionChecksums.Store(sanitizePath(path), checksum.Sum32())
+			}
+		}
 		if re, ok := err.(Lz4Error); ok {
 
 			log.Printf("FATAL: could not upload '%s' due to compression error\n%+v\n", path, re)
@@ -236,16 +360,18 @@ func (s *S3TarBall) StartUpload(name string, crypter Crypter) io.WriteCloser {
 		wc, err := crypter.Encrypt(pw)
 
 		if err != nil {
-			log.Fatal("upload: encryption error ",err)
+			// Writes of the partition fail, so that the error is returned by the walk instead of exiting
+			pw.CloseWithError(errors.Wrap(err, "upload: encryption error"))
+			return &Lz4CascadeClose{newCompressingWriter(pw), pw}
 		}
 
-		return &Lz4CascadeClose2{lz4.NewWriter(wc), wc, pw}
+		return &Lz4CascadeClose2{newCompressingWriter(wc), wc, pw}
 	}
 
-	return &Lz4CascadeClose{lz4.NewWriter(pw), pw}
+	return &Lz4CascadeClose{newCompressingWriter(pw), pw}
 }
 
-// UploadWal compresses a WAL file using LZ4 and uploads to S3. Returns
+// UploadWal compresses a WAL file using WALG_COMPRESSION_METHOD and uploads to S3. Returns
 // the first error encountered and an empty string upon failure.
 func (tu *TarUploader) UploadWal(path string, pre *Prefix, verify bool) (string, error) {
 	f, err := os.Open(path)
@@ -253,53 +379,83 @@ func (tu *TarUploader) UploadWal(path string, pre *Prefix, verify bool) (string,
 		return "", errors.Wrapf(err, "UploadWal: failed to open file %s\n", path)
 	}
 
+	// Checksum of uncompressed file is verified by wal-fetch before file is handed to Postgres
+	checksum := newMemberChecksum()
 	lz := &LzPipeWriter{
-		Input: f,
+		Input: io.TeeReader(f, checksum),
 	}
 
-	lz.Compress(&OpenPGPCrypter{})
+	lz.Compress(NewCrypter())
 
-	p := sanitizePath(tu.server + "/wal_005/" + filepath.Base(path) + ".lz4")
+	p := GetWALPath(tu.server) + filepath.Base(path) + "." + compressionFileFormat(getCompressionMethod())
 	reader := lz.Output
 
-	if verify {
-		reader = newMd5Reader(reader)
+	// History and backup label files are small by nature, only segments are checked
+	var sizeChecker *minSizeReader
+	floor := getWALMinCompressedSize()
+	if _, err := ParseWALFileName(filepath.Base(path)); err == nil && floor > 0 {
+		sizeChecker = &minSizeReader{internal: reader, floor: floor, path: path}
+		reader = sizeChecker
 	}
 
-	input := tu.createUploadInput(p, reader)
+	// ETag is computed while body is uploaded, so verification does not download it
+	var etag *etagReader
+	if verify {
+		etag = newETagReader(reader, int64(getUploadPartSize()))
+		reader = etag
+	}
 
 	tu.wg.Add(1)
 	go func() {
 		defer tu.wg.Done()
-		err = tu.upload(input, path)
-
+		err = tu.put(p, reader)
+		if err == nil {
+			tu.markSuccess()
+		}
 	}()
 
 	tu.Finish()
+	if sizeChecker != nil && sizeChecker.err != nil {
+		// Upload failed reading body, report the cause instead of storage error
+		return p, sizeChecker.err
+	}
+	if err == nil {
+		err = tu.uploadWALChecksum(filepath.Base(path), checksum.Sum32())
+	}
 	fmt.Println("WAL PATH:", p)
-	if verify {
-		sum := reader.(*md5Reader).Sum()
-		a := &Archive{
-			Prefix:  pre,
-			Archive: aws.String(p),
-		}
-		eTag, err := a.GetETag()
-		if err != nil {
-			log.Fatalf("Unable to verify WAL %s", err)
-		}
-		if eTag == nil {
-			log.Fatalf("Unable to verify WAL: nil ETag ")
-		}
-
-		trimETag := strings.Trim(*eTag, "\"")
-		if sum != trimETag {
-			log.Fatalf("WAL verification failed: md5 %s ETag %s", sum, trimETag)
-		}
-		fmt.Println("ETag ", trimETag)
+	if verify && err == nil {
+		err = tu.verifyWALUpload(pre, p, etag)
 	}
 	return p, err
 }
 
+// verifyWALUpload compares ETag of uploaded object with the one computed from its body during
+// upload, single or multipart, so corruption on the way to storage fails the push
+func (tu *TarUploader) verifyWALUpload(pre *Prefix, key string, body *etagReader) error {
+	if tu.ServerSideEncryption == "aws:kms" {
+		log.Printf("WARNING: ETag of %s encrypted with aws:kms is not MD5 of its body, upload is not verified\n", key)
+		return nil
+	}
+	a := &Archive{
+		Prefix:  pre,
+		Archive: aws.String(key),
+	}
+	eTag, err := a.GetETag()
+	if err != nil {
+		return errors.Wrapf(err, "verifyWALUpload: failed to get ETag of %s", key)
+	}
+	if eTag == nil {
+		return errors.Errorf("verifyWALUpload: storage returned no ETag of %s", key)
+	}
+
+	actual := strings.Trim(*eTag, "\"")
+	if expected := body.ExpectedETag(actual); actual != expected {
+		return errors.Errorf("verifyWALUpload: ETag of %s is %s, but uploaded body has %s", key, actual, expected)
+	}
+	fmt.Println("ETag ", actual)
+	return nil
+}
+
 // HandleSentinel uploads the compressed tar file of `pg_control`. Will only be called
 // after the rest of the backup is successfully uploaded to S3. Returns
 // an error upon failure.
@@ -310,7 +466,7 @@ func (bundle *Bundle) HandleSentinel() error {
 
 	bundle.NewTarBall(false)
 	tarBall := bundle.Tb
-	tarBall.SetUp(&bundle.Crypter, "pg_control.tar.lz4")
+	tarBall.SetUp(bundle.Crypter, "pg_control.tar."+compressionFileFormat(getCompressionMethod()))
 	tarWriter := tarBall.Tw()
 
 	hdr, err := tar.FileInfoHeader(info, fileName)
@@ -332,8 +488,12 @@ func (bundle *Bundle) HandleSentinel() error {
 			return errors.Wrapf(err, "HandleSentinel: failed to open file %s\n", path)
 		}
 
+		var checksum hash.Hash
+		if bundle.Manifest != nil {
+			checksum = bundle.Manifest.NewChecksum()
+		}
 		lim := &io.LimitedReader{
-			R: f,
+			R: checksumReader(f, checksum),
 			N: int64(hdr.Size),
 		}
 
@@ -341,6 +501,9 @@ func (bundle *Bundle) HandleSentinel() error {
 		if err != nil {
 			return errors.Wrap(err, "HandleSentinel: copy failed")
 		}
+		if bundle.Manifest != nil {
+			bundle.Manifest.AddFile(hdr.Name, hdr.Size, info.ModTime(), checksum.Sum(nil))
+		}
 
 		tarBall.AddSize(hdr.Size)
 		f.Close()
@@ -365,6 +528,11 @@ func (bundle *Bundle) HandleLabelFiles(conn *pgx.Conn) (uint64, error) {
 	if err != nil {
 		return 0, errors.Wrap(err, "HandleLabelFiles: Failed to build query runner.")
 	}
+	wait, err := getStopBackupWaitArchive()
+	if err != nil {
+		return 0, err
+	}
+	queryRunner.NoArchiveWait = !wait
 	lb, sc, lsnStr, err = queryRunner.StopBackup()
 	if err != nil {
 		return 0, errors.Wrap(err, "HandleLabelFiles: failed to stop backup")
@@ -378,50 +546,109 @@ func (bundle *Bundle) HandleLabelFiles(conn *pgx.Conn) (uint64, error) {
 	if queryRunner.Version < 90600 {
 		return lsn, nil
 	}
+	// Without backup_label restore does not know the checkpoint to start redo from
+	if lb == "" {
+		return 0, errors.Errorf("HandleLabelFiles: stop backup of Postgres %d returned empty backup_label", queryRunner.Version)
+	}
 
 	bundle.NewTarBall(false)
 	tarBall := bundle.Tb
-	tarBall.SetUp(&bundle.Crypter)
+	tarBall.SetUp(bundle.Crypter)
 	tarWriter := tarBall.Tw()
 
-	lhdr := &tar.Header{
-		Name:     "backup_label",
-		Mode:     int64(0600),
-		Size:     int64(len(lb)),
-		Typeflag: tar.TypeReg,
+	err = writeLabelFile(tarWriter, "backup_label", lb, bundle.Manifest)
+	if err != nil {
+		return 0, err
 	}
-
-	err = tarWriter.WriteHeader(lhdr)
+	err = writeLabelFile(tarWriter, "tablespace_map", sc, bundle.Manifest)
 	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: failed to write header")
+		return 0, err
+	}
+	// Manifest lists label files, so it is written after them
+	if bundle.Manifest != nil {
+		err = writeLabelFile(tarWriter, BackupManifestName, string(bundle.Manifest.Bytes(lsn)), nil)
+		if err != nil {
+			return 0, err
+		}
 	}
-	_, err = io.Copy(tarWriter, strings.NewReader(lb))
+
+	err = tarBall.CloseTar()
 	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: copy failed")
+		return 0, errors.Wrap(err, "HandleLabelFiles: failed to close tarball")
 	}
-	fmt.Println(lhdr.Name)
 
-	shdr := &tar.Header{
-		Name:     "tablespace_map",
+	return lsn, nil
+}
+
+// writeLabelFile writes file with given content to tarball of label files and records it in manifest
+func writeLabelFile(tarWriter *tar.Writer, name string, content string, manifest *BackupManifest) error {
+	hdr := &tar.Header{
+		Name:     name,
 		Mode:     int64(0600),
-		Size:     int64(len(sc)),
+		Size:     int64(len(content)),
+		ModTime:  time.Now(),
 		Typeflag: tar.TypeReg,
 	}
 
-	err = tarWriter.WriteHeader(shdr)
+	err := tarWriter.WriteHeader(hdr)
 	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: failed to write header")
+		return errors.Wrap(err, "HandleLabelFiles: failed to write header")
 	}
-	_, err = io.Copy(tarWriter, strings.NewReader(sc))
+	_, err = io.Copy(tarWriter, strings.NewReader(content))
 	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: copy failed")
+		return errors.Wrap(err, "HandleLabelFiles: copy failed")
+	}
+	if manifest != nil {
+		checksum := manifest.NewChecksum()
+		checksum.Write([]byte(content))
+		manifest.AddFile(name, hdr.Size, hdr.ModTime, checksum.Sum(nil))
 	}
-	fmt.Println(shdr.Name)
+	fmt.Println(hdr.Name)
+	return nil
+}
 
-	err = tarBall.CloseTar()
+// getStopBackupWaitArchive tells whether stop backup waits for WAL of backup to be archived, true by default
+func getStopBackupWaitArchive() (bool, error) {
+	waitStr, ok := os.LookupEnv("WALG_STOP_BACKUP_WAIT_FOR_ARCHIVE")
+	if !ok {
+		return true, nil
+	}
+	wait, err := strconv.ParseBool(waitStr)
 	if err != nil {
-		return 0, errors.Wrap(err, "HandleLabelFiles: failed to close tarball")
+		return false, errors.Wrap(err, "getStopBackupWaitArchive: failed to parse WALG_STOP_BACKUP_WAIT_FOR_ARCHIVE")
 	}
+	return wait, nil
+}
 
-	return lsn, nil
+// getWALMinCompressedSize returns minimal plausible size of compressed WAL segment, 0 disables the check
+func getWALMinCompressedSize() int64 {
+	floorStr, ok := os.LookupEnv("WALG_WAL_MIN_COMPRESSED_SIZE")
+	if !ok {
+		return 0
+	}
+	floor, err := strconv.ParseInt(floorStr, 10, 64)
+	if err != nil {
+		log.Fatal("Unable to parse WALG_WAL_MIN_COMPRESSED_SIZE ", err)
+	}
+	return floor
+}
+
+// minSizeReader fails at the end of input smaller than floor,
+// so that upload is aborted instead of storing the object
+type minSizeReader struct {
+	internal io.Reader
+	size     int64
+	floor    int64
+	path     string
+	err      error
+}
+
+func (r *minSizeReader) Read(p []byte) (n int, err error) {
+	n, err = r.internal.Read(p)
+	r.size += int64(n)
+	if err == io.EOF && r.size < r.floor {
+		r.err = CompressedWALTooSmallError{r.path, r.size, r.floor}
+		err = r.err
+	}
+	return
 }
@@ -0,0 +1,69 @@
+// This test file is located within the walg package in order to access the
+// unexported configureS3Endpoint function.
+package walg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestS3CustomEndpoint(t *testing.T) {
+	var paths []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Host+r.URL.Path)
+	}))
+	defer server.Close()
+
+	env := map[string]string{
+		"WALG_S3_ENDPOINT":         server.URL,
+		"AWS_ENDPOINT":             "http://ignored:9000",
+		"WALG_S3_FORCE_PATH_STYLE": "true",
+		"WALG_S3_SKIP_CERT_VERIFY": "true",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	config := aws.NewConfig().
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("key", "secret", ""))
+	err := configureS3Endpoint(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aws.BoolValue(config.S3ForcePathStyle) {
+		t.Errorf("upload: expected WALG_S3_FORCE_PATH_STYLE to enable path-style addressing")
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s3.New(sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("server/wal_005/000000010000000000000001.lz4"),
+	})
+	if err != nil {
+		t.Errorf("upload: expected request to endpoint with self-signed certificate to succeed but got %v", err)
+	}
+	expected := server.Listener.Addr().String() + "/bucket/server/wal_005/000000010000000000000001.lz4"
+	if len(paths) != 1 || paths[0] != expected {
+		t.Errorf("upload: expected path-style request %s but got %v", expected, paths)
+	}
+}
+
+func TestS3CustomEndpointErrors(t *testing.T) {
+	os.Setenv("WALG_S3_SKIP_CERT_VERIFY", "maybe")
+	defer os.Unsetenv("WALG_S3_SKIP_CERT_VERIFY")
+	err := configureS3Endpoint(aws.NewConfig())
+	if err == nil {
+		t.Errorf("upload: expected invalid WALG_S3_SKIP_CERT_VERIFY to fail but got `<nil>`")
+	}
+}
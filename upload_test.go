@@ -1,9 +1,25 @@
 package walg_test
 
 import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/wal-g/wal-g"
 )
 
@@ -193,3 +209,375 @@ func TestUploadError(t *testing.T) {
 		t.Errorf("upload: UploadWal expected error but got `<nil>`")
 	}
 }
+
+func TestUploadWalMinCompressedSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("WALG_WAL_MIN_COMPRESSED_SIZE")
+
+	// Segment of zeroes compresses to almost nothing
+	segment := filepath.Join(dir, "000000010000000000000002")
+	err = ioutil.WriteFile(segment, make([]byte, walg.WalSegmentSize), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tu, pre, client := newMemoryStorage()
+	_, err = tu.UploadWal(segment, pre, false)
+	if err != nil {
+		t.Errorf("upload: check must be disabled by default, got %v", err)
+	}
+
+	os.Setenv("WALG_WAL_MIN_COMPRESSED_SIZE", "1048576")
+	tu, pre, client = newMemoryStorage()
+	_, err = tu.UploadWal(segment, pre, false)
+	if _, ok := err.(walg.CompressedWALTooSmallError); !ok {
+		t.Errorf("upload: expected CompressedWALTooSmallError but got %v", err)
+	}
+	if len(client.objects) != 0 {
+		t.Errorf("upload: suspiciously small WAL was stored")
+	}
+}
+
+// fakeMultipartS3 serves the multipart upload subset of S3 REST API
+type fakeMultipartS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	parts   map[int][]byte
+	// requests counts UploadPart requests by part number
+	requests map[int]int
+	// failParts makes that many requests of part number fail
+	failParts map[int]int
+	aborted   bool
+	// requiredSSE denies uploads without this server-side encryption, like bucket policy does
+	requiredSSE    string
+	requiredKMSKey string
+	// classes records storage class requested for each object
+	classes map[string]string
+}
+
+func (f *fakeMultipartS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	_, uploads := query["uploads"]
+	initiates := r.Method == http.MethodPost && uploads || r.Method == http.MethodPut && query.Get("partNumber") == ""
+	if initiates && f.requiredSSE != "" && (r.Header.Get("X-Amz-Server-Side-Encryption") != f.requiredSSE ||
+		r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id") != f.requiredKMSKey) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>")
+		return
+	}
+	if initiates {
+		f.classes[r.URL.Path] = r.Header.Get("X-Amz-Storage-Class")
+	}
+	switch {
+	case r.Method == http.MethodPost && uploads:
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == http.MethodPut && query.Get("partNumber") != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.requests[number]++
+		if f.failParts[number] > 0 {
+			f.failParts[number]--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f.parts[number] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", number))
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		var object []byte
+		for number := 1; number <= len(f.parts); number++ {
+			object = append(object, f.parts[number]...)
+		}
+		f.objects[r.URL.Path] = object
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		f.aborted = true
+		f.parts = make(map[int][]byte)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[r.URL.Path] = body
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newFakeMultipartS3(t *testing.T) (*fakeMultipartS3, *httptest.Server, *s3.S3) {
+	fake := &fakeMultipartS3{
+		objects:   make(map[string][]byte),
+		parts:     make(map[int][]byte),
+		requests:  make(map[int]int),
+		failParts: make(map[int]int),
+		classes:   make(map[string]string),
+	}
+	server := httptest.NewServer(fake)
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(3),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, server, s3.New(sess)
+}
+
+func TestMultipartUploadRetriesPart(t *testing.T) {
+	fake, server, svc := newFakeMultipartS3(t)
+	defer server.Close()
+	fake.failParts[2] = 1
+
+	partSize := s3manager.MinUploadPartSize
+	content := bytes.Repeat([]byte("wal-g"), int(3*partSize)/5)
+	upl := walg.CreateUploader(svc, int(partSize), 2)
+	_, err := upl.Upload(&s3manager.UploadInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("basebackups_005/part_1.tar.lz4"),
+		Body:   bytes.NewReader(content),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fake.objects["/bucket/basebackups_005/part_1.tar.lz4"], content) {
+		t.Errorf("upload: object assembled from parts differs")
+	}
+	for number, expected := range map[int]int{1: 1, 2: 2, 3: 1} {
+		if fake.requests[number] != expected {
+			t.Errorf("upload: part %d expected to be sent %d times but was sent %d", number, expected, fake.requests[number])
+		}
+	}
+}
+
+func TestMultipartUploadAbort(t *testing.T) {
+	fake, server, svc := newFakeMultipartS3(t)
+	defer server.Close()
+	fake.failParts[2] = 100
+
+	partSize := s3manager.MinUploadPartSize
+	upl := walg.CreateUploader(svc, int(partSize), 2)
+	_, err := upl.Upload(&s3manager.UploadInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("basebackups_005/part_1.tar.lz4"),
+		Body:   bytes.NewReader(make([]byte, 3*partSize)),
+	})
+	if _, ok := err.(s3manager.MultiUploadFailure); !ok {
+		t.Fatalf("upload: expected MultiUploadFailure but got %v", err)
+	}
+	if !fake.aborted || len(fake.parts) != 0 {
+		t.Errorf("upload: incomplete multipart upload is left in storage")
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("upload: failed upload produced an object")
+	}
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	fake, server, _ := newFakeMultipartS3(t)
+	defer server.Close()
+	fake.requiredSSE = "aws:kms"
+	fake.requiredKMSKey = "key"
+
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	segment := filepath.Join(dir, "000000010000000000000002")
+	if err = ioutil.WriteFile(segment, []byte("segment"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	setFake(t)
+	defer setEmpty(t)
+	os.Setenv("WALE_S3_PREFIX", "s3://bucket/server")
+	os.Setenv("AWS_REGION", "us-east-1")
+	os.Setenv("WALG_S3_ENDPOINT", server.URL)
+	os.Setenv("WALG_S3_FORCE_PATH_STYLE", "true")
+	defer os.Unsetenv("WALG_S3_ENDPOINT")
+	defer os.Unsetenv("WALG_S3_FORCE_PATH_STYLE")
+	defer os.Unsetenv("WALG_S3_SSE")
+	defer os.Unsetenv("WALG_S3_SSE_KMS_KEY_ID")
+
+	tu, pre, err := walg.Configure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tu.UploadWal(segment, pre, false); err == nil {
+		t.Errorf("upload: expected upload without SSE to be denied")
+	}
+
+	os.Setenv("WALG_S3_SSE", "aws:kms")
+	os.Setenv("WALG_S3_SSE_KMS_KEY_ID", "key")
+	tu, pre, err = walg.Configure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tu.UploadWal(segment, pre, false); err != nil {
+		t.Errorf("upload: expected upload with SSE to succeed but got %v", err)
+	}
+	if len(fake.objects) != 2 {
+		t.Errorf("upload: expected WAL and its checksum to be stored but got %v", fake.objects)
+	}
+
+	for sse, keyID := range map[string]string{"AES256": "key", "aws:kms:dsse": ""} {
+		os.Setenv("WALG_S3_SSE", sse)
+		os.Setenv("WALG_S3_SSE_KMS_KEY_ID", keyID)
+		if _, _, err = walg.Configure(); err == nil {
+			t.Errorf("upload: expected WALG_S3_SSE=%s with key '%s' to be rejected", sse, keyID)
+		}
+	}
+}
+
+func TestWALStorageClass(t *testing.T) {
+	fake, server, _ := newFakeMultipartS3(t)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	segment := filepath.Join(dir, "000000010000000000000002")
+	if err = ioutil.WriteFile(segment, []byte("segment"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(dir, "data")
+	os.MkdirAll(filepath.Join(data, "global"), 0700)
+	if err = ioutil.WriteFile(filepath.Join(data, "global", "pg_control"), []byte("control"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	setFake(t)
+	defer setEmpty(t)
+	os.Setenv("WALE_S3_PREFIX", "s3://bucket/server")
+	os.Setenv("AWS_REGION", "us-east-1")
+	os.Setenv("WALG_S3_ENDPOINT", server.URL)
+	os.Setenv("WALG_S3_FORCE_PATH_STYLE", "true")
+	os.Setenv("WALG_S3_STORAGE_CLASS", "STANDARD_IA")
+	os.Setenv("WALG_S3_WAL_STORAGE_CLASS", "STANDARD")
+	defer os.Unsetenv("WALG_S3_ENDPOINT")
+	defer os.Unsetenv("WALG_S3_FORCE_PATH_STYLE")
+	defer os.Unsetenv("WALG_S3_STORAGE_CLASS")
+	defer os.Unsetenv("WALG_S3_WAL_STORAGE_CLASS")
+
+	tu, pre, err := walg.Configure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tu.UploadWal(segment, pre, false); err != nil {
+		t.Fatal(err)
+	}
+	bundle := &walg.Bundle{MinSize: 10, Files: &sync.Map{}}
+	bundle.Tbm = &walg.S3TarBallMaker{BaseDir: "data", Trim: data, BkupName: "base_000000010000000000000002", Tu: tu}
+	bundle.StartQueue()
+	if err = filepath.Walk(data, bundle.TarWalker); err != nil {
+		t.Fatal(err)
+	}
+	if err = bundle.FinishQueue(); err != nil {
+		t.Fatal(err)
+	}
+	tu.Finish()
+
+	var backupObjects int
+	for key, class := range fake.classes {
+		expected := "STANDARD_IA"
+		if strings.Contains(key, "/wal_005/") {
+			expected = "STANDARD"
+		} else {
+			backupObjects++
+		}
+		if class != expected {
+			t.Errorf("upload: expected %s in %s but got %s", key, expected, class)
+		}
+	}
+	if backupObjects == 0 || len(fake.classes) == backupObjects {
+		t.Errorf("upload: expected both WAL and backup to be uploaded but got %v", fake.classes)
+	}
+}
+
+// multipartETagS3Client stores uploads in memory and gives objects larger than partSize
+// ETag of multipart upload. With corrupt, stored object differs from uploaded body.
+type multipartETagS3Client struct {
+	*memoryS3Client
+	partSize int
+	corrupt  bool
+}
+
+func (m *multipartETagS3Client) Upload(input *s3manager.UploadInput, f ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	output, err := m.memoryS3Client.Upload(input, f...)
+	if err == nil && m.corrupt {
+		m.objects[*input.Key][0] ^= 0xFF
+	}
+	return output, err
+}
+
+func (m *multipartETagS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	output, err := m.memoryS3Client.HeadObject(input)
+	body := m.objects[*input.Key]
+	if err != nil || len(body) <= m.partSize {
+		return output, err
+	}
+	var sums []byte
+	parts := 0
+	for ; len(body) > 0; parts++ {
+		part := body
+		if len(part) > m.partSize {
+			part = part[:m.partSize]
+		}
+		sum := md5.Sum(part)
+		sums = append(sums, sum[:]...)
+		body = body[len(part):]
+	}
+	output.ETag = aws.String(fmt.Sprintf("\"%x-%d\"", md5.Sum(sums), parts))
+	return output, nil
+}
+
+func TestWALPushVerifiesETag(t *testing.T) {
+	partSize := int(s3manager.MinUploadPartSize)
+	os.Setenv("WALG_UPLOAD_PART_SIZE", strconv.Itoa(partSize))
+	defer os.Unsetenv("WALG_UPLOAD_PART_SIZE")
+	dir, err := ioutil.TempDir("", "walg_verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	small := filepath.Join(dir, "000000010000000000000002")
+	if err = ioutil.WriteFile(small, make([]byte, walg.WalSegmentSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Random segment does not compress, so it is uploaded in parts
+	large := filepath.Join(dir, "000000010000000000000003")
+	random := make([]byte, walg.WalSegmentSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	if err = ioutil.WriteFile(large, random, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, corrupt := range []bool{false, true} {
+		for _, path := range []string{small, large} {
+			client := &multipartETagS3Client{memoryS3Client: newMemoryS3Client(), partSize: partSize, corrupt: corrupt}
+			pre := &walg.Prefix{Svc: client, Bucket: aws.String("bucket"), Server: aws.String("server")}
+			tu := walg.NewTarUploader(client, "bucket", "server", "region")
+			tu.Upl = client
+
+			key, err := tu.UploadWal(path, pre, true)
+			if err != nil && !corrupt {
+				t.Errorf("upload: intact upload of %s failed verification: %v", filepath.Base(path), err)
+			} else if err == nil && corrupt {
+				t.Errorf("upload: corrupted upload of %s passed verification", filepath.Base(path))
+			}
+			if head, _ := client.HeadObject(&s3.HeadObjectInput{Key: aws.String(key)}); path == large &&
+				!strings.Contains(aws.StringValue(head.ETag), "-") {
+				t.Errorf("upload: expected %s to have ETag of multipart upload but got %s", key, aws.StringValue(head.ETag))
+			}
+		}
+	}
+}
@@ -3,15 +3,18 @@ package walg
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"fmt"
 	"hash"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 	"encoding/json"
+
+	"github.com/pkg/errors"
 )
 
 // BackupTime is used to sort backups by
@@ -50,19 +53,6 @@ func partition(a []string, b int) [][]string {
 	return c
 }
 
-func partitionObjects(a []*s3.ObjectIdentifier, b int) [][]*s3.ObjectIdentifier {
-	// I've unsuccessfully tried this with interface{} but there was too much of casting
-	c := make([][]*s3.ObjectIdentifier, 0)
-	for i := 0; i < len(a); i += b {
-		if i+b > len(a) {
-			c = append(c, a[i:])
-		} else {
-			c = append(c, a[i:i+b])
-		}
-	}
-	return c
-}
-
 // ResolveSymlink converts path to physical if it is symlink
 func ResolveSymlink(path string) string {
 	resolve, err := filepath.EvalSymlinks(path)
@@ -103,10 +93,99 @@ func GetSentinelUserData() interface{} {
 	return out
 }
 
+// getMaxRestoreMoveConcurrency limits moves of files unchanged by delta during backup-fetch
+func getMaxRestoreMoveConcurrency(default_value int) int {
+	return getMaxConcurrency("WALG_RESTORE_MOVE_CONCURRENCY", default_value)
+}
+
 func getMaxUploadDiskConcurrency() int {
 	return getMaxConcurrency("WALG_UPLOAD_DISK_CONCURRENCY", 1)
 }
 
+// getPrefetchCount returns how many segments after the fetched one are prefetched, 0 disables prefetch.
+// By default it follows WALG_DOWNLOAD_CONCURRENCY, which disables prefetch when set to 1.
+func getPrefetchCount() int {
+	countStr, ok := os.LookupEnv("WALG_PREFETCH_COUNT")
+	if !ok {
+		count := getMaxDownloadConcurrency(8)
+		if count == 1 {
+			return 0
+		}
+		return count
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 0 {
+		log.Fatal("Unable to parse WALG_PREFETCH_COUNT ", countStr)
+	}
+	return count
+}
+
+// getPrefetchConcurrency returns how many of count prefetched segments are downloaded at once, by default all
+func getPrefetchConcurrency(count int) int {
+	return getMaxConcurrency("WALG_PREFETCH_CONCURRENCY", count)
+}
+
+// getSmallFileSize returns size below which files are packed into partitions of small files, 0 disables them
+func getSmallFileSize() (int64, error) {
+	sizeStr, ok := os.LookupEnv("WALG_SMALL_FILE_SIZE")
+	if !ok {
+		return 1024 * 1024, nil
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "getSmallFileSize: failed to parse WALG_SMALL_FILE_SIZE")
+	}
+	return size, nil
+}
+
+// DefaultTarSizeThreshold is the size of tar partition of backup-push, unless WALG_TAR_SIZE_THRESHOLD is set
+const DefaultTarSizeThreshold = int64(1000000000)
+
+// MinTarSizeThreshold keeps number of partitions of large clusters reasonable
+const MinTarSizeThreshold = int64(16 << 20)
+
+// GetTarSizeThreshold returns size after which tar partition of backup is closed and a new one is started
+func GetTarSizeThreshold() (int64, error) {
+	sizeStr, ok := os.LookupEnv("WALG_TAR_SIZE_THRESHOLD")
+	if !ok {
+		return DefaultTarSizeThreshold, nil
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "GetTarSizeThreshold: failed to parse WALG_TAR_SIZE_THRESHOLD")
+	}
+	if size < MinTarSizeThreshold {
+		return 0, errors.Errorf("GetTarSizeThreshold: WALG_TAR_SIZE_THRESHOLD must be at least %d bytes, got %d", MinTarSizeThreshold, size)
+	}
+	return size, nil
+}
+
+// getBackupDataKey tells whether WALG_BACKUP_DATA_KEY asks to encrypt each backup with its own key
+func getBackupDataKey() (bool, error) {
+	useStr, ok := os.LookupEnv("WALG_BACKUP_DATA_KEY")
+	if !ok {
+		// Envelope encryption by KMS makes a data key per backup by default
+		return getKMSKeyId() != "", nil
+	}
+	use, err := strconv.ParseBool(useStr)
+	if err != nil {
+		return false, errors.Wrap(err, "getBackupDataKey: failed to parse WALG_BACKUP_DATA_KEY")
+	}
+	return use, nil
+}
+
+// getBackupNameTimestamp tells whether WALG_BACKUP_NAME_FORMAT asks to put start time into backup names
+func getBackupNameTimestamp() (bool, error) {
+	format := os.Getenv("WALG_BACKUP_NAME_FORMAT")
+	switch format {
+	case "", "lsn":
+		return false, nil
+	case "timestamp":
+		return true, nil
+	}
+	return false, errors.Errorf("getBackupNameTimestamp: unknown WALG_BACKUP_NAME_FORMAT '%s'", format)
+}
+
 func getMaxConcurrency(key string, default_value int) int {
 	var con int
 	var err error
@@ -127,25 +206,54 @@ func getMaxConcurrency(key string, default_value int) int {
 	return max(con, 1)
 }
 
-type md5Reader struct {
+// etagReader computes ETag which S3 gives to object uploaded from the body it reads: MD5 of body
+// for a single PUT, or MD5 of concatenated MD5s of parts followed by "-" and number of parts for
+// multipart upload with parts of partSize
+type etagReader struct {
 	internal io.Reader
-	md5      hash.Hash
+	partSize int64
+	whole    hash.Hash
+	part     hash.Hash
+	partLen  int64
+	partSums []byte
+	parts    int
 }
 
-func newMd5Reader(reader io.Reader) *md5Reader {
-	return &md5Reader{internal: reader, md5: md5.New()}
+func newETagReader(reader io.Reader, partSize int64) *etagReader {
+	return &etagReader{internal: reader, partSize: partSize, whole: md5.New(), part: md5.New()}
 }
 
-func (r *md5Reader) Read(p []byte) (n int, err error) {
+func (r *etagReader) Read(p []byte) (n int, err error) {
 	n, err = r.internal.Read(p)
-	if err != nil {
-		return
+	r.whole.Write(p[:n])
+	for data := p[:n]; len(data) > 0; {
+		chunk := data
+		if rest := r.partSize - r.partLen; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		r.part.Write(chunk)
+		r.partLen += int64(len(chunk))
+		data = data[len(chunk):]
+		if r.partLen == r.partSize {
+			r.partSums = r.part.Sum(r.partSums)
+			r.parts++
+			r.part.Reset()
+			r.partLen = 0
+		}
 	}
-	_, err = r.md5.Write(p[:n])
 	return
 }
 
-func (r *md5Reader) Sum() string {
-	bytes := r.md5.Sum(nil)
-	return hex.EncodeToString(bytes)
+// ExpectedETag returns ETag of body in the form of etag, which tells how object was uploaded
+func (r *etagReader) ExpectedETag(etag string) string {
+	if !strings.Contains(strings.Trim(etag, "\""), "-") {
+		return hex.EncodeToString(r.whole.Sum(nil))
+	}
+	sums, parts := r.partSums, r.parts
+	if r.partLen > 0 {
+		sums = r.part.Sum(append([]byte(nil), sums...))
+		parts++
+	}
+	composite := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(composite[:]), parts)
 }
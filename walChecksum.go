@@ -0,0 +1,88 @@
+package walg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// walChecksumExtension is appended to name of WAL file to get its checksum object. It lies
+// next to the archive in folder of WAL, so it is deleted along with it, but is not a WAL file itself.
+const walChecksumExtension = "crc32"
+
+// walChecksumAttempts is how many times wal-fetch downloads file whose checksum does not match
+const walChecksumAttempts = 2
+
+func getWALChecksumKey(server, walFileName string) string {
+	return GetWALPath(server) + walFileName + "." + walChecksumExtension
+}
+
+// bufferWriteCloser collects encrypted body of small object
+type bufferWriteCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferWriteCloser) Close() error { return nil }
+
+// uploadWALChecksum uploads CRC32C of uncompressed WAL file, encrypted like the file itself
+func (tu *TarUploader) uploadWALChecksum(walFileName string, sum uint32) error {
+	body := []byte(fmt.Sprintf("%08x", sum))
+	crypter := NewCrypter()
+	if crypter.IsUsed() {
+		buffer := &bufferWriteCloser{}
+		wc, err := crypter.Encrypt(buffer)
+		if err != nil {
+			return errors.Wrapf(err, "uploadWALChecksum: failed to encrypt checksum of %s", walFileName)
+		}
+		if _, err = wc.Write(body); err != nil {
+			return errors.Wrapf(err, "uploadWALChecksum: failed to encrypt checksum of %s", walFileName)
+		}
+		if err = wc.Close(); err != nil {
+			return errors.Wrapf(err, "uploadWALChecksum: failed to encrypt checksum of %s", walFileName)
+		}
+		body = buffer.Bytes()
+	}
+	err := tu.put(getWALChecksumKey(tu.server, walFileName), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "uploadWALChecksum: failed to upload checksum of %s", walFileName)
+	}
+	return nil
+}
+
+// readWALChecksum downloads CRC32C of WAL file. WAL pushed by older versions has no
+// checksum, then ok is false.
+func readWALChecksum(pre *Prefix, walFileName string) (sum uint32, ok bool, err error) {
+	key := getWALChecksumKey(*pre.Server, walFileName)
+	archive, err := pre.Storage().GetArchive(key)
+	if err != nil {
+		exists, existsErr := pre.Storage().Exists(key)
+		if existsErr == nil && !exists {
+			return 0, false, nil
+		}
+		return 0, false, errors.Wrapf(err, "readWALChecksum: failed to get checksum of %s", walFileName)
+	}
+	defer archive.Close()
+
+	var reader io.Reader = archive
+	crypter := NewCrypter()
+	if crypter.IsUsed() {
+		reader, err = crypter.Decrypt(archive)
+		if err != nil {
+			return 0, false, errors.Wrapf(err, "readWALChecksum: failed to decrypt checksum of %s", walFileName)
+		}
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "readWALChecksum: failed to read checksum of %s", walFileName)
+	}
+	parsed, err := strconv.ParseUint(strings.TrimSpace(string(body)), 16, 32)
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "readWALChecksum: failed to parse checksum of %s", walFileName)
+	}
+	return uint32(parsed), true, nil
+}
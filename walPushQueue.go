@@ -0,0 +1,176 @@
+package walg
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	walPushQueueLockName  = ".drain.lock"
+	walPushQueueTmpSuffix = ".tmp"
+	walPushDrainAttempts  = 10
+)
+
+// GetWALPushQueue returns directory of durable local wal-push queue,
+// empty if WAL is uploaded by archive_command itself
+func GetWALPushQueue() string {
+	return os.Getenv("WALG_WAL_PUSH_QUEUE")
+}
+
+// EnqueueWAL durably copies WAL file into queue directory. The copy is written under
+// temporary name, fsynced and renamed, then directory is fsynced, so once this returns
+// nil the segment survives a crash and Postgres may recycle the original.
+func EnqueueWAL(queueDir string, walFilePath string) error {
+	err := os.MkdirAll(queueDir, 0700)
+	if err != nil {
+		return errors.Wrapf(err, "EnqueueWAL: failed to create queue directory %s", queueDir)
+	}
+
+	name := filepath.Base(walFilePath)
+	target := filepath.Join(queueDir, name)
+	tmp := target + walPushQueueTmpSuffix
+	src, err := os.Open(walFilePath)
+	if err != nil {
+		return errors.Wrapf(err, "EnqueueWAL: failed to open %s", walFilePath)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "EnqueueWAL: failed to create %s", tmp)
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "EnqueueWAL: failed to copy %s", name)
+	}
+
+	err = os.Rename(tmp, target)
+	if err != nil {
+		return errors.Wrapf(err, "EnqueueWAL: failed to rename %s", tmp)
+	}
+	return syncDir(queueDir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "syncDir: failed to open %s", dir)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return errors.Wrapf(err, "syncDir: fsync of %s failed", dir)
+	}
+	return nil
+}
+
+// getQueuedWALFiles lists queued files in upload order
+func getQueuedWALFiles(queueDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(queueDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getQueuedWALFiles: failed to read %s", queueDir)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, walPushQueueTmpSuffix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DrainWALQueue uploads queued files in order and removes each one after it is uploaded.
+// Only one drainer works on a queue at a time, others return immediately.
+// Failed upload is retried with growing pause; after walPushDrainAttempts failures in a row
+// drainer gives up, and the next wal-push starts a new one.
+func DrainWALQueue(tu *TarUploader, pre *Prefix, queueDir string, verify bool) error {
+	lock, err := os.OpenFile(filepath.Join(queueDir, walPushQueueLockName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "DrainWALQueue: failed to open lock file")
+	}
+	defer lock.Close()
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "DrainWALQueue: failed to lock queue")
+	}
+
+	failures := 0
+	pause := time.Second
+	for {
+		names, err := getQueuedWALFiles(queueDir)
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return nil
+		}
+
+		for _, name := range names {
+			path := filepath.Join(queueDir, name)
+			_, err = tu.UploadWal(path, pre, verify)
+			if err != nil {
+				break
+			}
+			err = os.Remove(path)
+			if err != nil {
+				return errors.Wrapf(err, "DrainWALQueue: failed to remove uploaded %s", name)
+			}
+			failures = 0
+			pause = time.Second
+		}
+		if err != nil {
+			failures++
+			log.Printf("WAL-G: queued WAL upload failed (%d of %d attempts): %v\n", failures, walPushDrainAttempts, err)
+			if failures >= walPushDrainAttempts {
+				return errors.Wrap(err, "DrainWALQueue: giving up")
+			}
+			time.Sleep(pause)
+			if pause < time.Minute {
+				pause *= 2
+			}
+		}
+	}
+}
+
+// forkWALPushDrain starts background wal-push-drain, which outlives archive_command
+func forkWALPushDrain(queueDir string, verify bool) {
+	args := []string{"wal-push-drain"}
+	if verify {
+		args = append(args, "--verify")
+	}
+	cmd := exec.Command(os.Args[0], append(args, queueDir)...)
+	cmd.Env = os.Environ()
+	err := cmd.Start()
+	if err != nil {
+		// Segment is safely queued, next wal-push will start drainer again
+		log.Println("WAL-G: failed to start wal-push-drain: ", err)
+	}
+}
+
+// HandleWALPushDrain is invoked to perform wal-g wal-push-drain
+func HandleWALPushDrain(tu *TarUploader, pre *Prefix, queueDir string, verify bool) error {
+	return DrainWALQueue(tu, pre, queueDir, verify)
+}
@@ -0,0 +1,51 @@
+package walg_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wal-g/wal-g"
+)
+
+func TestWALPushQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walg-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queueDir := filepath.Join(dir, "queue")
+
+	var names = []string{"000000010000000000000002", "000000010000000000000001"}
+	for _, name := range names {
+		walPath := filepath.Join(dir, name)
+		err = ioutil.WriteFile(walPath, []byte(name), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = walg.EnqueueWAL(queueDir, walPath)
+		if err != nil {
+			t.Fatalf("queue: failed to enqueue %s: %+v", name, err)
+		}
+	}
+
+	tu, pre, client := newMemoryStorage()
+	err = walg.DrainWALQueue(tu, pre, queueDir, false)
+	if err != nil {
+		t.Fatalf("queue: drain failed: %+v", err)
+	}
+	for _, name := range names {
+		if _, ok := client.objects["server/wal_005/"+name+".lz4"]; !ok {
+			t.Errorf("queue: %s was not uploaded", name)
+		}
+	}
+
+	left, err := filepath.Glob(filepath.Join(queueDir, "0*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("queue: expected queue to be empty after drain, found %v", left)
+	}
+}
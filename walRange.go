@@ -0,0 +1,147 @@
+package walg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// BackupWALRange is the inclusive range of WAL segments
+// which must be replayed to make a backup consistent
+type BackupWALRange struct {
+	Timeline   uint32
+	FirstSegNo uint64
+	LastSegNo  uint64
+	// SegmentSize of the cluster, WalSegmentSize if it is not set
+	SegmentSize uint64
+}
+
+// GetSegmentSize returns size of segments of the range
+func (r BackupWALRange) GetSegmentSize() uint64 {
+	if r.SegmentSize == 0 {
+		return WalSegmentSize
+	}
+	return r.SegmentSize
+}
+
+// First returns name of the first segment of the range
+func (r BackupWALRange) First() string {
+	return formatWALFileName(r.Timeline, r.FirstSegNo, r.GetSegmentSize())
+}
+
+// Last returns name of the last segment of the range
+func (r BackupWALRange) Last() string {
+	return formatWALFileName(r.Timeline, r.LastSegNo, r.GetSegmentSize())
+}
+
+// Count returns number of segments in the range
+func (r BackupWALRange) Count() uint64 { return r.LastSegNo - r.FirstSegNo + 1 }
+
+// ErrNoLSNInSentinel happens when backup was made without support for LSN tracking
+var ErrNoLSNInSentinel = errors.New("Backup sentinel does not contain LSN range. Backup was made by older version of WAL-G")
+
+// GetBackupWALRange computes WAL segments from start to finish LSN of the backup.
+// Timeline is taken from the backup name, which is named after its first WAL segment.
+func GetBackupWALRange(backupName string, sentinel S3TarBallSentinelDto) (BackupWALRange, error) {
+	if sentinel.LSN == nil || sentinel.FinishLSN == nil {
+		return BackupWALRange{}, ErrNoLSNInSentinel
+	}
+
+	timeline, err := ParseWALFileName(stripWalFileName(backupName))
+	if err != nil {
+		return BackupWALRange{}, errors.Wrapf(err, "GetBackupWALRange: unable to determine timeline of backup %s", backupName)
+	}
+
+	segmentSize := sentinel.GetWalSegmentSize()
+	walRange := BackupWALRange{
+		Timeline:    timeline,
+		FirstSegNo:  getPreviousSegmentNo(*sentinel.LSN, segmentSize),
+		LastSegNo:   getPreviousSegmentNo(*sentinel.FinishLSN, segmentSize),
+		SegmentSize: segmentSize,
+	}
+	if walRange.LastSegNo < walRange.FirstSegNo {
+		return BackupWALRange{}, errors.Errorf("GetBackupWALRange: finish LSN %x precedes start LSN %x", *sentinel.FinishLSN, *sentinel.LSN)
+	}
+	return walRange, nil
+}
+
+// fetchBackupSentinel resolves LATEST and fetches sentinel of existing backup
+func fetchBackupSentinel(pre *Prefix, backupName string) (string, S3TarBallSentinelDto, error) {
+	var bk = &Backup{
+		Prefix: pre,
+		Path:   GetBackupPath(pre),
+	}
+
+	if backupName == "LATEST" {
+		latest, err := bk.GetLatest()
+		if err != nil {
+			return "", S3TarBallSentinelDto{}, err
+		}
+		backupName = latest
+	} else {
+		bk.Name = aws.String(backupName)
+		bk.Js = aws.String(*bk.Path + backupName + SentinelSuffix)
+		exists, err := bk.CheckExistence()
+		if err != nil {
+			return "", S3TarBallSentinelDto{}, err
+		}
+		if !exists {
+			return "", S3TarBallSentinelDto{}, errors.Errorf("fetchBackupSentinel: backup '%s' does not exist", backupName)
+		}
+	}
+
+	sentinel, err := readSentinel(backupName, bk, pre)
+	return backupName, sentinel, err
+}
+
+// fetchWALSegmentSize returns size of WAL segments of prefix recorded in sentinel of the latest
+// backup. Without backups it is read from header of archived segment, WalSegmentSize if the
+// segment cannot be fetched.
+func fetchWALSegmentSize(pre *Prefix, segment string) (uint64, error) {
+	_, sentinel, err := fetchBackupSentinel(pre, "LATEST")
+	if err == nil {
+		return sentinel.GetWalSegmentSize(), nil
+	}
+	if err != ErrLatestNotFound {
+		return 0, err
+	}
+	if segment == "" {
+		return WalSegmentSize, nil
+	}
+
+	dir, err := ioutil.TempDir("", "wal-g-segment")
+	if err != nil {
+		return 0, errors.Wrap(err, "fetchWALSegmentSize: failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	location := path.Join(dir, segment)
+	if found, err := DownloadWALFile(pre, segment, location); err != nil || !found {
+		log.Printf("Size of WAL segments is unknown without backups and segment %s, %d is assumed: %v\n", segment, WalSegmentSize, err)
+		return WalSegmentSize, nil
+	}
+	return readWALFileSegmentSize(location), nil
+}
+
+// HandleBackupWALRange is invoked to perform wal-g backup-wal-range
+func HandleBackupWALRange(pre *Prefix, backupName string) error {
+	backupName, sentinel, err := fetchBackupSentinel(pre, backupName)
+	if err != nil {
+		return err
+	}
+	walRange, err := GetBackupWALRange(backupName, sentinel)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "name\ttimeline\tfirst_segment\tlast_segment\tsegment_count")
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", backupName, walRange.Timeline, walRange.First(), walRange.Last(), walRange.Count())
+	return nil
+}
@@ -0,0 +1,55 @@
+package walg
+
+import "testing"
+
+func TestGetBackupWALRange(t *testing.T) {
+	start := uint64(0x1A8000028)
+	finish := uint64(0x1AA000100)
+	sentinel := S3TarBallSentinelDto{LSN: &start, FinishLSN: &finish}
+
+	walRange, err := GetBackupWALRange("base_0000000200000001000000A8_D_000000010000000100000090", sentinel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walRange.First() != "0000000200000001000000A8" || walRange.Last() != "0000000200000001000000AA" || walRange.Count() != 3 {
+		t.Errorf("walRange: unexpected range %v - %v (%d)", walRange.First(), walRange.Last(), walRange.Count())
+	}
+
+	// Finish LSN exactly on segment boundary does not need the next segment
+	finish = 0x1AB000000
+	walRange, err = GetBackupWALRange("base_0000000200000001000000A8", sentinel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walRange.Last() != "0000000200000001000000AA" {
+		t.Errorf("walRange: expected last segment 0000000200000001000000AA but got %v", walRange.Last())
+	}
+
+	walRange, err = GetBackupWALRange("base_20181017T093000Z_0000000200000001000000A8", sentinel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walRange.Timeline != 2 {
+		t.Errorf("walRange: expected timeline 2 for name with time but got %v", walRange.Timeline)
+	}
+
+	// Cluster of 64MB segments has 64 segments in each xlogid
+	sentinel.WalSegmentSize = 64 << 20
+	walRange, err = GetBackupWALRange("base_00000002000000010000002A", sentinel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walRange.First() != "00000002000000010000002A" || walRange.Last() != "00000002000000010000002A" || walRange.Count() != 1 {
+		t.Errorf("walRange: unexpected range of 64MB segments %v - %v (%d)", walRange.First(), walRange.Last(), walRange.Count())
+	}
+
+	_, err = GetBackupWALRange("base_0000000200000001000000A8", S3TarBallSentinelDto{})
+	if err != ErrNoLSNInSentinel {
+		t.Errorf("walRange: expected ErrNoLSNInSentinel but got %v", err)
+	}
+
+	_, err = GetBackupWALRange("some_backup", sentinel)
+	if err == nil {
+		t.Errorf("walRange: expected error for backup name without WAL segment")
+	}
+}
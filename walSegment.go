@@ -0,0 +1,176 @@
+package walg
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// XLP_LONG_HEADER flag of xlp_info, set on the first page of each segment
+	walLongHeaderFlag = 0x0002
+	// SizeOfXLogLongPHD, xlp_seg_size is at offset 32 of the long page header
+	walLongHeaderSize = 40
+	// Magic of the oldest Postgres version, checked when version is unknown
+	minWALPageMagic = 0xD061
+)
+
+// walPageMagics are XLOG_PAGE_MAGIC of Postgres major versions, xlog_internal.h
+var walPageMagics = map[int]uint16{
+	90300:  0xD075,
+	90400:  0xD07E,
+	90500:  0xD087,
+	90600:  0xD093,
+	100000: 0xD097,
+	110000: 0xD098,
+	120000: 0xD101,
+	130000: 0xD106,
+	140000: 0xD10D,
+	150000: 0xD110,
+	160000: 0xD113,
+	170000: 0xD116,
+}
+
+// readWALPageHeader reads magic of the first page of segment and segment size
+// from its long header. Size is zero if the page has no long header.
+func readWALPageHeader(file io.ReaderAt) (magic uint16, segmentSize uint64, err error) {
+	header := make([]byte, walLongHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	if n < 4 {
+		return 0, 0, nil
+	}
+	magic = binary.LittleEndian.Uint16(header)
+	info := binary.LittleEndian.Uint16(header[2:])
+	if n == walLongHeaderSize && info&walLongHeaderFlag != 0 {
+		segmentSize = uint64(binary.LittleEndian.Uint32(header[32:]))
+	}
+	return magic, segmentSize, nil
+}
+
+// getExpectedWALSegmentSize returns size of segment recorded in its header,
+// WalSegmentSize if the header does not have valid one
+func getExpectedWALSegmentSize(file io.ReaderAt) (uint64, error) {
+	_, segmentSize, err := readWALPageHeader(file)
+	if err != nil {
+		return 0, err
+	}
+	if !isValidWalSegmentSize(segmentSize) {
+		return WalSegmentSize, nil
+	}
+	return segmentSize, nil
+}
+
+// readWALFileSegmentSize returns size of segment recorded in header of WAL file at filePath,
+// WalSegmentSize if the file cannot be read
+func readWALFileSegmentSize(filePath string) uint64 {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return WalSegmentSize
+	}
+	defer file.Close()
+	segmentSize, err := getExpectedWALSegmentSize(file)
+	if err != nil {
+		return WalSegmentSize
+	}
+	return segmentSize
+}
+
+// findWALDirSegmentSize returns size of segments in walDirectory read from header of one
+// of them, WalSegmentSize if there is none
+func findWALDirSegmentSize(walDirectory string) uint64 {
+	fileInfos, err := ioutil.ReadDir(walDirectory)
+	if err != nil {
+		return WalSegmentSize
+	}
+	for _, info := range fileInfos {
+		if _, err := ParseWALFileName(info.Name()); err == nil && info.Mode().IsRegular() {
+			return readWALFileSegmentSize(path.Join(walDirectory, info.Name()))
+		}
+	}
+	return WalSegmentSize
+}
+
+// walPageMagicSize is the size of xlp_magic and xlp_info, the least of page header checked
+const walPageMagicSize = 4
+
+// checkWALFileMagic verifies magic of segment against Postgres version pgVersion,
+// zero or unknown version accepts magic of any supported version
+func checkWALFileMagic(file io.ReaderAt, pgVersion int) error {
+	header := make([]byte, walPageMagicSize)
+	_, err := io.ReadFull(io.NewSectionReader(file, 0, walPageMagicSize), header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.Errorf("WAL-G: WAL file is shorter than %d bytes of page magic", walPageMagicSize)
+	}
+	if err != nil {
+		return errors.Wrap(err, "checkWALFileMagic: failed to read page magic")
+	}
+	magic := binary.LittleEndian.Uint16(header)
+	if expected, ok := walPageMagics[pgVersion/100*100]; ok {
+		if magic != expected {
+			return errors.Errorf("WAL-G: WAL file magic %X is not %X of Postgres %d", magic, expected, pgVersion)
+		}
+		return nil
+	}
+	if magic < minWALPageMagic {
+		return errors.New("WAL-G: WAL file magic is invalid ")
+	}
+	return nil
+}
+
+// checkWALFile verifies size and magic of segment in location
+func checkWALFile(location string, pgVersion int) error {
+	file, err := os.Open(location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	segmentSize, err := getExpectedWALSegmentSize(file)
+	if err != nil {
+		return err
+	}
+	if stat.Size() != int64(segmentSize) {
+		return errors.Errorf("WAL-G: wrong size of WAL file %d, expected %d", stat.Size(), segmentSize)
+	}
+	return checkWALFileMagic(file, pgVersion)
+}
+
+// getWALDirPgVersion reads version of data directory containing WAL directory walDir,
+// in format of server_version_num. Zero if it can not be read.
+func getWALDirPgVersion(walDir string) int {
+	data, err := ioutil.ReadFile(path.Join(walDir, "..", "PG_VERSION"))
+	if err != nil {
+		return 0
+	}
+	return parsePgVersionFile(string(data))
+}
+
+// parsePgVersionFile converts content of PG_VERSION, like 9.6 or 15, to server_version_num
+func parsePgVersionFile(content string) int {
+	parts := strings.SplitN(strings.TrimSpace(content), ".", 2)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+	if len(parts) == 1 {
+		return major * 10000
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0
+	}
+	return major*10000 + minor*100
+}
@@ -0,0 +1,93 @@
+package walg
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// WalSegmentName identifies WAL segment by timeline and number.
+// Segments are ordered by timeline first, then by number, which names of segments
+// written in different case or of other timelines do not always follow.
+type WalSegmentName struct {
+	Timeline uint32
+	LogSegNo uint64
+	// SegmentSize of the cluster, WalSegmentSize if it is not set
+	SegmentSize uint64
+}
+
+// ParseWalSegmentName parses name of WAL segment of walSegmentSize like 000000010000000A000000FF.
+// Size comes from the sentinel of a backup or from the header of a segment of the cluster.
+func ParseWalSegmentName(name string, walSegmentSize uint64) (WalSegmentName, error) {
+	timeline, logSegNo, err := parseWALFileName(name, walSegmentSize)
+	if err != nil {
+		return WalSegmentName{}, err
+	}
+	return WalSegmentName{Timeline: timeline, LogSegNo: logSegNo, SegmentSize: walSegmentSize}, nil
+}
+
+// parseWalSegmentOrder parses name of WAL segment of any size only to order it. Numbers of
+// segments of the least size keep order of segments of every size, but not their distance.
+func parseWalSegmentOrder(name string) (WalSegmentName, error) {
+	return ParseWalSegmentName(name, minWalSegmentSize)
+}
+
+// GetSegmentSize returns size of the segment
+func (segment WalSegmentName) GetSegmentSize() uint64 {
+	if segment.SegmentSize == 0 {
+		return WalSegmentSize
+	}
+	return segment.SegmentSize
+}
+
+// String formats name of segment as Postgres does
+func (segment WalSegmentName) String() string {
+	return formatWALFileName(segment.Timeline, segment.LogSegNo, segment.GetSegmentSize())
+}
+
+// LogID is the logical WAL file of segment, the middle part of its name
+func (segment WalSegmentName) LogID() uint32 {
+	return uint32(segment.LogSegNo / getSegmentsPerXLogId(segment.GetSegmentSize()))
+}
+
+// SegNo is the number of segment in its logical WAL file, the last part of its name
+func (segment WalSegmentName) SegNo() uint32 {
+	return uint32(segment.LogSegNo % getSegmentsPerXLogId(segment.GetSegmentSize()))
+}
+
+// Less tells whether segment precedes other
+func (segment WalSegmentName) Less(other WalSegmentName) bool {
+	if segment.Timeline != other.Timeline {
+		return segment.Timeline < other.Timeline
+	}
+	return segment.LogSegNo < other.LogSegNo
+}
+
+// Next is the segment following this one on the same timeline
+func (segment WalSegmentName) Next() WalSegmentName {
+	return WalSegmentName{Timeline: segment.Timeline, LogSegNo: segment.LogSegNo + 1, SegmentSize: segment.SegmentSize}
+}
+
+// Previous is the segment preceding this one on the same timeline
+func (segment WalSegmentName) Previous() (WalSegmentName, error) {
+	if segment.LogSegNo == 0 {
+		return WalSegmentName{}, errors.Errorf("Previous: %v is the first segment of timeline", segment)
+	}
+	return WalSegmentName{Timeline: segment.Timeline, LogSegNo: segment.LogSegNo - 1, SegmentSize: segment.SegmentSize}, nil
+}
+
+// sortWALFileNames sorts names of files of WAL archive. Segments are ordered by
+// timeline and number, other files such as history files follow them by name.
+func sortWALFileNames(names []string) {
+	sort.SliceStable(names, func(i, j int) bool {
+		first, errFirst := parseWalSegmentOrder(names[i])
+		second, errSecond := parseWalSegmentOrder(names[j])
+		switch {
+		case errFirst == nil && errSecond == nil:
+			return first.Less(second)
+		case errFirst == nil || errSecond == nil:
+			return errFirst == nil
+		}
+		return names[i] < names[j]
+	})
+}
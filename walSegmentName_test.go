@@ -0,0 +1,71 @@
+package walg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWalSegmentNameBoundary(t *testing.T) {
+	last, err := ParseWalSegmentName("0000000100000001000000FF", WalSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.LogID() != 1 || last.SegNo() != 0xFF {
+		t.Errorf("walSegmentName: unexpected parts %d %d", last.LogID(), last.SegNo())
+	}
+	first := last.Next()
+	if first.String() != "000000010000000200000000" || !last.Less(first) || first.Less(last) {
+		t.Errorf("walSegmentName: %v does not follow %v", first, last)
+	}
+	if previous, err := first.Previous(); err != nil || previous != last {
+		t.Errorf("walSegmentName: expected %v before %v but got %v, %v", last, first, previous, err)
+	}
+	if _, err := (WalSegmentName{Timeline: 1}).Previous(); err == nil {
+		t.Errorf("walSegmentName: expected no segment before the first one")
+	}
+	// Any segment of a later timeline follows segments of earlier ones
+	if !first.Less(WalSegmentName{Timeline: 2}) {
+		t.Errorf("walSegmentName: timeline 2 does not follow %v", first)
+	}
+
+	last, err = ParseWalSegmentName("00000001000000010000003F", 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Next().String() != "000000010000000200000000" || last.LogSegNo != 0x7F {
+		t.Errorf("walSegmentName: unexpected segment %v after %v of 64MB", last.Next(), last)
+	}
+	if _, err = ParseWalSegmentName("000000010000000100000040", 64<<20); err == nil {
+		t.Errorf("walSegmentName: segment number beyond logical file of 64MB is accepted")
+	}
+}
+
+func TestSortWALFileNames(t *testing.T) {
+	names := []string{
+		"00000002.history",
+		"000000010000000200000000",
+		"0000000200000001000000fe",
+		"0000000100000001000000ff",
+		"0000000200000001000000FF",
+		"0000000100000001000000FE",
+	}
+	sortWALFileNames(names)
+	expected := []string{
+		"0000000100000001000000FE",
+		"0000000100000001000000ff",
+		"000000010000000200000000",
+		"0000000200000001000000fe",
+		"0000000200000001000000FF",
+		"00000002.history",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("walSegmentName: expected order %v but got %v", expected, names)
+	}
+	gaps := FindWALGaps([]string{"0000000100000001000000fe", "000000010000000200000001"}, WalSegmentSize)
+	if len(gaps) != 1 || gaps[0].First != "0000000100000001000000FF" || gaps[0].Last != "000000010000000200000000" || gaps[0].Count != 2 {
+		t.Errorf("walSegmentName: unexpected gaps across boundary %+v", gaps)
+	}
+	if gaps := FindWALGaps([]string{"00000001000000010000003F", "000000010000000200000000"}, 64<<20); len(gaps) != 0 {
+		t.Errorf("walSegmentName: unexpected gaps across boundary of 64MB segments %+v", gaps)
+	}
+}
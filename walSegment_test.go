@@ -0,0 +1,115 @@
+package walg
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// makeWALSegment makes segment of segmentSize with long header of the first page
+func makeWALSegment(magic uint16, segmentSize uint64) []byte {
+	segment := make([]byte, segmentSize)
+	binary.LittleEndian.PutUint16(segment, magic)
+	binary.LittleEndian.PutUint16(segment[2:], walLongHeaderFlag)
+	binary.LittleEndian.PutUint32(segment[32:], uint32(segmentSize))
+	return segment
+}
+
+func TestCheckWALFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walSegment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Segment of cluster initialized with --wal-segsize=1
+	segment := makeWALSegment(0xD098, 1<<20)
+	location := path.Join(dir, "000000010000000000000001")
+	ioutil.WriteFile(location, segment, 0600)
+	if err := checkWALFile(location, 110005); err != nil {
+		t.Errorf("walSegment: 1MB segment of Postgres 11 rejected: %v", err)
+	}
+	if err := checkWALFile(location, 0); err != nil {
+		t.Errorf("walSegment: 1MB segment of unknown version rejected: %v", err)
+	}
+	if err := checkWALFile(location, 100000); err == nil {
+		t.Errorf("walSegment: segment of Postgres 11 accepted as one of Postgres 10")
+	}
+
+	ioutil.WriteFile(location, segment[:len(segment)/2], 0600)
+	if err := checkWALFile(location, 110005); err == nil {
+		t.Errorf("walSegment: truncated segment accepted")
+	}
+
+	// Without long header size of segment is the default one
+	binary.LittleEndian.PutUint16(segment[2:], 0)
+	ioutil.WriteFile(location, segment, 0600)
+	if err := checkWALFile(location, 110005); err == nil {
+		t.Errorf("walSegment: 1MB segment without long header accepted")
+	}
+}
+
+func TestCheckWALFileMagicOfShortFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walSegment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The first bytes of magic of Postgres 11 alone
+	location := path.Join(dir, "000000010000000000000001")
+	ioutil.WriteFile(location, []byte{0x98, 0xD0}, 0600)
+	file, err := os.Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, pgVersion := range []int{0, 110005} {
+		err := checkWALFileMagic(file, pgVersion)
+		if err == nil || !strings.Contains(err.Error(), "shorter") {
+			t.Errorf("walSegment: expected 2 byte file to be rejected as short for version %d, but got %v", pgVersion, err)
+		}
+	}
+}
+
+func TestGetWALDirPgVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walSegment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	walDir := path.Join(dir, "pg_wal")
+	os.Mkdir(walDir, 0700)
+	if version := getWALDirPgVersion(walDir); version != 0 {
+		t.Errorf("walSegment: expected unknown version without PG_VERSION but got %d", version)
+	}
+	ioutil.WriteFile(path.Join(dir, "PG_VERSION"), []byte("15\n"), 0600)
+	if version := getWALDirPgVersion(walDir); version != 150000 {
+		t.Errorf("walSegment: expected version 150000 but got %d", version)
+	}
+	ioutil.WriteFile(path.Join(dir, "PG_VERSION"), []byte("9.6\n"), 0600)
+	if version := getWALDirPgVersion(walDir); version != 90600 {
+		t.Errorf("walSegment: expected version 90600 but got %d", version)
+	}
+}
+
+func TestFindWALDirSegmentSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walSegment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if size := findWALDirSegmentSize(dir); size != WalSegmentSize {
+		t.Errorf("walSegment: expected default size without segments but got %d", size)
+	}
+	ioutil.WriteFile(path.Join(dir, "00000002.history"), []byte("1\t0/3000000\tno recovery target specified\n"), 0600)
+	ioutil.WriteFile(path.Join(dir, "000000020000000100000003"), makeWALSegment(0xD098, 1<<20), 0600)
+	if size := findWALDirSegmentSize(dir); size != 1<<20 {
+		t.Errorf("walSegment: expected size of 1MB from segment header but got %d", size)
+	}
+}
@@ -0,0 +1,118 @@
+package walg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// WALShowTimeline describes archived WAL of one timeline, as printed by wal-show
+type WALShowTimeline struct {
+	TimelineInfo
+	// HistoryFile is the name of history file of the timeline, empty if it is not archived
+	HistoryFile string `json:",omitempty"`
+	// Gaps are runs of segments missing between the first and the last archived ones
+	Gaps []WALSegmentRun
+}
+
+// FindWALGaps finds runs of missing segments between sorted segments of one timeline of segmentSize
+func FindWALGaps(segments []string, segmentSize uint64) []WALSegmentRun {
+	var gaps []WALSegmentRun
+	for i := 1; i < len(segments); i++ {
+		previous, err := ParseWalSegmentName(segments[i-1], segmentSize)
+		if err != nil {
+			continue
+		}
+		current, err := ParseWalSegmentName(segments[i], segmentSize)
+		if err != nil || !previous.Next().Less(current) {
+			continue
+		}
+		last, _ := current.Previous()
+		gaps = append(gaps, WALSegmentRun{
+			First:   previous.Next().String(),
+			Last:    last.String(),
+			Count:   int(current.LogSegNo - previous.LogSegNo - 1),
+			Missing: true,
+		})
+	}
+	return gaps
+}
+
+// ShowWAL lists archived WAL segments and history files grouped by timeline, sorted by timeline.
+// Gaps are found in segments of size of the cluster, see fetchWALSegmentSize.
+func ShowWAL(pre *Prefix) ([]WALShowTimeline, error) {
+	names, err := listArchivedWALNames(pre)
+	if err != nil {
+		return nil, err
+	}
+	sortWALFileNames(names)
+	timelines, err := listTimelinesOf(pre, names)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make(map[uint32][]string)
+	first := ""
+	for _, name := range names {
+		if timeline, err := ParseWALFileName(name); err == nil {
+			segments[timeline] = append(segments[timeline], name)
+			if first == "" {
+				first = name
+			}
+		}
+	}
+	segmentSize, err := fetchWALSegmentSize(pre, first)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]WALShowTimeline, len(timelines))
+	for i, info := range timelines {
+		result[i] = WALShowTimeline{TimelineInfo: info, Gaps: FindWALGaps(segments[info.Timeline], segmentSize)}
+		if info.HasHistory {
+			result[i].HistoryFile = fmt.Sprintf("%08X%s", info.Timeline, timelineHistorySuffix)
+		}
+	}
+	return result, nil
+}
+
+// HandleWALShow is invoked to perform wal-g wal-show
+func HandleWALShow(pre *Prefix, asJSON bool) error {
+	timelines, err := ShowWAL(pre)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(timelines)
+	}
+	if len(timelines) == 0 {
+		fmt.Println("No WAL found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "timeline\tparent\tswitch_lsn\thistory\tsegments\tfirst_segment\tlast_segment\tgaps")
+	for _, info := range timelines {
+		parent, switchLSN, history := "-", "-", "-"
+		if info.HasHistory {
+			parent = fmt.Sprintf("%d", info.Parent)
+			switchLSN = fmt.Sprintf("%x", info.SwitchLSN)
+			history = info.HistoryFile
+		}
+		first, last := "-", "-"
+		if info.SegmentCount > 0 {
+			first, last = info.FirstSegment, info.LastSegment
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\t%d\n", info.Timeline, parent, switchLSN, history, info.SegmentCount, first, last, len(info.Gaps))
+	}
+	w.Flush()
+
+	for _, info := range timelines {
+		for _, gap := range info.Gaps {
+			fmt.Printf("timeline %d is missing %s - %s (%d segments)\n", info.Timeline, gap.First, gap.Last, gap.Count)
+		}
+	}
+	return nil
+}
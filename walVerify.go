@@ -0,0 +1,379 @@
+package walg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// TimelineHistoryRecord is one line of timeline history file:
+// timeline Timeline ended at SwitchLSN, where its child began
+type TimelineHistoryRecord struct {
+	Timeline  uint32
+	SwitchLSN uint64
+}
+
+// ParseTimelineHistory parses content of NNNNNNNN.history file
+func ParseTimelineHistory(data []byte) ([]TimelineHistoryRecord, error) {
+	var records []TimelineHistoryRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, errors.Errorf("ParseTimelineHistory: invalid line '%s'", line)
+		}
+		timeline, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "ParseTimelineHistory: invalid timeline in line '%s'", line)
+		}
+		lsn, err := ParseLsn(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "ParseTimelineHistory: invalid switch point in line '%s'", line)
+		}
+		records = append(records, TimelineHistoryRecord{uint32(timeline), lsn})
+	}
+	return records, nil
+}
+
+// GetWALSegmentsBetween lists WAL segments needed to recover from the end of backup from
+// to the start of backup to, which is on timeline target descending from the timeline of from.
+// Segment containing switch point is read from the new timeline, as Postgres does.
+// history is the history of target timeline, empty if both backups are on the same timeline.
+func GetWALSegmentsBetween(from BackupWALRange, to BackupWALRange, history []TimelineHistoryRecord) ([]string, error) {
+	if to.FirstSegNo < from.LastSegNo {
+		return nil, errors.Errorf("GetWALSegmentsBetween: backup starting at %s precedes end of backup %s", to.First(), from.Last())
+	}
+	segmentSize := from.GetSegmentSize()
+	if to.GetSegmentSize() != segmentSize {
+		return nil, errors.Errorf("GetWALSegmentsBetween: backups have WAL segments of different size %d and %d", segmentSize, to.GetSegmentSize())
+	}
+
+	// Timelines from the one of from to target with segment numbers where they begin
+	type timelineStart struct {
+		timeline uint32
+		segNo    uint64
+	}
+	var timelines []timelineStart
+	if from.Timeline != to.Timeline {
+		found := false
+		for i, record := range history {
+			if record.Timeline == from.Timeline {
+				if record.SwitchLSN/segmentSize < from.LastSegNo {
+					return nil, errors.Errorf("GetWALSegmentsBetween: timeline %d ends at %x before backup end %s", record.Timeline, record.SwitchLSN, from.Last())
+				}
+				found = true
+			}
+			if !found {
+				continue
+			}
+			next := to.Timeline
+			if i+1 < len(history) {
+				next = history[i+1].Timeline
+			}
+			timelines = append(timelines, timelineStart{next, record.SwitchLSN / segmentSize})
+		}
+		if !found {
+			return nil, errors.Errorf("GetWALSegmentsBetween: timeline %d is not an ancestor of timeline %d", from.Timeline, to.Timeline)
+		}
+	}
+
+	names := make([]string, 0, to.FirstSegNo-from.LastSegNo+1)
+	timeline := from.Timeline
+	for segNo := from.LastSegNo; segNo <= to.FirstSegNo; segNo++ {
+		for len(timelines) > 0 && timelines[0].segNo <= segNo {
+			timeline = timelines[0].timeline
+			timelines = timelines[1:]
+		}
+		names = append(names, formatWALFileName(timeline, segNo, segmentSize))
+	}
+	return names, nil
+}
+
+// getWALArchive finds compressed WAL file in storage, nil if it is absent
+func getWALArchive(pre *Prefix, walFileName string) (*Archive, error) {
+	for _, decompressor := range decompressors {
+		a := &Archive{
+			Prefix:  pre,
+			Archive: aws.String(GetWALPath(*pre.Server) + walFileName + "." + decompressor.FileExtension()),
+		}
+		exists, err := a.CheckExistence()
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return a, nil
+		}
+	}
+	return nil, nil
+}
+
+// fetchTimelineHistory downloads and parses history file of timeline
+func fetchTimelineHistory(pre *Prefix, timeline uint32) ([]TimelineHistoryRecord, error) {
+	name := fmt.Sprintf("%08X.history", timeline)
+	a, err := getWALArchive(pre, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetchTimelineHistory: failed to check %s", name)
+	}
+	if a == nil {
+		return nil, errors.Errorf("fetchTimelineHistory: %s is not in archive", name)
+	}
+
+	arch, err := a.GetArchive()
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetchTimelineHistory: failed to fetch %s", name)
+	}
+	defer arch.Close()
+	var reader io.Reader = arch
+	crypter := NewCrypter()
+	if crypter.IsUsed() {
+		reader, err = crypter.Decrypt(arch)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetchTimelineHistory: failed to decrypt %s", name)
+		}
+	}
+
+	var data bytes.Buffer
+	_, err = GetDecompressor(CheckType(*a.Archive)).Decompress(&data, reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetchTimelineHistory: failed to decompress %s", name)
+	}
+	return ParseTimelineHistory(data.Bytes())
+}
+
+// FindMissingWALSegments checks existence of segments concurrently, bounded by WALG_DOWNLOAD_CONCURRENCY.
+// Returns names of missing segments in the order of names.
+func FindMissingWALSegments(pre *Prefix, names []string) ([]string, error) {
+	type result struct {
+		index  int
+		exists bool
+		err    error
+	}
+	indexes := make(chan int)
+	results := make(chan result)
+	workers := getMaxDownloadConcurrency(min(len(names), 16))
+	for i := 0; i < workers; i++ {
+		go func() {
+			for index := range indexes {
+				a, err := getWALArchive(pre, names[index])
+				results <- result{index, a != nil, err}
+			}
+		}()
+	}
+	go func() {
+		for i := range names {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	missing := make([]bool, len(names))
+	var firstErr error
+	for range names {
+		r := <-results
+		if r.err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(r.err, "FindMissingWALSegments: failed to check %s", names[r.index])
+		}
+		missing[r.index] = !r.exists
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var missingNames []string
+	for i, name := range names {
+		if missing[i] {
+			missingNames = append(missingNames, name)
+		}
+	}
+	return missingNames, nil
+}
+
+// HandleWALVerifyBetween is invoked to perform wal-g wal-verify-between.
+// Returns error if some WAL between backups is missing.
+func HandleWALVerifyBetween(pre *Prefix, fromName string, toName string) error {
+	fromName, fromSentinel, err := fetchBackupSentinel(pre, fromName)
+	if err != nil {
+		return err
+	}
+	toName, toSentinel, err := fetchBackupSentinel(pre, toName)
+	if err != nil {
+		return err
+	}
+	from, err := GetBackupWALRange(fromName, fromSentinel)
+	if err != nil {
+		return err
+	}
+	to, err := GetBackupWALRange(toName, toSentinel)
+	if err != nil {
+		return err
+	}
+
+	var history []TimelineHistoryRecord
+	if from.Timeline != to.Timeline {
+		history, err = fetchTimelineHistory(pre, to.Timeline)
+		if err != nil {
+			return err
+		}
+	}
+	names, err := GetWALSegmentsBetween(from, to, history)
+	if err != nil {
+		return err
+	}
+	missing, err := FindMissingWALSegments(pre, names)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range missing {
+		fmt.Printf("missing %s\n", name)
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("HandleWALVerifyBetween: WAL between %s and %s has gaps: %d of %d segments are missing",
+			fromName, toName, len(missing), len(names))
+	}
+	fmt.Printf("WAL between %s and %s is complete: %d segments from %s to %s.\n",
+		fromName, toName, len(names), names[0], names[len(names)-1])
+	return nil
+}
+
+// WALSegmentRun is a run of consecutive segments which are all archived or all missing
+type WALSegmentRun struct {
+	First   string
+	Last    string
+	Count   int
+	Missing bool
+}
+
+// GetWALSegmentsInRange lists segments of segmentSize from start to end inclusive. If end is on
+// a later timeline, history of its timeline is followed, as recovery from start to end would.
+func GetWALSegmentsInRange(start string, end string, history []TimelineHistoryRecord, segmentSize uint64) ([]string, error) {
+	startTimeline, startSegNo, err := parseWALFileName(start, segmentSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetWALSegmentsInRange: invalid start segment")
+	}
+	endTimeline, endSegNo, err := parseWALFileName(end, segmentSize)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetWALSegmentsInRange: invalid end segment")
+	}
+	if endSegNo < startSegNo || endTimeline < startTimeline {
+		return nil, errors.Errorf("GetWALSegmentsInRange: end segment %s precedes start segment %s", end, start)
+	}
+	from := BackupWALRange{Timeline: startTimeline, FirstSegNo: startSegNo, LastSegNo: startSegNo, SegmentSize: segmentSize}
+	to := BackupWALRange{Timeline: endTimeline, FirstSegNo: endSegNo, LastSegNo: endSegNo, SegmentSize: segmentSize}
+	return GetWALSegmentsBetween(from, to, history)
+}
+
+// ListArchivedWALSegments lists names of segments in folder of WAL, compressed with any of codecs
+func ListArchivedWALSegments(pre *Prefix) (map[string]bool, error) {
+	names, err := listArchivedWALNames(pre)
+	if err != nil {
+		return nil, err
+	}
+	segments := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, err := ParseWALFileName(name); err == nil {
+			segments[name] = true
+		}
+	}
+	return segments, nil
+}
+
+// listArchivedWALNames lists names of files in folder of WAL which can be fetched, without extension
+func listArchivedWALNames(pre *Prefix) ([]string, error) {
+	objects, err := pre.Storage().List(GetWALPath(*pre.Server))
+	if err != nil {
+		return nil, errors.Wrap(err, "listArchivedWALNames: failed to list WAL")
+	}
+	names := make([]string, 0, len(objects))
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		extension := CheckType(name)
+		if isDecompressorExtension(extension) {
+			names = append(names, strings.TrimSuffix(name, "."+extension))
+		}
+	}
+	return names, nil
+}
+
+// isDecompressorExtension tells whether WAL files with extension can be fetched
+func isDecompressorExtension(extension string) bool {
+	for _, decompressor := range decompressors {
+		if decompressor.FileExtension() == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// GetWALSegmentRuns splits names into runs of consecutive archived and missing segments
+func GetWALSegmentRuns(names []string, archived map[string]bool) []WALSegmentRun {
+	var runs []WALSegmentRun
+	for _, name := range names {
+		missing := !archived[name]
+		if len(runs) > 0 && runs[len(runs)-1].Missing == missing {
+			runs[len(runs)-1].Last = name
+			runs[len(runs)-1].Count++
+			continue
+		}
+		runs = append(runs, WALSegmentRun{First: name, Last: name, Count: 1, Missing: missing})
+	}
+	return runs
+}
+
+// HandleWALVerify is invoked to perform wal-g wal-verify. Segments are of size of the cluster,
+// see fetchWALSegmentSize. Returns error if some segment from start to end is missing.
+func HandleWALVerify(pre *Prefix, start string, end string) error {
+	startTimeline, err := ParseWALFileName(start)
+	if err != nil {
+		return err
+	}
+	endTimeline, err := ParseWALFileName(end)
+	if err != nil {
+		return err
+	}
+	var history []TimelineHistoryRecord
+	if startTimeline != endTimeline {
+		history, err = fetchTimelineHistory(pre, endTimeline)
+		if err != nil {
+			return err
+		}
+	}
+	segmentSize, err := fetchWALSegmentSize(pre, start)
+	if err != nil {
+		return err
+	}
+	names, err := GetWALSegmentsInRange(start, end, history, segmentSize)
+	if err != nil {
+		return err
+	}
+	archived, err := ListArchivedWALSegments(pre)
+	if err != nil {
+		return err
+	}
+
+	missingCount := 0
+	for _, run := range GetWALSegmentRuns(names, archived) {
+		state := "archived"
+		if run.Missing {
+			state = "missing"
+			missingCount += run.Count
+		}
+		fmt.Printf("%s %s - %s (%d segments)\n", state, run.First, run.Last, run.Count)
+	}
+	if missingCount > 0 {
+		return errors.Errorf("HandleWALVerify: WAL from %s to %s has gaps: %d of %d segments are missing", start, end, missingCount, len(names))
+	}
+	fmt.Printf("WAL from %s to %s is complete: %d segments.\n", start, end, len(names))
+	return nil
+}
@@ -0,0 +1,99 @@
+package walg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTimelineHistory(t *testing.T) {
+	history, err := ParseTimelineHistory([]byte("1\t0/3000060\tno recovery target specified\n\n" +
+		"2\t1/A8000000\tbefore 2018-06-01 12:00:00+00\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TimelineHistoryRecord{{1, 0x3000060}, {2, 0x1A8000000}}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("history: expected %v but got %v", expected, history)
+	}
+
+	_, err = ParseTimelineHistory([]byte("1\n"))
+	if err == nil {
+		t.Errorf("history: expected error for line without switch point")
+	}
+}
+
+func TestGetWALSegmentsBetween(t *testing.T) {
+	from := BackupWALRange{Timeline: 1, FirstSegNo: 0x1A0, LastSegNo: 0x1A2}
+	to := BackupWALRange{Timeline: 1, FirstSegNo: 0x1A5, LastSegNo: 0x1A6}
+	names, err := GetWALSegmentsBetween(from, to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"0000000100000001000000A2", "0000000100000001000000A3", "0000000100000001000000A4", "0000000100000001000000A5"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("between: expected %v but got %v", expected, names)
+	}
+
+	// Timeline 1 switched to 2 in the middle of segment A3, 2 switched to 3 at the start of A5
+	to.Timeline = 3
+	history := []TimelineHistoryRecord{{1, 0x1A3000100}, {2, 0x1A5000000}}
+	names, err = GetWALSegmentsBetween(from, to, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"0000000100000001000000A2", "0000000200000001000000A3", "0000000200000001000000A4", "0000000300000001000000A5"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("between: expected %v but got %v", expected, names)
+	}
+
+	// Backup on timeline 2 cannot be recovered to timeline 3 forked from 1
+	from.Timeline = 2
+	_, err = GetWALSegmentsBetween(from, to, []TimelineHistoryRecord{{1, 0x1A3000100}})
+	if err == nil {
+		t.Errorf("between: expected error for unrelated timelines")
+	}
+
+	// Timeline 1 ended before the end of the first backup
+	from.Timeline = 1
+	_, err = GetWALSegmentsBetween(from, to, []TimelineHistoryRecord{{1, 0x1A1000000}})
+	if err == nil {
+		t.Errorf("between: expected error for backup after timeline switch")
+	}
+
+	_, err = GetWALSegmentsBetween(to, from, history)
+	if err == nil {
+		t.Errorf("between: expected error for backups in wrong order")
+	}
+}
+
+func TestGetWALSegmentRuns(t *testing.T) {
+	history := []TimelineHistoryRecord{{1, 0x1A3000100}}
+	names, err := GetWALSegmentsInRange("0000000100000001000000A2", "0000000200000001000000A5", history, WalSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"0000000100000001000000A2", "0000000200000001000000A3", "0000000200000001000000A4", "0000000200000001000000A5"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("runs: expected %v but got %v", expected, names)
+	}
+	_, err = GetWALSegmentsInRange("0000000100000001000000A5", "0000000100000001000000A2", nil, WalSegmentSize)
+	if err == nil {
+		t.Errorf("runs: expected error for end before start")
+	}
+	// Logical WAL file ends after 64 segments of 64MB
+	names64, err := GetWALSegmentsInRange("00000001000000010000003F", "000000010000000200000000", nil, 64<<20)
+	if err != nil || !reflect.DeepEqual(names64, []string{"00000001000000010000003F", "000000010000000200000000"}) {
+		t.Errorf("runs: unexpected segments of 64MB %v, %v", names64, err)
+	}
+
+	archived := map[string]bool{names[0]: true, names[3]: true}
+	runs := GetWALSegmentRuns(names, archived)
+	expectedRuns := []WALSegmentRun{
+		{names[0], names[0], 1, false},
+		{names[1], names[2], 2, true},
+		{names[3], names[3], 1, false},
+	}
+	if !reflect.DeepEqual(runs, expectedRuns) {
+		t.Errorf("runs: expected %v but got %v", expectedRuns, runs)
+	}
+}
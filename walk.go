@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"fmt"
 	"github.com/pkg/errors"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
@@ -35,11 +36,26 @@ func (bundle *Bundle) TarWalker(path string, info os.FileInfo, err error) error
 		}
 		return errors.Wrap(err, "TarWalker: walk failed")
 	}
+	// File packed in background has failed, backup can't be completed
+	if err := bundle.workerError(); err != nil {
+		return err
+	}
+
+	if oid, ok := tablespaceOfLink(path, info); ok {
+		location, err := os.Readlink(path)
+		if err != nil {
+			return errors.Wrap(err, "TarWalker: failed to read tablespace link")
+		}
+		if bundle.Tablespaces == nil {
+			bundle.Tablespaces = make(map[uint32]string)
+		}
+		bundle.Tablespaces[oid] = location
+	}
 
 	if info.Name() == "pg_control" {
 		bundle.Sen = &Sentinel{info, path}
 	} else {
-		err = HandleTar(bundle, path, info, &bundle.Crypter)
+		err = HandleTar(bundle, path, info, bundle.Crypter)
 		if err == filepath.SkipDir {
 			return err
 		}
@@ -55,7 +71,6 @@ func (bundle *Bundle) TarWalker(path string, info os.FileInfo, err error) error
 // in the final tarball. EXCLUDED directories are created
 // but their contents are not written to local disk.
 func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter) error {
-	fileName := info.Name()
 	_, excluded := EXCLUDE[info.Name()]
 
 	tarBall := bundle.Deque()
@@ -66,12 +81,10 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 	tarWriter := tarBall.Tw()
 
 	if !excluded {
-		hdr, err := tar.FileInfoHeader(info, fileName)
+		hdr, err := newTarHeader(info, path, tarBall.Trim())
 		if err != nil {
 			return errors.Wrap(err, "HandleTar: could not grab header info")
 		}
-
-		hdr.Name = strings.TrimPrefix(path, tarBall.Trim())
 		fmt.Println(hdr.Name)
 
 		if info.Mode().IsRegular() {
@@ -85,31 +98,49 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 			// For details see
 			// https://www.postgresql.org/message-id/flat/F0627DEB-7D0D-429B-97A9-D321450365B4%40yandex-team.ru#F0627DEB-7D0D-429B-97A9-D321450365B4@yandex-team.ru
 
-			if wasInBase && (time.Equal(bf.MTime)) {
+			// Size is recorded at the same moment as MTime for the next delta
+			fileSize := info.Size()
+
+			// Files modified in place keep their size, but not MTime. Strict mode
+			// does not trust MTime at all, e.g. for filesystems mounted with coarse timestamps
+			if wasInBase && time.Equal(bf.MTime) && fileSize == bf.Size && !bundle.IsStrictDelta() {
 				// File was not changed since previous backup
 
-				fmt.Println("Skiped due to unchanged modification time")
-				bundle.GetFiles().Store(hdr.Name, BackupFileDescription{IsSkipped: true, IsIncremented: false, MTime: time})
+				fmt.Println("Skiped due to unchanged modification time and size")
+				bundle.GetFiles().Store(hdr.Name, BackupFileDescription{IsSkipped: true, IsIncremented: false, MTime: time, Size: fileSize})
+				bundle.GetProgress().AddFile(fileSize)
 
 			} else {
 				// !excluded means file was not observed previously
-				worker := func() error {
-					f, isPaged, size, err := ReadDatabaseFile(path, bundle.GetIncrementBaseLsn(), !wasInBase)
+				packFile := func(tarBall TarBall) error {
+					tarWriter := tarBall.Tw()
+					f, isPaged, size, err := ReadDatabaseFile(path, bundle.GetIncrementBaseLsn(), !wasInBase && !bundle.IsCatchup())
 					if err != nil {
 						return errors.Wrapf(err, "HandleTar: failed to open file '%s'\n", path)
 					}
 
 					hdr.Size = size
 
-					bundle.GetFiles().Store(hdr.Name, BackupFileDescription{IsSkipped: false, IsIncremented: isPaged, MTime: time})
+					var content io.Reader = f
+					if detector := bundle.GetTornPageDetector(); detector != nil && !isPaged && IsPagedFile(info, path) {
+						if file, ok := f.(io.ReaderAt); ok {
+							content = detector.Reader(f, file, hdr.Name)
+						}
+					}
 
 					err = tarWriter.WriteHeader(hdr)
 					if err != nil {
 						return errors.Wrap(err, "HandleTar: failed to write header")
 					}
 
+					var checksum hash.Hash
+					manifest := bundle.GetManifest()
+					if manifest != nil {
+						checksum = manifest.NewChecksum()
+					}
+					crc := newMemberChecksum()
 					lim := &io.LimitedReader{
-						R: io.MultiReader(f, &ZeroReader{}),
+						R: checksumReader(checksumReader(io.MultiReader(content, &ZeroReader{}), checksum), crc),
 						N: int64(hdr.Size),
 					}
 
@@ -122,21 +153,38 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 						return errors.Errorf("HandleTar: packed wrong numbers of bytes %d instead of %d", size, hdr.Size)
 					}
 
+					// Checksum is of tar member, which is the increment for paged files of delta
+					memberChecksum := crc.Sum32()
+					bundle.GetFiles().Store(hdr.Name, BackupFileDescription{IsSkipped: false, IsIncremented: isPaged, MTime: time, Size: fileSize, Crc32c: &memberChecksum})
+
+					if manifest != nil {
+						manifest.AddFile(hdr.Name, hdr.Size, time, checksum.Sum(nil))
+					}
 					tarBall.AddSize(hdr.Size)
 					f.Close()
+					bundle.GetProgress().AddFile(fileSize)
 					return nil
 				}
 
+				// Small files are read right away, there is little to gain from parallel read
+				if bundle.IsSmallFile(fileSize) {
+					return bundle.PackSmallFile(packFile)
+				}
+
+				worker := func() error { return packFile(tarBall) }
+
 				workerWrapper := func() {
-					// TODO: Refactor this functional mess
-					// And maybe do a better error handling
+					// Failure is returned by FinishQueue, tarball goes back to queue so that it is not waited for forever
 					workerError := worker()
 					if workerError != nil {
-						panic(workerError)
+						bundle.ReportWorkerError(workerError)
+						notParallel := false
+						bundle.EnqueueBack(tarBall, &notParallel)
+						return
 					}
 					bundleError := bundle.CheckSizeAndEnqueueBack(tarBall)
 					if bundleError != nil {
-						panic(bundleError)
+						bundle.ReportWorkerError(bundleError)
 					}
 				}
 
@@ -150,21 +198,58 @@ func HandleTar(bundle TarBundle, path string, info os.FileInfo, crypter Crypter)
 				return errors.Wrap(err, "HandleTar: failed to write header")
 			}
 		}
-	} else if excluded && info.Mode().IsDir() {
-		hdr, err := tar.FileInfoHeader(info, fileName)
+	} else if excluded && (info.Mode().IsDir() || isLinkedDir(path, info)) {
+		hdr, err := newTarHeader(info, path, tarBall.Trim())
 		if err != nil {
 			return errors.Wrap(err, "HandleTar: failed to grab header info")
 		}
-
-		hdr.Name = strings.TrimPrefix(path, tarBall.Trim())
+		if hdr.Typeflag == tar.TypeSymlink {
+			// Linked directory, e.g. pg_wal on another disk, is restored as an empty one
+			hdr.Typeflag = tar.TypeDir
+			hdr.Linkname = ""
+			hdr.Mode = 0700
+		}
 		fmt.Println(hdr.Name)
 
 		err = tarWriter.WriteHeader(hdr)
 		if err != nil {
 			return errors.Wrap(err, "HandleTar: failed to write header")
 		}
-		return filepath.SkipDir
+		if info.Mode().IsDir() {
+			return filepath.SkipDir
+		}
 	}
 
 	return nil
 }
+
+// isLinkedDir tells whether file is a symlink to directory
+func isLinkedDir(path string, info os.FileInfo) bool {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	target, err := os.Stat(path)
+	return err == nil && target.IsDir()
+}
+
+// newTarHeader creates header of file named relative to trim.
+// Format is deliberately left unspecified: tar.Writer emits plain USTAR
+// headers when possible and switches to PAX records for names longer
+// than 100 bytes or files of 8GB and larger, which USTAR cannot represent.
+// tar.Reader in extractOne understands both.
+func newTarHeader(info os.FileInfo, path string, trim string) (*tar.Header, error) {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = strings.TrimPrefix(path, trim)
+	return hdr, nil
+}
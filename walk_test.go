@@ -1,11 +1,13 @@
 package walg_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"github.com/wal-g/wal-g"
 	"github.com/wal-g/wal-g/test_tools"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"strconv"
 	"testing"
 	"sync"
+	"time"
 )
 
 const BUFSIZE = 4 * 1024
@@ -52,19 +55,19 @@ func createLabelFiles(t *testing.T, dir string) {
 	defer s.Close()
 }
 
-// Generate 5 1MB of random data and write to temp
-// directory 'data...'. Also creates a fake sentinel file and
-// tests that excluded directories are handled correctly.
+// Generate 5 1MB of random data and write to directory 'data'
+// in a new temp directory, which is removed by the caller. Also creates
+// a fake sentinel file and tests that excluded directories are handled correctly.
 func generateData(t *testing.T) string {
-	cwd, err := filepath.Abs("./")
+	//Create temp directory.
+	parent, err := ioutil.TempDir("", "walg_walk")
 	if err != nil {
-		t.Log(err)
+		t.Fatal(err)
 	}
-
-	//Create temp directory.
-	dir, err := ioutil.TempDir(cwd, "data")
+	dir := filepath.Join(parent, "data")
+	err = os.Mkdir(dir, 0700)
 	if err != nil {
-		t.Log(err)
+		t.Fatal(err)
 	}
 	fmt.Println(dir)
 
@@ -322,6 +325,8 @@ func isEmpty(t *testing.T, path string) bool {
 func TestWalk(t *testing.T) {
 	// Generate random data and write to tmp dir `data...`.
 	data := generateData(t)
+	// Compressed and extracted files are put next to data
+	defer os.RemoveAll(filepath.Dir(data))
 
 	// Bundle and compress files to `compressed`.
 	bundle := &walg.Bundle{
@@ -374,12 +379,7 @@ func TestWalk(t *testing.T) {
 
 	// Extracts compressed directory to `extracted`.
 	extracted := extract(t, compressed)
-	if compare(t, data, extracted) {
-		// Clean up only if the test succeeds.
-		defer os.RemoveAll(data)
-		defer os.RemoveAll(compressed)
-		defer os.RemoveAll(extracted)
-	} else {
+	if !compare(t, data, extracted) {
 		t.Errorf("walk: Extracted and original directories are not the same.")
 	}
 
@@ -396,3 +396,243 @@ func TestWalk(t *testing.T) {
 		t.Logf("%+v\n", err)
 	}
 }
+
+func TestDeltaSkipsUnchangedFiles(t *testing.T) {
+	data, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+
+	for _, name := range []string{"unchanged", "resized", "touched"} {
+		err = ioutil.WriteFile(filepath.Join(data, name), []byte("content"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(filepath.Join(data, "unchanged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := info.ModTime()
+	base := walg.BackupFileList{
+		"/unchanged": {MTime: mtime, Size: 7},
+		"/resized":   {MTime: mtime, Size: 3},
+		"/touched":   {MTime: mtime.Add(-time.Second), Size: 7},
+	}
+	os.Chtimes(filepath.Join(data, "resized"), mtime, mtime)
+	os.Chtimes(filepath.Join(data, "touched"), mtime, mtime)
+
+	for _, strict := range []bool{false, true} {
+		pr, pw := io.Pipe()
+		go io.Copy(ioutil.Discard, pr)
+		bundle := &walg.Bundle{
+			MinSize:            int64(1) << 62,
+			IncrementFromLsn:   new(uint64),
+			IncrementFromFiles: base,
+			StrictDelta:        strict,
+			Files:              &sync.Map{},
+			Tbm:                &pipeTarBallMaker{&pipeTarBall{trim: data, w: pw}},
+		}
+		bundle.StartQueue()
+		err = walg.Walk(data, bundle.TarWalker)
+		if err != nil {
+			t.Fatalf("walk: %v", err)
+		}
+		err = bundle.FinishQueue()
+		if err != nil {
+			t.Fatalf("walk: %v", err)
+		}
+
+		for name, expectSkipped := range map[string]bool{"/unchanged": !strict, "/resized": false, "/touched": false} {
+			value, ok := bundle.Files.Load(name)
+			if !ok {
+				t.Fatalf("walk: %s is missing in file list", name)
+			}
+			description := value.(walg.BackupFileDescription)
+			if description.IsSkipped != expectSkipped {
+				t.Errorf("walk: strict=%v expected %s skipped=%v", strict, name, expectSkipped)
+			}
+			if description.Size != 7 {
+				t.Errorf("walk: expected size 7 recorded for %s, got %d", name, description.Size)
+			}
+			if !description.IsSkipped && (description.Crc32c == nil || *description.Crc32c != crc32.Checksum([]byte("content"), crc32.MakeTable(crc32.Castagnoli))) {
+				t.Errorf("walk: expected checksum of content recorded for %s", name)
+			}
+		}
+	}
+}
+
+// memoryTarBall keeps uncompressed tar in memory
+type memoryTarBall struct {
+	number int
+	trim   string
+	size   int64
+	buf    bytes.Buffer
+	tw     *tar.Writer
+}
+
+func (m *memoryTarBall) SetUp(crypter walg.Crypter, args ...string) {
+	if m.tw == nil {
+		m.tw = tar.NewWriter(&m.buf)
+	}
+}
+func (m *memoryTarBall) CloseTar() error                                  { return m.tw.Close() }
+func (m *memoryTarBall) Finish(sentinel *walg.S3TarBallSentinelDto) error { return nil }
+func (m *memoryTarBall) BaseDir() string                                  { return "" }
+func (m *memoryTarBall) Trim() string                                     { return m.trim }
+func (m *memoryTarBall) Nop() bool                                        { return false }
+func (m *memoryTarBall) Number() int                                      { return m.number }
+func (m *memoryTarBall) Size() int64                                      { return m.size }
+func (m *memoryTarBall) AddSize(i int64)                                  { m.size += i }
+func (m *memoryTarBall) Tw() *tar.Writer                                  { return m.tw }
+func (m *memoryTarBall) AwaitUploads()                                    {}
+
+type memoryTarBallMaker struct {
+	trim     string
+	tarBalls []*memoryTarBall
+}
+
+func (m *memoryTarBallMaker) Make(dedicatedUploader bool) walg.TarBall {
+	tarBall := &memoryTarBall{number: len(m.tarBalls) + 1, trim: m.trim}
+	m.tarBalls = append(m.tarBalls, tarBall)
+	return tarBall
+}
+
+func TestWalkPacksSmallFilesTogether(t *testing.T) {
+	data, err := ioutil.TempDir("", "small_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+
+	for i := 0; i < 20; i++ {
+		err = ioutil.WriteFile(filepath.Join(data, "small"+strconv.Itoa(i)), bytes.Repeat([]byte{byte(i)}, 100), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		err = ioutil.WriteFile(filepath.Join(data, "large"+strconv.Itoa(i)), bytes.Repeat([]byte{byte(i)}, 10000), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	os.Setenv("WALG_UPLOAD_DISK_CONCURRENCY", "3")
+	defer os.Unsetenv("WALG_UPLOAD_DISK_CONCURRENCY")
+	maker := &memoryTarBallMaker{trim: data}
+	bundle := &walg.Bundle{
+		MinSize:       int64(1) << 62,
+		SmallFileSize: 1000,
+		Files:         &sync.Map{},
+		Tbm:           maker,
+	}
+	bundle.StartQueue()
+	err = walg.Walk(data, bundle.TarWalker)
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	err = bundle.FinishQueue()
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+
+	partitions := make(map[string]int)
+	for _, tarBall := range maker.tarBalls {
+		tr := tar.NewReader(&tarBall.buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("walk: partition %d is broken: %v", tarBall.number, err)
+			}
+			partitions[hdr.Name] = tarBall.number
+		}
+	}
+
+	smallPartition := partitions["/small0"]
+	for i := 0; i < 20; i++ {
+		name := "/small" + strconv.Itoa(i)
+		if number, ok := partitions[name]; !ok || number != smallPartition {
+			t.Errorf("walk: expected %s in partition %d of small files, got %d", name, smallPartition, number)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		name := "/large" + strconv.Itoa(i)
+		if number, ok := partitions[name]; !ok || number == smallPartition {
+			t.Errorf("walk: expected %s outside partition of small files", name)
+		}
+	}
+}
+
+func TestWalkSplitsPartitionsByTarSizeThreshold(t *testing.T) {
+	data, err := ioutil.TempDir("", "tar_size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(data)
+	for i := 0; i < 4; i++ {
+		err = ioutil.WriteFile(filepath.Join(data, "relation"+strconv.Itoa(i)), bytes.Repeat([]byte{byte(i)}, 9<<20), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer os.Unsetenv("WALG_TAR_SIZE_THRESHOLD")
+	for _, invalid := range []string{"1000", "1GB"} {
+		os.Setenv("WALG_TAR_SIZE_THRESHOLD", invalid)
+		if _, err := walg.GetTarSizeThreshold(); err == nil {
+			t.Errorf("walk: expected WALG_TAR_SIZE_THRESHOLD=%s to be rejected", invalid)
+		}
+	}
+	os.Setenv("WALG_TAR_SIZE_THRESHOLD", strconv.FormatInt(walg.MinTarSizeThreshold, 10))
+	threshold, err := walg.GetTarSizeThreshold()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	maker := &memoryTarBallMaker{trim: data}
+	bundle := &walg.Bundle{
+		MinSize: threshold,
+		Files:   &sync.Map{},
+		Tbm:     maker,
+	}
+	bundle.StartQueue()
+	if err = walg.Walk(data, bundle.TarWalker); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if err = bundle.FinishQueue(); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+
+	// Partition is closed once it grows over threshold, so 9MB files go two by two
+	var partitions int
+	for _, tarBall := range maker.tarBalls {
+		tr := tar.NewReader(&tarBall.buf)
+		files := 0
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("walk: partition %d is broken: %v", tarBall.number, err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				files++
+			}
+		}
+		if files > 2 {
+			t.Errorf("walk: partition %d has %d files over threshold", tarBall.number, files)
+		}
+		if files > 0 {
+			partitions++
+		}
+	}
+	if partitions < 2 {
+		t.Errorf("walk: expected files split into partitions by threshold but got %d", partitions)
+	}
+}